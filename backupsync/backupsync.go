@@ -0,0 +1,539 @@
+// Package backupsync distributes backup replicas over graphsync.
+//
+// The node holding a file asks each target peer, over PushProtocol, to pull
+// the part of the file DAG allocated to it. The target checks the push with
+// its PushAuthorizer, then requests that part with graphsync, a few
+// selectors rather than block by block, and the holder only serves the
+// requests matching a pending allocation of the peer. Later, the holder can
+// restore the blocks from the peers it pushed them to.
+//
+// The service runs a graphsync exchange of its own, on GraphsyncProtocol,
+// so that it neither depends on Experimental.GraphsyncEnabled nor serves
+// anything but backups, and so that backup traffic can be throttled apart.
+package backupsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	"github.com/ipfs/go-graphsync/ipldutil"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	logging "github.com/ipfs/go-log"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/ipfs/go-ipfs/connprotect"
+)
+
+var log = logging.Logger("backupsync")
+
+const (
+	// ProtocolPrefix is the prefix of the protocols of the service, for
+	// the bandwidth limits.
+	ProtocolPrefix = "/ipfs/backup/"
+
+	// PushProtocol carries the push requests and their outcome.
+	PushProtocol protocol.ID = ProtocolPrefix + "push/1.0.0"
+
+	// GraphsyncProtocol is the graphsync protocol of the backup exchange.
+	GraphsyncProtocol protocol.ID = ProtocolPrefix + "graphsync/1.0.0"
+
+	// ExtensionName is the graphsync extension telling what a request is
+	// for.
+	ExtensionName graphsync.ExtensionName = "ipfs-backup/1"
+)
+
+const (
+	// pullConcurrency is the number of graphsync requests a target keeps
+	// in flight for a push.
+	pullConcurrency = 8
+
+	// maxPushRequestSize bounds the push requests read by a target.
+	maxPushRequestSize = 16 << 20
+
+	// restorePersistence is the persistence option of the restored blocks.
+	restorePersistence = "ipfs-backup-restore"
+)
+
+// Kinds of backup graphsync requests.
+const (
+	kindPush    = "push"
+	kindRestore = "restore"
+)
+
+var (
+	errNoExtension    = errors.New("not a backup request")
+	errNoAuthorizer   = errors.New("backup pushes are not accepted")
+	errNotAllocated   = errors.New("request does not match an allocation")
+	errNotReplica     = errors.New("not a replica pushed by the requesting peer")
+	errSelector       = errors.New("unsupported selector")
+	errNothingFetched = errors.New("peer sent no block")
+)
+
+// Root is a part of a DAG to transfer: the whole DAG under Cid, or the
+// block alone.
+type Root struct {
+	Cid cid.Cid
+	All bool
+}
+
+// selectAll selects a whole DAG, selectBlock its root block only.
+var selectAll, selectBlock = func() (ipld.Node, ipld.Node) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	all := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	return all, ssb.Matcher().Node()
+}()
+
+var selectAllBytes, selectBlockBytes = func() ([]byte, []byte) {
+	all, err := ipldutil.EncodeNode(selectAll)
+	if err != nil {
+		panic(err)
+	}
+	block, err := ipldutil.EncodeNode(selectBlock)
+	if err != nil {
+		panic(err)
+	}
+	return all, block
+}()
+
+func (r Root) selector() ipld.Node {
+	if r.All {
+		return selectAll
+	}
+	return selectBlock
+}
+
+// extension is the data of the ExtensionName extension.
+type extension struct {
+	Kind   string
+	Ticket string `json:",omitempty"`
+}
+
+type wireRoot struct {
+	Cid string
+	All bool `json:",omitempty"`
+}
+
+// pushRequest asks a target to pull roots from the sender.
+type pushRequest struct {
+	Ticket string
+	File   string
+	Uid    string
+	Roots  []wireRoot
+}
+
+// pushResponse reports the outcome of a pull.
+type pushResponse struct {
+	Received int
+	Error    string `json:",omitempty"`
+}
+
+// IncomingPush is a push request received from a peer: the roots of the
+// part of File allocated to this node.
+type IncomingPush struct {
+	File  cid.Cid
+	Uid   string
+	Roots []Root
+}
+
+// PushAuthorizer checks an incoming push against the allocation of its
+// file, and returns an error unless p may push it to this node.
+type PushAuthorizer func(p peer.ID, push IncomingPush) error
+
+// allocation is a pending push, on the holder.
+type allocation struct {
+	peer  peer.ID
+	roots map[cid.Cid]bool // whether the whole DAG may be pulled
+}
+
+// Service pushes backup replicas to other peers and pulls the ones pushed
+// to this node.
+type Service struct {
+	ctx  context.Context
+	host host.Host
+	gs   graphsync.GraphExchange
+	ds   datastore.Datastore
+
+	// holds keeps the peers of the pushes and restores in progress from
+	// being trimmed.
+	holds *connprotect.Holds
+
+	unregister []graphsync.UnregisterHookFunc
+
+	mu        sync.Mutex
+	pushes    map[string]*allocation
+	authorize PushAuthorizer
+}
+
+// New starts the service. Replicas pulled from other peers are written to
+// replicas, blocks restored from them to restored.
+func New(ctx context.Context, h host.Host, ds datastore.Datastore, replicas, restored ipld.LinkSystem) (*Service, error) {
+	gsHost := &protocolHost{Host: h, from: gsnet.ProtocolGraphsync, to: GraphsyncProtocol}
+	s := &Service{
+		ctx:    ctx,
+		host:   h,
+		gs:     gsimpl.New(ctx, gsnet.NewFromLibp2pHost(gsHost), replicas),
+		ds:     ds,
+		holds:  connprotect.NewHolds(h.ConnManager()),
+		pushes: make(map[string]*allocation),
+	}
+	if err := s.gs.RegisterPersistenceOption(restorePersistence, restored); err != nil {
+		return nil, err
+	}
+	s.unregister = append(s.unregister,
+		s.gs.RegisterIncomingRequestHook(s.validate),
+		s.gs.RegisterOutgoingRequestHook(s.persistence),
+	)
+	h.SetStreamHandler(PushProtocol, s.handlePush)
+	return s, nil
+}
+
+// SetAuthorizer sets the check of the incoming pushes. Until it is set,
+// every push is refused.
+func (s *Service) SetAuthorizer(a PushAuthorizer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorize = a
+}
+
+// Close stops serving push requests.
+func (s *Service) Close() error {
+	s.host.RemoveStreamHandler(PushProtocol)
+	for _, unregister := range s.unregister {
+		unregister()
+	}
+	return nil
+}
+
+// Push asks p to pull roots, the part of file allocated to it, and returns
+// once it is done, with the number of blocks it received. file and uid are
+// recorded by p along with the replicas.
+func (s *Service) Push(ctx context.Context, p peer.ID, file cid.Cid, uid string, roots []Root) (int, error) {
+	ticket, err := newTicket()
+	if err != nil {
+		return 0, err
+	}
+	a := &allocation{peer: p, roots: make(map[cid.Cid]bool, len(roots))}
+	req := pushRequest{Ticket: ticket, File: file.String(), Uid: uid, Roots: make([]wireRoot, 0, len(roots))}
+	for _, r := range roots {
+		a.roots[r.Cid] = a.roots[r.Cid] || r.All
+		req.Roots = append(req.Roots, wireRoot{Cid: r.Cid.String(), All: r.All})
+	}
+
+	defer s.holds.Hold(p, connprotect.BackupPush)()
+
+	s.mu.Lock()
+	s.pushes[ticket] = a
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pushes, ticket)
+		s.mu.Unlock()
+	}()
+
+	st, err := s.host.NewStream(ctx, p, PushProtocol)
+	if err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = st.Reset()
+		case <-done:
+		}
+	}()
+
+	if err := json.NewEncoder(st).Encode(&req); err != nil {
+		_ = st.Reset()
+		return 0, err
+	}
+	if err := st.CloseWrite(); err != nil {
+		_ = st.Reset()
+		return 0, err
+	}
+	var resp pushResponse
+	if err := json.NewDecoder(st).Decode(&resp); err != nil {
+		_ = st.Reset()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("reading the push response of %s: %s", p, err)
+	}
+	st.Close()
+	if resp.Error != "" {
+		return resp.Received, fmt.Errorf("%s: %s", p, resp.Error)
+	}
+	return resp.Received, nil
+}
+
+// Restore fetches r back from a peer it was pushed to, and returns the
+// blocks received.
+func (s *Service) Restore(ctx context.Context, p peer.ID, r Root) ([]cid.Cid, error) {
+	defer s.holds.Hold(p, connprotect.BackupRestore)()
+	return s.fetch(ctx, p, r, extension{Kind: kindRestore})
+}
+
+func (s *Service) handlePush(st network.Stream) {
+	p := st.Conn().RemotePeer()
+
+	var resp pushResponse
+	var req pushRequest
+	if err := json.NewDecoder(io.LimitReader(st, maxPushRequestSize)).Decode(&req); err != nil {
+		log.Debugf("reading the push request of %s: %s", p, err)
+		_ = st.Reset()
+		return
+	}
+	received, err := s.pull(p, req)
+	resp.Received = received
+	if err != nil {
+		log.Warnf("pulling the replicas pushed by %s: %s", p, err)
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(st).Encode(&resp); err != nil {
+		_ = st.Reset()
+		return
+	}
+	st.Close()
+}
+
+// pull checks a push request, fetches its roots and records the replicas.
+func (s *Service) pull(p peer.ID, req pushRequest) (int, error) {
+	file, err := cid.Decode(req.File)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file %q: %s", req.File, err)
+	}
+	roots := make([]Root, 0, len(req.Roots))
+	for _, wr := range req.Roots {
+		c, err := cid.Decode(wr.Cid)
+		if err != nil {
+			return 0, fmt.Errorf("invalid root %q: %s", wr.Cid, err)
+		}
+		roots = append(roots, Root{Cid: c, All: wr.All})
+	}
+
+	s.mu.Lock()
+	authorize := s.authorize
+	s.mu.Unlock()
+	if authorize == nil {
+		return 0, errNoAuthorizer
+	}
+	if err := authorize(p, IncomingPush{File: file, Uid: req.Uid, Roots: roots}); err != nil {
+		return 0, fmt.Errorf("push refused: %s", err)
+	}
+
+	defer s.holds.Hold(p, connprotect.BackupPush)()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		received int
+		firstErr error
+	)
+	sem := make(chan struct{}, pullConcurrency)
+	for _, r := range roots {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r Root) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			got, err := s.fetch(s.ctx, p, r, extension{Kind: kindPush, Ticket: req.Ticket})
+			if err == nil {
+				err = PutReplicas(s.ds, got, Replica{
+					Source:   p.Pretty(),
+					Uid:      req.Uid,
+					File:     file.String(),
+					Subtree:  r.All,
+					Received: time.Now(),
+				})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			received += len(got)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s: %s", r.Cid, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	return received, firstErr
+}
+
+// fetch requests r from p and returns the blocks received.
+func (s *Service) fetch(ctx context.Context, p peer.ID, r Root, ext extension) ([]cid.Cid, error) {
+	data, err := json.Marshal(ext)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress, errs := s.gs.Request(ctx, p, cidlink.Link{Cid: r.Cid}, r.selector(),
+		graphsync.ExtensionData{Name: ExtensionName, Data: data})
+
+	seen := make(map[cid.Cid]bool)
+	var got []cid.Cid
+	for progress != nil || errs != nil {
+		select {
+		case pr, ok := <-progress:
+			if !ok {
+				progress = nil
+				continue
+			}
+			if l, ok := pr.LastBlock.Link.(cidlink.Link); ok && !seen[l.Cid] {
+				seen[l.Cid] = true
+				got = append(got, l.Cid)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if err != nil {
+				return got, err
+			}
+		}
+	}
+	if len(got) == 0 {
+		return nil, errNothingFetched
+	}
+	return got, nil
+}
+
+// validate only lets through the requests of a pending allocation of the
+// requesting peer, and the restores of the replicas it pushed.
+func (s *Service) validate(p peer.ID, req graphsync.RequestData, actions graphsync.IncomingRequestHookActions) {
+	if err := s.check(p, req); err != nil {
+		log.Debugf("rejecting the backup request of %s for %s: %s", p, req.Root(), err)
+		actions.TerminateWithError(err)
+		return
+	}
+	actions.ValidateRequest()
+}
+
+func (s *Service) check(p peer.ID, req graphsync.RequestData) error {
+	data, ok := req.Extension(ExtensionName)
+	if !ok {
+		return errNoExtension
+	}
+	var ext extension
+	if err := json.Unmarshal(data, &ext); err != nil {
+		return err
+	}
+	all, err := selectsAll(req.Selector())
+	if err != nil {
+		return err
+	}
+
+	switch ext.Kind {
+	case kindPush:
+		s.mu.Lock()
+		a, ok := s.pushes[ext.Ticket]
+		s.mu.Unlock()
+		if !ok || a.peer != p {
+			return errNotAllocated
+		}
+		allowAll, ok := a.roots[req.Root()]
+		if !ok || (all && !allowAll) {
+			return errNotAllocated
+		}
+		return nil
+	case kindRestore:
+		rep, err := GetReplica(s.ds, req.Root(), p.Pretty())
+		if err != nil || (all && !rep.Subtree) {
+			return errNotReplica
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown backup request %q", ext.Kind)
+	}
+}
+
+// selectsAll tells selectAll from selectBlock, the only selectors served.
+func selectsAll(sel ipld.Node) (bool, error) {
+	b, err := ipldutil.EncodeNode(sel)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case bytes.Equal(b, selectAllBytes):
+		return true, nil
+	case bytes.Equal(b, selectBlockBytes):
+		return false, nil
+	default:
+		return false, errSelector
+	}
+}
+
+// persistence writes the restored blocks apart from the replicas.
+func (s *Service) persistence(p peer.ID, req graphsync.RequestData, actions graphsync.OutgoingRequestHookActions) {
+	data, ok := req.Extension(ExtensionName)
+	if !ok {
+		return
+	}
+	var ext extension
+	if err := json.Unmarshal(data, &ext); err == nil && ext.Kind == kindRestore {
+		actions.UsePersistenceOption(restorePersistence)
+	}
+}
+
+func newTicket() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// protocolHost serves the graphsync network of the service under another
+// protocol.
+type protocolHost struct {
+	host.Host
+	from, to protocol.ID
+}
+
+func (h *protocolHost) rename(pid protocol.ID) protocol.ID {
+	if pid == h.from {
+		return h.to
+	}
+	return pid
+}
+
+func (h *protocolHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(h.rename(pid), handler)
+}
+
+func (h *protocolHost) RemoveStreamHandler(pid protocol.ID) {
+	h.Host.RemoveStreamHandler(h.rename(pid))
+}
+
+func (h *protocolHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	renamed := make([]protocol.ID, len(pids))
+	for i, pid := range pids {
+		renamed[i] = h.rename(pid)
+	}
+	return h.Host.NewStream(ctx, p, renamed...)
+}
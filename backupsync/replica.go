@@ -0,0 +1,214 @@
+package backupsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// replicaPrefix is the datastore namespace recording the replicas pulled
+// from other peers.
+var replicaPrefix = datastore.NewKey("/local/backup-replicas")
+
+// Replica records a block pulled from a peer holding it. A block pulled
+// from several peers has a record per peer.
+type Replica struct {
+	// Source is the peer the block was pushed by, the only one allowed to
+	// restore it.
+	Source string
+	Uid    string
+
+	// File is the root of the allocated file the block belongs to. The
+	// record expires once the file is no longer registered on chain.
+	File string
+
+	// Subtree is set when the whole DAG under the block was pulled, so
+	// that it can be restored in one request.
+	Subtree  bool
+	Received time.Time
+}
+
+func replicaKey(c cid.Cid, source string) datastore.Key {
+	return replicaPrefix.ChildString(c.String()).ChildString(source)
+}
+
+// GetReplica returns the record of the replica c pulled from source. It
+// returns datastore.ErrNotFound if source pushed no such replica.
+func GetReplica(ds datastore.Datastore, c cid.Cid, source string) (Replica, error) {
+	var rep Replica
+	b, err := ds.Get(replicaKey(c, source))
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	return rep, err
+}
+
+// HasReplica tells whether c was pulled from any peer.
+func HasReplica(ds datastore.Datastore, c cid.Cid) (bool, error) {
+	res, err := ds.Query(dsq.Query{
+		Prefix:   replicaPrefix.ChildString(c.String()).String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return false, err
+	}
+	entries, err := res.Rest()
+	return len(entries) > 0, err
+}
+
+// PutReplicas records cids as replicas pulled as described by rep.
+func PutReplicas(ds datastore.Datastore, cids []cid.Cid, rep Replica) error {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		if err := ds.Put(replicaKey(c, rep.Source), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicaCid returns the CID of the replica recorded under key.
+func replicaCid(key string) (cid.Cid, error) {
+	k := datastore.RawKey(key)
+	c, err := cid.Decode(k.Parent().BaseNamespace())
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid replica key %s: %s", k, err)
+	}
+	return c, nil
+}
+
+// Replicas returns the CIDs of all the replicas recorded in ds.
+func Replicas(ds datastore.Datastore) ([]cid.Cid, error) {
+	res, err := ds.Query(dsq.Query{Prefix: replicaPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	cids := make([]cid.Cid, 0, len(entries))
+	seen := make(map[cid.Cid]bool, len(entries))
+	for _, e := range entries {
+		c, err := replicaCid(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[c] {
+			seen[c] = true
+			cids = append(cids, c)
+		}
+	}
+	return cids, nil
+}
+
+// PruneReplicas drops the records of the replicas keep returns false for,
+// and returns how many were dropped. The blocks are left to the garbage
+// collector.
+func PruneReplicas(ds datastore.Datastore, keep func(Replica) bool) (int, error) {
+	res, err := ds.Query(dsq.Query{Prefix: replicaPrefix.String()})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		var rep Replica
+		if err := json.Unmarshal(e.Value, &rep); err != nil {
+			return removed, fmt.Errorf("invalid replica record %s: %s", e.Key, err)
+		}
+		if keep(rep) {
+			continue
+		}
+		if err := ds.Delete(datastore.RawKey(e.Key)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Roots covers the blocks of a DAG allocated to a peer with as few
+// requests as possible: a DAG made of allocated blocks only is one Root
+// with All set, the other allocated blocks are a Root each. nodes are the
+// blocks of the DAG, its root first.
+func Roots(nodes []ipld.Node, allocated map[cid.Cid]bool) []Root {
+	if len(nodes) == 0 {
+		return nil
+	}
+	byCid := make(map[cid.Cid]ipld.Node, len(nodes))
+	for _, nd := range nodes {
+		byCid[nd.Cid()] = nd
+	}
+
+	// whole tells whether the DAG under c is entirely allocated. Blocks
+	// missing from nodes are not.
+	memo := make(map[cid.Cid]bool, len(nodes))
+	var whole func(c cid.Cid) bool
+	whole = func(c cid.Cid) bool {
+		if w, ok := memo[c]; ok {
+			return w
+		}
+		nd, ok := byCid[c]
+		w := ok && allocated[c]
+		if w {
+			for _, l := range nd.Links() {
+				if !whole(l.Cid) {
+					w = false
+					break
+				}
+			}
+		}
+		memo[c] = w
+		return w
+	}
+
+	var roots []Root
+	seen := make(map[cid.Cid]bool, len(nodes))
+	// cover marks the DAG under c as transferred, for the blocks linked
+	// from several places.
+	var cover func(c cid.Cid)
+	cover = func(c cid.Cid) {
+		seen[c] = true
+		for _, l := range byCid[c].Links() {
+			if !seen[l.Cid] {
+				cover(l.Cid)
+			}
+		}
+	}
+	var walk func(c cid.Cid)
+	walk = func(c cid.Cid) {
+		if seen[c] {
+			return
+		}
+		if whole(c) {
+			roots = append(roots, Root{Cid: c, All: true})
+			cover(c)
+			return
+		}
+		seen[c] = true
+		if allocated[c] {
+			roots = append(roots, Root{Cid: c})
+		}
+		if nd, ok := byCid[c]; ok {
+			for _, l := range nd.Links() {
+				walk(l.Cid)
+			}
+		}
+	}
+	walk(nodes[0].Cid())
+	return roots
+}
@@ -0,0 +1,250 @@
+package backupsync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestRoots(t *testing.T) {
+	// root -> a -> (a1, a2), root -> b -> (b1, b2)
+	a1, a2 := dag.NewRawNode([]byte("a1")), dag.NewRawNode([]byte("a2"))
+	b1, b2 := dag.NewRawNode([]byte("b1")), dag.NewRawNode([]byte("b2"))
+	a, b := &dag.ProtoNode{}, &dag.ProtoNode{}
+	for _, l := range []struct {
+		parent *dag.ProtoNode
+		child  ipld.Node
+	}{{a, a1}, {a, a2}, {b, b1}, {b, b2}} {
+		if err := l.parent.AddNodeLink(l.child.Cid().String(), l.child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := &dag.ProtoNode{}
+	for _, nd := range []ipld.Node{a, b} {
+		if err := root.AddNodeLink(nd.Cid().String(), nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes := []ipld.Node{root, a, a1, a2, b, b1, b2}
+
+	allocated := map[cid.Cid]bool{
+		a.Cid(): true, a1.Cid(): true, a2.Cid(): true,
+		b.Cid(): true, b2.Cid(): true,
+	}
+	roots := Roots(nodes, allocated)
+	expected := []Root{{Cid: a.Cid(), All: true}, {Cid: b.Cid()}, {Cid: b2.Cid(), All: true}}
+	if len(roots) != len(expected) {
+		t.Fatalf("expected %d roots, got %d: %v", len(expected), len(roots), roots)
+	}
+	for i := range expected {
+		if !roots[i].Cid.Equals(expected[i].Cid) || roots[i].All != expected[i].All {
+			t.Errorf("root %d: expected %v, got %v", i, expected[i], roots[i])
+		}
+	}
+
+	if roots := Roots(nodes, map[cid.Cid]bool{}); len(roots) != 0 {
+		t.Errorf("expected no roots, got %v", roots)
+	}
+}
+
+type testPeer struct {
+	id       peer.ID
+	s        *Service
+	ds       datastore.Datastore
+	bs       blockstore.Blockstore
+	restored blockstore.Blockstore
+}
+
+// newTestPeers runs the service on n connected peers.
+func newTestPeers(t *testing.T, n int) []*testPeer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mn, err := mocknet.FullMeshConnected(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []*testPeer
+	for _, h := range mn.Hosts() {
+		ds := dssync.MutexWrap(datastore.NewMapDatastore())
+		tp := &testPeer{
+			id:       h.ID(),
+			ds:       ds,
+			bs:       blockstore.NewBlockstore(ds),
+			restored: blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore())),
+		}
+		tp.s, err = New(ctx, h, ds, storeutil.LinkSystemForBlockstore(tp.bs), storeutil.LinkSystemForBlockstore(tp.restored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tp.s.Close() })
+		peers = append(peers, tp)
+	}
+	return peers
+}
+
+// testFile adds a small DAG to bs and returns its nodes, the root first.
+func testFile(t *testing.T, bs blockstore.Blockstore) []ipld.Node {
+	t.Helper()
+	leaf1, leaf2 := dag.NewRawNode([]byte("leaf 1")), dag.NewRawNode([]byte("leaf 2"))
+	inner := &dag.ProtoNode{}
+	for _, l := range []ipld.Node{leaf1, leaf2} {
+		if err := inner.AddNodeLink(l.Cid().String(), l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := &dag.ProtoNode{}
+	if err := root.AddNodeLink("inner", inner); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []ipld.Node{root, inner, leaf1, leaf2}
+	for _, nd := range nodes {
+		if err := bs.Put(nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func allocateAll(nodes []ipld.Node) []Root {
+	all := make(map[cid.Cid]bool, len(nodes))
+	for _, nd := range nodes {
+		all[nd.Cid()] = true
+	}
+	return Roots(nodes, all)
+}
+
+func hasAll(t *testing.T, bs blockstore.Blockstore, nodes []ipld.Node) bool {
+	t.Helper()
+	for _, nd := range nodes {
+		if has, err := bs.Has(nd.Cid()); err != nil {
+			t.Fatal(err)
+		} else if !has {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPushRefused(t *testing.T) {
+	ctx := context.Background()
+	peers := newTestPeers(t, 2)
+	holder, target := peers[0], peers[1]
+	nodes := testFile(t, holder.bs)
+	root := nodes[0].Cid()
+
+	// without an authorizer, nothing is accepted
+	if _, err := holder.s.Push(ctx, target.id, root, "uid", allocateAll(nodes)); err == nil {
+		t.Fatal("a push was accepted without an authorizer")
+	}
+
+	target.s.SetAuthorizer(func(p peer.ID, push IncomingPush) error {
+		return errors.New("not allocated to this node")
+	})
+	_, err := holder.s.Push(ctx, target.id, root, "uid", allocateAll(nodes))
+	if err == nil || !strings.Contains(err.Error(), "not allocated to this node") {
+		t.Fatalf("expected the push to be refused, got %v", err)
+	}
+
+	if has, _ := target.bs.Has(root); has {
+		t.Fatal("the blocks of a refused push were pulled")
+	}
+	if cids, err := Replicas(target.ds); err != nil || len(cids) != 0 {
+		t.Fatalf("replicas were recorded for a refused push: %v, %v", cids, err)
+	}
+}
+
+func TestPushAndRestore(t *testing.T) {
+	ctx := context.Background()
+	peers := newTestPeers(t, 3)
+	holder, target, other := peers[0], peers[1], peers[2]
+	nodes := testFile(t, holder.bs)
+	root := nodes[0].Cid()
+
+	target.s.SetAuthorizer(func(p peer.ID, push IncomingPush) error {
+		if p != holder.id || !push.File.Equals(root) || push.Uid != "uid" {
+			return errors.New("not allocated to this node")
+		}
+		return nil
+	})
+	n, err := holder.s.Push(ctx, target.id, root, "uid", allocateAll(nodes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(nodes) || !hasAll(t, target.bs, nodes) {
+		t.Fatalf("the target received %d of %d blocks", n, len(nodes))
+	}
+	rep, err := GetReplica(target.ds, root, holder.id.Pretty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.File != root.String() || rep.Uid != "uid" || !rep.Subtree {
+		t.Fatalf("unexpected replica record: %+v", rep)
+	}
+
+	// only the peer that pushed the replicas restores them
+	if _, err := other.s.Restore(ctx, target.id, Root{Cid: root, All: true}); err == nil {
+		t.Fatal("a peer restored the replicas of another")
+	}
+	got, err := holder.s.Restore(ctx, target.id, Root{Cid: root, All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(nodes) || !hasAll(t, holder.restored, nodes) {
+		t.Fatalf("restored %d of %d blocks", len(got), len(nodes))
+	}
+
+	// once expired, the replicas are no longer served
+	removed, err := PruneReplicas(target.ds, func(rep Replica) bool { return rep.File != root.String() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(nodes) {
+		t.Fatalf("removed %d records, expected %d", removed, len(nodes))
+	}
+	if ok, err := HasReplica(target.ds, root); err != nil || ok {
+		t.Fatalf("the replica is still recorded: %v", err)
+	}
+	if _, err := holder.s.Restore(ctx, target.id, Root{Cid: root, All: true}); err == nil {
+		t.Fatal("an expired replica was restored")
+	}
+}
+
+func TestReplicaSources(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	c := dag.NewRawNode([]byte("shared block")).Cid()
+	for _, src := range []string{"first", "second"} {
+		if err := PutReplicas(ds, []cid.Cid{c}, Replica{Source: src, File: src}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cids, err := Replicas(ds); err != nil || len(cids) != 1 {
+		t.Fatalf("expected the block once, got %v, %v", cids, err)
+	}
+
+	// the record of one source expiring leaves the other one
+	if _, err := PruneReplicas(ds, func(rep Replica) bool { return rep.Source != "first" }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetReplica(ds, c, "first"); err != datastore.ErrNotFound {
+		t.Fatalf("expected the first record to be removed, got %v", err)
+	}
+	if rep, err := GetReplica(ds, c, "second"); err != nil || rep.File != "second" {
+		t.Fatalf("the second record was lost: %+v, %v", rep, err)
+	}
+	if ok, err := HasReplica(ds, c); err != nil || !ok {
+		t.Fatalf("the block is no longer a replica: %v", err)
+	}
+}
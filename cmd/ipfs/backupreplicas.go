@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs-auth/selector"
+	logging "github.com/ipfs/go-log"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/commands/blockchain"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+)
+
+var replicaLog = logging.Logger("backupreplicas")
+
+// replicaExpiryInterval is the time between two checks of the replicas
+// against the chain files.
+const replicaExpiryInterval = time.Hour
+
+// chainFiles reads the files registered on chain, by multihash.
+func chainFiles() (map[string]bool, error) {
+	list, err := selector.GetFileList(0)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(list))
+	for _, s := range list {
+		// entries are paths, with or without the /ipfs prefix
+		for _, seg := range strings.Split(s, "/") {
+			if c, err := cid.Decode(seg); err == nil {
+				files[c.Hash().KeyString()] = true
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// authorizeChainPush accepts the pushes of the chain peers for the files
+// registered on chain. The chain keeps no record of the peers a block is
+// allocated to, only of the files and of the peers allocations pick their
+// targets from: both ends of the push must be chain peers.
+func authorizeChainPush(self peer.ID) backupsync.PushAuthorizer {
+	return func(p peer.ID, push backupsync.IncomingPush) error {
+		if !libp2p.ChainPeers.Has(p) {
+			return fmt.Errorf("%s is not registered on chain", p)
+		}
+		if !libp2p.ChainPeers.Has(self) {
+			return errors.New("this node is not registered on chain")
+		}
+		files, err := chainFiles()
+		if err != nil {
+			return fmt.Errorf("reading the chain files: %s", err)
+		}
+		if !files[push.File.Hash().KeyString()] {
+			return fmt.Errorf("file %s is not registered on chain", push.File)
+		}
+		return nil
+	}
+}
+
+// expireReplicas drops the records of the replicas of the files no longer
+// registered on chain, leaving their blocks to the garbage collector.
+func expireReplicas(ds datastore.Datastore) error {
+	files, err := chainFiles()
+	if err != nil {
+		return err
+	}
+	// an empty list is more likely a failure of the chain than every file
+	// gone at once
+	if len(files) == 0 {
+		return errors.New("the chain lists no file, keeping the replicas")
+	}
+	n, err := backupsync.PruneReplicas(ds, func(rep backupsync.Replica) bool {
+		c, err := cid.Decode(rep.File)
+		return err == nil && files[c.Hash().KeyString()]
+	})
+	if n > 0 {
+		replicaLog.Infof("dropped %d expired backup replicas", n)
+	}
+	return err
+}
+
+// startBackupReplicas makes the backup service accept the pushes of the
+// chain allocations. Until ctx is done, it expires the replicas of the files
+// removed from the chain, and keeps the peers holding the replicas of this
+// node tagged, starting from the allocations recorded before the restart.
+func startBackupReplicas(ctx context.Context, node *core.IpfsNode) {
+	if node.BackupSync == nil {
+		return
+	}
+	libp2p.ChainPeers.Prefetch()
+	node.BackupSync.SetAuthorizer(authorizeChainPush(node.Identity))
+
+	go func() {
+		ticker := time.NewTicker(replicaExpiryInterval)
+		defer ticker.Stop()
+		for {
+			if err := expireReplicas(node.Repo.Datastore()); err != nil {
+				replicaLog.Errorf("expiring the backup replicas: %s", err)
+			}
+			// the connection manager forgets the tags of the peers it
+			// is not connected to for long
+			if err := blockchain.TagBackupHolders(ctx, node); err != nil {
+				replicaLog.Errorf("tagging the backup holders: %s", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
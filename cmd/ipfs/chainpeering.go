@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+var chainPeeringLog = logging.Logger("chainpeering")
+
+// chainPeeringConfigKey is the config section holding the chainPeeringConfig.
+const chainPeeringConfigKey = "ChainPeering"
+
+// chainPeeringConfig configures the peering with the peers registered on
+// chain.
+type chainPeeringConfig struct {
+	// Disabled leaves the chain peers to the bootstrap list only.
+	Disabled bool
+
+	// MaxPeers caps the number of chain peers peered with.
+	MaxPeers int
+
+	// Interval is the time between two reads of the chain peer list.
+	Interval string
+
+	// Priority lists peer IDs peered with first, in this order. The other
+	// chain peers follow, the lowest latency first.
+	Priority []string
+}
+
+// Defaults for the chainPeeringConfig fields left unset.
+const (
+	defaultChainPeeringMaxPeers = 16
+	defaultChainPeeringInterval = 5 * time.Minute
+)
+
+// chainPeeringOwner is the owner of the peers chainPeering adds to the
+// peering service.
+const chainPeeringOwner = "chain"
+
+// peeringSet is the part of the peering service chainPeering drives.
+type peeringSet interface {
+	AddPeerAs(owner string, info peer.AddrInfo)
+	RemovePeerAs(owner string, id peer.ID)
+}
+
+// chainPeering keeps the peering service in sync with the chain peer list.
+// The peering service keeps the peers the user added, from Peering.Peers or
+// at runtime, when chainPeering drops them, and leaves out the chain peers the
+// user removed.
+type chainPeering struct {
+	cfg      chainPeeringConfig
+	self     peer.ID
+	ps       peeringSet
+	list     func() ([]peer.AddrInfo, error)
+	latency  func(peer.ID) time.Duration
+	priority map[peer.ID]int
+
+	managed map[peer.ID]bool
+}
+
+func newChainPeering(cfg chainPeeringConfig, self peer.ID, ps peeringSet) (*chainPeering, error) {
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = defaultChainPeeringMaxPeers
+	}
+	cp := &chainPeering{
+		cfg:      cfg,
+		self:     self,
+		ps:       ps,
+		priority: make(map[peer.ID]int, len(cfg.Priority)),
+		managed:  make(map[peer.ID]bool),
+		latency:  func(peer.ID) time.Duration { return 0 },
+	}
+	for i, s := range cfg.Priority {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s.Priority peer %q: %s", chainPeeringConfigKey, s, err)
+		}
+		cp.priority[id] = i
+	}
+	return cp, nil
+}
+
+// selectPeers orders the chain peers by priority, then by latency, the
+// peers of unknown latency last, and keeps the first MaxPeers of them.
+func (cp *chainPeering) selectPeers(infos []peer.AddrInfo) []peer.AddrInfo {
+	selected := make([]peer.AddrInfo, 0, len(infos))
+	seen := make(map[peer.ID]bool, len(infos))
+	for _, ai := range infos {
+		if ai.ID == cp.self || seen[ai.ID] {
+			continue
+		}
+		seen[ai.ID] = true
+		selected = append(selected, ai)
+	}
+
+	rank := func(id peer.ID) (int, time.Duration) {
+		prio, ok := cp.priority[id]
+		if !ok {
+			prio = len(cp.priority)
+		}
+		lat := cp.latency(id)
+		if lat == 0 {
+			lat = time.Duration(1<<63 - 1)
+		}
+		return prio, lat
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		pi, li := rank(selected[i].ID)
+		pj, lj := rank(selected[j].ID)
+		if pi != pj {
+			return pi < pj
+		}
+		return li < lj
+	})
+
+	if len(selected) > cp.cfg.MaxPeers {
+		selected = selected[:cp.cfg.MaxPeers]
+	}
+	return selected
+}
+
+// sync reads the chain peer list and updates the peering service.
+func (cp *chainPeering) sync() error {
+	infos, err := cp.list()
+	if err != nil {
+		return err
+	}
+
+	selected := cp.selectPeers(infos)
+	keep := make(map[peer.ID]bool, len(selected))
+	for _, ai := range selected {
+		keep[ai.ID] = true
+		if !cp.managed[ai.ID] {
+			chainPeeringLog.Infof("peering with chain peer %s", ai.ID)
+		}
+		// refreshes the addresses of the peers already there
+		cp.ps.AddPeerAs(chainPeeringOwner, ai)
+		cp.managed[ai.ID] = true
+	}
+	for id := range cp.managed {
+		if !keep[id] {
+			chainPeeringLog.Infof("no longer peering with chain peer %s", id)
+			cp.ps.RemovePeerAs(chainPeeringOwner, id)
+			delete(cp.managed, id)
+		}
+	}
+	return nil
+}
+
+func (cp *chainPeering) run(ctx context.Context) error {
+	interval := defaultChainPeeringInterval
+	if cp.cfg.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(cp.cfg.Interval); err != nil {
+			return fmt.Errorf("invalid %s.Interval: %s", chainPeeringConfigKey, err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cp.sync(); err != nil {
+			chainPeeringLog.Errorf("reading the chain peers: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// startChainPeering peers the node with the chain peers until ctx is done.
+func startChainPeering(ctx context.Context, node *core.IpfsNode) error {
+	if node.Peering == nil {
+		return nil
+	}
+	var cfg chainPeeringConfig
+	if err := repo.ConfigSection(node.Repo, chainPeeringConfigKey, &cfg); err != nil {
+		return err
+	}
+	if cfg.Disabled {
+		return nil
+	}
+	cp, err := newChainPeering(cfg, node.Identity, node.Peering)
+	if err != nil {
+		return err
+	}
+	cp.list = libp2p.ChainPeers.Infos
+	cp.latency = node.Peerstore.LatencyEWMA
+
+	go func() {
+		if err := cp.run(ctx); err != nil {
+			chainPeeringLog.Error(err)
+		}
+	}()
+	return nil
+}
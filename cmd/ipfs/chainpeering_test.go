@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// testPeeringSet holds the peers added as chainPeeringOwner.
+type testPeeringSet map[peer.ID]peer.AddrInfo
+
+func (s testPeeringSet) AddPeerAs(owner string, ai peer.AddrInfo) {
+	if owner == chainPeeringOwner {
+		s[ai.ID] = ai
+	}
+}
+
+func (s testPeeringSet) RemovePeerAs(owner string, id peer.ID) {
+	if owner == chainPeeringOwner {
+		delete(s, id)
+	}
+}
+
+func testChainPeer(i int) peer.AddrInfo {
+	return peer.AddrInfo{
+		ID:    peer.ID(fmt.Sprintf("peer-%d", i)),
+		Addrs: []ma.Multiaddr{ma.StringCast(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", i))},
+	}
+}
+
+func TestChainPeeringSync(t *testing.T) {
+	ps := testPeeringSet{}
+	cp, err := newChainPeering(chainPeeringConfig{MaxPeers: 3}, testChainPeer(0).ID, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.priority[testChainPeer(5).ID] = 0
+	cp.latency = func(id peer.ID) time.Duration {
+		if id == testChainPeer(2).ID {
+			return time.Millisecond
+		}
+		return 0
+	}
+
+	chain := []peer.AddrInfo{testChainPeer(0), testChainPeer(1), testChainPeer(2), testChainPeer(3), testChainPeer(4), testChainPeer(5)}
+	cp.list = func() ([]peer.AddrInfo, error) { return chain, nil }
+	if err := cp.sync(); err != nil {
+		t.Fatal(err)
+	}
+	// self excluded, priority first, then known latency, then chain order
+	for _, i := range []int{5, 2, 1} {
+		if _, ok := ps[testChainPeer(i).ID]; !ok {
+			t.Errorf("expected peer %d to be peered with", i)
+		}
+	}
+	if len(ps) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(ps))
+	}
+
+	// peers leaving the chain are removed
+	chain = []peer.AddrInfo{testChainPeer(4)}
+	if err := cp.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 {
+		t.Fatalf("expected 1 peer, got %d: %v", len(ps), ps)
+	}
+	if _, ok := ps[testChainPeer(4).ID]; !ok {
+		t.Error("expected the new chain peer to be peered with")
+	}
+}
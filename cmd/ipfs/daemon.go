@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	_ "expvar"
@@ -41,6 +42,7 @@ import (
 	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
 	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	nodeMount "github.com/ipfs/go-ipfs/fuse/node"
+	repo "github.com/ipfs/go-ipfs/repo"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
 	sockets "github.com/libp2p/go-socket-activation"
@@ -423,6 +425,9 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 	if node.PNetFingerprint != nil {
 		fmt.Println("Swarm is limited to private network of peers with the swarm key")
 		fmt.Printf("Swarm key fingerprint: %x\n", node.PNetFingerprint)
+		if _, next := node.PNetKeys.Fingerprints(); next != nil {
+			fmt.Printf("Next swarm key fingerprint: %x\n", next)
+		}
 	}
 
 	printSwarmAddrs(node)
@@ -474,6 +479,56 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 		return err
 	}
 
+	// pins added with an expiry are removed in the background
+	go corerepo.PeriodicPinExpiry(req.Context, node)
+
+	// storage quotas are enforced once the blocks are classified
+	go func() {
+		if err := corerepo.PeriodicQuota(req.Context, node); err != nil {
+			log.Errorf("storage quota: %s", err)
+		}
+	}()
+
+	scrubCfg, err := corerepo.ScrubConfigFromRepo(node.Repo)
+	if err != nil {
+		return err
+	}
+	if scrubCfg.Enabled {
+		go func() {
+			if err := corerepo.PeriodicScrub(req.Context, node, scrubCfg); err != nil {
+				log.Errorf("periodic scrub: %s", err)
+			}
+		}()
+	}
+
+	var watchCfg corerepo.FilestoreWatchConfig
+	if err := repo.ConfigSection(node.Repo, corerepo.FilestoreWatchConfigKey, &watchCfg); err != nil {
+		return err
+	}
+	if watchCfg.Enabled && node.Filestore != nil {
+		fw, err := corerepo.NewFilestoreWatcher(node, watchCfg)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := fw.Run(req.Context); err != nil {
+				log.Errorf("filestore watch: %s", err)
+			}
+		}()
+	}
+
+	snapshotCfg, err := corerepo.FilesSnapshotConfigFromRepo(node.Repo)
+	if err != nil {
+		return err
+	}
+	if snapshotCfg.Enabled {
+		go func() {
+			if err := corerepo.PeriodicFilesSnapshot(req.Context, node, snapshotCfg); err != nil {
+				log.Errorf("MFS snapshots: %s", err)
+			}
+		}()
+	}
+
 	// Add any files downloaded by migration.
 	if cacheMigrations || pinMigrations {
 		err = addMigrations(cctx.Context(), node, fetcher, pinMigrations)
@@ -547,6 +602,13 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 		if err != nil {
 			return err
 		}
+		// bootstrap connections get trimmed, the peering service keeps
+		// the node connected to the chain peers
+		if err := startChainPeering(req.Context, node); err != nil {
+			return err
+		}
+		// replicas are pushed by and kept for the chain allocations
+		startBackupReplicas(req.Context, node)
 		// 定时更新本节点存储的块数量
 		if cfg.Mining {
 			go func() {
@@ -759,11 +821,13 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 		listenerAddrs[string(listener.Multiaddr().Bytes())] = true
 	}
 
+	secure := make(map[manet.Listener]bool)
 	for _, addr := range apiAddrs {
 		apiMaddr, err := ma.NewMultiaddr(addr)
 		if err != nil {
 			return nil, fmt.Errorf("serveHTTPApi: invalid API address: %q (err: %s)", addr, err)
 		}
+		apiMaddr, isTLS := corehttp.SplitTLS(apiMaddr)
 		if listenerAddrs[string(apiMaddr.Bytes())] {
 			continue
 		}
@@ -775,15 +839,20 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 
 		listenerAddrs[string(apiMaddr.Bytes())] = true
 		listeners = append(listeners, apiLis)
+		secure[apiLis] = isTLS
 	}
 
 	for _, listener := range listeners {
 		// we might have listened to /tcp/0 - let's see what we are listing on
-		fmt.Printf("API server listening on %s\n", listener.Multiaddr())
+		fmt.Printf("API server listening on %s\n", listenerMultiaddr(listener, secure[listener]))
 		// Browsers require TCP.
 		switch listener.Addr().Network() {
 		case "tcp", "tcp4", "tcp6":
-			fmt.Printf("WebUI: http://%s/webui\n", listener.Addr())
+			scheme := "http"
+			if secure[listener] {
+				scheme = "https"
+			}
+			fmt.Printf("WebUI: %s://%s/webui\n", scheme, listener.Addr())
 		}
 	}
 
@@ -821,7 +890,12 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 		return nil, fmt.Errorf("serveHTTPApi: ConstructNode() failed: %s", err)
 	}
 
-	if err := node.Repo.SetAPIAddr(listeners[0].Multiaddr()); err != nil {
+	tlsConf, err := listenerTLSConfig(cctx, node, secure, func(c corehttp.TLSConfig) corehttp.TLSListenerConfig { return c.API })
+	if err != nil {
+		return nil, fmt.Errorf("serveHTTPApi: %s", err)
+	}
+
+	if err := node.Repo.SetAPIAddr(listenerMultiaddr(listeners[0], secure[listeners[0]])); err != nil {
 		return nil, fmt.Errorf("serveHTTPApi: SetAPIAddr() failed: %s", err)
 	}
 
@@ -831,7 +905,7 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 		wg.Add(1)
 		go func(lis manet.Listener) {
 			defer wg.Done()
-			errc <- corehttp.Serve(node, manet.NetListener(lis), opts...)
+			errc <- corehttp.Serve(node, netListener(lis, secure[lis], tlsConf), opts...)
 		}(apiLis)
 	}
 
@@ -896,12 +970,14 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 		listenerAddrs[string(listener.Multiaddr().Bytes())] = true
 	}
 
+	secure := make(map[manet.Listener]bool)
 	gatewayAddrs := cfg.Addresses.Gateway
 	for _, addr := range gatewayAddrs {
 		gatewayMaddr, err := ma.NewMultiaddr(addr)
 		if err != nil {
 			return nil, fmt.Errorf("serveHTTPGateway: invalid gateway address: %q (err: %s)", addr, err)
 		}
+		gatewayMaddr, isTLS := corehttp.SplitTLS(gatewayMaddr)
 
 		if listenerAddrs[string(gatewayMaddr.Bytes())] {
 			continue
@@ -913,6 +989,7 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 		}
 		listenerAddrs[string(gatewayMaddr.Bytes())] = true
 		listeners = append(listeners, gwLis)
+		secure[gwLis] = isTLS
 	}
 
 	// we might have listened to /tcp/0 - let's see what we are listing on
@@ -922,20 +999,42 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 	}
 
 	for _, listener := range listeners {
-		fmt.Printf("Gateway (%s) server listening on %s\n", gwType, listener.Multiaddr())
+		fmt.Printf("Gateway (%s) server listening on %s\n", gwType, listenerMultiaddr(listener, secure[listener]))
 	}
 
 	cmdctx := *cctx
 	cmdctx.Gateway = true
 
+	node, err := cctx.ConstructNode()
+	if err != nil {
+		return nil, fmt.Errorf("serveHTTPGateway: ConstructNode() failed: %s", err)
+	}
+
+	tlsConf, err := listenerTLSConfig(cctx, node, secure, func(c corehttp.TLSConfig) corehttp.TLSListenerConfig { return c.Gateway })
+	if err != nil {
+		return nil, fmt.Errorf("serveHTTPGateway: %s", err)
+	}
+
+	var limits corehttp.RateLimitConfig
+	if err := repo.ConfigSection(node.Repo, corehttp.RateLimitConfigKey, &limits); err != nil {
+		return nil, fmt.Errorf("serveHTTPGateway: invalid %s config: %s", corehttp.RateLimitConfigKey, err)
+	}
+
 	var opts = []corehttp.ServeOption{
 		corehttp.MetricsCollectionOption("gateway"),
 		corehttp.HostnameOption(),
+	}
+
+	if limits.Enabled() {
+		opts = append(opts, corehttp.RateLimitOption(limits))
+	}
+
+	opts = append(opts,
 		corehttp.GatewayOption(writable, "/ipfs", "/ipns"),
 		corehttp.VersionOption(),
 		corehttp.CheckVersionOption(),
 		corehttp.CommandsROOption(cmdctx),
-	}
+	)
 
 	if cfg.Experimental.P2pHttpProxy {
 		opts = append(opts, corehttp.P2PProxyOption())
@@ -949,18 +1048,13 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 		log.Error("Support for X-Ipfs-Gateway-Prefix and Gateway.PathPrefixes is deprecated and will be removed in the next release. Please comment on the issue if you're using this feature: https://github.com/ipfs/go-ipfs/issues/7702")
 	}
 
-	node, err := cctx.ConstructNode()
-	if err != nil {
-		return nil, fmt.Errorf("serveHTTPGateway: ConstructNode() failed: %s", err)
-	}
-
 	errc := make(chan error)
 	var wg sync.WaitGroup
 	for _, lis := range listeners {
 		wg.Add(1)
 		go func(lis manet.Listener) {
 			defer wg.Done()
-			errc <- corehttp.Serve(node, manet.NetListener(lis), opts...)
+			errc <- corehttp.Serve(node, netListener(lis, secure[lis], tlsConf), opts...)
 		}(lis)
 	}
 
@@ -972,6 +1066,41 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 	return errc, nil
 }
 
+// listenerTLSConfig loads the certificate for the listeners marked as secure.
+// It returns nil when none of them is.
+func listenerTLSConfig(cctx *oldcmds.Context, node *core.IpfsNode, secure map[manet.Listener]bool, section func(corehttp.TLSConfig) corehttp.TLSListenerConfig) (*tls.Config, error) {
+	needed := false
+	for _, s := range secure {
+		needed = needed || s
+	}
+	if !needed {
+		return nil, nil
+	}
+
+	var cfg corehttp.TLSConfig
+	if err := repo.ConfigSection(node.Repo, corehttp.TLSConfigKey, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %s", corehttp.TLSConfigKey, err)
+	}
+	return corehttp.NewTLSConfig(section(cfg), cctx.ConfigRoot, node.Process.Closing())
+}
+
+// listenerMultiaddr returns the address of lis, marked with /tls if it
+// serves TLS.
+func listenerMultiaddr(lis manet.Listener, secure bool) ma.Multiaddr {
+	addr := lis.Multiaddr()
+	if secure {
+		addr = addr.Encapsulate(ma.StringCast("/tls"))
+	}
+	return addr
+}
+
+func netListener(lis manet.Listener, secure bool, conf *tls.Config) net.Listener {
+	if secure {
+		return tls.NewListener(manet.NetListener(lis), conf)
+	}
+	return manet.NetListener(lis)
+}
+
 //collects options and opens the fuse mountpoint
 func mountFuse(req *cmds.Request, cctx *oldcmds.Context) error {
 	cfg, err := cctx.GetConfig()
@@ -1077,8 +1206,6 @@ func printVersion() {
 	fmt.Printf("Golang version: %s\n", runtime.Version())
 }
 
-const fileExistKey = "fileExist/"
-
 func getNewFile(ctx context.Context, ds datastore.Datastore, api coreiface.CoreAPI) error {
 	// 拉取链上文件列表
 	fileList, err := selector.GetFileList(0)
@@ -1087,7 +1214,7 @@ func getNewFile(ctx context.Context, ds datastore.Datastore, api coreiface.CoreA
 	}
 	// 取出新增文件列表（本地不存在的文件）
 	for _, s := range fileList {
-		key := datastore.NewKey(fileExistKey + s)
+		key := datastore.NewKey(corerepo.ChainFileKeyPrefix + s)
 		_, err := ds.Get(key)
 		if err == datastore.ErrNotFound {
 			// 拉取文件
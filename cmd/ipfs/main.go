@@ -3,8 +3,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -25,6 +28,7 @@ import (
 	"github.com/ipfs/go-ipfs-cmds/cli"
 	cmdhttp "github.com/ipfs/go-ipfs-cmds/http"
 	config "github.com/ipfs/go-ipfs-config"
+	serialize "github.com/ipfs/go-ipfs-config/serialize"
 	u "github.com/ipfs/go-ipfs-util"
 	logging "github.com/ipfs/go-log"
 	loggables "github.com/libp2p/go-libp2p-loggables"
@@ -43,6 +47,12 @@ const (
 	EnvEnableProfiling = "IPFS_PROF"
 	cpuProfile         = "ipfs.cpuprof"
 	heapProfile        = "ipfs.memprof"
+
+	// EnvAPITLSCA, EnvAPITLSCert and EnvAPITLSKey configure the client
+	// side of API addresses ending in /tls.
+	EnvAPITLSCA   = "IPFS_API_TLS_CA"
+	EnvAPITLSCert = "IPFS_API_TLS_CERT"
+	EnvAPITLSKey  = "IPFS_API_TLS_KEY"
 )
 
 func loadPlugins(repoPath string) (*loader.PluginLoader, error) {
@@ -252,6 +262,18 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 		return exe, nil
 	}
 
+	// Addresses ending in /tls are dialed over TLS, verifying the name
+	// the user gave us rather than the resolved IP.
+	apiAddr, secure := corehttp.SplitTLS(apiAddr)
+	var tlsConf *tls.Config
+	if secure {
+		serverName := corehttp.TLSServerName(apiAddr, apiTLSListenerConfig(cctx.ConfigRoot), cctx.ConfigRoot)
+		tlsConf, err = apiClientTLSConfig(serverName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Resolve the API addr.
 	apiAddr, err = resolveAddr(req.Context, apiAddr)
 	if err != nil {
@@ -273,16 +295,28 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 		opts = append(opts, cmdhttp.ClientWithFallback(exe))
 	}
 
+	var dialer net.Dialer
 	switch network {
 	case "tcp", "tcp4", "tcp6":
+		if tlsConf != nil {
+			opts = append(opts, cmdhttp.ClientWithHTTPClient(&http.Client{
+				Transport: &http.Transport{
+					DialContext: dialTLS(dialer.DialContext, tlsConf),
+				},
+			}))
+		}
 	case "unix":
 		path := host
 		host = "unix"
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		if tlsConf != nil {
+			dial = dialTLS(dial, tlsConf)
+		}
 		opts = append(opts, cmdhttp.ClientWithHTTPClient(&http.Client{
 			Transport: &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("unix", path)
-				},
+				DialContext: dial,
 			},
 		}))
 	default:
@@ -360,6 +394,75 @@ func profileIfEnabled() (func(), error) {
 	return func() {}, nil
 }
 
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialTLS performs a TLS handshake on the connections returned by dial. The
+// HTTP client keeps speaking plain HTTP over them.
+func dialTLS(dial dialFunc, conf *tls.Config) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		tconn := tls.Client(conn, conf)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tconn, nil
+	}
+}
+
+// apiTLSListenerConfig reads the certificate of the API from the config of
+// the repo at root, if any. The config is read directly as the repo is
+// locked by the daemon.
+func apiTLSListenerConfig(root string) corehttp.TLSListenerConfig {
+	var cfg struct {
+		HTTPTLS corehttp.TLSConfig // corehttp.TLSConfigKey
+	}
+	filename, err := config.Filename(root)
+	if err != nil {
+		return corehttp.TLSListenerConfig{}
+	}
+	if err := serialize.ReadConfigFile(filename, &cfg); err != nil {
+		return corehttp.TLSListenerConfig{}
+	}
+	return cfg.HTTPTLS.API
+}
+
+// apiClientTLSConfig builds the TLS configuration used to reach an API
+// listening on a /tls address. The CA and client certificate come from the
+// environment, the system roots are trusted otherwise.
+func apiClientTLSConfig(serverName string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if ca := os.Getenv(EnvAPITLSCA); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found in %s", EnvAPITLSCA, ca)
+		}
+		conf.RootCAs = pool
+	}
+	if cert := os.Getenv(EnvAPITLSCert); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, os.Getenv(EnvAPITLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("loading API client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
 func resolveAddr(ctx context.Context, addr ma.Multiaddr) (ma.Multiaddr, error) {
 	ctx, cancelFunc := context.WithTimeout(ctx, 10*time.Second)
 	defer cancelFunc()
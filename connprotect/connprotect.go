@@ -0,0 +1,116 @@
+// Package connprotect names the reasons the node keeps the connections to a
+// peer open. The connection manager trims the connections of the peers with
+// the lowest tag weights first, and never trims the protected ones; each
+// Tier is a tag with its weight, protected or not.
+package connprotect
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Tier is a reason to keep the connections to a peer.
+type Tier struct {
+	// Tag is the connection manager tag of the tier.
+	Tag string
+	// Weight is added to the value of the peer.
+	Weight int
+	// Protect keeps the connections from being trimmed at all.
+	Protect bool
+	// Reason describes the tier for 'ipfs swarm peers'.
+	Reason string
+}
+
+var (
+	// BackupPush is an allocation push in progress, on both sides.
+	BackupPush = Tier{Tag: "backup-push", Weight: 100, Protect: true, Reason: "backup allocation push"}
+	// BackupRestore is a restore of backup replicas in progress.
+	BackupRestore = Tier{Tag: "backup-restore", Weight: 100, Protect: true, Reason: "backup restore"}
+	// BackupHolder is a peer holding backup replicas of this node.
+	BackupHolder = Tier{Tag: "backup-holder", Weight: 50, Reason: "holds backup replicas"}
+	// StreamForward is a peer with open streams of local 'ipfs p2p'
+	// forwards. Only the streams this node opens protect their peer.
+	StreamForward = Tier{Tag: "stream-fwd", Weight: 20, Protect: true, Reason: "p2p forward stream"}
+	// Peering is a peer of the peering service.
+	Peering = Tier{Tag: "ipfs-peering", Protect: true, Reason: "peering"}
+)
+
+// Tiers lists the tiers, highest weight first.
+var Tiers = []Tier{BackupPush, BackupRestore, BackupHolder, StreamForward, Peering}
+
+// Add puts p in the tier t.
+func Add(cm connmgr.ConnManager, p peer.ID, t Tier) {
+	if t.Weight != 0 {
+		cm.TagPeer(p, t.Tag, t.Weight)
+	}
+	if t.Protect {
+		cm.Protect(p, t.Tag)
+	}
+}
+
+// Remove takes p out of the tier t.
+func Remove(cm connmgr.ConnManager, p peer.ID, t Tier) {
+	if t.Weight != 0 {
+		cm.UntagPeer(p, t.Tag)
+	}
+	if t.Protect {
+		cm.Unprotect(p, t.Tag)
+	}
+}
+
+// Reasons returns the reasons p is protected for.
+func Reasons(cm connmgr.ConnManager, p peer.ID) []string {
+	var reasons []string
+	for _, t := range Tiers {
+		if t.Protect && cm.IsProtected(p, t.Tag) {
+			reasons = append(reasons, t.Reason)
+		}
+	}
+	return reasons
+}
+
+// Holds counts the operations keeping peers in a tier, so that a peer
+// leaves it once the last one is done.
+type Holds struct {
+	cm connmgr.ConnManager
+
+	mu     sync.Mutex
+	counts map[holdKey]int
+}
+
+type holdKey struct {
+	p   peer.ID
+	tag string
+}
+
+// NewHolds returns the holds on the tiers of cm.
+func NewHolds(cm connmgr.ConnManager) *Holds {
+	return &Holds{cm: cm, counts: make(map[holdKey]int)}
+}
+
+// Hold keeps p in the tier t until the returned function is called.
+func (h *Holds) Hold(p peer.ID, t Tier) (release func()) {
+	k := holdKey{p, t.Tag}
+
+	h.mu.Lock()
+	if h.counts[k] == 0 {
+		Add(h.cm, p, t)
+	}
+	h.counts[k]++
+	h.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.counts[k]--
+			if h.counts[k] == 0 {
+				delete(h.counts, k)
+				Remove(h.cm, p, t)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package connprotect
+
+import (
+	"testing"
+	"time"
+
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestHolds(t *testing.T) {
+	cm := connmgr.NewConnManager(1, 2, time.Minute)
+	p := peer.ID("peer")
+	h := NewHolds(cm)
+
+	first := h.Hold(p, BackupPush)
+	second := h.Hold(p, BackupPush)
+	if !cm.IsProtected(p, BackupPush.Tag) {
+		t.Fatal("expected the peer to be protected")
+	}
+
+	first()
+	first() // released once only
+	if !cm.IsProtected(p, BackupPush.Tag) {
+		t.Fatal("expected the peer to stay protected while held")
+	}
+	if r := Reasons(cm, p); len(r) != 1 || r[0] != BackupPush.Reason {
+		t.Fatalf("unexpected reasons: %v", r)
+	}
+
+	second()
+	if cm.IsProtected(p, BackupPush.Tag) {
+		t.Fatal("expected the peer to be unprotected once released")
+	}
+	if r := Reasons(cm, p); len(r) != 0 {
+		t.Fatalf("unexpected reasons: %v", r)
+	}
+}
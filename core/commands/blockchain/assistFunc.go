@@ -3,25 +3,35 @@ package blockchain
 import (
 	"context"
 	"fmt"
-	"github.com/ipfs/go-bitswap"
 	bsmsg "github.com/ipfs/go-bitswap/message"
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-ipfs-auth/selector"
 	"github.com/ipfs/go-ipfs-auth/standard/model"
 	"github.com/ipfs/go-ipfs-backup/allocate"
 	"github.com/ipfs/go-ipfs-backup/backup"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/connprotect"
 	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/repo"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+	dag "github.com/ipfs/go-merkledag"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
+	"strings"
 	"sync"
 	"time"
 )
 
+var log = logging.Logger("blockchain")
+
 func BlockGetRecursive(ctx context.Context, api coreiface.CoreAPI, cid cid.Cid) ([]blocks.Block, error) {
 	var blockList []blocks.Block
 	obj, err := api.Dag().Get(ctx, cid)
@@ -65,9 +75,13 @@ func CidGet(ctx context.Context, api coreiface.CoreAPI, cid cid.Cid, reFlag bool
 	return cidList, nil
 }
 
-func Allocate(node *core.IpfsNode, blockList []blocks.Block, serverList []model.CorePeer, setting allocate.Setting, uid string, size uint64) error {
+// backupLeaseHolder prefixes the uid of an allocation in the lease keeping
+// the allocated file.
+const backupLeaseHolder = "backup "
+
+func Allocate(ctx context.Context, node *core.IpfsNode, blockList []blocks.Block, serverList []model.CorePeer, setting allocate.Setting, uid string, size uint64) error {
 	ds := node.Repo.Datastore()
-	bs, oneLineFlag := node.Exchange.(*bitswap.Bitswap)
+	oneLineFlag := node.IsOnline && node.BackupSync != nil
 
 	// 查询文件在本节点（或者全网络，暂未实现）已有的分布情况
 	loadList, filePeerMap, err := findAllocateConditionLocal(ds, blockList, serverList, uid, setting.TargetNum)
@@ -97,15 +111,28 @@ func Allocate(node *core.IpfsNode, blockList []blocks.Block, serverList []model.
 					return err
 				}
 			}
-			// 记录备份信息
-			_, err := backup.AddFileBackupInfo(ds, loadList, uid, size)
+			// 本地副本在备份信息删除前不被GC回收
+			lease := gc.Lease{Root: blockList[0].Cid(), Holder: backupLeaseHolder + uid}
+			err = gc.PutLease(ds, lease)
 			if err != nil {
 				return err
 			}
-			// 分片分发
-			bs.PushTasks(loadList)
-			// 记录的逻辑在func (e *Engine) MessageSent(p peer.ID, m bsmsg.BitSwapMessage)中
-			// todo 或者考虑在这里先记录分发信息，在messageSent中响应分发是否成功
+			// 分片分发：目标节点通过graphsync拉取分配给它的分片
+			if err := distribute(ctx, node, blockList, loadList, uid); err != nil {
+				// 未记录备份信息，再次添加时重新分配
+				if err := gc.RemoveLease(ds, lease.Root); err != nil && err != datastore.ErrNotFound {
+					log.Errorf("removing the lease of %s: %s", lease.Root, err)
+				}
+				return err
+			}
+			// 记录备份信息
+			if _, err := backup.AddFileBackupInfo(ds, loadList, uid, size); err != nil {
+				return err
+			}
+			// keep the holders of the replicas connected for the restores
+			if err := TagBackupHolders(ctx, node); err != nil {
+				log.Warnf("tagging the backup holders: %s", err)
+			}
 			return nil
 		} else {
 			// todo 线下模式，记录未分发，提示用户
@@ -120,6 +147,130 @@ func Allocate(node *core.IpfsNode, blockList []blocks.Block, serverList []model.
 
 }
 
+// distribute asks every target peer of the allocation to pull the blocks
+// allocated to it over graphsync, whole subtrees at once where possible. It
+// returns an error if any of the peers failed to.
+func distribute(ctx context.Context, node *core.IpfsNode, blockList []blocks.Block, loadList []bsmsg.Load, uid string) error {
+	nodes := make([]ipld.Node, 0, len(blockList))
+	for _, b := range blockList {
+		if nd, ok := b.(ipld.Node); ok {
+			nodes = append(nodes, nd)
+		}
+	}
+
+	allocated := make(map[peer.ID]map[cid.Cid]bool)
+	for _, l := range loadList {
+		for _, name := range l.TargetPeerList {
+			pid, err := peer.Decode(name)
+			if err != nil || pid == node.Identity {
+				continue
+			}
+			if allocated[pid] == nil {
+				allocated[pid] = make(map[cid.Cid]bool)
+			}
+			allocated[pid][l.Block.Cid()] = true
+		}
+	}
+
+	file := blockList[0].Cid()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for pid, set := range allocated {
+		wg.Add(1)
+		go func(pid peer.ID, set map[cid.Cid]bool) {
+			defer wg.Done()
+			roots := backupsync.Roots(nodes, set)
+			n, err := node.BackupSync.Push(ctx, pid, file, uid, roots)
+			if err != nil {
+				log.Errorf("pushing %d blocks to %s: %s", len(set), pid, err)
+				mu.Lock()
+				failed = append(failed, pid.Pretty())
+				mu.Unlock()
+				return
+			}
+			log.Infof("pushed %d blocks to %s in %d requests", n, pid, len(roots))
+		}(pid, set)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("分发失败的节点：%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// backupHolders returns the peers the backup records of node list as
+// holding blocks of its allocated files.
+func backupHolders(ctx context.Context, node *core.IpfsNode) (map[peer.ID]bool, error) {
+	ds := node.Repo.Datastore()
+	leases, err := gc.ActiveLeases(ds, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// the leased files are local, don't fetch anything
+	ng := dag.NewDAGService(blockservice.New(node.Blockstore, offline.Exchange(node.Blockstore)))
+
+	holders := make(map[peer.ID]bool)
+	for _, l := range leases {
+		if !strings.HasPrefix(l.Holder, backupLeaseHolder) {
+			continue
+		}
+		var lerr error
+		err := dag.Walk(ctx, dag.GetLinksWithDAG(ng), l.Root, func(c cid.Cid) bool {
+			info, err := backup.Get(ds, c.String())
+			switch err {
+			case nil:
+			case datastore.ErrNotFound:
+				return true
+			default:
+				lerr = err
+				return false
+			}
+			for name := range info.TargetPeerList {
+				if pid, err := peer.Decode(name); err == nil && pid != node.Identity {
+					holders[pid] = true
+				}
+			}
+			return true
+		})
+		if lerr != nil {
+			return nil, lerr
+		}
+		if err != nil {
+			log.Warnf("reading the allocated file %s: %s", l.Root, err)
+		}
+	}
+	return holders, nil
+}
+
+// TagBackupHolders puts the peers holding backup replicas of node in the
+// BackupHolder tier, and takes out the peers it no longer allocates to,
+// such as the holders of the files removed since.
+func TagBackupHolders(ctx context.Context, node *core.IpfsNode) error {
+	if node.PeerHost == nil {
+		return nil
+	}
+	holders, err := backupHolders(ctx, node)
+	if err != nil {
+		return err
+	}
+	cm := node.PeerHost.ConnManager()
+	for p := range holders {
+		connprotect.Add(cm, p, connprotect.BackupHolder)
+	}
+	for _, p := range node.Peerstore.Peers() {
+		if holders[p] {
+			continue
+		}
+		if ti := cm.GetTagInfo(p); ti != nil && ti.Tags[connprotect.BackupHolder.Tag] != 0 {
+			connprotect.Remove(cm, p, connprotect.BackupHolder)
+		}
+	}
+	return nil
+}
+
 // 查询文件在本节点记录的分布情况
 func findAllocateConditionLocal(ds repo.Datastore, blockList []blocks.Block, peerList []model.CorePeer, uid string, n int) ([]bsmsg.Load, map[string]backup.StringSet, error) {
 	load := make([]bsmsg.Load, len(blockList))
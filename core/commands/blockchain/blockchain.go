@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/ipfs/go-cid"
@@ -11,10 +12,11 @@ import (
 	"github.com/ipfs/go-ipfs-backup/allocate"
 	"github.com/ipfs/go-ipfs-backup/backup"
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/util"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
-	"github.com/prometheus/common/log"
 	"io"
 	"os"
 	"path"
@@ -92,6 +94,7 @@ var FileCmd = &cmds.Command{
 		"delete":   DeleteCmd,
 		"backup":   BackupInfoCmd,
 		"recharge": RechargeCmd,
+		"token":    TokenCmd,
 	},
 }
 
@@ -264,9 +267,14 @@ only-hash, and progress/status related flags) will change the final hash.
 		b := req.Options[privateOptionName].(bool)
 		days := req.Options[fileStoreDays].(int)
 
+		// 私密文件的内容用随机密钥加密，密钥只保存在本节点
+		var contentKey []byte
 		if b {
 			cidVerSet = true
 			cidVer = 2
+			if contentKey, err = util.GenerateContentKey(); err != nil {
+				return err
+			}
 		}
 
 		hashFunCode, ok := mh.Names[strings.ToLower(hashFunStr)]
@@ -280,9 +288,12 @@ only-hash, and progress/status related flags) will change the final hash.
 		}
 
 		toadd := req.Files
+		if contentKey != nil {
+			toadd = util.EncryptDirectory(toadd, contentKey)
+		}
 		if wrap {
 			toadd = files.NewSliceDirectory([]files.DirEntry{
-				files.FileEntry("", req.Files),
+				files.FileEntry("", toadd),
 			})
 		}
 
@@ -341,6 +352,11 @@ only-hash, and progress/status related flags) will change the final hash.
 				h := ""
 				if output.Path != nil {
 					h = enc.Encode(output.Path.Cid())
+					if contentKey != nil {
+						if err := util.PutContentKey(node.Repo.Datastore(), output.Path.Cid(), contentKey); err != nil {
+							return err
+						}
+					}
 				}
 				if !dir && addit.Name() != "" {
 					output.Name = addit.Name()
@@ -397,7 +413,7 @@ only-hash, and progress/status related flags) will change the final hash.
 							return fmt.Errorf("在线节点数不满足备份条件")
 						}
 
-						return Allocate(node, blockList, peerList, setting, uid, uint64(s))
+						return Allocate(ctx, node, blockList, peerList, setting, uid, uint64(s))
 					}
 					errChan := make(chan error)
 					go func() {
@@ -614,7 +630,21 @@ var DeleteCmd = &cmds.Command{
 			return err
 		}
 		// 现在清除备份信息 todo 向备份节点传播删除信息
-		return backup.Remove(node.Repo.Datastore(), cids...)
+		err = backup.Remove(node.Repo.Datastore(), cids...)
+		if err != nil {
+			return err
+		}
+		err = gc.RemoveLease(node.Repo.Datastore(), c)
+		if err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		// 不再保存副本的节点取消标记
+		if node.IsOnline {
+			if err := TagBackupHolders(req.Context, node); err != nil {
+				log.Warnf("tagging the backup holders: %s", err)
+			}
+		}
+		return nil
 	},
 	Helptext: cmds.HelpText{
 		Tagline:          "",
@@ -708,6 +738,73 @@ var BackupInfoCmd = &cmds.Command{
 	Type: backup.FileInfo{},
 }
 
+const tokenTTL = "ttl"
+
+var TokenCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline:          "签发私密文件的网关访问令牌",
+		ShortDescription: "使用本节点私钥签发访问令牌，持有令牌即可通过网关读取并解密私密文件",
+		LongDescription: `
+使用本节点私钥签发访问令牌。令牌只包含文件的根cid和有效期，不包含解密密钥：
+网关在 X-Ipfs-Access-Token 请求头中收到令牌后验证签名和有效期，再用本地保存
+的密钥解密返回文件内容，因此只有保存了该文件密钥的网关能够使用令牌。
+在保存文件密钥之前添加的私密文件没有密钥，网关按节点读取的内容直接返回。
+其他网关需要在 GatewayPrivate.TokenIssuers 中配置本节点id才会接受该令牌。
+
+  > curl -H "X-Ipfs-Access-Token: <token>" http://127.0.0.1:8080/ipfs/<cid>
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("cid", true, false, "私密文件的根cid"),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(tokenTTL, "令牌有效期").WithDefault("24h"),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		node, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if node.PrivateKey == nil {
+			return fmt.Errorf("本节点没有私钥，无法签发令牌")
+		}
+
+		c, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		if c.Version() != 2 {
+			return fmt.Errorf("%s 不是私密文件", c)
+		}
+		ttl, err := time.ParseDuration(req.Options[tokenTTL].(string))
+		if err != nil {
+			return err
+		}
+
+		pub, err := crypto.MarshalPublicKey(node.PrivateKey.GetPublic())
+		if err != nil {
+			return err
+		}
+		token, err := util.EncodeAccessToken(util.AccessToken{
+			Root:      c.String(),
+			Issuer:    node.Identity.String(),
+			Expires:   time.Now().Add(ttl).Unix(),
+			PublicKey: base64.StdEncoding.EncodeToString(pub),
+		}, node.PrivateKey.Sign)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, token)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, token string) error {
+			_, err := fmt.Fprintln(w, token)
+			return err
+		}),
+	},
+	Type: "",
+}
+
 var InitPeerCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline:          "初始化区块链身份",
@@ -58,7 +58,7 @@ var CatCmd = &cmds.Command{
 			return err
 		}
 
-		readers, length, err := cat(req.Context, api, req.Arguments, int64(offset), int64(max))
+		readers, length, err := cat(req.Context, env, api, req.Arguments, int64(offset), int64(max))
 		if err != nil {
 			return err
 		}
@@ -111,7 +111,7 @@ var CatCmd = &cmds.Command{
 	},
 }
 
-func cat(ctx context.Context, api iface.CoreAPI, paths []string, offset int64, max int64) ([]io.Reader, uint64, error) {
+func cat(ctx context.Context, env cmds.Environment, api iface.CoreAPI, paths []string, offset int64, max int64) ([]io.Reader, uint64, error) {
 	readers := make([]io.Reader, 0, len(paths))
 	length := uint64(0)
 	if max == 0 {
@@ -122,6 +122,9 @@ func cat(ctx context.Context, api iface.CoreAPI, paths []string, offset int64, m
 		if err != nil {
 			return nil, 0, err
 		}
+		if f, err = decryptPrivate(ctx, env, api, path.New(p), f); err != nil {
+			return nil, 0, err
+		}
 
 		var file files.File
 		switch f := f.(type) {
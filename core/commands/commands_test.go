@@ -126,9 +126,15 @@ func TestCommands(t *testing.T) {
 		"/files/mv",
 		"/files/read",
 		"/files/rm",
+		"/files/snapshot",
+		"/files/snapshot/create",
+		"/files/snapshot/ls",
+		"/files/snapshot/restore",
+		"/files/snapshot/rm",
 		"/files/stat",
 		"/filestore",
 		"/filestore/dups",
+		"/filestore/gc",
 		"/filestore/ls",
 		"/filestore/verify",
 		"/files/write",
@@ -178,6 +184,8 @@ func TestCommands(t *testing.T) {
 		"/p2p/stream/ls",
 		"/pin",
 		"/pin/add",
+		"/pin/export",
+		"/pin/import",
 		"/pin/ls",
 		"/pin/remote",
 		"/pin/remote/add",
@@ -192,6 +200,9 @@ func TestCommands(t *testing.T) {
 		"/pin/verify",
 		"/ping",
 		"/pubsub",
+		"/pubsub/durable",
+		"/pubsub/durable/ls",
+		"/pubsub/durable/rm",
 		"/pubsub/ls",
 		"/pubsub/peers",
 		"/pubsub/pub",
@@ -201,6 +212,11 @@ func TestCommands(t *testing.T) {
 		"/repo",
 		"/repo/fsck",
 		"/repo/gc",
+		"/repo/gc/pause",
+		"/repo/gc/resume",
+		"/repo/scrub",
+		"/repo/scrub/start",
+		"/repo/scrub/status",
 		"/repo/stat",
 		"/repo/verify",
 		"/repo/version",
@@ -221,6 +237,19 @@ func TestCommands(t *testing.T) {
 		"/swarm/filters",
 		"/swarm/filters/add",
 		"/swarm/filters/rm",
+		"/swarm/key",
+		"/swarm/key/ls",
+		"/swarm/key/promote",
+		"/swarm/key/retire",
+		"/swarm/key/rotate",
+		"/swarm/limit",
+		"/swarm/limit/ls",
+		"/swarm/limit/rm",
+		"/swarm/limit/set",
+		"/swarm/peering",
+		"/swarm/peering/add",
+		"/swarm/peering/ls",
+		"/swarm/peering/rm",
 		"/swarm/peers",
 		"/tar",
 		"/tar/add",
@@ -228,6 +257,7 @@ func TestCommands(t *testing.T) {
 		"/update",
 		"/urlstore",
 		"/urlstore/add",
+		"/urlstore/verify",
 		"/version",
 		"/version/deps",
 		"/cid",
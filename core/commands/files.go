@@ -70,16 +70,17 @@ operations.
 		cmds.BoolOption(filesFlushOptionName, "f", "Flush target and ancestors after write.").WithDefault(true),
 	},
 	Subcommands: map[string]*cmds.Command{
-		"read":  filesReadCmd,
-		"write": filesWriteCmd,
-		"mv":    filesMvCmd,
-		"cp":    filesCpCmd,
-		"ls":    filesLsCmd,
-		"mkdir": filesMkdirCmd,
-		"stat":  filesStatCmd,
-		"rm":    filesRmCmd,
-		"flush": filesFlushCmd,
-		"chcid": filesChcidCmd,
+		"read":     filesReadCmd,
+		"write":    filesWriteCmd,
+		"mv":       filesMvCmd,
+		"cp":       filesCpCmd,
+		"ls":       filesLsCmd,
+		"mkdir":    filesMkdirCmd,
+		"stat":     filesStatCmd,
+		"rm":       filesRmCmd,
+		"flush":    filesFlushCmd,
+		"chcid":    filesChcidCmd,
+		"snapshot": filesSnapshotCmd,
 	},
 }
 
@@ -389,13 +390,13 @@ GC'ed.
 			return fmt.Errorf("cp: cannot get node from path %s: %s", src, err)
 		}
 
-		err = mfs.PutNode(nd.FilesRoot, dst, node)
+		err = mfs.PutNode(nd.Files(), dst, node)
 		if err != nil {
 			return fmt.Errorf("cp: cannot put node in path %s: %s", dst, err)
 		}
 
 		if flush {
-			_, err := mfs.FlushPath(req.Context, nd.FilesRoot, dst)
+			_, err := mfs.FlushPath(req.Context, nd.Files(), dst)
 			if err != nil {
 				return fmt.Errorf("cp: cannot flush the created file %s: %s", dst, err)
 			}
@@ -410,7 +411,7 @@ func getNodeFromPath(ctx context.Context, node *core.IpfsNode, api iface.CoreAPI
 	case strings.HasPrefix(p, "/ipfs/"):
 		return api.ResolveNode(ctx, path.New(p))
 	default:
-		fsn, err := mfs.Lookup(node.FilesRoot, p)
+		fsn, err := mfs.Lookup(node.Files(), p)
 		if err != nil {
 			return nil, err
 		}
@@ -475,7 +476,7 @@ Examples:
 			return err
 		}
 
-		fsn, err := mfs.Lookup(nd.FilesRoot, path)
+		fsn, err := mfs.Lookup(nd.Files(), path)
 		if err != nil {
 			return err
 		}
@@ -595,7 +596,7 @@ Examples:
 			return err
 		}
 
-		fsn, err := mfs.Lookup(nd.FilesRoot, path)
+		fsn, err := mfs.Lookup(nd.Files(), path)
 		if err != nil {
 			return err
 		}
@@ -690,9 +691,9 @@ Example:
 			return err
 		}
 
-		err = mfs.Mv(nd.FilesRoot, src, dst)
+		err = mfs.Mv(nd.Files(), src, dst)
 		if err == nil && flush {
-			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, "/")
+			_, err = mfs.FlushPath(req.Context, nd.Files(), "/")
 		}
 		return err
 	},
@@ -783,13 +784,13 @@ stat' on the file or any of its ancestors.
 		}
 
 		if mkParents {
-			err := ensureContainingDirectoryExists(nd.FilesRoot, path, prefix)
+			err := ensureContainingDirectoryExists(nd.Files(), path, prefix)
 			if err != nil {
 				return err
 			}
 		}
 
-		fi, err := getFileHandle(nd.FilesRoot, path, create, prefix)
+		fi, err := getFileHandle(nd.Files(), path, create, prefix)
 		if err != nil {
 			return err
 		}
@@ -888,7 +889,7 @@ Examples:
 		if err != nil {
 			return err
 		}
-		root := n.FilesRoot
+		root := n.Files()
 
 		err = mfs.Mkdir(root, dirtomake, mfs.MkdirOpts{
 			Mkparents:  dashp,
@@ -931,7 +932,7 @@ are run with the '--flush=false'.
 			path = req.Arguments[0]
 		}
 
-		n, err := mfs.FlushPath(req.Context, nd.FilesRoot, path)
+		n, err := mfs.FlushPath(req.Context, nd.Files(), path)
 		if err != nil {
 			return err
 		}
@@ -973,9 +974,9 @@ Change the CID version or hash function of the root node of a given path.
 			return err
 		}
 
-		err = updatePath(nd.FilesRoot, path, prefix)
+		err = updatePath(nd.Files(), path, prefix)
 		if err == nil && flush {
-			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, path)
+			_, err = mfs.FlushPath(req.Context, nd.Files(), path)
 		}
 		return err
 	},
@@ -1049,7 +1050,7 @@ Remove files or directories.
 
 		dir, name := gopath.Split(path)
 
-		pdir, err := getParentDir(nd.FilesRoot, dir)
+		pdir, err := getParentDir(nd.Files(), dir)
 		if err != nil {
 			if force && err == os.ErrNotExist {
 				return nil
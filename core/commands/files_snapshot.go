@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+// FilesSnapshotOutput describes a snapshot of the MFS root.
+type FilesSnapshotOutput struct {
+	Name    string
+	Cid     string
+	Created time.Time
+	Auto    bool `json:",omitempty"`
+}
+
+// FilesSnapshotList is the output of 'ipfs files snapshot ls'.
+type FilesSnapshotList struct {
+	Snapshots []FilesSnapshotOutput
+}
+
+// FilesSnapshotRestoreOutput is the output of 'ipfs files snapshot restore'.
+type FilesSnapshotRestoreOutput struct {
+	Restored FilesSnapshotOutput
+	Previous FilesSnapshotOutput
+}
+
+func newFilesSnapshotOutput(s corerepo.FilesSnapshot) FilesSnapshotOutput {
+	return FilesSnapshotOutput{Name: s.Name, Cid: s.Cid.String(), Created: s.Created, Auto: s.Auto}
+}
+
+var filesSnapshotCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Record and restore past versions of the MFS root.",
+		ShortDescription: `
+A snapshot records the CID of the MFS root under a name, and keeps it from
+GC without pinning it. 'ipfs files snapshot restore' brings the whole MFS
+tree back to a snapshot, for instance after an accidental 'ipfs files rm -r':
+
+  $ ipfs files snapshot create before-cleanup
+  $ ipfs files rm -r /shared/old
+  $ ipfs files snapshot restore before-cleanup
+
+Set FilesSnapshot.Enabled in the config to snapshot the MFS root periodically
+while the daemon runs. FilesSnapshot.Keep and FilesSnapshot.MaxAge bound the
+automatic snapshots kept; the ones created by hand are kept until removed.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"create":  filesSnapshotCreateCmd,
+		"ls":      filesSnapshotLsCmd,
+		"rm":      filesSnapshotRmCmd,
+		"restore": filesSnapshotRestoreCmd,
+	},
+}
+
+var filesSnapshotCreateCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Snapshot the MFS root.",
+		ShortDescription: `
+Flushes the MFS root and records it under the given name, or under the
+current time when no name is given.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", false, false, "Name of the snapshot."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		var name string
+		if len(req.Arguments) > 0 {
+			name = req.Arguments[0]
+		}
+		s, err := corerepo.CreateFilesSnapshot(req.Context, n, name)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, newFilesSnapshotOutput(s))
+	},
+	Type: FilesSnapshotOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *FilesSnapshotOutput) error {
+			_, err := fmt.Fprintf(w, "created snapshot %s of %s\n", out.Name, out.Cid)
+			return err
+		}),
+	},
+}
+
+var filesSnapshotLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the snapshots of the MFS root, oldest first.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := corerepo.FilesSnapshots(n.Repo.Datastore())
+		if err != nil {
+			return err
+		}
+		out := &FilesSnapshotList{Snapshots: make([]FilesSnapshotOutput, 0, len(snapshots))}
+		for _, s := range snapshots {
+			out.Snapshots = append(out.Snapshots, newFilesSnapshotOutput(s))
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Type: FilesSnapshotList{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *FilesSnapshotList) error {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			for _, s := range out.Snapshots {
+				kind := "manual"
+				if s.Auto {
+					kind = "auto"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.Cid, s.Created.Format(time.RFC3339), kind)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var filesSnapshotRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove snapshots of the MFS root.",
+		ShortDescription: `
+Removes the snapshots, and unpins their roots unless they were pinned before
+the snapshot was created or another snapshot still records them.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, true, "Name of the snapshot."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range req.Arguments {
+			if err := corerepo.RemoveFilesSnapshot(req.Context, n, name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	},
+}
+
+var filesSnapshotRestoreCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Make a snapshot the MFS root.",
+		ShortDescription: `
+Replaces the whole MFS tree by the snapshot in one step. The replaced root is
+recorded first in a snapshot named pre-restore-<time>, so a restore can be
+undone by restoring that snapshot.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, false, "Name of the snapshot."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		name := req.Arguments[0]
+		prev, err := corerepo.RestoreFilesSnapshot(req.Context, n, name)
+		if err != nil {
+			return err
+		}
+		s, err := corerepo.GetFilesSnapshot(n.Repo.Datastore(), name)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &FilesSnapshotRestoreOutput{
+			Restored: newFilesSnapshotOutput(s),
+			Previous: newFilesSnapshotOutput(prev),
+		})
+	},
+	Type: FilesSnapshotRestoreOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *FilesSnapshotRestoreOutput) error {
+			_, err := fmt.Fprintf(w, "restored snapshot %s (%s), previous root saved as %s\n",
+				out.Restored.Name, out.Restored.Cid, out.Previous.Name)
+			return err
+		}),
+	},
+}
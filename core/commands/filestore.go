@@ -9,6 +9,7 @@ import (
 	core "github.com/ipfs/go-ipfs/core"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-cmds"
@@ -22,6 +23,7 @@ var FileStoreCmd = &cmds.Command{
 		"ls":     lsFileStore,
 		"verify": verifyFileStore,
 		"dups":   dupsFileStore,
+		"gc":     gcFileStore,
 	},
 }
 
@@ -223,6 +225,53 @@ var dupsFileStore = &cmds.Command{
 	Type:     RefWrapper{},
 }
 
+const (
+	filestoreDryRunOptionName = "dry-run"
+)
+
+var gcFileStore = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove filestore entries whose backing file is gone or changed.",
+		LongDescription: `
+Remove the filestore entries that can no longer be reconstructed because
+their backing file was removed or modified. Each entry is verified again
+while holding the GC lock, so entries repaired in the meantime are kept.
+
+The output is the same as for 'ipfs filestore verify', one line per removed
+entry.
+
+When the FilestoreWatch config section is enabled, the daemon follows files
+moved within the watched directories and adds modified files again, so only
+the entries of files that are really gone are left for this command.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(filestoreDryRunOptionName, "Only list the entries that would be removed."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, _, err := getFilestore(env)
+		if err != nil {
+			return err
+		}
+
+		dryRun, _ := req.Options[filestoreDryRunOptionName].(bool)
+		return corerepo.FilestoreGC(req.Context, n, dryRun, func(r *filestore.ListRes) error {
+			return res.Emit(r)
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, r *filestore.ListRes) error {
+			enc, err := cmdenv.GetCidEncoder(req)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%s %s\n", r.Status.Format(), r.FormatLong(enc.Encode))
+			return err
+		}),
+	},
+	Type: filestore.ListRes{},
+}
+
 func getFilestore(env cmds.Environment) (*core.IpfsNode, *filestore.Filestore, error) {
 	n, err := cmdenv.GetNode(env)
 	if err != nil {
@@ -76,6 +76,9 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		if err != nil {
 			return err
 		}
+		if file, err = decryptPrivate(req.Context, env, api, p, file); err != nil {
+			return err
+		}
 
 		size, err := file.Size()
 		if err != nil {
@@ -12,8 +12,10 @@ import (
 
 	core "github.com/ipfs/go-ipfs/core"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	p2p "github.com/ipfs/go-ipfs/p2p"
 
+	humanize "github.com/dustin/go-humanize"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	pstore "github.com/libp2p/go-libp2p-core/peerstore"
@@ -30,6 +32,19 @@ type P2PListenerInfoOutput struct {
 	Protocol      string
 	ListenAddress string
 	TargetAddress string
+	Transport     string
+
+	// Rejected counts the streams refused by the listener, the most recent
+	// of which are listed in Rejections.
+	Rejected   uint64               `json:",omitempty"`
+	Rejections []P2PRejectionOutput `json:",omitempty"`
+}
+
+// P2PRejectionOutput describes a stream refused by a listener
+type P2PRejectionOutput struct {
+	Peer   string
+	Reason string
+	Time   time.Time
 }
 
 // P2PStreamInfoOutput is output type of streams command
@@ -38,6 +53,7 @@ type P2PStreamInfoOutput struct {
 	Protocol      string
 	OriginAddress string
 	TargetAddress string
+	Transport     string
 }
 
 // P2PLsOutput is output type of ls command
@@ -53,6 +69,10 @@ type P2PStreamsOutput struct {
 const (
 	allowCustomProtocolOptionName = "allow-custom-protocol"
 	reportPeerIDOptionName        = "report-peer-id"
+	allowPeerOptionName           = "allow-peer"
+	allowChainPeersOptionName     = "allow-chain-peers"
+	maxStreamsPerPeerOptionName   = "max-streams-per-peer"
+	peerBandwidthOptionName       = "peer-bandwidth"
 )
 
 var resolveTimeout = 10 * time.Second
@@ -86,9 +106,15 @@ Forward connections made to <listen-address> to <target-address>.
 <protocol> specifies the libp2p protocol name to use for libp2p
 connections and/or handlers. It must be prefixed with '` + P2PProtoPrefix + `'.
 
+<listen-address> may be a TCP address, a Unix socket (/unix/<path>) or a UDP
+address. The datagrams sent to a UDP address are forwarded to the service,
+with a stream for each client, and its replies are sent back to the client.
+
 Example:
   ipfs p2p forward ` + P2PProtoPrefix + `myproto /ip4/127.0.0.1/tcp/4567 /p2p/QmPeer
     - Forward connections to 127.0.0.1:4567 to '` + P2PProtoPrefix + `myproto' service on /p2p/QmPeer
+  ipfs p2p forward ` + P2PProtoPrefix + `dns /ip4/127.0.0.1/udp/5353 /p2p/QmPeer
+    - Forward the datagrams sent to 127.0.0.1:5353 to '` + P2PProtoPrefix + `dns' service on /p2p/QmPeer
 
 `,
 	},
@@ -186,9 +212,24 @@ Create libp2p service and forward connections made to <target-address>.
 
 <protocol> specifies the libp2p handler name. It must be prefixed with '` + P2PProtoPrefix + `'.
 
+<target-address> may be a TCP address, a Unix socket (/unix/<path>) or a UDP
+address. For a UDP target, each stream is a client whose datagrams are sent
+from a socket of its own, so that the replies find their way back.
+
+By default any peer may open a stream. --allow-peer and --allow-chain-peers
+restrict the service to the given peers and to the peers registered on chain.
+--max-streams-per-peer and --peer-bandwidth cap the concurrent streams of a
+peer and the bytes per second it sends and receives over them. Refused
+streams are logged and listed by 'ipfs p2p ls -v'.
+
 Example:
   ipfs p2p listen ` + P2PProtoPrefix + `myproto /ip4/127.0.0.1/tcp/1234
     - Forward connections to 'myproto' libp2p service to 127.0.0.1:1234
+  ipfs p2p listen ` + P2PProtoPrefix + `db /unix/run/db.sock
+    - Forward connections to 'db' libp2p service to the Unix socket /run/db.sock
+  ipfs p2p listen --allow-chain-peers --max-streams-per-peer=4 --peer-bandwidth=1MB ` + P2PProtoPrefix + `syslog /ip4/127.0.0.1/udp/514
+    - Forward the datagrams of the chain peers to 127.0.0.1:514, at most 4
+      clients and 1MB/s per peer
 
 `,
 	},
@@ -199,6 +240,10 @@ Example:
 	Options: []cmds.Option{
 		cmds.BoolOption(allowCustomProtocolOptionName, "Don't require /x/ prefix"),
 		cmds.BoolOption(reportPeerIDOptionName, "r", "Send remote base58 peerid to target when a new connection is established"),
+		cmds.StringsOption(allowPeerOptionName, "Only accept streams from this peer. May be given multiple times."),
+		cmds.BoolOption(allowChainPeersOptionName, "Only accept streams from the peers registered on chain, and the --allow-peer ones."),
+		cmds.IntOption(maxStreamsPerPeerOptionName, "Maximum number of concurrent streams of a peer. 0 means no limit."),
+		cmds.StringOption(peerBandwidthOptionName, "Maximum bytes per second a peer sends and receives, e.g. 512KB. Empty means no limit."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := p2pGetNode(env)
@@ -228,14 +273,60 @@ Example:
 			return errors.New("protocol name must be within '" + P2PProtoPrefix + "' namespace")
 		}
 
-		_, err = n.P2P.ForwardRemote(n.Context(), proto, target, reportPeerID)
+		policy, err := p2pListenPolicy(req)
+		if err != nil {
+			return err
+		}
+
+		_, err = n.P2P.ForwardRemote(n.Context(), proto, target, reportPeerID, policy)
 		return err
 	},
 }
 
+// p2pListenPolicy builds the policy of a listener from the options of
+// 'ipfs p2p listen'.
+func p2pListenPolicy(req *cmds.Request) (*p2p.ListenPolicy, error) {
+	policy := &p2p.ListenPolicy{}
+
+	allowArgs, _ := req.Options[allowPeerOptionName].([]string)
+	if len(allowArgs) > 0 {
+		policy.Allow = make(map[peer.ID]bool, len(allowArgs))
+		for _, arg := range allowArgs {
+			id, err := peer.Decode(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer ID %q: %s", arg, err)
+			}
+			policy.Allow[id] = true
+		}
+	}
+	if allowChain, _ := req.Options[allowChainPeersOptionName].(bool); allowChain {
+		policy.AllowFunc = libp2p.ChainPeers.Has
+		libp2p.ChainPeers.Prefetch()
+	}
+
+	maxStreams, _ := req.Options[maxStreamsPerPeerOptionName].(int)
+	if maxStreams < 0 {
+		return nil, fmt.Errorf("--%s can't be negative", maxStreamsPerPeerOptionName)
+	}
+	policy.MaxStreamsPerPeer = maxStreams
+
+	if bw, _ := req.Options[peerBandwidthOptionName].(string); bw != "" {
+		rate, err := humanize.ParseBytes(bw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %s", peerBandwidthOptionName, err)
+		}
+		policy.BandwidthPerPeer = float64(rate)
+	}
+	return policy, nil
+}
+
 // checkPort checks whether target multiaddr contains tcp or udp protocol
-// and whether the port is equal to 0
+// and whether the port is equal to 0. Unix sockets have no port.
 func checkPort(target ma.Multiaddr) error {
+	if p2p.Transport(target) == p2p.TransportUnix {
+		return nil
+	}
+
 	// get tcp or udp port from multiaddr
 	getPort := func() (string, error) {
 		sport, _ := target.ValueForProtocol(ma.P_TCP)
@@ -282,9 +373,15 @@ const (
 var p2pLsCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "List active p2p listeners.",
+		ShortDescription: `
+With -v, a Type column with the transport of the listener follows the target
+address. This breaks the -v output of earlier versions, which had three
+columns: scripts parsing it must expect the fourth one. The output without -v
+is unchanged.
+`,
 	},
 	Options: []cmds.Option{
-		cmds.BoolOption(p2pHeadersOptionName, "v", "Print table headers (Protocol, Listen, Target)."),
+		cmds.BoolOption(p2pHeadersOptionName, "v", "Print table headers (Protocol, Listen, Target, Type), the transports and the refused streams."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := p2pGetNode(env)
@@ -300,17 +397,31 @@ var p2pLsCmd = &cmds.Command{
 				Protocol:      string(listener.Protocol()),
 				ListenAddress: listener.ListenAddress().String(),
 				TargetAddress: listener.TargetAddress().String(),
+				Transport:     p2pTransport(listener.ListenAddress(), listener.TargetAddress()),
 			})
 		}
 		n.P2P.ListenersLocal.Unlock()
 
 		n.P2P.ListenersP2P.Lock()
 		for _, listener := range n.P2P.ListenersP2P.Listeners {
-			output.Listeners = append(output.Listeners, P2PListenerInfoOutput{
+			info := P2PListenerInfoOutput{
 				Protocol:      string(listener.Protocol()),
 				ListenAddress: listener.ListenAddress().String(),
 				TargetAddress: listener.TargetAddress().String(),
-			})
+				Transport:     p2pTransport(listener.ListenAddress(), listener.TargetAddress()),
+			}
+			if g, ok := listener.(p2p.GuardedListener); ok {
+				var recent []p2p.Rejection
+				info.Rejected, recent = g.Rejections()
+				for _, r := range recent {
+					info.Rejections = append(info.Rejections, P2PRejectionOutput{
+						Peer:   r.Peer.Pretty(),
+						Reason: r.Reason,
+						Time:   r.Time,
+					})
+				}
+			}
+			output.Listeners = append(output.Listeners, info)
 		}
 		n.P2P.ListenersP2P.Unlock()
 
@@ -323,7 +434,15 @@ var p2pLsCmd = &cmds.Command{
 			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
 			for _, listener := range out.Listeners {
 				if headers {
-					fmt.Fprintln(tw, "Protocol\tListen Address\tTarget Address")
+					fmt.Fprintln(tw, "Protocol\tListen Address\tTarget Address\tType")
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", listener.Protocol, listener.ListenAddress, listener.TargetAddress, listener.Transport)
+					if listener.Rejected > 0 {
+						fmt.Fprintf(tw, "  rejected %d streams, the last ones:\t\t\t\n", listener.Rejected)
+						for _, r := range listener.Rejections {
+							fmt.Fprintf(tw, "    %s\t%s\t%s\t\n", r.Time.Format(time.RFC3339), r.Peer, r.Reason)
+						}
+					}
+					continue
 				}
 
 				fmt.Fprintf(tw, "%s\t%s\t%s\n", listener.Protocol, listener.ListenAddress, listener.TargetAddress)
@@ -441,9 +560,15 @@ var p2pStreamCmd = &cmds.Command{
 var p2pStreamLsCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "List active p2p streams.",
+		ShortDescription: `
+With -v, a Type column with the transport of the stream follows the target
+address. This breaks the -v output of earlier versions, which had four
+columns: scripts parsing it must expect the fifth one. The output without -v
+is unchanged.
+`,
 	},
 	Options: []cmds.Option{
-		cmds.BoolOption(p2pHeadersOptionName, "v", "Print table headers (ID, Protocol, Local, Remote)."),
+		cmds.BoolOption(p2pHeadersOptionName, "v", "Print table headers (ID, Protocol, Local, Remote, Type) and the transports."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := p2pGetNode(env)
@@ -462,6 +587,7 @@ var p2pStreamLsCmd = &cmds.Command{
 
 				OriginAddress: s.OriginAddr.String(),
 				TargetAddress: s.TargetAddr.String(),
+				Transport:     p2pTransport(s.OriginAddr, s.TargetAddr),
 			})
 		}
 		n.P2P.Streams.Unlock()
@@ -475,7 +601,9 @@ var p2pStreamLsCmd = &cmds.Command{
 			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
 			for _, stream := range out.Streams {
 				if headers {
-					fmt.Fprintln(tw, "ID\tProtocol\tOrigin\tTarget")
+					fmt.Fprintln(tw, "ID\tProtocol\tOrigin\tTarget\tType")
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", stream.HandlerID, stream.Protocol, stream.OriginAddress, stream.TargetAddress, stream.Transport)
+					continue
 				}
 
 				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", stream.HandlerID, stream.Protocol, stream.OriginAddress, stream.TargetAddress)
@@ -538,6 +666,15 @@ var p2pStreamCloseCmd = &cmds.Command{
 	},
 }
 
+// p2pTransport returns the transport of the local end of a listener or
+// stream, the other end being a /p2p address.
+func p2pTransport(a, b ma.Multiaddr) string {
+	if t := p2p.Transport(a); t != "" {
+		return t
+	}
+	return p2p.Transport(b)
+}
+
 func p2pGetNode(env cmds.Environment) (*core.IpfsNode, error) {
 	nd, err := cmdenv.GetNode(env)
 	if err != nil {
@@ -0,0 +1,643 @@
+package pin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	mh "github.com/multiformats/go-multihash"
+
+	core "github.com/ipfs/go-ipfs/core"
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	e "github.com/ipfs/go-ipfs/core/commands/e"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+)
+
+const (
+	pinExportDagOptionName         = "dag"
+	pinImportRootOptionName        = "root"
+	pinImportSyncOptionName        = "sync"
+	pinImportPruneOptionName       = "prune"
+	pinImportConcurrencyOptionName = "concurrency"
+)
+
+const (
+	// pinExportVersion is the version of the exported DAG.
+	pinExportVersion = 1
+	// pinExportPartSize is the number of pins per node of the exported DAG.
+	pinExportPartSize = 1000
+)
+
+// PinExportEntry is a pin of an export.
+type PinExportEntry struct {
+	Cid     string
+	Type    string            // recursive or direct
+	Name    string            `json:",omitempty"`
+	Labels  map[string]string `json:",omitempty"`
+	Expires *time.Time        `json:",omitempty"`
+}
+
+// PinExportOutput is either a pin, or the root of the export stored as a DAG.
+type PinExportOutput struct {
+	Pin  *PinExportEntry `json:",omitempty"`
+	Root string          `json:",omitempty"`
+}
+
+var exportPinCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Export the pin set.",
+		ShortDescription: `
+Writes the recursive and direct pins, with their names, labels and expiry,
+one JSON object per line:
+
+  $ ipfs pin export > pins.json
+  $ ipfs pin import --sync pins.json
+
+With --dag, the pin set is stored in IPFS as a dag-cbor DAG instead, and its
+root is pinned and written. The pinned CIDs are stored as strings, not links,
+so the DAG can be pinned and moved around without pulling the pinned content.
+Unpin the root once the export is no longer needed.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(pinExportDagOptionName, "Store the pin set as a DAG and write its root."),
+	},
+	Type: PinExportOutput{},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+		asDag, _ := req.Options[pinExportDagOptionName].(bool)
+
+		metas, err := corerepo.PinMetas(n.Repo.Datastore())
+		if err != nil {
+			return err
+		}
+
+		var entries []PinExportEntry
+		for _, opt := range []options.PinLsOption{options.Pin.Ls.Recursive(), options.Pin.Ls.Direct()} {
+			pins, err := api.Pin().Ls(req.Context, opt)
+			if err != nil {
+				return err
+			}
+			for p := range pins {
+				if err := p.Err(); err != nil {
+					return err
+				}
+				entry := newPinExportEntry(p.Path().Cid(), p.Type(), metas)
+				if asDag {
+					entries = append(entries, entry)
+					continue
+				}
+				if err := res.Emit(&PinExportOutput{Pin: &entry}); err != nil {
+					return err
+				}
+			}
+		}
+		if !asDag {
+			return nil
+		}
+
+		root, parts, err := pinExportNodes(entries)
+		if err != nil {
+			return err
+		}
+		if err := pinExportDag(req.Context, n, root, parts); err != nil {
+			return err
+		}
+		return res.Emit(&PinExportOutput{Root: root.Cid().String()})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *PinExportOutput) error {
+			if out.Pin == nil {
+				_, err := fmt.Fprintln(w, out.Root)
+				return err
+			}
+			return json.NewEncoder(w).Encode(out.Pin)
+		}),
+	},
+}
+
+// pinExportDag stores the nodes of an export and pins its root, so that a
+// GC does not collect the export before it is read.
+func pinExportDag(ctx context.Context, n *core.IpfsNode, root ipld.Node, parts []ipld.Node) error {
+	defer n.Blockstore.PinLock().Unlock()
+	if err := n.DAG.AddMany(ctx, append(parts, root)); err != nil {
+		return err
+	}
+	if err := n.Pinning.Pin(ctx, root, true); err != nil {
+		return err
+	}
+	return n.Pinning.Flush(ctx)
+}
+
+func newPinExportEntry(c cid.Cid, pinType string, metas map[cid.Cid]corerepo.PinMeta) PinExportEntry {
+	entry := PinExportEntry{Cid: c.String(), Type: pinType}
+	if m, ok := metas[c]; ok {
+		entry.Name = m.Name
+		entry.Labels = m.Labels
+		if !m.Expires.IsZero() {
+			expires := m.Expires
+			entry.Expires = &expires
+		}
+	}
+	return entry
+}
+
+// pinExportNodes stores entries as dag-cbor nodes: a root listing parts of
+// pinExportPartSize pins each.
+func pinExportNodes(entries []PinExportEntry) (ipld.Node, []ipld.Node, error) {
+	var parts []ipld.Node
+	links := make([]interface{}, 0, len(entries)/pinExportPartSize+1)
+	for i := 0; i < len(entries); i += pinExportPartSize {
+		end := i + pinExportPartSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		pins := make([]interface{}, 0, end-i)
+		for _, entry := range entries[i:end] {
+			p := map[string]interface{}{
+				"cid":  entry.Cid,
+				"type": entry.Type,
+			}
+			if entry.Name != "" {
+				p["name"] = entry.Name
+			}
+			if len(entry.Labels) > 0 {
+				p["labels"] = entry.Labels
+			}
+			if entry.Expires != nil {
+				p["expires"] = entry.Expires.Format(time.RFC3339Nano)
+			}
+			pins = append(pins, p)
+		}
+		nd, err := cbor.WrapObject(map[string]interface{}{"pins": pins}, mh.SHA2_256, -1)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, nd)
+		links = append(links, nd.Cid())
+	}
+
+	root, err := cbor.WrapObject(map[string]interface{}{
+		"version": pinExportVersion,
+		"count":   len(entries),
+		"parts":   links,
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, parts, nil
+}
+
+// readPinExportDag reads the pins of an export stored by pinExportNodes.
+func readPinExportDag(ctx context.Context, ng ipld.NodeGetter, root cid.Cid) ([]PinExportEntry, error) {
+	var r struct {
+		Version int
+		Parts   []cid.Cid
+	}
+	if err := getCbor(ctx, ng, root, &r); err != nil {
+		return nil, err
+	}
+	if r.Version != pinExportVersion {
+		return nil, fmt.Errorf("unsupported pin export version %d", r.Version)
+	}
+
+	var entries []PinExportEntry
+	for _, c := range r.Parts {
+		var part struct {
+			Pins []PinExportEntry
+		}
+		if err := getCbor(ctx, ng, c, &part); err != nil {
+			return nil, err
+		}
+		entries = append(entries, part.Pins...)
+	}
+	return entries, nil
+}
+
+// getCbor decodes a dag-cbor node into out, through its JSON form.
+func getCbor(ctx context.Context, ng ipld.NodeGetter, c cid.Cid, out interface{}) error {
+	nd, err := ng.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	cnd, ok := nd.(*cbor.Node)
+	if !ok {
+		return fmt.Errorf("%s is not a pin export", c)
+	}
+	b, err := cnd.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("%s is not a pin export: %s", c, err)
+	}
+	return nil
+}
+
+// readPinExportLines reads the pins written by 'ipfs pin export'.
+func readPinExportLines(r io.Reader) ([]PinExportEntry, error) {
+	var entries []PinExportEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		b := scanner.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		var entry PinExportEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Actions reported by pin import.
+const (
+	pinImportPinned   = "pinned"
+	pinImportExists   = "exists"
+	pinImportUnpinned = "unpinned"
+	pinImportFailed   = "failed"
+)
+
+// PinImportOutput reports a pin processed by pin import, or the progress of
+// the fetch.
+type PinImportOutput struct {
+	Cid      string `json:",omitempty"`
+	Action   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Done     int    `json:",omitempty"`
+	Total    int    `json:",omitempty"`
+	Progress int    `json:",omitempty"`
+}
+
+var importPinCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Pin everything listed in a pin set export.",
+		ShortDescription: `
+Reads a pin set written by 'ipfs pin export', from a file or stdin, or from
+the DAG given with --root, and pins everything listed with its name, labels
+and expiry. Pins that already expired are skipped.
+
+Missing content is fetched for --concurrency pins at a time. Every pin is
+reported as it completes; a pin that cannot be added is reported and does
+not stop the others, but the command fails at the end.
+
+With --sync, the names, labels and expiry of the pins already present are
+replaced by the ones of the export. With --sync --prune, the recursive and
+direct pins not listed are removed, so that the pin set matches the export.
+Nothing is removed if a pin could not be imported, or if the export lists no
+pin:
+
+  $ ipfs pin export > pins.json   # on the old node
+  $ ipfs pin import --sync --prune pins.json
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.FileArg("file", false, false, "Pin set written by 'ipfs pin export'.").EnableStdin(),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(pinImportRootOptionName, "Read the pin set from the DAG written by 'ipfs pin export --dag'."),
+		cmds.BoolOption(pinImportSyncOptionName, "Replace the metadata of the pins already present."),
+		cmds.BoolOption(pinImportPruneOptionName, "With --sync, remove the pins not listed."),
+		cmds.IntOption(pinImportConcurrencyOptionName, "Number of pins fetched concurrently.").WithDefault(4),
+		cmds.BoolOption(pinProgressOptionName, "Show progress"),
+	},
+	Type: PinImportOutput{},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+
+		rootPath, _ := req.Options[pinImportRootOptionName].(string)
+		syncMeta, _ := req.Options[pinImportSyncOptionName].(bool)
+		prune, _ := req.Options[pinImportPruneOptionName].(bool)
+		concurrency, _ := req.Options[pinImportConcurrencyOptionName].(int)
+		showProgress, _ := req.Options[pinProgressOptionName].(bool)
+		if prune && !syncMeta {
+			return fmt.Errorf("--%s requires --%s", pinImportPruneOptionName, pinImportSyncOptionName)
+		}
+		if concurrency < 1 {
+			return fmt.Errorf("--%s must be positive", pinImportConcurrencyOptionName)
+		}
+
+		var entries []PinExportEntry
+		switch {
+		case rootPath != "":
+			rp, err := api.ResolvePath(req.Context, path.New(rootPath))
+			if err != nil {
+				return err
+			}
+			if entries, err = readPinExportDag(req.Context, api.Dag(), rp.Cid()); err != nil {
+				return err
+			}
+		case req.Files != nil:
+			it := req.Files.Entries()
+			if !it.Next() {
+				if err := it.Err(); err != nil {
+					return err
+				}
+				return errors.New("no pin set given")
+			}
+			file := files.FileFromEntry(it)
+			if file == nil {
+				return errors.New("expected a file")
+			}
+			entries, err = readPinExportLines(file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("no pin set given")
+		}
+
+		plan, err := planPinImport(req.Context, api, entries, time.Now())
+		if err != nil {
+			return err
+		}
+		if prune {
+			if err := plan.checkPrune(0); err != nil {
+				return err
+			}
+		}
+
+		ds := n.Repo.Datastore()
+		var (
+			emitLk sync.Mutex
+			done   int
+			failed int
+		)
+		total := len(plan.pin) + len(plan.present)
+		if prune {
+			total += len(plan.unlisted)
+		}
+		emit := func(c cid.Cid, action string, err error) {
+			emitLk.Lock()
+			defer emitLk.Unlock()
+			done++
+			out := &PinImportOutput{Cid: c.String(), Action: action, Done: done, Total: total}
+			if err != nil {
+				failed++
+				out.Action, out.Error = pinImportFailed, err.Error()
+			}
+			if err := res.Emit(out); err != nil {
+				log.Debugf("pin import: %s", err)
+			}
+		}
+
+		for _, entry := range plan.present {
+			c, _ := cid.Decode(entry.Cid)
+			var err error
+			if syncMeta {
+				err = putImportedPinMeta(ds, c, entry)
+			}
+			emit(c, pinImportExists, err)
+		}
+
+		tracker := new(dag.ProgressTracker)
+		ctx := tracker.DeriveContext(req.Context)
+		stopProgress := make(chan struct{})
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			if !showProgress {
+				return
+			}
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					emitLk.Lock()
+					err := res.Emit(&PinImportOutput{Progress: tracker.Value()})
+					emitLk.Unlock()
+					if err != nil {
+						return
+					}
+				case <-stopProgress:
+					return
+				}
+			}
+		}()
+
+		queue := make(chan PinExportEntry)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency && i < len(plan.pin); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for entry := range queue {
+					c, _ := cid.Decode(entry.Cid)
+					err := api.Pin().Add(ctx, path.IpfsPath(c), options.Pin.Recursive(entry.Type != "direct"))
+					if err == nil {
+						err = putImportedPinMeta(ds, c, entry)
+					}
+					emit(c, pinImportPinned, err)
+				}
+			}()
+		}
+	feed:
+		for _, entry := range plan.pin {
+			select {
+			case queue <- entry:
+			case <-req.Context.Done():
+				break feed
+			}
+		}
+		close(queue)
+		wg.Wait()
+		close(stopProgress)
+		<-progressDone
+
+		if err := req.Context.Err(); err != nil {
+			return err
+		}
+
+		if prune {
+			if err := plan.checkPrune(failed); err != nil {
+				return err
+			}
+			for c, recursive := range plan.unlisted {
+				err := api.Pin().Rm(req.Context, path.IpfsPath(c), options.Pin.RmRecursive(recursive))
+				if err == nil {
+					if err = corerepo.RemovePinMeta(ds, c); err == datastore.ErrNotFound {
+						err = nil
+					}
+				}
+				emit(c, pinImportUnpinned, err)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d pins could not be imported", failed, total)
+		}
+		return nil
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *PinImportOutput) error {
+			if out.Action == "" {
+				return nil
+			}
+			var err error
+			if out.Error != "" {
+				_, err = fmt.Fprintf(w, "[%d/%d] %s %s: %s\n", out.Done, out.Total, out.Action, out.Cid, out.Error)
+			} else {
+				_, err = fmt.Fprintf(w, "[%d/%d] %s %s\n", out.Done, out.Total, out.Action, out.Cid)
+			}
+			return err
+		}),
+	},
+	PostRun: cmds.PostRunMap{
+		cmds.CLI: func(res cmds.Response, re cmds.ResponseEmitter) error {
+			for {
+				v, err := res.Next()
+				if err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+
+				out, ok := v.(*PinImportOutput)
+				if !ok {
+					return e.TypeErr(out, v)
+				}
+				if out.Action == "" {
+					fmt.Fprintf(os.Stderr, "Fetched/Processed %d nodes\r", out.Progress)
+					continue
+				}
+				if err := re.Emit(out); err != nil {
+					return err
+				}
+			}
+		},
+	},
+}
+
+// pinImportPlan sorts the pins of an export.
+type pinImportPlan struct {
+	pin      []PinExportEntry // listed, to be pinned
+	present  []PinExportEntry // listed, already pinned
+	unlisted map[cid.Cid]bool // pinned but not listed, recursively or not
+}
+
+// checkPrune refuses to prune the unlisted pins when the export lists no
+// pin, such as an empty or truncated file, or when failed pins of the export
+// could not be imported.
+func (p *pinImportPlan) checkPrune(failed int) error {
+	if len(p.pin)+len(p.present) == 0 {
+		return fmt.Errorf("the pin set lists no pin, not removing the %d pins present", len(p.unlisted))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d pins could not be imported, not removing the unlisted pins", failed)
+	}
+	return nil
+}
+
+func planPinImport(ctx context.Context, api coreiface.CoreAPI, entries []PinExportEntry, now time.Time) (*pinImportPlan, error) {
+	existing := make(map[cid.Cid]bool) // recursive or not
+	for _, opt := range []options.PinLsOption{options.Pin.Ls.Recursive(), options.Pin.Ls.Direct()} {
+		pins, err := api.Pin().Ls(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		for p := range pins {
+			if err := p.Err(); err != nil {
+				return nil, err
+			}
+			existing[p.Path().Cid()] = p.Type() == "recursive"
+		}
+	}
+	return sortPinImport(entries, existing, now)
+}
+
+// sortPinImport compares the pins of an export with the existing ones.
+func sortPinImport(entries []PinExportEntry, existing map[cid.Cid]bool, now time.Time) (*pinImportPlan, error) {
+	plan := &pinImportPlan{unlisted: make(map[cid.Cid]bool)}
+	listed := make(map[cid.Cid]bool)
+	for _, entry := range entries {
+		c, err := cid.Decode(entry.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %q: %s", entry.Cid, err)
+		}
+		switch entry.Type {
+		case "":
+			entry.Type = "recursive"
+		case "recursive", "direct":
+		default:
+			return nil, fmt.Errorf("invalid type %q for pin %s", entry.Type, entry.Cid)
+		}
+		if entry.Expires != nil && !now.Before(*entry.Expires) {
+			continue
+		}
+		if listed[c] {
+			continue
+		}
+		listed[c] = true
+
+		recursive, ok := existing[c]
+		if ok && (recursive || entry.Type == "direct") {
+			plan.present = append(plan.present, entry)
+		} else {
+			// a direct pin is made recursive by pinning again
+			plan.pin = append(plan.pin, entry)
+		}
+	}
+	for c, recursive := range existing {
+		if !listed[c] {
+			plan.unlisted[c] = recursive
+		}
+	}
+	return plan, nil
+}
+
+// putImportedPinMeta records the metadata of an imported pin, dropping the
+// previous one when the export has none.
+func putImportedPinMeta(ds datastore.Datastore, c cid.Cid, entry PinExportEntry) error {
+	meta := corerepo.PinMeta{
+		Cid:       c,
+		Name:      entry.Name,
+		Labels:    entry.Labels,
+		Recursive: entry.Type != "direct",
+	}
+	if entry.Expires != nil {
+		meta.Expires = *entry.Expires
+	}
+	if meta.Name == "" && len(meta.Labels) == 0 && meta.Expires.IsZero() {
+		if err := corerepo.RemovePinMeta(ds, c); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return corerepo.PutPinMeta(ds, meta)
+}
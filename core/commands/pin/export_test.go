@@ -0,0 +1,113 @@
+package pin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func pinTestCid(s string) cid.Cid {
+	h, _ := mh.Sum([]byte(s), mh.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func TestPinExportDag(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	var entries []PinExportEntry
+	for i := 0; i < pinExportPartSize+10; i++ {
+		entries = append(entries, PinExportEntry{Cid: pinTestCid(string(rune(i))).String(), Type: "recursive"})
+	}
+	entries[3] = PinExportEntry{
+		Cid:     entries[3].Cid,
+		Type:    "direct",
+		Name:    "docs",
+		Labels:  map[string]string{"project": "docs"},
+		Expires: &expires,
+	}
+
+	root, parts, err := pinExportNodes(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(parts))
+	}
+
+	ctx := context.Background()
+	ds := mdtest.Mock()
+	if err := ds.AddMany(ctx, append(parts, root)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPinExportDag(ctx, ds, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("expected %d pins, got %d", len(entries), len(got))
+	}
+	e := got[3]
+	if e.Cid != entries[3].Cid || e.Type != "direct" || e.Name != "docs" || e.Labels["project"] != "docs" ||
+		e.Expires == nil || !e.Expires.Equal(expires) {
+		t.Fatalf("unexpected pin: %+v", e)
+	}
+}
+
+func TestSortPinImport(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	a, b, c, d, x := pinTestCid("a"), pinTestCid("b"), pinTestCid("c"), pinTestCid("d"), pinTestCid("x")
+
+	entries, err := readPinExportLines(strings.NewReader(`{"Cid":"` + a.String() + `","Type":"recursive"}
+{"Cid":"` + b.String() + `","Type":"recursive"}
+
+{"Cid":"` + c.String() + `"}
+{"Cid":"` + d.String() + `","Type":"direct","Expires":"` + past.Format(time.RFC3339) + `"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is pinned recursively, b only directly, x is not listed
+	existing := map[cid.Cid]bool{a: true, b: false, x: true}
+	plan, err := sortPinImport(entries, existing, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.present) != 1 || plan.present[0].Cid != a.String() {
+		t.Fatalf("unexpected present pins: %+v", plan.present)
+	}
+	if len(plan.pin) != 2 || plan.pin[0].Cid != b.String() || plan.pin[1].Cid != c.String() || plan.pin[1].Type != "recursive" {
+		t.Fatalf("unexpected pins to add: %+v", plan.pin)
+	}
+	if len(plan.unlisted) != 1 || !plan.unlisted[x] {
+		t.Fatalf("unexpected unlisted pins: %+v", plan.unlisted)
+	}
+
+	if err := plan.checkPrune(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.checkPrune(1); err == nil {
+		t.Fatal("expected failed imports to prevent pruning")
+	}
+
+	// an empty export, or one that only lists expired pins, prunes nothing
+	expired, err := sortPinImport(entries[3:], existing, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expired.checkPrune(0); err == nil {
+		t.Fatal("expected an empty pin set to prevent pruning")
+	}
+
+	if _, err := readPinExportLines(strings.NewReader("not json\n")); err == nil {
+		t.Fatal("expected invalid lines to be rejected")
+	}
+	if _, err := sortPinImport([]PinExportEntry{{Cid: a.String(), Type: "indirect"}}, nil, now); err == nil {
+		t.Fatal("expected invalid types to be rejected")
+	}
+}
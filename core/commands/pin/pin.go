@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	bserv "github.com/ipfs/go-blockservice"
 	cid "github.com/ipfs/go-cid"
 	cidenc "github.com/ipfs/go-cidutil/cidenc"
+	datastore "github.com/ipfs/go-datastore"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	dag "github.com/ipfs/go-merkledag"
@@ -22,6 +24,7 @@ import (
 	core "github.com/ipfs/go-ipfs/core"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
 )
 
 var PinCmd = &cmds.Command{
@@ -36,6 +39,8 @@ var PinCmd = &cmds.Command{
 		"verify": verifyPinCmd,
 		"update": updatePinCmd,
 		"remote": remotePinCmd,
+		"export": exportPinCmd,
+		"import": importPinCmd,
 	},
 }
 
@@ -51,12 +56,25 @@ type AddPinOutput struct {
 const (
 	pinRecursiveOptionName = "recursive"
 	pinProgressOptionName  = "progress"
+	pinLabelOptionName     = "label"
+	pinExpireInOptionName  = "expire-in"
 )
 
 var addPinCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline:          "Pin objects to local storage.",
 		ShortDescription: "Stores an IPFS object(s) from a given path locally to disk.",
+		LongDescription: `
+Stores an IPFS object(s) from a given path locally to disk.
+
+A pin can carry a name and any number of key=value labels, which
+'ipfs pin ls --name' and 'ipfs pin ls --label' filter on. With --expire-in,
+the daemon removes the pin once the given duration has passed. An object
+that is already pinned without expiry stays pinned for good, and pinning
+an object again without --expire-in makes its pin permanent:
+
+  $ ipfs pin add --name=site --label project=docs --expire-in=720h <cid>
+`,
 	},
 
 	Arguments: []cmds.Argument{
@@ -65,9 +83,17 @@ var addPinCmd = &cmds.Command{
 	Options: []cmds.Option{
 		cmds.BoolOption(pinRecursiveOptionName, "r", "Recursively pin the object linked to by the specified object(s).").WithDefault(true),
 		cmds.BoolOption(pinProgressOptionName, "Show progress"),
+		cmds.StringOption(pinNameOptionName, "An optional name for the pin."),
+		cmds.StringsOption(pinLabelOptionName, "A key=value label for the pin. May be given multiple times."),
+		cmds.StringOption(pinExpireInOptionName, "Remove the pin after this duration, e.g. 24h."),
 	},
 	Type: AddPinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
@@ -77,6 +103,11 @@ var addPinCmd = &cmds.Command{
 		recursive, _ := req.Options[pinRecursiveOptionName].(bool)
 		showProgress, _ := req.Options[pinProgressOptionName].(bool)
 
+		record, err := pinMetaRecorder(req, n.Repo.Datastore(), recursive)
+		if err != nil {
+			return err
+		}
+
 		if err := req.ParseBodyArgs(); err != nil {
 			return err
 		}
@@ -87,7 +118,7 @@ var addPinCmd = &cmds.Command{
 		}
 
 		if !showProgress {
-			added, err := pinAddMany(req.Context, api, enc, req.Arguments, recursive)
+			added, err := pinAddMany(req.Context, api, enc, req.Arguments, recursive, record)
 			if err != nil {
 				return err
 			}
@@ -105,7 +136,7 @@ var addPinCmd = &cmds.Command{
 
 		ch := make(chan pinResult, 1)
 		go func() {
-			added, err := pinAddMany(ctx, api, enc, req.Arguments, recursive)
+			added, err := pinAddMany(ctx, api, enc, req.Arguments, recursive, record)
 			ch <- pinResult{pins: added, err: err}
 		}()
 
@@ -181,7 +212,10 @@ var addPinCmd = &cmds.Command{
 	},
 }
 
-func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder, paths []string, recursive bool) ([]string, error) {
+// pinAddMany pins the given paths, calling record, when set, for every
+// pinned CID along with whether it was directly or recursively pinned
+// before.
+func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder, paths []string, recursive bool, record func(c cid.Cid, pinned bool) error) ([]string, error) {
 	added := make([]string, len(paths))
 	for i, b := range paths {
 		rp, err := api.ResolvePath(ctx, path.New(b))
@@ -189,15 +223,79 @@ func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder,
 			return nil, err
 		}
 
+		var pinned bool
+		if record != nil {
+			how, ok, err := api.Pin().IsPinned(ctx, rp)
+			if err != nil {
+				return nil, err
+			}
+			pinned = ok && (how == "recursive" || how == "direct")
+		}
 		if err := api.Pin().Add(ctx, rp, options.Pin.Recursive(recursive)); err != nil {
 			return nil, err
 		}
+		if record != nil {
+			if err := record(rp.Cid(), pinned); err != nil {
+				return nil, err
+			}
+		}
 		added[i] = enc.Encode(rp.Cid())
 	}
 
 	return added, nil
 }
 
+// pinMetaRecorder returns a function storing the name, labels and expiry
+// given to pin add. Re-adding a pin without --expire-in makes it permanent.
+func pinMetaRecorder(req *cmds.Request, ds datastore.Datastore, recursive bool) (func(c cid.Cid, pinned bool) error, error) {
+	name, _ := req.Options[pinNameOptionName].(string)
+	labelArgs, _ := req.Options[pinLabelOptionName].([]string)
+	expireIn, _ := req.Options[pinExpireInOptionName].(string)
+
+	labels, err := parsePinLabels(labelArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var expires time.Time
+	if expireIn != "" {
+		d, err := time.ParseDuration(expireIn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %s", pinExpireInOptionName, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("--%s must be positive", pinExpireInOptionName)
+		}
+		expires = time.Now().Add(d)
+	}
+
+	return func(c cid.Cid, pinned bool) error {
+		return corerepo.RecordPinMeta(ds, corerepo.PinMeta{
+			Cid:       c,
+			Name:      name,
+			Labels:    labels,
+			Expires:   expires,
+			Recursive: recursive,
+		}, pinned)
+	}, nil
+}
+
+// parsePinLabels parses key=value labels.
+func parsePinLabels(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(args))
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", a)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
 var rmPinCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Remove pinned objects from local storage.",
@@ -223,6 +321,11 @@ ipfs pin ls -t indirect <cid>
 	},
 	Type: PinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
@@ -252,6 +355,9 @@ ipfs pin ls -t indirect <cid>
 			if err := api.Pin().Rm(req.Context, rp, options.Pin.RmRecursive(recursive)); err != nil {
 				return err
 			}
+			if err := corerepo.RemovePinMeta(n.Repo.Datastore(), rp.Cid()); err != nil {
+				return err
+			}
 		}
 
 		return cmds.EmitOnce(res, &PinOutput{pins})
@@ -300,6 +406,9 @@ With arguments, the command fails if any of the arguments is not a pinned
 object. And if --type=<type> is additionally used, the command will also fail
 if any of the arguments is not of the specified type.
 
+Use --name=<name> and --label=<key>=<value> to only list the pins added with
+that name and those labels. Named pins are listed with their name.
+
 Example:
 	$ echo "hello" | ipfs add -q
 	QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN
@@ -324,8 +433,15 @@ Example:
 		cmds.StringOption(pinTypeOptionName, "t", "The type of pinned keys to list. Can be \"direct\", \"indirect\", \"recursive\", or \"all\".").WithDefault("all"),
 		cmds.BoolOption(pinQuietOptionName, "q", "Write just hashes of objects."),
 		cmds.BoolOption(pinStreamOptionName, "s", "Enable streaming of pins as they are discovered."),
+		cmds.StringOption(pinNameOptionName, "Only list the pins with this name."),
+		cmds.StringsOption(pinLabelOptionName, "Only list the pins with this key=value label. May be given multiple times."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
@@ -334,6 +450,11 @@ Example:
 		typeStr, _ := req.Options[pinTypeOptionName].(string)
 		stream, _ := req.Options[pinStreamOptionName].(bool)
 
+		filter, err := newPinLsFilter(req, n.Repo.Datastore())
+		if err != nil {
+			return err
+		}
+
 		switch typeStr {
 		case "all", "direct", "indirect", "recursive":
 		default:
@@ -347,15 +468,20 @@ Example:
 		if !stream {
 			emit = func(v interface{}) error {
 				obj := v.(*PinLsOutputWrapper)
-				lgcList[obj.PinLsObject.Cid] = PinLsType{Type: obj.PinLsObject.Type}
+				lgcList[obj.PinLsObject.Cid] = PinLsType{
+					Type:    obj.PinLsObject.Type,
+					Name:    obj.PinLsObject.Name,
+					Labels:  obj.PinLsObject.Labels,
+					Expires: obj.PinLsObject.Expires,
+				}
 				return nil
 			}
 		}
 
 		if len(req.Arguments) > 0 {
-			err = pinLsKeys(req, typeStr, api, emit)
+			err = pinLsKeys(req, typeStr, api, filter, emit)
 		} else {
-			err = pinLsAll(req, typeStr, api, emit)
+			err = pinLsAll(req, typeStr, api, filter, emit)
 		}
 		if err != nil {
 			return err
@@ -389,6 +515,8 @@ Example:
 			if stream {
 				if quiet {
 					fmt.Fprintf(w, "%s\n", out.PinLsObject.Cid)
+				} else if out.PinLsObject.Name != "" {
+					fmt.Fprintf(w, "%s %s %s\n", out.PinLsObject.Cid, out.PinLsObject.Type, out.PinLsObject.Name)
 				} else {
 					fmt.Fprintf(w, "%s %s\n", out.PinLsObject.Cid, out.PinLsObject.Type)
 				}
@@ -398,6 +526,8 @@ Example:
 			for k, v := range out.PinLsList.Keys {
 				if quiet {
 					fmt.Fprintf(w, "%s\n", k)
+				} else if v.Name != "" {
+					fmt.Fprintf(w, "%s %s %s\n", k, v.Type, v.Name)
 				} else {
 					fmt.Fprintf(w, "%s %s\n", k, v.Type)
 				}
@@ -421,18 +551,68 @@ type PinLsList struct {
 	Keys map[string]PinLsType
 }
 
-// PinLsType contains the type of a pin
+// PinLsType contains the type of a pin, along with its name, labels and
+// expiry if it has any
 type PinLsType struct {
-	Type string
+	Type    string
+	Name    string            `json:",omitempty"`
+	Labels  map[string]string `json:",omitempty"`
+	Expires *time.Time        `json:",omitempty"`
 }
 
 // PinLsObject contains the description of a pin
 type PinLsObject struct {
-	Cid  string `json:",omitempty"`
-	Type string `json:",omitempty"`
+	Cid     string            `json:",omitempty"`
+	Type    string            `json:",omitempty"`
+	Name    string            `json:",omitempty"`
+	Labels  map[string]string `json:",omitempty"`
+	Expires *time.Time        `json:",omitempty"`
+}
+
+// pinLsFilter attaches the pin metadata to the listed pins and, when a name
+// or labels are given, drops the pins not matching them.
+type pinLsFilter struct {
+	metas  map[cid.Cid]corerepo.PinMeta
+	name   string
+	labels map[string]string
+}
+
+func newPinLsFilter(req *cmds.Request, ds datastore.Datastore) (*pinLsFilter, error) {
+	name, _ := req.Options[pinNameOptionName].(string)
+	labelArgs, _ := req.Options[pinLabelOptionName].([]string)
+	labels, err := parsePinLabels(labelArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	metas, err := corerepo.PinMetas(ds)
+	if err != nil {
+		return nil, err
+	}
+	return &pinLsFilter{metas: metas, name: name, labels: labels}, nil
+}
+
+// object describes the pin on c, reporting false if it is filtered out.
+func (f *pinLsFilter) object(enc cidenc.Encoder, c cid.Cid, pinType string) (PinLsObject, bool) {
+	obj := PinLsObject{Cid: enc.Encode(c), Type: pinType}
+	meta, ok := f.metas[c]
+	if !ok {
+		return obj, f.name == "" && len(f.labels) == 0
+	}
+	if !meta.Matches(f.name, f.labels) {
+		return obj, false
+	}
+
+	obj.Name = meta.Name
+	obj.Labels = meta.Labels
+	if !meta.Expires.IsZero() {
+		expires := meta.Expires
+		obj.Expires = &expires
+	}
+	return obj, true
 }
 
-func pinLsKeys(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit func(value interface{}) error) error {
+func pinLsKeys(req *cmds.Request, typeStr string, api coreiface.CoreAPI, filter *pinLsFilter, emit func(value interface{}) error) error {
 	enc, err := cmdenv.GetCidEncoder(req)
 	if err != nil {
 		return err
@@ -470,13 +650,11 @@ func pinLsKeys(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit fu
 			pinType = "indirect through " + pinType
 		}
 
-		err = emit(&PinLsOutputWrapper{
-			PinLsObject: PinLsObject{
-				Type: pinType,
-				Cid:  enc.Encode(rp.Cid()),
-			},
-		})
-		if err != nil {
+		obj, ok := filter.object(enc, rp.Cid(), pinType)
+		if !ok {
+			continue
+		}
+		if err := emit(&PinLsOutputWrapper{PinLsObject: obj}); err != nil {
 			return err
 		}
 	}
@@ -484,7 +662,7 @@ func pinLsKeys(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit fu
 	return nil
 }
 
-func pinLsAll(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit func(value interface{}) error) error {
+func pinLsAll(req *cmds.Request, typeStr string, api coreiface.CoreAPI, filter *pinLsFilter, emit func(value interface{}) error) error {
 	enc, err := cmdenv.GetCidEncoder(req)
 	if err != nil {
 		return err
@@ -511,13 +689,11 @@ func pinLsAll(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit fun
 		if err := p.Err(); err != nil {
 			return err
 		}
-		err = emit(&PinLsOutputWrapper{
-			PinLsObject: PinLsObject{
-				Type: p.Type(),
-				Cid:  enc.Encode(p.Path().Cid()),
-			},
-		})
-		if err != nil {
+		obj, ok := filter.object(enc, p.Path().Cid(), p.Type())
+		if !ok {
+			continue
+		}
+		if err := emit(&PinLsOutputWrapper{PinLsObject: obj}); err != nil {
 			return err
 		}
 	}
@@ -553,6 +729,11 @@ pin.
 	},
 	Type: PinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
@@ -580,6 +761,25 @@ pin.
 			return err
 		}
 
+		// the new pin inherits the name, labels and expiry of the old one
+		ds := n.Repo.Datastore()
+		meta, err := corerepo.GetPinMeta(ds, from.Cid())
+		switch err {
+		case nil:
+			meta.Cid = to.Cid()
+			if err := corerepo.PutPinMeta(ds, meta); err != nil {
+				return err
+			}
+			if unpin {
+				if err := corerepo.RemovePinMeta(ds, from.Cid()); err != nil {
+					return err
+				}
+			}
+		case datastore.ErrNotFound:
+		default:
+			return err
+		}
+
 		return cmds.EmitOnce(res, &PinOutput{Pins: []string{enc.Encode(from.Cid()), enc.Encode(to.Cid())}})
 	},
 	Encoders: cmds.EncoderMap{
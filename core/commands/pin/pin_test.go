@@ -0,0 +1,59 @@
+package pin
+
+import (
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	cidenc "github.com/ipfs/go-cidutil/cidenc"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestParsePinLabels(t *testing.T) {
+	labels, err := parsePinLabels([]string{"project=docs", "owner=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || labels["project"] != "docs" || labels["owner"] != "a=b" || labels["empty"] != "" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	for _, bad := range []string{"novalue", "=value"} {
+		if _, err := parsePinLabels([]string{bad}); err == nil {
+			t.Errorf("expected label %q to be rejected", bad)
+		}
+	}
+}
+
+func TestPinLsFilter(t *testing.T) {
+	mkcid := func(s string) cid.Cid {
+		h, _ := mh.Sum([]byte(s), mh.SHA2_256, -1)
+		return cid.NewCidV1(cid.DagProtobuf, h)
+	}
+	named, plain := mkcid("named"), mkcid("plain")
+	metas := map[cid.Cid]corerepo.PinMeta{
+		named: {Cid: named, Name: "site", Labels: map[string]string{"project": "docs"}},
+	}
+	enc := cidenc.Default()
+
+	all := &pinLsFilter{metas: metas}
+	if obj, ok := all.object(enc, named, "recursive"); !ok || obj.Name != "site" || obj.Labels["project"] != "docs" {
+		t.Fatalf("unexpected named pin: %v %v", obj, ok)
+	}
+	if _, ok := all.object(enc, plain, "recursive"); !ok {
+		t.Fatal("unnamed pin filtered out without a filter")
+	}
+
+	byLabel := &pinLsFilter{metas: metas, labels: map[string]string{"project": "docs"}}
+	if _, ok := byLabel.object(enc, named, "recursive"); !ok {
+		t.Fatal("matching pin filtered out")
+	}
+	if _, ok := byLabel.object(enc, plain, "recursive"); ok {
+		t.Fatal("unlabeled pin listed")
+	}
+
+	byName := &pinLsFilter{metas: metas, name: "other"}
+	if _, ok := byName.object(enc, named, "recursive"); ok {
+		t.Fatal("pin with another name listed")
+	}
+}
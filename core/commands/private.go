@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/util"
+
+	"github.com/ipfs/go-datastore"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// privateCidVersion marks the roots added with 'blockchain file add --private'.
+const privateCidVersion = 2
+
+// decryptPrivate returns n, read from p, decrypted with the content key the
+// node holds for the private root of p. Private files added before the
+// content keys have none and are returned as read.
+func decryptPrivate(ctx context.Context, env cmds.Environment, api iface.CoreAPI, p path.Path, n files.Node) (files.Node, error) {
+	rp, err := api.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	root := rp.Root()
+	if root.Version() != privateCidVersion {
+		return n, nil
+	}
+	node, err := cmdenv.GetNode(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := util.GetContentKey(node.Repo.Datastore(), root)
+	if err == datastore.ErrNotFound {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return util.DecryptNode(n, key), nil
+}
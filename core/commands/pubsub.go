@@ -3,12 +3,17 @@ package commands
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"sort"
+	"strings"
+	"text/tabwriter"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	durablesub "github.com/ipfs/go-ipfs/durablesub"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	options "github.com/ipfs/interface-go-ipfs-core/options"
@@ -28,22 +33,30 @@ To use, the daemon must be run with '--enable-pubsub-experiment'.
 `,
 	},
 	Subcommands: map[string]*cmds.Command{
-		"pub":   PubsubPubCmd,
-		"sub":   PubsubSubCmd,
-		"ls":    PubsubLsCmd,
-		"peers": PubsubPeersCmd,
+		"pub":     PubsubPubCmd,
+		"sub":     PubsubSubCmd,
+		"ls":      PubsubLsCmd,
+		"peers":   PubsubPeersCmd,
+		"durable": PubsubDurableCmd,
 	},
 }
 
 const (
 	pubsubDiscoverOptionName = "discover"
+	pubsubDurableOptionName  = "durable"
+	pubsubSinceOptionName    = "since"
 )
 
+// pubsubReplayBatch is the number of messages of a durable subscription
+// read from the datastore at once.
+const pubsubReplayBatch = 100
+
 type pubsubMessage struct {
 	From       []byte   `json:"from,omitempty"`
 	Data       []byte   `json:"data,omitempty"`
 	Seqno      []byte   `json:"seqno,omitempty"`
 	TopicIDs   []string `json:"topicIDs,omitempty"`
+	Seq        uint64   `json:"seq,omitempty"`
 	DataString string
 }
 
@@ -69,6 +82,15 @@ To use, the daemon must be run with '--enable-pubsub-experiment'.
 This command outputs data in the following encodings:
   * "json"
 (Specified by the "--encoding" or "--enc" flag)
+
+With --durable, the subscription is kept by the daemon under the given
+subscriber name after the command exits: the messages of the topic are
+recorded in the repo, up to PubsubDurable.MaxMessages, and numbered. The
+command replays the recorded messages numbered after --since, then the live
+ones. Pass the number of the last message processed as --since when
+reconnecting to get each message at least once. The numbers are in the
+"seq" field of the json output. A gap in them means that the history was
+trimmed. 'ipfs pubsub durable rm' ends the subscription.
 `,
 	},
 	Arguments: []cmds.Argument{
@@ -76,14 +98,21 @@ This command outputs data in the following encodings:
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(pubsubDiscoverOptionName, "Deprecated option to instruct pubsub to discovery peers for the topic. Discovery is now built into pubsub."),
+		cmds.StringOption(pubsubDurableOptionName, "Subscriber name of a durable subscription, kept by the daemon."),
+		cmds.Uint64Option(pubsubSinceOptionName, "With --durable, replay the messages numbered after this one.").WithDefault(uint64(0)),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		topic := req.Arguments[0]
+		if name, _ := req.Options[pubsubDurableOptionName].(string); name != "" {
+			since, _ := req.Options[pubsubSinceOptionName].(uint64)
+			return durableSubscribe(req, res, env, name, topic, since)
+		}
+
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
 		}
 
-		topic := req.Arguments[0]
 		sub, err := api.PubSub().Subscribe(req.Context, topic)
 		if err != nil {
 			return err
@@ -136,6 +165,63 @@ This command outputs data in the following encodings:
 	Type: pubsubMessage{},
 }
 
+func durableSubscribe(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment, name, topic string, since uint64) error {
+	nd, err := cmdenv.GetNode(env)
+	if err != nil {
+		return err
+	}
+	if nd.DurableSubs == nil {
+		return errors.New("durable subscriptions need the daemon to run with --enable-pubsub-experiment")
+	}
+
+	if err := nd.DurableSubs.Subscribe(name, topic); err != nil {
+		return err
+	}
+	notify, stop, err := nd.DurableSubs.Watch(name)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if f, ok := res.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	for {
+		msgs, err := nd.DurableSubs.Read(name, since, pubsubReplayBatch)
+		if err == durablesub.ErrNotFound {
+			return nil // removed meanwhile
+		} else if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := res.Emit(&pubsubMessage{
+				Data:       m.Data,
+				From:       []byte(m.From),
+				Seqno:      m.Seqno,
+				TopicIDs:   m.TopicIDs,
+				Seq:        m.Seq,
+				DataString: string(m.Data),
+			}); err != nil {
+				return err
+			}
+			since = m.Seq
+		}
+		if len(msgs) == pubsubReplayBatch {
+			continue
+		}
+
+		select {
+		case _, ok := <-notify:
+			if !ok {
+				return nil
+			}
+		case <-req.Context.Done():
+			return nil
+		}
+	}
+}
+
 var PubsubPubCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Publish a message to a given pubsub topic.",
@@ -175,11 +261,30 @@ To use, the daemon must be run with '--enable-pubsub-experiment'.
 	},
 }
 
+const (
+	pubsubVerboseOptionName = "verbose"
+)
+
+// pubsubTopics lists the subscribed topics. Topics is only set with
+// --verbose, Strings keeps the output of older versions.
+type pubsubTopics struct {
+	Strings []string
+	Topics  []pubsubTopic `json:",omitempty"`
+}
+
+type pubsubTopic struct {
+	Name     string
+	Policy   *libp2p.PubsubTopicPolicy `json:",omitempty"`
+	Rejected map[string]uint64         `json:",omitempty"`
+}
+
 var PubsubLsCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "List subscribed topics by name.",
 		ShortDescription: `
 ipfs pubsub ls lists out the names of topics you are currently subscribed to.
+With --verbose, it also shows the policy configured for each topic in
+PubsubACL and the number of messages rejected by it.
 
 This is an experimental feature. It is not intended in its current state
 to be used in a production environment.
@@ -187,6 +292,9 @@ to be used in a production environment.
 To use, the daemon must be run with '--enable-pubsub-experiment'.
 `,
 	},
+	Options: []cmds.Option{
+		cmds.BoolOption(pubsubVerboseOptionName, "v", "Show the topic policies and rejected message counts."),
+	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
@@ -198,14 +306,75 @@ To use, the daemon must be run with '--enable-pubsub-experiment'.
 			return err
 		}
 
-		return cmds.EmitOnce(res, stringList{l})
+		out := &pubsubTopics{Strings: l}
+		if verbose, _ := req.Options[pubsubVerboseOptionName].(bool); verbose {
+			nd, err := cmdenv.GetNode(env)
+			if err != nil {
+				return err
+			}
+			out.Topics = make([]pubsubTopic, 0, len(l))
+			for _, name := range l {
+				t := pubsubTopic{Name: name}
+				if p, ok := nd.PubsubACL.Policy(name); ok {
+					t.Policy = &p
+					t.Rejected = nd.PubsubACL.Rejected(name)
+				}
+				out.Topics = append(out.Topics, t)
+			}
+		}
+		return cmds.EmitOnce(res, out)
 	},
-	Type: stringList{},
+	Type: pubsubTopics{},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *pubsubTopics) error {
+			if out.Topics == nil {
+				return stringListEncoder(req, w, &stringList{out.Strings})
+			}
+			for _, t := range out.Topics {
+				var total uint64
+				reasons := make([]string, 0, len(t.Rejected))
+				for reason, n := range t.Rejected {
+					total += n
+					reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+				}
+				sort.Strings(reasons)
+
+				fmt.Fprintf(w, "%s\n", cmdenv.EscNonPrint(t.Name))
+				fmt.Fprintf(w, "  policy: %s\n", topicPolicyString(t.Policy))
+				if len(reasons) > 0 {
+					fmt.Fprintf(w, "  rejected: %d (%s)\n", total, strings.Join(reasons, ", "))
+				} else {
+					fmt.Fprintf(w, "  rejected: 0\n")
+				}
+			}
+			return nil
+		}),
 	},
 }
 
+func topicPolicyString(p *libp2p.PubsubTopicPolicy) string {
+	if p == nil {
+		return "none"
+	}
+	var parts []string
+	if len(p.Publishers) > 0 {
+		parts = append(parts, fmt.Sprintf("%d publishers", len(p.Publishers)))
+	}
+	if p.ChainPeers {
+		parts = append(parts, "chain peers")
+	}
+	if p.RequireSignature {
+		parts = append(parts, "signature required")
+	}
+	if p.MaxMessageSize != "" {
+		parts = append(parts, "max size "+p.MaxMessageSize)
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
 func stringListEncoder(req *cmds.Request, w io.Writer, list *stringList) error {
 	for _, str := range list.Strings {
 		_, err := fmt.Fprintf(w, "%s\n", cmdenv.EscNonPrint(str))
@@ -262,3 +431,82 @@ To use, the daemon must be run with '--enable-pubsub-experiment'.
 		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
 	},
 }
+
+var PubsubDurableCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the durable subscriptions.",
+		ShortDescription: `
+Durable subscriptions are created with 'ipfs pubsub sub --durable'. The daemon
+keeps recording their messages until they are removed.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"ls": pubsubDurableLsCmd,
+		"rm": pubsubDurableRmCmd,
+	},
+}
+
+type durableSubList struct {
+	Subscriptions []durablesub.Info
+}
+
+var pubsubDurableLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the durable subscriptions.",
+		ShortDescription: `
+Lists the durable subscriptions with their topic and the range of message
+numbers recorded.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if nd.DurableSubs == nil {
+			return cmds.EmitOnce(res, &durableSubList{Subscriptions: []durablesub.Info{}})
+		}
+		return cmds.EmitOnce(res, &durableSubList{Subscriptions: nd.DurableSubs.List()})
+	},
+	Type: durableSubList{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *durableSubList) error {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, s := range out.Subscriptions {
+				kept := "none"
+				if s.Last > 0 {
+					kept = fmt.Sprintf("%d-%d", s.First, s.Last)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Name, cmdenv.EscNonPrint(s.Topic), kept)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var pubsubDurableRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove a durable subscription.",
+		ShortDescription: `
+Ends the durable subscription and drops its recorded messages.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, true, "Subscriber names of the subscriptions to remove."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if nd.DurableSubs == nil {
+			return durablesub.ErrNotFound
+		}
+		for _, name := range req.Arguments {
+			if err := nd.DurableSubs.Remove(name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	},
+}
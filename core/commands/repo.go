@@ -10,10 +10,12 @@ import (
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+	"github.com/ipfs/go-ipfs/gc"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 
 	cid "github.com/ipfs/go-cid"
@@ -39,18 +41,26 @@ var RepoCmd = &cmds.Command{
 		"fsck":    repoFsckCmd,
 		"version": repoVersionCmd,
 		"verify":  repoVerifyCmd,
+		"scrub":   repoScrubCmd,
 	},
 }
 
-// GcResult is the result returned by "repo gc" command.
+// GcResult is the result returned by "repo gc" command. Results with a
+// Reason describe a root that was kept rather than removed.
 type GcResult struct {
-	Key   cid.Cid
-	Error string `json:",omitempty"`
+	Key      cid.Cid
+	Reason   string       `json:",omitempty"`
+	Progress *gc.Progress `json:",omitempty"`
+	Error    string       `json:",omitempty"`
 }
 
 const (
 	repoStreamErrorsOptionName = "stream-errors"
 	repoQuietOptionName        = "quiet"
+	repoRetainedOptionName     = "retained"
+	repoConcurrentOptionName   = "concurrent"
+	repoDeleteRateOptionName   = "deletes-per-second"
+	repoStreamOptionName       = "stream"
 )
 
 var repoGcCmd = &cmds.Command{
@@ -60,11 +70,29 @@ var repoGcCmd = &cmds.Command{
 'ipfs repo gc' is a plumbing command that will sweep the local
 set of stored objects and remove ones that are not pinned in
 order to reclaim hard disk space.
+
+Besides pins and the MFS root, blocks stored as backup replicas for the
+blockchain are kept. Pass --retained to list every kept root along with
+the reason it was kept.
+
+With --concurrent, the node keeps accepting writes while the collection
+marks live blocks; the GC lock is only taken for short sweep batches.
+Deletions can be throttled with --deletes-per-second, and the run can be
+paused and resumed with 'ipfs repo gc pause' and 'ipfs repo gc resume'.
+Pass --stream to report how far the run got every few seconds.
 `,
 	},
+	Subcommands: map[string]*cmds.Command{
+		"pause":  repoGcPauseCmd,
+		"resume": repoGcResumeCmd,
+	},
 	Options: []cmds.Option{
 		cmds.BoolOption(repoStreamErrorsOptionName, "Stream errors."),
 		cmds.BoolOption(repoQuietOptionName, "q", "Write minimal output."),
+		cmds.BoolOption(repoRetainedOptionName, "List the roots kept and why."),
+		cmds.BoolOption(repoConcurrentOptionName, "Collect without blocking writes while marking."),
+		cmds.FloatOption(repoDeleteRateOptionName, "Limit the deletion rate of a concurrent run. 0 means no limit.").WithDefault(0.0),
+		cmds.BoolOption(repoStreamOptionName, "Stream the progress of a concurrent run."),
 	},
 	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := cmdenv.GetNode(env)
@@ -73,32 +101,83 @@ order to reclaim hard disk space.
 		}
 
 		streamErrors, _ := req.Options[repoStreamErrorsOptionName].(bool)
+		showRetained, _ := req.Options[repoRetainedOptionName].(bool)
+
+		concurrent, _ := req.Options[repoConcurrentOptionName].(bool)
+		deleteRate, _ := req.Options[repoDeleteRateOptionName].(float64)
+		showProgress, _ := req.Options[repoStreamOptionName].(bool)
 
-		gcOutChan := corerepo.GarbageCollectAsync(n, req.Context)
+		if !concurrent && (deleteRate != 0 || showProgress) {
+			return fmt.Errorf("--%s and --%s require --%s", repoDeleteRateOptionName, repoStreamOptionName, repoConcurrentOptionName)
+		}
+		if deleteRate < 0 {
+			return fmt.Errorf("--%s must not be negative", repoDeleteRateOptionName)
+		}
+
+		opts := gc.Options{ReportRetained: showRetained}
+		var gcOutChan <-chan gc.Result
+		if concurrent {
+			copts := gc.ConcurrentOptions{
+				Options:          opts,
+				DeletesPerSecond: deleteRate,
+			}
+			if showProgress {
+				copts.ProgressInterval = gcProgressInterval
+			}
+			gcOutChan, err = corerepo.ConcurrentGarbageCollect(n, req.Context, copts)
+			if err != nil {
+				return err
+			}
+		} else {
+			gcOutChan = corerepo.GarbageCollectWithOptions(n, req.Context, opts)
+		}
 
-		if streamErrors {
-			errs := false
+		if streamErrors || showProgress {
+			var errs []error
 			for res := range gcOutChan {
 				if res.Error != nil {
+					if !streamErrors {
+						errs = append(errs, res.Error)
+						continue
+					}
 					if err := re.Emit(&GcResult{Error: res.Error.Error()}); err != nil {
 						return err
 					}
-					errs = true
+					errs = append(errs, res.Error)
+				} else if res.Progress != nil {
+					if !showProgress {
+						continue
+					}
+					if err := re.Emit(&GcResult{Progress: res.Progress}); err != nil {
+						return err
+					}
+				} else if res.KeyRetained.Defined() {
+					if err := re.Emit(&GcResult{Key: res.KeyRetained, Reason: res.Reason}); err != nil {
+						return err
+					}
 				} else {
 					if err := re.Emit(&GcResult{Key: res.KeyRemoved}); err != nil {
 						return err
 					}
 				}
 			}
-			if errs {
+			switch {
+			case len(errs) == 0:
+			case streamErrors:
 				return errors.New("encountered errors during gc run")
+			case len(errs) == 1:
+				return errs[0]
+			default:
+				return corerepo.NewMultiError(errs...)
 			}
 		} else {
-			err := corerepo.CollectResult(req.Context, gcOutChan, func(k cid.Cid) {
+			err := corerepo.CollectResultWithRetained(req.Context, gcOutChan, func(k cid.Cid) {
 				// Nothing to do with this error, really. This
 				// most likely means that the client is gone but
 				// we still need to let the GC finish.
 				_ = re.Emit(&GcResult{Key: k})
+			}, func(k cid.Cid, reason string) {
+				_ = re.Emit(&GcResult{Key: k, Reason: reason})
 			})
 			if err != nil {
 				return err
@@ -117,6 +196,28 @@ order to reclaim hard disk space.
 				return err
 			}
 
+			if p := gcr.Progress; p != nil {
+				if quiet {
+					return nil
+				}
+				state := p.Phase
+				if p.Paused {
+					state += ", paused"
+				}
+				_, err := fmt.Fprintf(w, "progress (%s): %d marked, %d scanned, %d candidates, %d removed\n",
+					state, p.Marked, p.Scanned, p.Candidates, p.Removed)
+				return err
+			}
+
+			if gcr.Reason != "" {
+				if quiet {
+					_, err := fmt.Fprintf(w, "%s %s\n", gcr.Key, gcr.Reason)
+					return err
+				}
+				_, err := fmt.Fprintf(w, "retained %s (%s)\n", gcr.Key, gcr.Reason)
+				return err
+			}
+
 			prefix := "removed "
 			if quiet {
 				prefix = ""
@@ -128,9 +229,43 @@ order to reclaim hard disk space.
 	},
 }
 
+// gcProgressInterval is how often "repo gc --stream" reports.
+const gcProgressInterval = 5 * time.Second
+
+var repoGcPauseCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Pause the running concurrent garbage collection.",
+		ShortDescription: `
+'ipfs repo gc pause' suspends the concurrent garbage collection started
+with 'ipfs repo gc --concurrent'. A paused run holds no lock.
+`,
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		return corerepo.PauseGC(n)
+	},
+}
+
+var repoGcResumeCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Resume the paused concurrent garbage collection.",
+	},
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		return corerepo.ResumeGC(n)
+	},
+}
+
 const (
 	repoSizeOnlyOptionName = "size-only"
 	repoHumanOptionName    = "human"
+	repoTiersOptionName    = "tiers"
 )
 
 var repoStatCmd = &cmds.Command{
@@ -145,11 +280,19 @@ StorageMax      string Maximum datastore size (from configuration)
 NumObjects      int Number of objects in the local repo.
 RepoPath        string The path to the repo being currently used.
 Version         string The repo version.
+
+With --tiers, the size, number of objects, reads served and migrations of
+every tier of a tiered datastore are reported as well.
+
+When storage quotas are enabled in the Quota config section, the space used
+by user content, backup replicas and cache is reported against its quota,
+along with the blocks evicted and the writes rejected.
 `,
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(repoSizeOnlyOptionName, "s", "Only report RepoSize and StorageMax."),
 		cmds.BoolOption(repoHumanOptionName, "H", "Print sizes in human readable format (e.g., 1K 234M 2G)"),
+		cmds.BoolOption(repoTiersOptionName, "Report the tiers of a tiered datastore."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := cmdenv.GetNode(env)
@@ -173,6 +316,13 @@ Version         string The repo version.
 			return err
 		}
 
+		if tiers, _ := req.Options[repoTiersOptionName].(bool); tiers {
+			stat.Tiers, err = corerepo.TierStats(n)
+			if err != nil {
+				return err
+			}
+		}
+
 		return cmds.EmitOnce(res, &stat)
 	},
 	Type: &corerepo.Stat{},
@@ -205,6 +355,44 @@ Version         string The repo version.
 				fmt.Fprintf(wtr, "Version:\t%s\n", stat.Version)
 			}
 
+			for _, t := range stat.Tiers {
+				fmt.Fprintf(wtr, "Tier %s:\n", t.Name)
+				fmt.Fprintf(wtr, "  NumObjects:\t%d\n", t.Keys)
+				printSize("  Size", t.Size)
+				if t.Capacity != 0 {
+					printSize("  Capacity", t.Capacity)
+				}
+				fmt.Fprintf(wtr, "  Hits:\t%d\n", t.Hits)
+				fmt.Fprintf(wtr, "  Promotions:\t%d\n", t.Promotions)
+				fmt.Fprintf(wtr, "  Demotions:\t%d\n", t.Demotions)
+			}
+
+			if q := stat.Quota; q != nil {
+				printUsage := func(name string, u gc.QuotaUsage) {
+					used := fmt.Sprintf("%d", u.Used)
+					limit := "none"
+					if human {
+						used = humanize.Bytes(u.Used)
+					}
+					if u.Limit != 0 {
+						limit = fmt.Sprintf("%d", u.Limit)
+						if human {
+							limit = humanize.Bytes(u.Limit)
+						}
+					}
+					fmt.Fprintf(wtr, "%s:\t%s of %s (%d blocks)\n", name, used, limit, u.Blocks)
+				}
+				if !q.Ready {
+					fmt.Fprintf(wtr, "Quota:\tnot enforced yet, blocks are being classified\n")
+				}
+				printUsage("Quota", q.Total)
+				for _, u := range q.Classes {
+					printUsage("  "+strings.Title(string(u.Class)), u)
+				}
+				fmt.Fprintf(wtr, "  Evicted:\t%d\n", q.Evicted)
+				fmt.Fprintf(wtr, "  Rejected:\t%d\n", q.Rejected)
+			}
+
 			return nil
 		}),
 	},
@@ -345,6 +533,121 @@ var repoVerifyCmd = &cmds.Command{
 	},
 }
 
+var repoScrubCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Find and repair corrupt blocks in the repo.",
+		ShortDescription: `
+The scrubber rehashes every block of the repo at a throttled rate. Corrupt
+blocks are moved to a quarantine namespace of the datastore and fetched
+again, first from the peers holding a backup of them and then from the
+network.
+
+Set Scrub.Enabled in the config to scrub periodically while the daemon runs.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"start":  repoScrubStartCmd,
+		"status": repoScrubStatusCmd,
+	},
+}
+
+var repoScrubStartCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Start a scrub pass now.",
+		ShortDescription: `
+'ipfs repo scrub start' starts a scrub pass in the background of the daemon.
+Without a running daemon, the pass runs in the foreground. Follow it with
+'ipfs repo scrub status'.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		cfg, err := corerepo.ScrubConfigFromRepo(n.Repo)
+		if err != nil {
+			return err
+		}
+
+		if n.IsDaemon {
+			if err := corerepo.StartScrub(n.Context(), n, cfg); err != nil {
+				return err
+			}
+			return cmds.EmitOnce(res, &MessageOutput{"scrub started\n"})
+		}
+
+		if err := corerepo.Scrub(req.Context, n, cfg); err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &MessageOutput{"scrub complete\n"})
+	},
+	Type: MessageOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *MessageOutput) error {
+			_, err := fmt.Fprint(w, out.Message)
+			return err
+		}),
+	},
+}
+
+var repoScrubStatusCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the progress and repairs of the last scrub pass.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		st, err := corerepo.GetScrubStatus(n.Repo.Datastore())
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &st)
+	},
+	Type: corerepo.ScrubStatus{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, st *corerepo.ScrubStatus) error {
+			if st.Started.IsZero() {
+				_, err := fmt.Fprintln(w, "the repo was never scrubbed")
+				return err
+			}
+
+			wtr := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+			defer wtr.Flush()
+
+			state := "finished"
+			switch {
+			case st.Running:
+				state = "running"
+			case st.Error != "":
+				state = "stopped: " + st.Error
+			}
+			fmt.Fprintf(wtr, "State:\t%s\n", state)
+			fmt.Fprintf(wtr, "Started:\t%s\n", st.Started.Format(time.RFC3339))
+			if !st.Running {
+				fmt.Fprintf(wtr, "Finished:\t%s\n", st.Finished.Format(time.RFC3339))
+			}
+			fmt.Fprintf(wtr, "Checked:\t%d\n", st.Checked)
+			fmt.Fprintf(wtr, "Corrupt:\t%d\n", st.Corrupt)
+			fmt.Fprintf(wtr, "Repaired:\t%d\n", st.Repaired)
+			fmt.Fprintf(wtr, "Failed:\t%d\n", st.Failed)
+
+			for _, r := range st.Repairs {
+				if r.Error != "" {
+					fmt.Fprintf(wtr, "%s\t%s\tnot repaired: %s\n", r.Time.Format(time.RFC3339), r.Cid, r.Error)
+				} else {
+					fmt.Fprintf(wtr, "%s\t%s\trepaired from %s\n", r.Time.Format(time.RFC3339), r.Cid, r.Source)
+				}
+			}
+			return nil
+		}),
+	},
+}
+
 var repoVersionCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Show the repo version.",
@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 
 	humanize "github.com/dustin/go-humanize"
 	cmds "github.com/ipfs/go-ipfs-cmds"
@@ -39,8 +43,33 @@ const (
 	statProtoOptionName    = "proto"
 	statPollOptionName     = "poll"
 	statIntervalOptionName = "interval"
+	statByProtoOptionName  = "by-proto"
 )
 
+// BandwidthStats is the output of 'ipfs stats bw'. Protocols is only set
+// with --by-proto.
+type BandwidthStats struct {
+	metrics.Stats
+	Protocols []ProtocolBandwidth `json:",omitempty"`
+}
+
+// ProtocolBandwidth is the bandwidth of a protocol and its throttling.
+type ProtocolBandwidth struct {
+	Protocol string
+	metrics.Stats
+
+	// LimitedBy is the protocol prefix of the limit applying to the
+	// protocol, if any. Limits in bytes per second are zero when unset.
+	LimitedBy string `json:",omitempty"`
+	LimitIn   float64
+	LimitOut  float64
+
+	// ThrottledIn and ThrottledOut report whether the streams of the
+	// limit waited in the last second.
+	ThrottledIn  bool
+	ThrottledOut bool
+}
+
 var statBwCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Print IPFS bandwidth information.",
@@ -76,11 +105,22 @@ Example:
     TotalOut: 12MB
     RateIn: 0B/s
     RateOut: 0B/s
+
+The '--by-proto' option lists every protocol seen, along with the limit set
+with 'ipfs swarm limit' or the BandwidthLimits config section that applies
+to it, and whether that limit is currently throttling the streams. The
+limits of a protocol prefix are shared by all the protocols it covers.
+
+    > ipfs stats bw --by-proto
+    Protocol                 TotalIn  TotalOut  RateIn   RateOut  Limit In/Out  Throttled
+    /ipfs/bitswap/1.2.0      4.9MB    21MB      12kB/s   1.0MB/s  -/1.0MB       out
+    /ipfs/kad/1.0.0          130kB    96kB      0B/s     0B/s     -/-
 `,
 	},
 	Options: []cmds.Option{
 		cmds.StringOption(statPeerOptionName, "p", "Specify a peer to print bandwidth for."),
 		cmds.StringOption(statProtoOptionName, "t", "Specify a protocol to print bandwidth for."),
+		cmds.BoolOption(statByProtoOptionName, "Print the bandwidth and throttling of each protocol."),
 		cmds.BoolOption(statPollOptionName, "Print bandwidth at an interval."),
 		cmds.StringOption(statIntervalOptionName, "i", `Time interval to wait between updating output, if 'poll' is true.
 
@@ -108,6 +148,10 @@ Example:
 		if pfound && tfound {
 			return cmds.Errorf(cmds.ErrClient, "please only specify peer OR protocol")
 		}
+		byProto, _ := req.Options[statByProtoOptionName].(bool)
+		if byProto && (pfound || tfound) {
+			return cmds.Errorf(cmds.ErrClient, "--by-proto cannot be combined with peer or protocol")
+		}
 
 		var pid peer.ID
 		if pfound {
@@ -126,22 +170,20 @@ Example:
 
 		doPoll, _ := req.Options[statPollOptionName].(bool)
 		for {
+			var out BandwidthStats
 			if pfound {
-				stats := nd.Reporter.GetBandwidthForPeer(pid)
-				if err := res.Emit(&stats); err != nil {
-					return err
-				}
+				out.Stats = nd.Reporter.GetBandwidthForPeer(pid)
 			} else if tfound {
 				protoId := protocol.ID(tstr)
-				stats := nd.Reporter.GetBandwidthForProtocol(protoId)
-				if err := res.Emit(&stats); err != nil {
-					return err
-				}
+				out.Stats = nd.Reporter.GetBandwidthForProtocol(protoId)
 			} else {
-				totals := nd.Reporter.GetBandwidthTotals()
-				if err := res.Emit(&totals); err != nil {
-					return err
-				}
+				out.Stats = nd.Reporter.GetBandwidthTotals()
+			}
+			if byProto {
+				out.Protocols = protocolBandwidth(nd.Reporter, nd.Limiter)
+			}
+			if err := res.Emit(&out); err != nil {
+				return err
 			}
 			if !doPoll {
 				return nil
@@ -153,12 +195,13 @@ Example:
 			}
 		}
 	},
-	Type: metrics.Stats{},
+	Type: BandwidthStats{},
 	PostRun: cmds.PostRunMap{
 		cmds.CLI: func(res cmds.Response, re cmds.ResponseEmitter) error {
 			polling, _ := res.Request().Options[statPollOptionName].(bool)
+			byProto, _ := res.Request().Options[statByProtoOptionName].(bool)
 
-			if polling {
+			if polling && !byProto {
 				fmt.Fprintln(os.Stdout, "Total Up    Total Down  Rate Up     Rate Down")
 			}
 			for {
@@ -170,7 +213,19 @@ Example:
 					return err
 				}
 
-				bs := v.(*metrics.Stats)
+				out := v.(*BandwidthStats)
+				bs := &out.Stats
+
+				if byProto {
+					if err := printProtocolBandwidth(os.Stdout, out.Protocols); err != nil {
+						return err
+					}
+					if !polling {
+						return nil
+					}
+					fmt.Fprintln(os.Stdout)
+					continue
+				}
 
 				if !polling {
 					printStats(os.Stdout, bs)
@@ -193,3 +248,54 @@ func printStats(out io.Writer, bs *metrics.Stats) {
 	fmt.Fprintf(out, "RateIn: %s/s\n", humanize.Bytes(uint64(bs.RateIn)))
 	fmt.Fprintf(out, "RateOut: %s/s\n", humanize.Bytes(uint64(bs.RateOut)))
 }
+
+// protocolBandwidth lists the bandwidth of the protocols seen by the
+// reporter, with the throttling of their limits.
+func protocolBandwidth(reporter *metrics.BandwidthCounter, limiter *libp2p.BandwidthLimiter) []ProtocolBandwidth {
+	byProto := reporter.GetBandwidthByProtocol()
+	out := make([]ProtocolBandwidth, 0, len(byProto))
+	for proto, stats := range byProto {
+		pb := ProtocolBandwidth{Protocol: string(proto), Stats: stats}
+		if limiter != nil {
+			if st, ok := limiter.ProtocolLimit(proto); ok {
+				pb.LimitedBy = st.Prefix
+				pb.LimitIn, pb.LimitOut = st.Limit.In, st.Limit.Out
+				pb.ThrottledIn, pb.ThrottledOut = st.ThrottledIn, st.ThrottledOut
+			}
+		}
+		out = append(out, pb)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Protocol < out[j].Protocol })
+	return out
+}
+
+func printProtocolBandwidth(out io.Writer, protos []ProtocolBandwidth) error {
+	rate := func(r float64) string {
+		if r <= 0 {
+			return "-"
+		}
+		return humanize.Bytes(uint64(r))
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Protocol\tTotalIn\tTotalOut\tRateIn\tRateOut\tLimit In/Out\tThrottled")
+	for _, p := range protos {
+		var throttled []string
+		if p.ThrottledIn {
+			throttled = append(throttled, "in")
+		}
+		if p.ThrottledOut {
+			throttled = append(throttled, "out")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s/s\t%s/s\t%s/%s\t%s\n",
+			p.Protocol,
+			humanize.Bytes(uint64(p.TotalIn)),
+			humanize.Bytes(uint64(p.TotalOut)),
+			humanize.Bytes(uint64(p.RateIn)),
+			humanize.Bytes(uint64(p.RateOut)),
+			rate(p.LimitIn), rate(p.LimitOut),
+			strings.Join(throttled, ","),
+		)
+	}
+	return tw.Flush()
+}
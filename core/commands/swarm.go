@@ -9,10 +9,12 @@ import (
 	"io"
 	"path"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	commands "github.com/ipfs/go-ipfs/commands"
+	connprotect "github.com/ipfs/go-ipfs/connprotect"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	repo "github.com/ipfs/go-ipfs/repo"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
@@ -53,6 +55,9 @@ ipfs peers in the internet.
 		"disconnect": swarmDisconnectCmd,
 		"filters":    swarmFiltersCmd,
 		"peers":      swarmPeersCmd,
+		"peering":    swarmPeeringCmd,
+		"limit":      swarmLimitCmd,
+		"key":        swarmKeyCmd,
 	},
 }
 
@@ -61,6 +66,7 @@ const (
 	swarmStreamsOptionName   = "streams"
 	swarmLatencyOptionName   = "latency"
 	swarmDirectionOptionName = "direction"
+	swarmTagsOptionName      = "tags"
 )
 
 var swarmPeersCmd = &cmds.Command{
@@ -75,17 +81,23 @@ var swarmPeersCmd = &cmds.Command{
 		cmds.BoolOption(swarmStreamsOptionName, "Also list information about open streams for each peer"),
 		cmds.BoolOption(swarmLatencyOptionName, "Also list information about latency to each peer"),
 		cmds.BoolOption(swarmDirectionOptionName, "Also list information about the direction of connection"),
+		cmds.BoolOption(swarmTagsOptionName, "Also list the connection manager tags of each peer and why it is protected"),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
 		}
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
 
 		verbose, _ := req.Options[swarmVerboseOptionName].(bool)
 		latency, _ := req.Options[swarmLatencyOptionName].(bool)
 		streams, _ := req.Options[swarmStreamsOptionName].(bool)
 		direction, _ := req.Options[swarmDirectionOptionName].(bool)
+		tags, _ := req.Options[swarmTagsOptionName].(bool)
 
 		conns, err := api.Swarm().Peers(req.Context)
 		if err != nil {
@@ -126,6 +138,13 @@ var swarmPeersCmd = &cmds.Command{
 					ci.Streams = append(ci.Streams, streamInfo{Protocol: string(s)})
 				}
 			}
+			if (verbose || tags) && n.PeerHost != nil {
+				cm := n.PeerHost.ConnManager()
+				if info := cm.GetTagInfo(c.ID()); info != nil && len(info.Tags) > 0 {
+					ci.Tags = info.Tags
+				}
+				ci.Protected = connprotect.Reasons(cm, c.ID())
+			}
 			sort.Sort(&ci)
 			out.Peers = append(out.Peers, ci)
 		}
@@ -147,6 +166,21 @@ var swarmPeersCmd = &cmds.Command{
 				}
 				fmt.Fprintln(w)
 
+				if len(info.Protected) > 0 {
+					fmt.Fprintf(w, "  protected: %s\n", strings.Join(info.Protected, ", "))
+				}
+				if len(info.Tags) > 0 {
+					names := make([]string, 0, len(info.Tags))
+					for name := range info.Tags {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					for i, name := range names {
+						names[i] = fmt.Sprintf("%s=%d", name, info.Tags[name])
+					}
+					fmt.Fprintf(w, "  tags: %s\n", strings.Join(names, ", "))
+				}
+
 				for _, s := range info.Streams {
 					if s.Protocol == "" {
 						s.Protocol = "<no protocol name>"
@@ -173,6 +207,8 @@ type connInfo struct {
 	Muxer     string
 	Direction inet.Direction
 	Streams   []streamInfo
+	Tags      map[string]int `json:",omitempty"`
+	Protected []string       `json:",omitempty"`
 }
 
 func (ci *connInfo) Less(i, j int) bool {
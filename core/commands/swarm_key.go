@@ -0,0 +1,320 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/tabwriter"
+
+	core "github.com/ipfs/go-ipfs/core"
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+// maxSwarmKeySize bounds the swarm key files read by 'ipfs swarm key rotate'.
+const maxSwarmKeySize = 4096
+
+var (
+	errNoPrivateNetwork = errors.New("no swarm key rotation: the repo has no swarm key, or LIBP2P_FORCE_PNET is set")
+	errNoNextKey        = errors.New("no key rotation in progress: install a next key with 'ipfs swarm key rotate' first")
+)
+
+// SwarmKeyPeer tells which swarm key a peer connected with.
+type SwarmKeyPeer struct {
+	Peer string
+	Key  string
+}
+
+// SwarmKeys is the output of 'ipfs swarm key ls'.
+type SwarmKeys struct {
+	Primary string
+	Next    string `json:",omitempty"`
+	Peers   []SwarmKeyPeer
+}
+
+var swarmKeyCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Rotate the private network key.",
+		ShortDescription: `
+A private network node dials with its primary swarm key. While the key is
+rotated, it also accepts a next key, and answers each peer with the key the
+peer dialed with, so that the nodes can switch keys one at a time:
+
+  1. generate the next key on one node with 'ipfs swarm key rotate', and
+     install it on every other node with 'ipfs swarm key rotate <file>';
+  2. once every node accepts it, run 'ipfs swarm key promote' on each node:
+     the next key becomes the primary one, the previous key is still
+     accepted as the next one;
+  3. once every node dials with the new key, run 'ipfs swarm key retire' on
+     each node to stop accepting the previous key.
+
+'ipfs swarm key ls' shows which key the connected peers use. The keys are
+stored in the swarm.key and swarm.key.next files of the repo, and apply to
+the new connections right away.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"ls":      swarmKeyLsCmd,
+		"rotate":  swarmKeyRotateCmd,
+		"promote": swarmKeyPromoteCmd,
+		"retire":  swarmKeyRetireCmd,
+	},
+}
+
+var swarmKeyLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the swarm keys and the key of each connected peer.",
+		ShortDescription: `
+'ipfs swarm key ls' shows the fingerprints of the primary and next swarm keys,
+and for each connected peer, the key it connected with: primary, next, or
+retired for a key no longer in use. Relayed peers are listed as unknown.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsOnline {
+			return ErrNotOnline
+		}
+		if n.PNetKeys == nil {
+			return errNoPrivateNetwork
+		}
+
+		primary, next := n.PNetKeys.Fingerprints()
+		out := &SwarmKeys{Primary: fmt.Sprintf("%x", primary)}
+		if next != nil {
+			out.Next = fmt.Sprintf("%x", next)
+		}
+		for _, p := range n.PeerHost.Network().Peers() {
+			key, ok := n.PNetKeys.PeerKey(p)
+			if !ok {
+				key = "unknown"
+			}
+			out.Peers = append(out.Peers, SwarmKeyPeer{Peer: p.Pretty(), Key: key})
+		}
+		sort.Slice(out.Peers, func(i, j int) bool { return out.Peers[i].Peer < out.Peers[j].Peer })
+		return cmds.EmitOnce(res, out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmKeys) error {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "primary\t%s\n", out.Primary)
+			if out.Next != "" {
+				fmt.Fprintf(tw, "next\t%s\n", out.Next)
+			}
+			for _, p := range out.Peers {
+				fmt.Fprintf(tw, "%s\t%s\n", p.Peer, p.Key)
+			}
+			return tw.Flush()
+		}),
+	},
+	Type: SwarmKeys{},
+}
+
+var swarmKeyRotateCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Install the next swarm key.",
+		ShortDescription: `
+'ipfs swarm key rotate' installs the swarm key in the given file as the next
+key: the node accepts it besides its primary key. Without a file, it
+generates a new key and writes it to the output, to be installed on the
+other nodes:
+
+  $ ipfs swarm key rotate > swarm.key.new
+  $ ipfs swarm key rotate swarm.key.new   # on every other node
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.FileArg("file", false, false, "Swarm key file to install as the next key."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		primary, next, err := swarmKeys(n)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return errors.New("a next key is installed already: promote or retire it first")
+		}
+
+		var key []byte
+		generated := req.Files == nil
+		if generated {
+			key, err = generateSwarmKey()
+		} else {
+			key, err = readSwarmKeyArg(req)
+		}
+		if err != nil {
+			return err
+		}
+		if sameSwarmKey(key, primary) {
+			return errors.New("the next key is the primary key")
+		}
+
+		if err := setSwarmKeys(n, primary, key); err != nil {
+			return err
+		}
+		if generated {
+			return cmds.EmitOnce(res, &stringList{[]string{string(key)}})
+		}
+		_, fp := n.PNetKeys.Fingerprints()
+		return cmds.EmitOnce(res, &stringList{[]string{fmt.Sprintf("next key %x installed\n", fp)}})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *stringList) error {
+			for _, s := range out.Strings {
+				if _, err := io.WriteString(w, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	},
+	Type: stringList{},
+}
+
+var swarmKeyPromoteCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Make the next swarm key the primary key.",
+		ShortDescription: `
+'ipfs swarm key promote' swaps the keys: the node dials with the next key,
+and still accepts the previous primary key until it is retired.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		primary, next, err := swarmKeys(n)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return errNoNextKey
+		}
+		if err := setSwarmKeys(n, next, primary); err != nil {
+			return err
+		}
+		fp, _ := n.PNetKeys.Fingerprints()
+		return cmds.EmitOnce(res, &stringList{[]string{fmt.Sprintf("primary key %x", fp)}})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmKeyRetireCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Stop accepting the next swarm key.",
+		ShortDescription: `
+'ipfs swarm key retire' removes the next key: after a promotion, the previous
+key; before, the key being rolled out, which aborts the rotation. The
+connections established with it are kept.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		primary, next, err := swarmKeys(n)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return errNoNextKey
+		}
+		_, fp := n.PNetKeys.Fingerprints()
+		if err := setSwarmKeys(n, primary, nil); err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &stringList{[]string{fmt.Sprintf("retired key %x", fp)}})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+// swarmKeys reads the key files of the repo of a private network node.
+func swarmKeys(n *core.IpfsNode) (primary, next []byte, err error) {
+	if !n.IsOnline {
+		return nil, nil, ErrNotOnline
+	}
+	if n.PNetKeys == nil {
+		return nil, nil, errNoPrivateNetwork
+	}
+	if primary, err = n.Repo.SwarmKey(); err != nil {
+		return nil, nil, err
+	}
+	if next, err = n.Repo.NextSwarmKey(); err != nil {
+		return nil, nil, err
+	}
+	return primary, next, nil
+}
+
+// setSwarmKeys records the keys in the repo and applies them.
+func setSwarmKeys(n *core.IpfsNode, primary, next []byte) error {
+	ppsk, err := pnet.DecodeV1PSK(bytes.NewReader(primary))
+	if err != nil {
+		return fmt.Errorf("invalid swarm key: %s", err)
+	}
+	var npsk pnet.PSK
+	if next != nil {
+		if npsk, err = pnet.DecodeV1PSK(bytes.NewReader(next)); err != nil {
+			return fmt.Errorf("invalid swarm key: %s", err)
+		}
+	}
+	if err := n.Repo.SetSwarmKeys(primary, next); err != nil {
+		return err
+	}
+	n.PNetKeys.Set(ppsk, npsk)
+	return nil
+}
+
+func generateSwarmKey() ([]byte, error) {
+	psk := make([]byte, 32)
+	if _, err := rand.Read(psk); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%x\n", psk)), nil
+}
+
+func readSwarmKeyArg(req *cmds.Request) ([]byte, error) {
+	file, err := cmdenv.GetFileArg(req.Files.Entries())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	key, err := ioutil.ReadAll(io.LimitReader(file, maxSwarmKeySize))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pnet.DecodeV1PSK(bytes.NewReader(key)); err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %s", err)
+	}
+	return key, nil
+}
+
+func sameSwarmKey(a, b []byte) bool {
+	pa, err := pnet.DecodeV1PSK(bytes.NewReader(a))
+	if err != nil {
+		return false
+	}
+	pb, err := pnet.DecodeV1PSK(bytes.NewReader(b))
+	return err == nil && bytes.Equal(pa, pb)
+}
@@ -0,0 +1,344 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	commands "github.com/ipfs/go-ipfs/commands"
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	repo "github.com/ipfs/go-ipfs/repo"
+	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	swarmLimitInOptionName      = "in"
+	swarmLimitOutOptionName     = "out"
+	swarmLimitPersistOptionName = "persist"
+
+	// swarmLimitPeers is the target of the default per-peer limit.
+	swarmLimitPeers = "peers"
+)
+
+// Kinds of bandwidth limits.
+const (
+	limitKindProtocol = "protocol"
+	limitKindPeer     = "peer"
+	limitKindPeers    = "peers"
+)
+
+// SwarmLimit is a bandwidth limit. Empty rates mean no limit.
+type SwarmLimit struct {
+	Kind   string
+	Target string
+	In     string
+	Out    string
+}
+
+// SwarmLimits is the output of 'ipfs swarm limit ls'.
+type SwarmLimits struct {
+	Limits []SwarmLimit
+}
+
+var swarmLimitCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Throttle the bandwidth of protocols and peers.",
+		ShortDescription: `
+The node throttles its libp2p streams with token buckets: one for each
+limited protocol prefix, shared by all the peers, and one for each peer,
+shared by all its protocols. A stream goes as fast as the slowest of them
+allows. The limits start from the BandwidthLimits config section and can be
+changed at runtime; pass --persist to record the changes in the config as
+well. 'ipfs stats bw --by-proto' shows which protocols are being throttled.
+
+A limit targets one of:
+
+  - a protocol: bitswap, graphsync, p2p (the 'ipfs p2p' forwards), backup,
+    or a protocol ID prefix such as /ipfs/kad
+  - a peer ID
+  - 'peers', for the default limit of each peer
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"set": swarmLimitSetCmd,
+		"rm":  swarmLimitRmCmd,
+		"ls":  swarmLimitLsCmd,
+	},
+}
+
+var swarmLimitSetCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Set the bandwidth limit of a protocol or peer.",
+		ShortDescription: `
+'ipfs swarm limit set' sets the rates, in bytes per second, a protocol or a
+peer may receive (--in) and send (--out). A direction not given keeps its
+current limit; a rate of 0 removes it. The open streams are throttled right
+away.
+
+Example:
+
+  $ ipfs swarm limit set --out=1MB --persist backup
+  $ ipfs swarm limit set --in=500kB --out=500kB peers
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("target", true, false, "Protocol, protocol prefix, peer ID, or 'peers'."),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(swarmLimitInOptionName, "Rate the target may receive, such as 1MB."),
+		cmds.StringOption(swarmLimitOutOptionName, "Rate the target may send, such as 1MB."),
+		cmds.BoolOption(swarmLimitPersistOptionName, "Record the limit in the BandwidthLimits config section."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Limiter == nil {
+			return ErrNotOnline
+		}
+		persist, _ := req.Options[swarmLimitPersistOptionName].(bool)
+
+		kind, key, err := parseLimitTarget(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		in, inFound := req.Options[swarmLimitInOptionName].(string)
+		out, outFound := req.Options[swarmLimitOutOptionName].(string)
+		if !inFound && !outFound {
+			return fmt.Errorf("give the rates to limit the target to with --in and --out")
+		}
+		given, err := libp2p.ParseRate(libp2p.BandwidthLimit{In: in, Out: out})
+		if err != nil {
+			return err
+		}
+
+		r := currentLimit(n.Limiter.Limits(), kind, key)
+		if inFound {
+			r.In = given.In
+		}
+		if outFound {
+			r.Out = given.Out
+		}
+
+		if persist {
+			if err := persistLimit(env, kind, req.Arguments[0], key, r); err != nil {
+				return err
+			}
+		}
+		applyLimit(n.Limiter, kind, key, r)
+
+		return cmds.EmitOnce(res, &stringList{[]string{
+			fmt.Sprintf("set %s %s", req.Arguments[0], formatLimit(r.Limit())),
+		}})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmLimitRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove the bandwidth limit of a protocol or peer.",
+		ShortDescription: `
+'ipfs swarm limit rm' removes the limits of a protocol or a peer. A peer
+falls back to the default limit of the peers.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("target", true, false, "Protocol, protocol prefix, peer ID, or 'peers'."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(swarmLimitPersistOptionName, "Remove the limit from the BandwidthLimits config section."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Limiter == nil {
+			return ErrNotOnline
+		}
+		persist, _ := req.Options[swarmLimitPersistOptionName].(bool)
+
+		kind, key, err := parseLimitTarget(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		if persist {
+			if err := persistLimit(env, kind, req.Arguments[0], key, libp2p.Rate{}); err != nil {
+				return err
+			}
+		}
+		applyLimit(n.Limiter, kind, key, libp2p.Rate{})
+
+		return cmds.EmitOnce(res, &stringList{[]string{"rm " + req.Arguments[0]}})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmLimitLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the bandwidth limits.",
+		ShortDescription: `
+'ipfs swarm limit ls' lists the limits in force: the protocol prefixes, the
+default limit of the peers, and the peers with a limit of their own.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Limiter == nil {
+			return ErrNotOnline
+		}
+
+		limits := n.Limiter.Limits()
+		out := &SwarmLimits{Limits: make([]SwarmLimit, 0, len(limits.Protocols)+len(limits.Peers)+1)}
+		add := func(kind, target string, r libp2p.Rate) {
+			l := r.Limit()
+			out.Limits = append(out.Limits, SwarmLimit{Kind: kind, Target: target, In: l.In, Out: l.Out})
+		}
+
+		prefixes := make([]string, 0, len(limits.Protocols))
+		for prefix := range limits.Protocols {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			add(limitKindProtocol, prefix, limits.Protocols[prefix])
+		}
+		if limits.PerPeer != (libp2p.Rate{}) {
+			add(limitKindPeers, swarmLimitPeers, limits.PerPeer)
+		}
+		ids := make([]string, 0, len(limits.Peers))
+		for id := range limits.Peers {
+			ids = append(ids, id.Pretty())
+		}
+		sort.Strings(ids)
+		for _, s := range ids {
+			id, _ := peer.Decode(s)
+			add(limitKindPeer, s, limits.Peers[id])
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmLimits) error {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			for _, l := range out.Limits {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", l.Kind, l.Target,
+					formatLimit(libp2p.BandwidthLimit{In: l.In, Out: l.Out}))
+			}
+			return tw.Flush()
+		}),
+	},
+	Type: SwarmLimits{},
+}
+
+// parseLimitTarget returns the kind of the limit a target names, and the
+// protocol prefix or peer ID it is for.
+func parseLimitTarget(target string) (kind, key string, err error) {
+	if target == swarmLimitPeers {
+		return limitKindPeers, "", nil
+	}
+	if prefix, err := libp2p.ProtocolPrefix(target); err == nil {
+		return limitKindProtocol, prefix, nil
+	}
+	id, err := peer.Decode(target)
+	if err != nil {
+		return "", "", fmt.Errorf("unknown target %q: expected a protocol, a protocol prefix, a peer ID or %q", target, swarmLimitPeers)
+	}
+	return limitKindPeer, string(id), nil
+}
+
+func currentLimit(limits libp2p.BandwidthLimitSet, kind, key string) libp2p.Rate {
+	switch kind {
+	case limitKindPeers:
+		return limits.PerPeer
+	case limitKindPeer:
+		return limits.Peers[peer.ID(key)]
+	default:
+		return limits.Protocols[key]
+	}
+}
+
+func applyLimit(l *libp2p.BandwidthLimiter, kind, key string, r libp2p.Rate) {
+	switch kind {
+	case limitKindPeers:
+		l.SetDefaultPeerLimit(r)
+	case limitKindPeer:
+		l.SetPeerLimit(peer.ID(key), r)
+	default:
+		l.SetProtocolLimit(key, r)
+	}
+}
+
+// persistLimit records a limit in the config, or removes it when r is zero.
+// Protocol limits are stored under the name given, replacing the names of
+// the same prefix.
+func persistLimit(env cmds.Environment, kind, target, key string, r libp2p.Rate) error {
+	rp, err := fsrepo.Open(env.(*commands.Context).ConfigRoot)
+	if err != nil {
+		return err
+	}
+	defer rp.Close()
+	return setLimitConfig(rp, kind, target, key, r)
+}
+
+func setLimitConfig(r repo.Repo, kind, target, key string, rate libp2p.Rate) error {
+	var cfg libp2p.BandwidthLimitsConfig
+	if err := repo.ConfigSection(r, libp2p.BandwidthLimitsConfigKey, &cfg); err != nil {
+		return err
+	}
+
+	limit := rate.Limit()
+	switch kind {
+	case limitKindPeers:
+		cfg.PerPeer = limit
+	case limitKindPeer:
+		if cfg.Peers == nil {
+			cfg.Peers = make(map[string]libp2p.BandwidthLimit)
+		}
+		for s := range cfg.Peers {
+			if id, err := peer.Decode(s); err == nil && string(id) == key {
+				delete(cfg.Peers, s)
+			}
+		}
+		if rate != (libp2p.Rate{}) {
+			cfg.Peers[target] = limit
+		}
+	default:
+		if cfg.Protocols == nil {
+			cfg.Protocols = make(map[string]libp2p.BandwidthLimit)
+		}
+		for name := range cfg.Protocols {
+			if prefix, err := libp2p.ProtocolPrefix(name); err == nil && prefix == key {
+				delete(cfg.Protocols, name)
+			}
+		}
+		if rate != (libp2p.Rate{}) {
+			cfg.Protocols[target] = limit
+		}
+	}
+	return r.SetConfigKey(libp2p.BandwidthLimitsConfigKey, cfg)
+}
+
+func formatLimit(l libp2p.BandwidthLimit) string {
+	rate := func(s string) string {
+		if s == "" {
+			return "unlimited"
+		}
+		return s + "/s"
+	}
+	return fmt.Sprintf("in %s, out %s", rate(l.In), rate(l.Out))
+}
@@ -0,0 +1,38 @@
+package commands
+
+import (
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestParseLimitTarget(t *testing.T) {
+	id := "QmUWKoHbjsqsSMesRC2Zoscs8edyFz6F77auBB1YBBhgpX"
+	pid, err := peer.Decode(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		target, kind, key string
+	}{
+		{"peers", limitKindPeers, ""},
+		{"bitswap", limitKindProtocol, "/ipfs/bitswap"},
+		{"p2p", limitKindProtocol, "/x/"},
+		{"/ipfs/kad", limitKindProtocol, "/ipfs/kad"},
+		{id, limitKindPeer, string(pid)},
+	} {
+		kind, key, err := parseLimitTarget(tc.target)
+		if err != nil {
+			t.Errorf("%s: %s", tc.target, err)
+			continue
+		}
+		if kind != tc.kind || key != tc.key {
+			t.Errorf("%s: got %s %q, expected %s %q", tc.target, kind, key, tc.kind, tc.key)
+		}
+	}
+
+	if _, _, err := parseLimitTarget("no-such-protocol"); err == nil {
+		t.Error("expected an unknown target to fail")
+	}
+}
@@ -0,0 +1,276 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	commands "github.com/ipfs/go-ipfs/commands"
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	repo "github.com/ipfs/go-ipfs/repo"
+	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const swarmPeeringPersistOptionName = "persist"
+
+// PeeringPeer describes a peer of the peering service.
+type PeeringPeer struct {
+	ID        string
+	Addrs     []string
+	Connected bool
+
+	// NextAttempt is when the next reconnect attempt is due, if
+	// disconnected.
+	NextAttempt time.Time     `json:",omitempty"`
+	Backoff     time.Duration `json:",omitempty"`
+}
+
+// PeeringPeers is the output of 'ipfs swarm peering ls'.
+type PeeringPeers struct {
+	Peers []PeeringPeer
+}
+
+var swarmPeeringCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the peers the node stays connected to.",
+		ShortDescription: `
+The peering service keeps the node connected to a set of peers, reconnecting
+with a backoff when the connection drops. The set starts from Peering.Peers
+in the config and can be changed at runtime; pass --persist to record the
+changes in the config as well.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"add": swarmPeeringAddCmd,
+		"rm":  swarmPeeringRmCmd,
+		"ls":  swarmPeeringLsCmd,
+	},
+}
+
+var swarmPeeringAddCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Add peers to the peering service.",
+		ShortDescription: `
+'ipfs swarm peering add' adds peers to the peering service, given as
+multiaddrs ending in /p2p/<peer ID>. The addresses of a peer already present
+are replaced.
+
+Example:
+
+  $ ipfs swarm peering add --persist /ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("address", true, true, "Address of the peer, ending in /p2p/<peer ID>.").EnableStdin(),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(swarmPeeringPersistOptionName, "Record the peers in Peering.Peers of the config."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Peering == nil {
+			return ErrNotOnline
+		}
+		persist, _ := req.Options[swarmPeeringPersistOptionName].(bool)
+
+		given, err := peeringAddrInfos(req.Arguments)
+		if err != nil {
+			return err
+		}
+		resolved, err := parseAddresses(req.Context, req.Arguments, n.DNSResolver)
+		if err != nil {
+			return err
+		}
+
+		if persist {
+			r, err := fsrepo.Open(env.(*commands.Context).ConfigRoot)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			if err := peeringPersist(r, given, nil); err != nil {
+				return err
+			}
+		}
+
+		output := make([]string, 0, len(resolved))
+		for _, ai := range resolved {
+			n.Peering.AddPeer(ai)
+			output = append(output, "add "+ai.ID.Pretty())
+		}
+		return cmds.EmitOnce(res, &stringList{output})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmPeeringRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove peers from the peering service.",
+		ShortDescription: `
+'ipfs swarm peering rm' removes peers from the peering service. The node no
+longer reconnects to them, but the open connections are left as they are.
+Chain peers removed this way are not added back while the node runs.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("peer", true, true, "ID of the peer.").EnableStdin(),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(swarmPeeringPersistOptionName, "Remove the peers from Peering.Peers of the config."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Peering == nil {
+			return ErrNotOnline
+		}
+		persist, _ := req.Options[swarmPeeringPersistOptionName].(bool)
+
+		ids := make([]peer.ID, 0, len(req.Arguments))
+		for _, arg := range req.Arguments {
+			id, err := peer.Decode(arg)
+			if err != nil {
+				return fmt.Errorf("invalid peer ID %q: %s", arg, err)
+			}
+			ids = append(ids, id)
+		}
+
+		if persist {
+			r, err := fsrepo.Open(env.(*commands.Context).ConfigRoot)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			if err := peeringPersist(r, nil, ids); err != nil {
+				return err
+			}
+		}
+
+		output := make([]string, 0, len(ids))
+		for _, id := range ids {
+			n.Peering.RemovePeer(id)
+			output = append(output, "rm "+id.Pretty())
+		}
+		return cmds.EmitOnce(res, &stringList{output})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmPeeringLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the peers of the peering service.",
+		ShortDescription: `
+'ipfs swarm peering ls' lists the peers of the peering service, whether the
+node is connected to them, and when it next tries to reconnect to the others.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(swarmVerboseOptionName, "v", "Display the addresses of the peers."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if n.Peering == nil {
+			return ErrNotOnline
+		}
+
+		states := n.Peering.ListPeers()
+		out := &PeeringPeers{Peers: make([]PeeringPeer, 0, len(states))}
+		for _, st := range states {
+			p := PeeringPeer{
+				ID:        st.ID.Pretty(),
+				Addrs:     make([]string, 0, len(st.Addrs)),
+				Connected: st.Connected,
+			}
+			for _, a := range st.Addrs {
+				p.Addrs = append(p.Addrs, a.String())
+			}
+			if !st.Connected {
+				p.NextAttempt = st.NextAttempt
+				p.Backoff = st.Backoff
+			}
+			out.Peers = append(out.Peers, p)
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *PeeringPeers) error {
+			verbose, _ := req.Options[swarmVerboseOptionName].(bool)
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			for _, p := range out.Peers {
+				state := "connected"
+				if !p.Connected {
+					state = "backoff"
+					if !p.NextAttempt.IsZero() {
+						state += fmt.Sprintf(" (next attempt in %s)", time.Until(p.NextAttempt).Round(time.Second))
+					}
+				}
+				fmt.Fprintf(tw, "%s\t%s\n", p.ID, state)
+				if verbose {
+					for _, a := range p.Addrs {
+						fmt.Fprintf(tw, "  %s\t\n", a)
+					}
+				}
+			}
+			return tw.Flush()
+		}),
+	},
+	Type: PeeringPeers{},
+}
+
+// peeringAddrInfos parses peer addresses as given, without resolving them.
+func peeringAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// peeringPersist adds the peers to Peering.Peers in the config, replacing
+// the addresses of the peers already there, and removes the peers in rm.
+func peeringPersist(r repo.Repo, add []peer.AddrInfo, rm []peer.ID) error {
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+
+	drop := make(map[peer.ID]bool, len(add)+len(rm))
+	for _, ai := range add {
+		drop[ai.ID] = true
+	}
+	for _, id := range rm {
+		drop[id] = true
+	}
+
+	peers := make([]peer.AddrInfo, 0, len(cfg.Peering.Peers)+len(add))
+	for _, ai := range cfg.Peering.Peers {
+		if !drop[ai.ID] {
+			peers = append(peers, ai)
+		}
+	}
+	cfg.Peering.Peers = append(peers, add...)
+	return r.SetConfig(cfg)
+}
@@ -1,15 +1,19 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	filestore "github.com/ipfs/go-filestore"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
+	"github.com/ipfs/go-datastore"
 	cmds "github.com/ipfs/go-ipfs-cmds"
-	files "github.com/ipfs/go-ipfs-files"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 )
 
@@ -18,10 +22,35 @@ var urlStoreCmd = &cmds.Command{
 		Tagline: "Interact with urlstore.",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"add": urlAdd,
+		"add":    urlAdd,
+		"verify": urlVerify,
 	},
 }
 
+const (
+	urlParallelOptionName = "parallel"
+	urlRetriesOptionName  = "retries"
+	urlResumeOptionName   = "resume"
+	urlFullOptionName     = "full"
+)
+
+// urlRetryBackoff is the wait before the first retry of a failed transfer,
+// doubled for every following one.
+var urlRetryBackoff = time.Second
+
+// urlTimeout bounds connecting to a server and waiting for its response.
+// Verification requests, which read at most one block, must also complete
+// within it.
+const urlTimeout = 30 * time.Second
+
+// URLAddOutput is the result of adding one URL.
+type URLAddOutput struct {
+	URL   string `json:",omitempty"`
+	Key   string `json:",omitempty"`
+	Size  int
+	Error string `json:",omitempty"`
+}
+
 var urlAdd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Add URL via urlstore.",
@@ -35,42 +64,72 @@ control.
 
 The file is added using raw-leaves but otherwise using the default
 settings for 'ipfs add'.
+`,
+		ShortDescription: `
+Several URLs can be given as arguments, or one per line on stdin:
+
+  > ipfs urlstore add < urls.txt
+
+They are added --parallel at a time. A transfer cut short is resumed with
+an HTTP range request, up to --retries times, as long as the server reports
+the same ETag or Last-Modified date. A URL that cannot be added is reported
+without stopping the others; the command fails at the end if any did.
 `,
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(trickleOptionName, "t", "Use trickle-dag format for dag generation."),
 		cmds.BoolOption(pinOptionName, "Pin this object when adding.").WithDefault(true),
+		cmds.IntOption(urlParallelOptionName, "Number of URLs added concurrently.").WithDefault(4),
+		cmds.IntOption(urlRetriesOptionName, "Number of times a failed transfer is resumed.").WithDefault(3),
 	},
 	Arguments: []cmds.Argument{
-		cmds.StringArg("url", true, false, "URL to add to IPFS"),
+		cmds.StringArg("url", true, true, "URL to add to IPFS").EnableStdin(),
 	},
-	Type: &BlockStat{},
+	Type: URLAddOutput{},
 
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		log.Error("The 'ipfs urlstore' command is deprecated, please use 'ipfs add --nocopy --cid-version=1")
 
-		urlString := req.Arguments[0]
-		if !filestore.IsURL(req.Arguments[0]) {
-			return fmt.Errorf("unsupported url syntax: %s", urlString)
+		if err := req.ParseBodyArgs(); err != nil {
+			return err
+		}
+		var urls []string
+		for _, u := range req.Arguments {
+			u = strings.TrimSpace(u)
+			if u == "" || strings.HasPrefix(u, "#") {
+				continue
+			}
+			if !filestore.IsURL(u) {
+				return fmt.Errorf("unsupported url syntax: %s", u)
+			}
+			urls = append(urls, u)
 		}
 
-		url, err := url.Parse(urlString)
+		enc, err := cmdenv.GetCidEncoder(req)
 		if err != nil {
 			return err
 		}
 
-		enc, err := cmdenv.GetCidEncoder(req)
+		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
 		}
 
-		api, err := cmdenv.GetApi(env, req)
+		n, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
 
 		useTrickledag, _ := req.Options[trickleOptionName].(bool)
 		dopin, _ := req.Options[pinOptionName].(bool)
+		parallel, _ := req.Options[urlParallelOptionName].(int)
+		retries, _ := req.Options[urlRetriesOptionName].(int)
+		if parallel < 1 {
+			return fmt.Errorf("--%s must be positive", urlParallelOptionName)
+		}
+		if retries < 0 {
+			return fmt.Errorf("--%s cannot be negative", urlRetriesOptionName)
+		}
 
 		opts := []options.UnixfsAddOption{
 			options.Unixfs.Pin(dopin),
@@ -83,22 +142,225 @@ settings for 'ipfs add'.
 			opts = append(opts, options.Unixfs.Layout(options.TrickleLayout))
 		}
 
-		file := files.NewWebFile(url)
+		client := coreunix.NewURLClient(urlTimeout, false)
+		add := func(ctx context.Context, u string) (*URLAddOutput, error) {
+			file, err := coreunix.NewURLFile(ctx, client, u, retries, urlRetryBackoff)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+
+			path, err := api.Unixfs().Add(ctx, file, opts...)
+			if err != nil {
+				return nil, err
+			}
+			v := file.Validators()
+			err = coreunix.PutURLRecord(n.Repo.Datastore(), coreunix.URLRecord{
+				URL:           u,
+				Root:          path.Cid(),
+				URLValidators: v,
+				Added:         time.Now(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &URLAddOutput{URL: u, Key: enc.Encode(path.Cid()), Size: int(v.Size)}, nil
+		}
+
+		var (
+			emitLk sync.Mutex
+			failed int
+			wg     sync.WaitGroup
+		)
+		queue := make(chan string)
+		for i := 0; i < parallel && i < len(urls); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range queue {
+					out, err := add(req.Context, u)
+					if err != nil {
+						out = &URLAddOutput{URL: u, Error: err.Error()}
+					}
+
+					emitLk.Lock()
+					if err != nil {
+						failed++
+					}
+					if err := res.Emit(out); err != nil {
+						log.Debugf("urlstore add: %s", err)
+					}
+					emitLk.Unlock()
+				}
+			}()
+		}
+
+	feed:
+		for _, u := range urls {
+			select {
+			case queue <- u:
+			case <-req.Context.Done():
+				break feed
+			}
+		}
+		close(queue)
+		wg.Wait()
 
-		path, err := api.Unixfs().Add(req.Context, file, opts...)
+		if err := req.Context.Err(); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d urls could not be added", failed, len(urls))
+		}
+		return nil
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *URLAddOutput) error {
+			var err error
+			switch {
+			case out.Error != "":
+				_, err = fmt.Fprintf(w, "failed %s: %s\n", out.URL, out.Error)
+			case len(req.Arguments) == 1:
+				_, err = fmt.Fprintln(w, out.Key)
+			default:
+				_, err = fmt.Fprintf(w, "%s %s\n", out.Key, out.URL)
+			}
+			return err
+		}),
+	},
+}
+
+var urlVerify = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Check that urlstore entries still match their URL.",
+		LongDescription: `
+Check that the blocks added with 'ipfs urlstore add' are still served by
+their URL, without downloading whole objects.
+
+When the server reports the ETag or Last-Modified date recorded when the URL
+was added, the URL is reported 'unchanged' after a single HEAD request.
+Otherwise, or with --full, each block is read back with an HTTP range
+request covering only its bytes and rehashed. The URL is then reported 'ok'
+and its new validators are recorded, or 'changed' with the blocks that no
+longer match, or 'unreachable'. A URL recorded without any block left in
+the urlstore is reported 'missing'.
+
+With --resume, the URLs already verified by an interrupted run are skipped.
+
+If one or more <url> is specified only verify those, otherwise verify every
+URL of the urlstore.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("url", false, true, "URLs to verify."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(urlResumeOptionName, "Skip the URLs verified by the last, interrupted, run."),
+		cmds.BoolOption(urlFullOptionName, "Read back every block, even when the validators match."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, fs, err := getFilestore(env)
 		if err != nil {
 			return err
 		}
-		size, _ := file.Size()
-		return cmds.EmitOnce(res, &BlockStat{
-			Key:  enc.Encode(path.Cid()),
-			Size: int(size),
-		})
+		resume, _ := req.Options[urlResumeOptionName].(bool)
+		full, _ := req.Options[urlFullOptionName].(bool)
+
+		blocks, err := urlBlocks(fs)
+		if err != nil {
+			return err
+		}
+		urls := req.Arguments
+		if len(urls) == 0 {
+			for u := range blocks {
+				urls = append(urls, u)
+			}
+		}
+
+		client := coreunix.NewURLClient(urlTimeout, true)
+		d := n.Repo.Datastore()
+		started, err := coreunix.BeginURLVerify(d, resume)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range urls {
+			rec, err := coreunix.GetURLRecord(d, u)
+			var recorded *coreunix.URLValidators
+			switch err {
+			case nil:
+				if resume && !rec.Verified.Before(started) {
+					continue
+				}
+				recorded = &rec.URLValidators
+			case datastore.ErrNotFound:
+				if len(blocks[u]) == 0 {
+					return fmt.Errorf("%s is not in the urlstore", u)
+				}
+				rec = coreunix.URLRecord{URL: u}
+			default:
+				return err
+			}
+
+			r := coreunix.VerifyURL(req.Context, client, u, recorded, blocks[u], full)
+			if err := req.Context.Err(); err != nil {
+				return err
+			}
+			if r.Status == coreunix.URLUnchanged || r.Status == coreunix.URLOk {
+				rec.URLValidators = r.Current
+				rec.Verified = time.Now()
+				if err := coreunix.PutURLRecord(d, rec); err != nil {
+					return err
+				}
+			}
+			if err := res.Emit(&r); err != nil {
+				return err
+			}
+		}
+		return coreunix.EndURLVerify(d)
 	},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, bs *BlockStat) error {
-			_, err := fmt.Fprintln(w, bs.Key)
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, r *coreunix.URLVerifyResult) error {
+			enc, err := cmdenv.GetCidEncoder(req)
+			if err != nil {
+				return err
+			}
+			switch {
+			case r.Error != "":
+				_, err = fmt.Fprintf(w, "%s %s: %s\n", r.Status, r.URL, r.Error)
+			case len(r.Bad) > 0:
+				_, err = fmt.Fprintf(w, "%s %s (%d of %d blocks)\n", r.Status, r.URL, len(r.Bad), r.Checked)
+				for _, c := range r.Bad {
+					if err != nil {
+						break
+					}
+					_, err = fmt.Fprintf(w, "  %s\n", enc.Encode(c))
+				}
+			default:
+				_, err = fmt.Fprintf(w, "%s %s\n", r.Status, r.URL)
+			}
 			return err
 		}),
 	},
+	Type: coreunix.URLVerifyResult{},
+}
+
+// urlBlocks groups the filestore entries backed by a URL.
+func urlBlocks(fs *filestore.Filestore) (map[string][]coreunix.URLBlock, error) {
+	next, err := filestore.ListAll(fs, false)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[string][]coreunix.URLBlock)
+	for r := next(); r != nil; r = next() {
+		if r.Status != filestore.StatusOk || !filestore.IsURL(r.FilePath) {
+			continue
+		}
+		blocks[r.FilePath] = append(blocks[r.FilePath], coreunix.URLBlock{
+			Key:    r.Key,
+			Offset: r.Offset,
+			Size:   r.Size,
+		})
+	}
+	return blocks, nil
 }
@@ -42,9 +42,11 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
 
+	"github.com/ipfs/go-ipfs/backupsync"
 	"github.com/ipfs/go-ipfs/core/bootstrap"
 	"github.com/ipfs/go-ipfs/core/node"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/durablesub"
 	"github.com/ipfs/go-ipfs/fuse/mount"
 	"github.com/ipfs/go-ipfs/p2p"
 	"github.com/ipfs/go-ipfs/peering"
@@ -68,6 +70,7 @@ type IpfsNode struct {
 	Mounts          Mounts                 `optional:"true"` // current mount state, if any.
 	PrivateKey      ic.PrivKey             `optional:"true"` // the local node's private Key
 	PNetFingerprint libp2p.PNetFingerprint `optional:"true"` // fingerprint of private network
+	PNetKeys        *libp2p.PNetKeys       `optional:"true"` // swarm keys of private network
 
 	// Services
 	Peerstore       pstore.Peerstore          `optional:"true"` // storage for other Peer instances
@@ -79,15 +82,16 @@ type IpfsNode struct {
 	DAG             ipld.DAGService           // the merkle dag service, get/add objects.
 	Resolver        *resolver.Resolver        // the path resolution system
 	Reporter        *metrics.BandwidthCounter `optional:"true"`
+	Limiter         *libp2p.BandwidthLimiter  `optional:"true"` // throttles the libp2p streams
 	Discovery       discovery.Service         `optional:"true"`
-	FilesRoot       *mfs.Root
+	FilesRoots      *node.FilesRoots          // the MFS root, read it with Files
 	RecordValidator record.Validator
 
 	//BlockchainAPI *selector.BlockchainAPI
 
 	// Online
 	PeerHost      p2phost.Host            `optional:"true"` // the network host (server+client)
-	Peering       peering.PeeringService  `optional:"true"`
+	Peering       *peering.PeeringService `optional:"true"`
 	Filters       *ma.Filters             `optional:"true"`
 	Bootstrapper  io.Closer               `optional:"true"` // the periodic bootstrapper
 	Routing       routing.Routing         `optional:"true"` // the routing system. recommend ipfs-dht
@@ -97,9 +101,13 @@ type IpfsNode struct {
 	Provider      provider.System         // the value provider system
 	IpnsRepub     *ipnsrp.Republisher     `optional:"true"`
 	GraphExchange graphsync.GraphExchange `optional:"true"`
+	BackupSync    *backupsync.Service     `optional:"true"` // pushes and pulls backup replicas
 
-	PubSub   *pubsub.PubSub             `optional:"true"`
-	PSRouter *psrouter.PubsubValueStore `optional:"true"`
+	PubSub    *pubsub.PubSub             `optional:"true"`
+	PubsubACL *libp2p.PubsubACL          `optional:"true"` // per-topic publish policies
+	PSRouter  *psrouter.PubsubValueStore `optional:"true"`
+
+	DurableSubs *durablesub.Service `optional:"true"` // buffers the messages of durable subscriptions
 
 	DHT       *ddht.DHT       `optional:"true"`
 	DHTClient routing.Routing `name:"dhtc" optional:"true"`
@@ -137,6 +145,12 @@ func (n *IpfsNode) Context() context.Context {
 	return n.ctx
 }
 
+// Files returns the MFS root. A snapshot restore may replace it, so it is
+// read again for every operation rather than kept.
+func (n *IpfsNode) Files() *mfs.Root {
+	return n.FilesRoots.Current()
+}
+
 // Bootstrap will set and call the IpfsNodes bootstrap function.
 func (n *IpfsNode) Bootstrap(cfg bootstrap.BootstrapConfig) error {
 	// TODO what should return value be when in offlineMode?
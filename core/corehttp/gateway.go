@@ -1,6 +1,7 @@
 package corehttp
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,8 +10,12 @@ import (
 	version "github.com/ipfs/go-ipfs"
 	core "github.com/ipfs/go-ipfs/core"
 	coreapi "github.com/ipfs/go-ipfs/core/coreapi"
+	repo "github.com/ipfs/go-ipfs/repo"
+	util "github.com/ipfs/go-ipfs/util"
 
+	cid "github.com/ipfs/go-cid"
 	options "github.com/ipfs/interface-go-ipfs-core/options"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
 )
 
@@ -18,6 +23,11 @@ type GatewayConfig struct {
 	Headers      map[string][]string
 	Writable     bool
 	PathPrefixes []string
+	// TokenIssuers are the peers allowed to sign access tokens for
+	// encrypted content.
+	TokenIssuers []peer.ID
+	// ContentKeys returns the key of encrypted content held by the node.
+	ContentKeys func(cid.Cid) ([]byte, error)
 }
 
 // A helper function to clean up a set of headers:
@@ -87,12 +97,47 @@ func GatewayOption(writable bool, paths ...string) ServeOption {
 				"X-Stream-Output",
 			}, headers[ACEHeadersName]...))
 
+		var private PrivateGatewayConfig
+		if err := repo.ConfigSection(n.Repo, PrivateGatewayConfigKey, &private); err != nil {
+			return nil, err
+		}
+		issuers := []peer.ID{n.Identity}
+		for _, s := range private.TokenIssuers {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s.TokenIssuers entry %q: %s", PrivateGatewayConfigKey, s, err)
+			}
+			issuers = append(issuers, p)
+		}
+
 		gateway := newGatewayHandler(GatewayConfig{
 			Headers:      headers,
 			Writable:     writable,
 			PathPrefixes: cfg.Gateway.PathPrefixes,
+			TokenIssuers: issuers,
+			ContentKeys: func(c cid.Cid) ([]byte, error) {
+				return util.GetContentKey(n.Repo.Datastore(), c)
+			},
 		}, api)
 
+		var cacheCfg GatewayCacheConfig
+		if err := repo.ConfigSection(n.Repo, GatewayCacheConfigKey, &cacheCfg); err != nil {
+			return nil, err
+		}
+		if cacheCfg.Enabled() {
+			if err := registerGatewayCacheMetrics(); err != nil {
+				return nil, err
+			}
+			if gateway.cache, err = newGatewayCache(cacheCfg, api); err != nil {
+				return nil, err
+			}
+			if n.Routing != nil {
+				gateway.cache.getRecord = func(ctx context.Context, key string) ([]byte, error) {
+					return n.Routing.GetValue(ctx, key)
+				}
+			}
+		}
+
 		for _, p := range paths {
 			mux.Handle(p+"/", gateway)
 		}
@@ -0,0 +1,324 @@
+package corehttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/gogo/protobuf/proto"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipns "github.com/ipfs/go-ipns"
+	ipns_pb "github.com/ipfs/go-ipns/pb"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// GatewayCacheConfigKey is the top-level config section configuring the
+// gateway response cache.
+const GatewayCacheConfigKey = "GatewayCache"
+
+// GatewayCacheConfig bounds the in-memory caches of the gateway. A zero
+// value for a size disables the corresponding cache.
+type GatewayCacheConfig struct {
+	// Names is the number of IPNS and DNSLink resolutions kept. IPNS
+	// names are kept for the TTL of their record, DNSLink names and names
+	// whose record cannot be read for NameTTL (a duration string, "1m" by
+	// default).
+	Names   int
+	NameTTL string
+
+	// Paths is the number of /ipfs path to CID resolutions kept. These
+	// never change and are only evicted when the cache is full.
+	Paths int
+
+	// MaxBytes is the memory used by cached file bodies, MaxFileSize the
+	// largest file that is cached.
+	MaxBytes    int64
+	MaxFileSize int64
+}
+
+// Enabled reports whether any of the caches is configured.
+func (c GatewayCacheConfig) Enabled() bool {
+	return c.Names > 0 || c.Paths > 0 || (c.MaxBytes > 0 && c.MaxFileSize > 0)
+}
+
+const (
+	defaultNameTTL = time.Minute
+	// maxCachedBodies bounds the entries of the body cache, which is
+	// otherwise only limited by its size in bytes.
+	maxCachedBodies = 1 << 16
+)
+
+var (
+	gatewayCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "gw_cache_hits_total",
+		Help:      "Gateway cache hits by cache (name, path, body).",
+	}, []string{"cache"})
+
+	gatewayCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "gw_cache_misses_total",
+		Help:      "Gateway cache misses by cache (name, path, body).",
+	}, []string{"cache"})
+
+	gatewayCacheBodyBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "gw_cache_body_bytes",
+		Help:      "Memory used by file bodies in the gateway cache.",
+	})
+)
+
+func registerGatewayCacheMetrics() error {
+	return registerCollectors(gatewayCacheHits, gatewayCacheMisses, gatewayCacheBodyBytes)
+}
+
+type cachedName struct {
+	path    ipath.Path
+	expires time.Time
+}
+
+// gatewayCache sits between the gateway handler and the CoreAPI, caching
+// name resolutions, path resolutions and small file bodies.
+type gatewayCache struct {
+	api coreiface.CoreAPI
+	// getRecord reads the IPNS record stored under a routing key.
+	getRecord func(ctx context.Context, key string) ([]byte, error)
+
+	nameTTL     time.Duration
+	maxBytes    int64
+	maxFileSize int64
+	now         func() time.Time
+
+	names *lru.Cache
+	paths *lru.Cache
+
+	bodyLk    sync.Mutex
+	bodies    *simplelru.LRU
+	bodyBytes int64
+}
+
+func newGatewayCache(cfg GatewayCacheConfig, api coreiface.CoreAPI) (*gatewayCache, error) {
+	c := &gatewayCache{
+		api:     api,
+		nameTTL: defaultNameTTL,
+		now:     time.Now,
+	}
+	if cfg.NameTTL != "" {
+		ttl, err := time.ParseDuration(cfg.NameTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s.NameTTL: %s", GatewayCacheConfigKey, err)
+		}
+		c.nameTTL = ttl
+	}
+
+	var err error
+	if cfg.Names > 0 {
+		if c.names, err = lru.New(cfg.Names); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Paths > 0 {
+		if c.paths, err = lru.New(cfg.Paths); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxBytes > 0 && cfg.MaxFileSize > 0 {
+		c.maxBytes = cfg.MaxBytes
+		c.maxFileSize = cfg.MaxFileSize
+		c.bodies, err = simplelru.NewLRU(maxCachedBodies, func(_, v interface{}) {
+			c.bodyBytes -= int64(len(v.([]byte)))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// resolvePath resolves p like CoreAPI.ResolvePath, serving the name and
+// path parts from the cache where possible.
+func (c *gatewayCache) resolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	if rp, ok := p.(ipath.Resolved); ok {
+		return rp, nil
+	}
+	if p.Namespace() == "ipns" && c.names != nil {
+		var err error
+		if p, err = c.resolveName(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	if c.paths == nil || p.Namespace() != "ipfs" {
+		return c.api.ResolvePath(ctx, p)
+	}
+
+	key := p.String()
+	if v, ok := c.paths.Get(key); ok {
+		gatewayCacheHits.WithLabelValues("path").Inc()
+		return v.(ipath.Resolved), nil
+	}
+	gatewayCacheMisses.WithLabelValues("path").Inc()
+
+	rp, err := c.api.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	c.paths.Add(key, rp)
+	return rp, nil
+}
+
+// resolveName replaces the IPNS name or DNSLink at the start of p by the
+// path it points to.
+func (c *gatewayCache) resolveName(ctx context.Context, p ipath.Path) (ipath.Path, error) {
+	rest := strings.TrimPrefix(p.String(), "/ipns/")
+	name, remainder := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		name, remainder = rest[:i], rest[i:]
+	}
+
+	var target ipath.Path
+	if v, ok := c.names.Get(name); ok && c.now().Before(v.(cachedName).expires) {
+		gatewayCacheHits.WithLabelValues("name").Inc()
+		target = v.(cachedName).path
+	} else {
+		gatewayCacheMisses.WithLabelValues("name").Inc()
+		var (
+			ttl time.Duration
+			err error
+		)
+		target, ttl, err = c.lookupName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			c.names.Add(name, cachedName{path: target, expires: c.now().Add(ttl)})
+		}
+	}
+
+	if remainder == "" {
+		return target, nil
+	}
+	return ipath.New(strings.TrimSuffix(target.String(), "/") + remainder), nil
+}
+
+// lookupName resolves the IPNS name or DNSLink name, and returns how long
+// the resolution may be cached. An IPNS record pointing to an /ipfs path is
+// used directly, and kept for its TTL, at most until it expires.
+func (c *gatewayCache) lookupName(ctx context.Context, name string) (ipath.Path, time.Duration, error) {
+	ttl := c.nameTTL
+	if pid, err := peer.Decode(name); err == nil && c.getRecord != nil {
+		if target, rttl, ok := c.readRecord(ctx, pid); ok {
+			if target.Namespace() == "ipfs" {
+				return target, rttl, nil
+			}
+			// a name pointing to another name: cache the chain for the
+			// TTL of its first record at most
+			if rttl < ttl {
+				ttl = rttl
+			}
+		}
+	}
+
+	target, err := c.api.Name().Resolve(ctx, "/ipns/"+name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return target, ttl, nil
+}
+
+// readRecord reads the IPNS record of pid from the routing system, which
+// validates it, and returns its value and TTL.
+func (c *gatewayCache) readRecord(ctx context.Context, pid peer.ID) (ipath.Path, time.Duration, bool) {
+	data, err := c.getRecord(ctx, ipns.RecordKey(pid))
+	if err != nil {
+		return nil, 0, false
+	}
+	entry := new(ipns_pb.IpnsEntry)
+	if err := proto.Unmarshal(data, entry); err != nil {
+		return nil, 0, false
+	}
+
+	target := ipath.New(string(entry.GetValue()))
+	if target.IsValid() != nil {
+		// old records hold a bare CID
+		cc, err := cid.Cast(entry.GetValue())
+		if err != nil {
+			return nil, 0, false
+		}
+		target = ipath.IpfsPath(cc)
+	}
+
+	ttl := c.nameTTL
+	if entry.Ttl != nil {
+		ttl = time.Duration(entry.GetTtl())
+	}
+	if eol, err := ipns.GetEOL(entry); err == nil {
+		if left := eol.Sub(c.now()); left < ttl {
+			ttl = left
+		}
+	}
+	return target, ttl, true
+}
+
+// file returns the cached body of the file with the given CID.
+func (c *gatewayCache) file(key cid.Cid) (files.File, bool) {
+	if c.bodies == nil {
+		return nil, false
+	}
+	c.bodyLk.Lock()
+	v, ok := c.bodies.Get(key)
+	c.bodyLk.Unlock()
+	if !ok {
+		gatewayCacheMisses.WithLabelValues("body").Inc()
+		return nil, false
+	}
+	gatewayCacheHits.WithLabelValues("body").Inc()
+	return files.NewBytesFile(v.([]byte)), true
+}
+
+// addFile reads f into the cache if it is small enough. It returns a file
+// to serve in place of f, which must not be used anymore.
+func (c *gatewayCache) addFile(key cid.Cid, f files.File) (files.File, error) {
+	if c.bodies == nil {
+		return f, nil
+	}
+	size, err := f.Size()
+	if err != nil || size > c.maxFileSize {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, c.maxFileSize+1))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.maxFileSize {
+		// the reported size was wrong, don't cache and don't truncate
+		return nil, fmt.Errorf("file %s is larger than its reported size", key)
+	}
+
+	c.bodyLk.Lock()
+	if !c.bodies.Contains(key) {
+		c.bodies.Add(key, data)
+		c.bodyBytes += int64(len(data))
+		for c.bodyBytes > c.maxBytes {
+			c.bodies.RemoveOldest()
+		}
+	}
+	gatewayCacheBodyBytes.Set(float64(c.bodyBytes))
+	c.bodyLk.Unlock()
+
+	return files.NewBytesFile(data), nil
+}
@@ -0,0 +1,209 @@
+package corehttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	ft "github.com/ipfs/go-unixfs"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const (
+	// defaultListingLimit is the page size of JSON directory listings when
+	// the client does not ask for one.
+	defaultListingLimit = 1000
+	// maxListingLimit bounds the page size a client can ask for.
+	maxListingLimit = 10000
+)
+
+// directoryListing is the JSON representation of a directory served to
+// clients that ask for application/json.
+type directoryListing struct {
+	Path    string
+	Cid     string
+	Sharded bool
+	Entries []directoryListingEntry
+	Offset  int
+	Limit   int
+	// Next is the offset of the following page, omitted on the last page.
+	Next *int `json:",omitempty"`
+}
+
+type directoryListingEntry struct {
+	Name string
+	Cid  string
+	Size uint64
+	Type string
+}
+
+// wantsJSONListing reports whether the client negotiated a JSON directory
+// listing, either with ?format=json or with an Accept header. A q-value of 0
+// refuses the media type.
+func wantsJSONListing(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, spec := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(spec))
+			if err != nil || mt != "application/json" {
+				continue
+			}
+			q, ok := params["q"]
+			if !ok {
+				return true
+			}
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func entryTypeName(t coreiface.FileType) string {
+	switch t {
+	case coreiface.TFile:
+		return "file"
+	case coreiface.TDirectory:
+		return "directory"
+	case coreiface.TSymlink:
+		return "symlink"
+	default:
+		return "unknown"
+	}
+}
+
+// parseListingPage reads the offset and limit query parameters.
+func parseListingPage(r *http.Request) (offset, limit int, err error) {
+	q := r.URL.Query()
+	limit = defaultListingLimit
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+		if limit > maxListingLimit {
+			limit = maxListingLimit
+		}
+	}
+	return offset, limit, nil
+}
+
+// resolveListingEntry fetches the child e links to for its type and size.
+func (i *gatewayHandler) resolveListingEntry(ctx context.Context, e coreiface.DirEntry) (directoryListingEntry, error) {
+	entry := directoryListingEntry{
+		Name: e.Name,
+		Cid:  e.Cid.String(),
+		Size: e.Size,
+		Type: entryTypeName(e.Type),
+	}
+	if e.Cid.Type() != cid.DagProtobuf {
+		return entry, nil
+	}
+
+	nd, err := i.api.Dag().Get(ctx, e.Cid)
+	if err != nil {
+		return entry, err
+	}
+	fsn, err := ft.ExtractFSNode(nd)
+	if err != nil {
+		return entry, nil
+	}
+	switch fsn.Type() {
+	case ft.TFile, ft.TRaw:
+		entry.Type = entryTypeName(coreiface.TFile)
+	case ft.THAMTShard, ft.TDirectory, ft.TMetadata:
+		entry.Type = entryTypeName(coreiface.TDirectory)
+	case ft.TSymlink:
+		entry.Type = entryTypeName(coreiface.TSymlink)
+	}
+	entry.Size = fsn.FileSize()
+	return entry, nil
+}
+
+// serveJSONListing writes one page of the directory at resolvedPath. Entries
+// are returned in DAG order, which is stable for a given CID, so offsets
+// remain valid across requests for sharded directories too. Only the
+// children on the page are fetched.
+func (i *gatewayHandler) serveJSONListing(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, urlPath string) {
+	offset, limit, err := parseListingPage(r)
+	if err != nil {
+		webError(w, "invalid listing page", err, http.StatusBadRequest)
+		return
+	}
+
+	nd, err := i.api.Dag().Get(r.Context(), resolvedPath.Cid())
+	if err != nil {
+		internalWebError(w, err)
+		return
+	}
+	sharded := false
+	if fsn, err := ft.ExtractFSNode(nd); err == nil {
+		sharded = fsn.Type() == ft.THAMTShard
+	}
+
+	listing := directoryListing{
+		Path:    urlPath,
+		Cid:     resolvedPath.Cid().String(),
+		Sharded: sharded,
+		Entries: []directoryListingEntry{},
+		Offset:  offset,
+		Limit:   limit,
+	}
+
+	// Stop the listing early once the page is full.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// One entry past the page tells whether there is a next page.
+	entries, err := i.api.Unixfs().Ls(ctx, resolvedPath, options.Unixfs.ResolveChildren(false))
+	if err != nil {
+		internalWebError(w, err)
+		return
+	}
+	n := 0
+	for e := range entries {
+		if e.Err != nil {
+			internalWebError(w, e.Err)
+			return
+		}
+		n++
+		if n <= offset {
+			continue
+		}
+		if len(listing.Entries) == limit {
+			next := offset + limit
+			listing.Next = &next
+			break
+		}
+		entry, err := i.resolveListingEntry(ctx, e)
+		if err != nil {
+			internalWebError(w, err)
+			return
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(listing); err != nil {
+		log.Debugf("failed to write directory listing: %s", err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
 	assets "github.com/ipfs/go-ipfs/assets"
+	"github.com/ipfs/go-ipfs/util"
 	dag "github.com/ipfs/go-merkledag"
 	mfs "github.com/ipfs/go-mfs"
 	path "github.com/ipfs/go-path"
@@ -62,6 +63,7 @@ type redirectTemplateData struct {
 type gatewayHandler struct {
 	config GatewayConfig
 	api    coreiface.CoreAPI
+	cache  *gatewayCache // nil when caching is disabled
 }
 
 // StatusResponseWriter enables us to override HTTP Status Code passed to
@@ -250,7 +252,7 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Resolve path to the final DAG node for the ETag
-	resolvedPath, err := i.api.ResolvePath(r.Context(), parsedPath)
+	resolvedPath, err := i.resolvePath(r.Context(), parsedPath)
 	switch err {
 	case nil:
 	case coreiface.ErrOffline:
@@ -265,7 +267,18 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	dr, err := i.api.Unixfs().Get(r.Context(), resolvedPath)
+	// Encrypted content is only served to clients presenting its key.
+	var contentKey []byte
+	encrypted := isEncryptedPath(resolvedPath)
+	if encrypted {
+		contentKey, err = i.decryptionKey(r.Header.Get, resolvedPath)
+		if err != nil {
+			webError(w, "ipfs cat "+escapedURLPath, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	dr, err := i.getUnixfsNode(r.Context(), resolvedPath, r.Method != http.MethodHead)
 	if err != nil {
 		webError(w, "ipfs cat "+escapedURLPath, err, http.StatusNotFound)
 		return
@@ -279,8 +292,12 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 
 	// we need to figure out whether this is a directory before doing most of the heavy lifting below
 	_, ok := dr.(files.Directory)
+	jsonListing := ok && wantsJSONListing(r)
 
-	if ok && assets.BindataVersionHash != "" {
+	if jsonListing {
+		// the JSON listing does not depend on the HTML templates
+		responseEtag = `"DirList-JSON_CID-` + resolvedPath.Cid().String() + `"`
+	} else if ok && assets.BindataVersionHash != "" {
 		responseEtag = `"DirIndex-` + assets.BindataVersionHash + `_CID-` + resolvedPath.Cid().String() + `"`
 	} else {
 		responseEtag = `"` + resolvedPath.Cid().String() + `"`
@@ -303,7 +320,10 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	modtime := time.Now()
 
 	if f, ok := dr.(files.File); ok {
-		if strings.HasPrefix(urlPath, ipfsPathPrefix) {
+		if encrypted {
+			// never let shared caches keep decrypted content
+			w.Header().Set("Cache-Control", "private, no-store")
+		} else if strings.HasPrefix(urlPath, ipfsPathPrefix) {
 			w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
 
 			// set modtime to a really long time ago, since files are immutable and should stay cached
@@ -324,7 +344,7 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		} else {
 			name = getFilename(urlPath)
 		}
-		i.serveFile(w, r, name, modtime, f)
+		i.serveFile(w, r, name, modtime, f, encrypted, contentKey)
 		return
 	}
 	dir, ok := dr.(files.Directory)
@@ -333,7 +353,14 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	idx, err := i.api.Unixfs().Get(r.Context(), ipath.Join(resolvedPath, "index.html"))
+	// directory responses depend on content negotiation
+	w.Header().Add("Vary", "Accept")
+	if jsonListing {
+		i.serveJSONListing(w, r, resolvedPath, urlPath)
+		return
+	}
+
+	idx, err := i.getUnixfsNode(r.Context(), ipath.Join(resolvedPath, "index.html"), r.Method != http.MethodHead)
 	switch err.(type) {
 	case nil:
 		dirwithoutslash := urlPath[len(urlPath)-1] != '/'
@@ -356,7 +383,7 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		}
 
 		// write to request
-		i.serveFile(w, r, "index.html", modtime, f)
+		i.serveFile(w, r, "index.html", modtime, f, encrypted, contentKey)
 		return
 	case resolver.ErrNoLink:
 		// no index.html; noop
@@ -392,7 +419,7 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		}
 
 		hash := ""
-		if r, err := i.api.ResolvePath(r.Context(), ipath.Join(resolvedPath, dirit.Name())); err == nil {
+		if r, err := i.resolvePath(r.Context(), ipath.Join(resolvedPath, dirit.Name())); err == nil {
 			// Path may not be resolved. Continue anyways.
 			hash = r.Cid().String()
 		}
@@ -475,7 +502,10 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func (i *gatewayHandler) serveFile(w http.ResponseWriter, req *http.Request, name string, modtime time.Time, file files.File) {
+// serveFile writes file to the response. If key is set, file holds
+// encrypted content which is decrypted on the fly. Without a key, the file of
+// an encrypted root is only served if it is not in the encrypted format.
+func (i *gatewayHandler) serveFile(w http.ResponseWriter, req *http.Request, name string, modtime time.Time, file files.File, encrypted bool, key []byte) {
 	size, err := file.Size()
 	if err != nil {
 		http.Error(w, "cannot serve files with unknown sizes", http.StatusBadGateway)
@@ -487,6 +517,28 @@ func (i *gatewayHandler) serveFile(w http.ResponseWriter, req *http.Request, nam
 		reader: file,
 	}
 
+	if key != nil {
+		dec, err := util.NewDecryptReader(file, size, key)
+		if err != nil {
+			webError(w, "cannot decrypt "+name, err, http.StatusForbidden)
+			return
+		}
+		content = &lazySeeker{
+			size:   dec.Size(),
+			reader: dec,
+		}
+	} else if encrypted {
+		sealed, err := util.IsEncryptedContent(content)
+		if err != nil {
+			internalWebError(w, err)
+			return
+		}
+		if sealed {
+			webError(w, "cannot decrypt "+name, errNoContentKey, http.StatusForbidden)
+			return
+		}
+	}
+
 	var ctype string
 	if _, isSymlink := file.(*files.Symlink); isSymlink {
 		// We should be smarter about resolving symlinks but this is the
@@ -524,6 +576,42 @@ func (i *gatewayHandler) serveFile(w http.ResponseWriter, req *http.Request, nam
 	http.ServeContent(w, req, name, modtime, content)
 }
 
+// resolvePath resolves p, going through the cache when it is enabled.
+func (i *gatewayHandler) resolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	if i.cache == nil {
+		return i.api.ResolvePath(ctx, p)
+	}
+	return i.cache.resolvePath(ctx, p)
+}
+
+// getUnixfsNode returns the node at p, serving small files from the cache
+// when it is enabled. Files are only read into the cache when fill is set,
+// not for HEAD requests, which don't read the body. Symlinks are never
+// cached, so that they are served as such.
+func (i *gatewayHandler) getUnixfsNode(ctx context.Context, p ipath.Path, fill bool) (files.Node, error) {
+	if i.cache == nil {
+		return i.api.Unixfs().Get(ctx, p)
+	}
+	rp, err := i.cache.resolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := i.cache.file(rp.Cid()); ok {
+		return f, nil
+	}
+	nd, err := i.api.Unixfs().Get(ctx, rp)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := nd.(*files.Symlink); ok || !fill {
+		return nd, nil
+	}
+	if f, ok := nd.(files.File); ok {
+		return i.cache.addFile(rp.Cid(), f)
+	}
+	return nd, nil
+}
+
 func (i *gatewayHandler) servePretty404IfPresent(w http.ResponseWriter, r *http.Request, parsedPath ipath.Path) bool {
 	resolved404Path, ctype, err := i.searchUpTreeFor404(r, parsedPath)
 	if err != nil {
@@ -0,0 +1,117 @@
+package corehttp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs/util"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// PrivateGatewayConfigKey is the top-level config section listing who may
+// issue access tokens for encrypted content.
+const PrivateGatewayConfigKey = "GatewayPrivate"
+
+// PrivateGatewayConfig configures access to encrypted content.
+type PrivateGatewayConfig struct {
+	// TokenIssuers are the peers whose signed access tokens are accepted,
+	// in addition to the local node.
+	TokenIssuers []string
+}
+
+const (
+	// decryptionKeyHeader carries the raw, base64 encoded content key, for
+	// clients that hold it.
+	decryptionKeyHeader = "X-Ipfs-Decryption-Key"
+	// accessTokenHeader carries a signed access token, see util.AccessToken.
+	accessTokenHeader = "X-Ipfs-Access-Token"
+
+	// encryptedCidVersion marks roots added with 'blockchain file add --private'.
+	encryptedCidVersion = 2
+)
+
+var (
+	errNoDecryptionKey = errors.New("encrypted content: a decryption key or access token is required")
+	errNoContentKey    = errors.New("encrypted content: this gateway does not hold the content key")
+)
+
+// isEncryptedPath reports whether p points into an encrypted root.
+func isEncryptedPath(p ipath.Resolved) bool {
+	return isEncryptedCid(p.Root()) || isEncryptedCid(p.Cid())
+}
+
+func isEncryptedCid(c cid.Cid) bool {
+	return c.Defined() && c.Version() == encryptedCidVersion
+}
+
+// decryptionKey returns the content key for the encrypted root of p: the key
+// sent by the client, or the key held by the gateway when the client presents
+// an access token for the root. Keys are never read from the query string,
+// where they would end up in logs and browser histories.
+//
+// A nil key with a nil error grants access to a root the gateway holds no key
+// for. Roots added before the content keys are stored that way and read in
+// the clear; serveFile refuses to hand out the content of the others.
+func (i *gatewayHandler) decryptionKey(header func(string) string, p ipath.Resolved) ([]byte, error) {
+	if k := header(decryptionKeyHeader); k != "" {
+		return decodeContentKey(k)
+	}
+	if t := header(accessTokenHeader); t != "" {
+		return i.verifyAccessToken(t, p.Root(), time.Now())
+	}
+	return nil, errNoDecryptionKey
+}
+
+func decodeContentKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encrypted content: malformed key: %s", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("encrypted content: invalid key length %d", len(key))
+	}
+}
+
+// verifyAccessToken checks that the token s grants access to root at now, and
+// returns the content key of root held by the gateway, if any.
+func (i *gatewayHandler) verifyAccessToken(s string, root cid.Cid, now time.Time) ([]byte, error) {
+	t, issuer, err := util.ParseAccessToken(s)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := false
+	for _, p := range i.config.TokenIssuers {
+		if p == issuer {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, fmt.Errorf("access token: issuer %s is not trusted", issuer)
+	}
+	if now.Unix() >= t.Expires {
+		return nil, errors.New("access token: expired")
+	}
+	if t.Root != root.String() {
+		return nil, errors.New("access token: not valid for this content")
+	}
+	if i.config.ContentKeys == nil {
+		return nil, nil
+	}
+	key, err := i.config.ContentKeys(root)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	return key, err
+}
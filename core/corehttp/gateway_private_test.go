@@ -0,0 +1,295 @@
+package corehttp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	coreapi "github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/util"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	files "github.com/ipfs/go-ipfs-files"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestPrivateContent(t *testing.T) {
+	n, err := newNodeWithMockNamesys(mockNamesys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what 'blockchain file add --private' does
+	key, err := util.GenerateContentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 3*util.StreamChunkSize+100)
+	rand.Read(secret)
+	dir := util.EncryptDirectory(files.NewMapDirectory(map[string]files.Node{
+		"secret.bin": files.NewBytesFile(secret),
+	}), key)
+	root, err := api.Unixfs().Add(n.Context(), dir, options.Unixfs.CidVersion(encryptedCidVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedCid(root.Cid()) {
+		t.Fatalf("expected an encrypted root, got %s", root.Cid())
+	}
+	if err := util.PutContentKey(n.Repo.Datastore(), root.Cid(), key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blocks hold ciphertext only
+	stored, err := api.Unixfs().Get(n.Context(), ipath.Join(root, "secret.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(stored.(files.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, secret[:64]) {
+		t.Fatal("the content was stored in the clear")
+	}
+
+	dh := &delegatedHandler{}
+	ts := httptest.NewServer(dh)
+	t.Cleanup(ts.Close)
+	dh.Handler, err = makeHandler(n, ts.Listener, GatewayOption(false, "/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key []byte, rng string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+root.String()+"/secret.bin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			req.Header.Set(decryptionKeyHeader, base64.StdEncoding.EncodeToString(key))
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	if res := get(nil, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("without a key: expected 403, got %d", res.StatusCode)
+	}
+	wrong, _ := util.GenerateContentKey()
+	if res := get(wrong, ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("with the wrong key: expected 403, got %d", res.StatusCode)
+	}
+
+	res := get(key, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, secret) {
+		t.Fatal("decrypted content differs")
+	}
+
+	off := util.StreamChunkSize - 10
+	res = get(key, fmt.Sprintf("bytes=%d-%d", off, off+19))
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, secret[off:off+20]) {
+		t.Fatal("wrong range content")
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	sk, pk, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := mh.Sum([]byte("root"), mh.SHA2_256, -1)
+	root := cid.NewCidV1(cid.DagProtobuf, h)
+
+	key, err := util.GenerateContentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := datastore.NewMapDatastore()
+	if err := util.PutContentKey(ds, root, key); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tok, err := util.EncodeAccessToken(util.AccessToken{
+		Root:    root.String(),
+		Issuer:  issuer.String(),
+		Expires: now.Add(time.Hour).Unix(),
+	}, sk.Sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(tok, base64.RawURLEncoding.EncodeToString(key)) {
+		t.Fatal("the token carries the key")
+	}
+
+	gw := &gatewayHandler{config: GatewayConfig{
+		TokenIssuers: []peer.ID{issuer},
+		ContentKeys: func(c cid.Cid) ([]byte, error) {
+			return util.GetContentKey(ds, c)
+		},
+	}}
+	got, err := gw.verifyAccessToken(tok, root, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatal("token returned the wrong key")
+	}
+
+	if _, err := gw.verifyAccessToken(tok, root, now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expired token was accepted")
+	}
+	other := cid.NewCidV1(cid.Raw, h)
+	if _, err := gw.verifyAccessToken(tok, other, now); err == nil {
+		t.Fatal("token was accepted for another root")
+	}
+	if _, err := (&gatewayHandler{}).verifyAccessToken(tok, root, now); err == nil {
+		t.Fatal("token from an untrusted issuer was accepted")
+	}
+	if _, err := gw.verifyAccessToken(tok[:len(tok)-2]+"AA", root, now); err == nil {
+		t.Fatal("token with a bad signature was accepted")
+	}
+
+	// a gateway without the key grants access, serveFile checks the format
+	nokey := &gatewayHandler{config: GatewayConfig{TokenIssuers: []peer.ID{issuer}}}
+	if got, err := nokey.verifyAccessToken(tok, root, now); got != nil || err != nil {
+		t.Fatalf("expected no key and no error, got %v, %v", got, err)
+	}
+}
+
+func TestPrivateLegacyContent(t *testing.T) {
+	n, err := newNodeWithMockNamesys(mockNamesys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// private files added before the content keys have none
+	plain := []byte("added before the content keys")
+	legacy, err := api.Unixfs().Add(n.Context(), files.NewBytesFile(plain), options.Unixfs.CidVersion(encryptedCidVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and a file in the encrypted format whose key this gateway lacks
+	key, _ := util.GenerateContentKey()
+	r, err := util.NewEncryptReader(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := api.Unixfs().Add(n.Context(), files.NewReaderFile(r), options.Unixfs.CidVersion(encryptedCidVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := datastore.NewMapDatastore()
+	ts := httptest.NewServer(newGatewayHandler(GatewayConfig{
+		TokenIssuers: []peer.ID{issuer},
+		ContentKeys: func(c cid.Cid) ([]byte, error) {
+			return util.GetContentKey(ds, c)
+		},
+	}, api))
+	t.Cleanup(ts.Close)
+
+	get := func(p ipath.Resolved, header, value string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+p.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	token := func(root cid.Cid) string {
+		tok, err := util.EncodeAccessToken(util.AccessToken{
+			Root:    root.String(),
+			Issuer:  issuer.String(),
+			Expires: time.Now().Add(time.Hour).Unix(),
+		}, sk.Sign)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	if res := get(legacy, "", ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("without a token: expected 403, got %d", res.StatusCode)
+	}
+	// a key cannot be checked against content that is not encrypted
+	if res := get(legacy, decryptionKeyHeader, base64.StdEncoding.EncodeToString(key)); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("with a key: expected 403, got %d", res.StatusCode)
+	}
+	res := get(legacy, accessTokenHeader, token(legacy.Cid()))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("with a token: expected 200, got %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain) {
+		t.Fatalf("expected %q, got %q", plain, body)
+	}
+
+	if res := get(sealed, accessTokenHeader, token(sealed.Cid())); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("encrypted content without its key: expected 403, got %d", res.StatusCode)
+	}
+}
@@ -2,6 +2,8 @@ package corehttp
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -11,21 +13,25 @@ import (
 	"testing"
 	"time"
 
+	cid "github.com/ipfs/go-cid"
 	version "github.com/ipfs/go-ipfs"
 	core "github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
 	repo "github.com/ipfs/go-ipfs/repo"
 	namesys "github.com/ipfs/go-namesys"
 
+	proto "github.com/gogo/protobuf/proto"
 	datastore "github.com/ipfs/go-datastore"
 	syncds "github.com/ipfs/go-datastore/sync"
 	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
+	ipns "github.com/ipfs/go-ipns"
 	path "github.com/ipfs/go-path"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	nsopts "github.com/ipfs/interface-go-ipfs-core/options/namesys"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
 )
 
@@ -706,6 +712,262 @@ func TestGoGetSupport(t *testing.T) {
 	}
 }
 
+func TestJSONDirectoryListing(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	k, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a.txt": files.NewBytesFile([]byte("a")),
+		"b.txt": files.NewBytesFile([]byte("bb")),
+		"c": files.NewMapDirectory(map[string]files.Node{
+			"d.txt": files.NewBytesFile([]byte("d")),
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string, accept string) directoryListing {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+k.String()+"/"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status is %d, expected 200", res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		var listing directoryListing
+		if err := json.NewDecoder(res.Body).Decode(&listing); err != nil {
+			t.Fatal(err)
+		}
+		return listing
+	}
+
+	listing := get("", "application/json")
+	if len(listing.Entries) != 3 || listing.Next != nil {
+		t.Fatalf("unexpected listing: %+v", listing)
+	}
+	if listing.Cid != k.Cid().String() {
+		t.Fatalf("expected cid %s, got %s", k.Cid(), listing.Cid)
+	}
+	b := listing.Entries[1]
+	if b.Name != "b.txt" || b.Type != "file" || b.Size != 2 {
+		t.Fatalf("unexpected entry: %+v", b)
+	}
+	if listing.Entries[2].Type != "directory" {
+		t.Fatalf("expected a directory entry, got %+v", listing.Entries[2])
+	}
+
+	page := get("?format=json&limit=2", "")
+	if len(page.Entries) != 2 || page.Next == nil || *page.Next != 2 {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page = get("?format=json&offset=2&limit=2", "")
+	if len(page.Entries) != 1 || page.Next != nil || page.Entries[0].Name != "c" {
+		t.Fatalf("unexpected last page: %+v", page)
+	}
+
+	// browsers keep getting the HTML index
+	req, err := http.NewRequest(http.MethodGet, ts.URL+k.String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/html" {
+		t.Fatalf("expected the HTML listing, got %q", ct)
+	}
+}
+
+func TestWantsJSONListing(t *testing.T) {
+	for _, tc := range []struct {
+		query, accept string
+		want          bool
+	}{
+		{"", "application/json", true},
+		{"", "text/html, application/json;q=0.5", true},
+		{"", "application/json;q=0", false},
+		{"", "application/json;q=0.0, text/html", false},
+		{"", "text/html,*/*;q=0.8", false},
+		{"?format=json", "", true},
+		{"?format=html", "application/json", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/foo/"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if got := wantsJSONListing(r); got != tc.want {
+			t.Errorf("%q %q: got %t, expected %t", tc.query, tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestGatewayCache(t *testing.T) {
+	ns := mockNamesys{}
+	_, api, ctx := newTestServerAndNode(t, ns)
+
+	v1, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("v1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("v2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns["/ipns/example.com"] = path.FromString(v1.String())
+
+	c, err := newGatewayCache(GatewayCacheConfig{
+		Names:       10,
+		NameTTL:     "1m",
+		Paths:       10,
+		MaxBytes:    3,
+		MaxFileSize: 2,
+	}, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	resolve := func() cid.Cid {
+		t.Helper()
+		rp, err := c.resolvePath(ctx, ipath.New("/ipns/example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rp.Cid()
+	}
+	if resolve() != v1.Cid() {
+		t.Fatal("resolved to the wrong content")
+	}
+
+	// the previous resolution is used until it expires
+	ns["/ipns/example.com"] = path.FromString(v2.String())
+	if resolve() != v1.Cid() {
+		t.Fatal("name resolution was not cached")
+	}
+	now = now.Add(2 * time.Minute)
+	if resolve() != v2.Cid() {
+		t.Fatal("expired name resolution was used")
+	}
+
+	gw := &gatewayHandler{api: api, cache: c}
+	for _, k := range []ipath.Resolved{v1, v2, v1} {
+		if _, ok := c.file(k.Cid()); ok {
+			t.Fatalf("%s should not be cached", k)
+		}
+		nd, err := gw.getUnixfsNode(ctx, k, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.file(k.Cid()); !ok {
+			t.Fatalf("%s was not cached", k)
+		}
+		nd.Close()
+	}
+	if c.bodies.Len() != 1 || c.bodyBytes != 2 {
+		t.Fatalf("body cache exceeds its size: %d entries, %d bytes", c.bodies.Len(), c.bodyBytes)
+	}
+
+	// HEAD requests don't read files into the cache
+	nd, err := gw.getUnixfsNode(ctx, v2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd.Close()
+	if _, ok := c.file(v2.Cid()); ok {
+		t.Fatal("file was cached for a HEAD request")
+	}
+
+	// symlinks are served as symlinks
+	link, err := api.Unixfs().Add(ctx, files.NewLinkFile("v1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err = gw.getUnixfsNode(ctx, link, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nd.(*files.Symlink); !ok {
+		t.Fatalf("expected a symlink, got %T", nd)
+	}
+	if _, ok := c.file(link.Cid()); ok {
+		t.Fatal("symlink was cached")
+	}
+}
+
+func TestGatewayCacheRecordTTL(t *testing.T) {
+	_, api, ctx := newTestServerAndNode(t, mockNamesys{})
+
+	v1, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("v1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk, err := ci.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	entry, err := ipns.Create(sk, []byte(v1.String()), 1, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := uint64(10 * time.Minute)
+	entry.Ttl = &ttl
+	record, err := proto.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newGatewayCache(GatewayCacheConfig{Names: 10, NameTTL: "1m"}, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+	lookups := 0
+	c.getRecord = func(_ context.Context, key string) ([]byte, error) {
+		if key != ipns.RecordKey(pid) {
+			t.Fatalf("unexpected record key %q", key)
+		}
+		lookups++
+		return record, nil
+	}
+
+	name := ipath.New("/ipns/" + pid.String())
+	for _, after := range []time.Duration{0, 5 * time.Minute, 11 * time.Minute} {
+		now = now.Add(after)
+		rp, err := c.resolvePath(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rp.Cid() != v1.Cid() {
+			t.Fatal("resolved to the wrong content")
+		}
+	}
+	// kept past NameTTL, refreshed after the record TTL
+	if lookups != 2 {
+		t.Fatalf("expected 2 record lookups, got %d", lookups)
+	}
+}
+
 func TestVersion(t *testing.T) {
 	version.CurrentCommit = "theshortcommithash"
 
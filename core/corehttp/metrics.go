@@ -14,6 +14,19 @@ import (
 	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// registerCollectors registers cs with the default prometheus registry,
+// ignoring the ones registered already by another listener.
+func registerCollectors(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // This adds the scraping endpoint which Prometheus uses to fetch metrics.
 func MetricsScrapingOption(path string) ServeOption {
 	return func(n *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
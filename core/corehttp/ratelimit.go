@@ -0,0 +1,298 @@
+package corehttp
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/ipfs/go-ipfs/core"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitConfigKey is the top-level config section holding the gateway
+// request limits.
+const RateLimitConfigKey = "GatewayLimits"
+
+// RateLimitConfig describes the limits enforced by RateLimitOption. A zero
+// value for any field disables that particular limit.
+type RateLimitConfig struct {
+	// RequestsPerSecond and Burst configure the token bucket applied to
+	// every client, keyed by its IP address.
+	RequestsPerSecond float64
+	Burst             int
+	// MaxConcurrentPerClient caps the requests a single client may have
+	// in progress at the same time.
+	MaxConcurrentPerClient int
+
+	// TokenHeader names the header carrying an access token. Requests
+	// presenting one of Tokens are limited per token instead of per IP using
+	// the Token* limits; any other token is ignored. Defaults to
+	// "Authorization" (with the "Bearer " scheme stripped).
+	TokenHeader            string
+	Tokens                 []string
+	TokenRequestsPerSecond float64
+	TokenBurst             int
+	MaxConcurrentPerToken  int
+
+	// MaxInFlight caps the number of content resolutions in progress
+	// across all clients.
+	MaxInFlight int
+
+	// TrustForwardedFor keys clients by the first X-Forwarded-For address.
+	// Only enable this behind a reverse proxy that sets the header.
+	TrustForwardedFor bool
+}
+
+// Enabled reports whether any limit is configured.
+func (c RateLimitConfig) Enabled() bool {
+	return c.RequestsPerSecond > 0 || c.MaxConcurrentPerClient > 0 ||
+		c.TokenRequestsPerSecond > 0 || c.MaxConcurrentPerToken > 0 ||
+		c.MaxInFlight > 0
+}
+
+const (
+	// clientIdleTimeout is how long an idle client is remembered.
+	clientIdleTimeout = 5 * time.Minute
+	// maxClients bounds the clients remembered at once. Past it, idle
+	// clients are forgotten early.
+	maxClients = 10000
+	// busyRetryAfter is the Retry-After sent when a concurrency limit is hit.
+	busyRetryAfter = time.Second
+)
+
+var (
+	rateLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "ratelimit_rejected_total",
+		Help:      "Requests rejected by the gateway rate limiter.",
+	}, []string{"reason"})
+
+	rateLimitClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "ratelimit_clients",
+		Help:      "Clients currently tracked by the gateway rate limiter.",
+	})
+
+	rateLimitInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "ratelimit_inflight",
+		Help:      "Requests currently in flight through the gateway rate limiter.",
+	})
+)
+
+// RateLimitOption throttles requests handled by the options that follow it.
+// Clients exceeding their budget get a 429 response with a Retry-After header.
+// The limiter is shared by every listener the option is used on.
+func RateLimitOption(cfg RateLimitConfig) ServeOption {
+	rl := newRateLimiter(cfg)
+	return func(_ *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		if err := registerCollectors(rateLimitRejected, rateLimitClients, rateLimitInFlight); err != nil {
+			return nil, err
+		}
+
+		childMux := http.NewServeMux()
+		mux.Handle("/", rl.wrap(childMux))
+		return childMux, nil
+	}
+}
+
+type clientState struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+type rateLimiter struct {
+	cfg    RateLimitConfig
+	tokens map[string]bool
+	now    func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	inFlight  int
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.TokenHeader == "" {
+		cfg.TokenHeader = "Authorization"
+	}
+	rl := &rateLimiter{
+		cfg:     cfg,
+		tokens:  make(map[string]bool, len(cfg.Tokens)),
+		now:     time.Now,
+		clients: make(map[string]*clientState),
+	}
+	for _, tok := range cfg.Tokens {
+		rl.tokens[tok] = true
+	}
+	return rl
+}
+
+func (rl *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, token := rl.clientKey(r)
+		release, retry, reason := rl.acquire(key, token)
+		if release == nil {
+			rateLimitRejected.WithLabelValues(reason).Inc()
+			log.Debugf("gateway rate limit (%s) hit by %s", reason, key)
+			secs := int(math.Ceil(retry.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "too many requests: "+reason, http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey returns the key requests are accounted under, and whether it
+// identifies an access token rather than an address. Unknown tokens are
+// accounted under the address, so that they cannot be used to get a fresh
+// bucket.
+func (rl *rateLimiter) clientKey(r *http.Request) (string, bool) {
+	if tok := r.Header.Get(rl.cfg.TokenHeader); tok != "" {
+		tok = strings.TrimSpace(strings.TrimPrefix(tok, "Bearer "))
+		if rl.tokens[tok] {
+			return "token:" + tok, true
+		}
+	}
+
+	if rl.cfg.TrustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return "ip:" + strings.TrimSpace(strings.Split(xff, ",")[0]), false
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, false
+}
+
+// acquire reserves a slot for a request from key. On success it returns a
+// release function that must be called once the request is done. Otherwise
+// release is nil and retry and reason describe the rejection.
+func (rl *rateLimiter) acquire(key string, token bool) (release func(), retry time.Duration, reason string) {
+	rate, burst, maxActive := rl.limits(token)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	c, ok := rl.clients[key]
+	if !ok {
+		if len(rl.clients) >= maxClients {
+			rl.evict(now)
+		}
+		c = &clientState{tokens: float64(burst), last: now}
+		rl.clients[key] = c
+		rateLimitClients.Set(float64(len(rl.clients)))
+	}
+
+	if rate > 0 {
+		c.tokens = math.Min(float64(burst), c.tokens+now.Sub(c.last).Seconds()*rate)
+	}
+	c.last = now
+
+	switch {
+	case maxActive > 0 && c.active >= maxActive:
+		return nil, busyRetryAfter, "client-concurrency"
+	case rl.cfg.MaxInFlight > 0 && rl.inFlight >= rl.cfg.MaxInFlight:
+		return nil, busyRetryAfter, "inflight"
+	case rate > 0 && c.tokens < 1:
+		return nil, time.Duration((1 - c.tokens) / rate * float64(time.Second)), "rate"
+	}
+
+	if rate > 0 {
+		c.tokens--
+	}
+	c.active++
+	rl.inFlight++
+	rateLimitInFlight.Set(float64(rl.inFlight))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			c.active--
+			rl.inFlight--
+			rateLimitInFlight.Set(float64(rl.inFlight))
+		})
+	}, 0, ""
+}
+
+// limits returns the limits of address or token clients.
+func (rl *rateLimiter) limits(token bool) (rate float64, burst, maxActive int) {
+	rate, burst, maxActive = rl.cfg.RequestsPerSecond, rl.cfg.Burst, rl.cfg.MaxConcurrentPerClient
+	if token {
+		rate, burst, maxActive = rl.cfg.TokenRequestsPerSecond, rl.cfg.TokenBurst, rl.cfg.MaxConcurrentPerToken
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return rate, burst, maxActive
+}
+
+// sweep forgets clients that have been idle for a while. Their buckets
+// would have refilled by now anyway. Must be called with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < clientIdleTimeout {
+		return
+	}
+	rl.lastSweep = now
+	for k, c := range rl.clients {
+		if c.active == 0 && now.Sub(c.last) >= clientIdleTimeout {
+			delete(rl.clients, k)
+		}
+	}
+	rateLimitClients.Set(float64(len(rl.clients)))
+}
+
+// evict makes room for a new client once maxClients are remembered. It
+// forgets the idle clients whose bucket has refilled, as those are the same
+// as new ones, or else the idle client seen least recently. Must be called
+// with rl.mu held.
+func (rl *rateLimiter) evict(now time.Time) {
+	var oldest string
+	for k, c := range rl.clients {
+		if c.active > 0 {
+			continue
+		}
+		if rl.refilled(k, c, now) {
+			delete(rl.clients, k)
+			continue
+		}
+		if oldest == "" || c.last.Before(rl.clients[oldest].last) {
+			oldest = k
+		}
+	}
+	if len(rl.clients) >= maxClients && oldest != "" {
+		delete(rl.clients, oldest)
+	}
+	rateLimitClients.Set(float64(len(rl.clients)))
+}
+
+// refilled reports whether the bucket of c is full again.
+func (rl *rateLimiter) refilled(key string, c *clientState, now time.Time) bool {
+	rate, burst, _ := rl.limits(strings.HasPrefix(key, "token:"))
+	if rate <= 0 {
+		return true
+	}
+	return c.tokens+now.Sub(c.last).Seconds()*rate >= float64(burst)
+}
@@ -0,0 +1,138 @@
+package corehttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 2})
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		release, _, reason := rl.acquire("ip:a", false)
+		if release == nil {
+			t.Fatalf("request %d rejected: %s", i, reason)
+		}
+		release()
+	}
+
+	release, retry, reason := rl.acquire("ip:a", false)
+	if release != nil {
+		t.Fatal("expected burst to be exhausted")
+	}
+	if reason != "rate" || retry <= 0 || retry > time.Second {
+		t.Fatalf("unexpected rejection: %s after %s", reason, retry)
+	}
+
+	// other clients have their own bucket
+	if release, _, _ := rl.acquire("ip:b", false); release == nil {
+		t.Fatal("unrelated client was rejected")
+	}
+
+	now = now.Add(time.Second)
+	if release, _, _ := rl.acquire("ip:a", false); release == nil {
+		t.Fatal("bucket did not refill")
+	}
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{MaxConcurrentPerClient: 1, MaxInFlight: 2})
+
+	r1, _, _ := rl.acquire("ip:a", false)
+	if r1 == nil {
+		t.Fatal("first request rejected")
+	}
+	if r, _, reason := rl.acquire("ip:a", false); r != nil || reason != "client-concurrency" {
+		t.Fatalf("expected client concurrency rejection, got %q", reason)
+	}
+
+	r2, _, _ := rl.acquire("ip:b", false)
+	if r2 == nil {
+		t.Fatal("second client rejected")
+	}
+	if r, _, reason := rl.acquire("ip:c", false); r != nil || reason != "inflight" {
+		t.Fatalf("expected in-flight rejection, got %q", reason)
+	}
+
+	r1()
+	r1() // releasing twice must not free another slot
+	if r, _, _ := rl.acquire("ip:c", false); r == nil {
+		t.Fatal("slot was not released")
+	}
+	if r, _, reason := rl.acquire("ip:d", false); r != nil || reason != "inflight" {
+		t.Fatalf("expected in-flight rejection, got %q", reason)
+	}
+}
+
+func TestRateLimiterHandler(t *testing.T) {
+	rl := newRateLimiter(RateLimitConfig{
+		RequestsPerSecond:      1,
+		Tokens:                 []string{"secret"},
+		TokenRequestsPerSecond: 100,
+	})
+	h := rl.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/foo", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(""); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w := do("")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected Retry-After %q", w.Header().Get("Retry-After"))
+	}
+
+	// token holders are limited separately from the address they use
+	for i := 0; i < 5; i++ {
+		if w := do("secret"); w.Code != http.StatusOK {
+			t.Fatalf("token request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+
+	// unknown tokens are limited by address
+	if w := do("made-up"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unknown token: expected 429, got %d", w.Code)
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1})
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < maxClients; i++ {
+		release, _, _ := rl.acquire(fmt.Sprintf("ip:%d", i), false)
+		if release == nil {
+			t.Fatalf("client %d rejected", i)
+		}
+		release()
+		now = now.Add(time.Millisecond)
+	}
+
+	if release, _, _ := rl.acquire("ip:new", false); release == nil {
+		t.Fatal("new client rejected")
+	}
+	if len(rl.clients) != maxClients {
+		t.Fatalf("%d clients remembered, expected %d", len(rl.clients), maxClients)
+	}
+	if _, ok := rl.clients["ip:0"]; ok {
+		t.Fatal("expected the client seen least recently to be forgotten")
+	}
+}
@@ -0,0 +1,264 @@
+package corehttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// TLSConfigKey is the top-level config section holding the certificates
+// used by API and gateway addresses ending in /tls.
+const TLSConfigKey = "HTTPTLS"
+
+// TLSConfig holds the certificates of the API and gateway listeners.
+type TLSConfig struct {
+	API     TLSListenerConfig
+	Gateway TLSListenerConfig
+}
+
+// TLSListenerConfig points to the PEM encoded certificate and key served on
+// a listener. Relative paths are resolved against the repo root.
+type TLSListenerConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, requires clients to present a certificate
+	// signed by one of the CAs in the file (mutual TLS).
+	ClientCAFile string
+}
+
+// tlsProtocolCode is the multicodec of /tls, registered below for
+// multiaddr versions that don't know it yet.
+const tlsProtocolCode = 0x01c0
+
+func init() {
+	if ma.ProtocolWithName("tls").Code != 0 {
+		return
+	}
+	err := ma.AddProtocol(ma.Protocol{
+		Name:  "tls",
+		Code:  tlsProtocolCode,
+		VCode: ma.CodeToVarint(tlsProtocolCode),
+	})
+	if err != nil {
+		log.Errorf("failed to register the /tls multiaddr protocol: %s", err)
+	}
+}
+
+// SplitTLS strips a trailing /tls from addr, reporting whether it was there.
+// The returned address is the one to listen on or dial.
+//
+// /unix takes the rest of the address as its path, so /unix/tmp/api.sock/tls
+// is the socket /tmp/api.sock/tls: the suffix is taken out of the path.
+func SplitTLS(addr ma.Multiaddr) (ma.Multiaddr, bool) {
+	rest, last := ma.SplitLast(addr)
+	if last == nil {
+		return addr, false
+	}
+	if last.Protocol().Code == ma.P_UNIX {
+		sock := strings.TrimSuffix(last.Value(), "/tls")
+		if sock == last.Value() || strings.Trim(sock, "/") == "" {
+			return addr, false
+		}
+		c, err := ma.NewComponent(last.Protocol().Name, sock)
+		if err != nil {
+			return addr, false
+		}
+		if rest == nil {
+			return c, true
+		}
+		return rest.Encapsulate(c), true
+	}
+	if rest == nil || last.Protocol().Name != "tls" {
+		return addr, false
+	}
+	return rest, true
+}
+
+// NewTLSConfig returns a server TLS configuration serving the certificate
+// described by c. The certificate, key and client CAs are reloaded whenever
+// their files change, until closing is closed.
+func NewTLSConfig(c TLSListenerConfig, repoRoot string, closing <-chan struct{}) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls: CertFile and KeyFile must be set")
+	}
+	r := &certReloader{
+		certFile: resolvePath(repoRoot, c.CertFile),
+		keyFile:  resolvePath(repoRoot, c.KeyFile),
+	}
+	if c.ClientCAFile != "" {
+		r.caFile = resolvePath(repoRoot, c.ClientCAFile)
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	if err := r.watch(closing); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}, nil
+}
+
+// TLSServerName returns the name a client verifies when it dials addr over
+// TLS: the host of addr, or for listeners without one, such as unix sockets,
+// the first name in the certificate of c, or "localhost".
+func TLSServerName(addr ma.Multiaddr, c TLSListenerConfig, repoRoot string) string {
+	for _, code := range []int{ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_IP4, ma.P_IP6} {
+		if host, err := addr.ValueForProtocol(code); err == nil {
+			return host
+		}
+	}
+
+	if c.CertFile != "" {
+		if name := certName(resolvePath(repoRoot, c.CertFile)); name != "" {
+			return name
+		}
+	}
+	return "localhost"
+}
+
+// certName returns the first DNS name or IP address of the certificate in
+// file, or "" if it cannot be read.
+func certName(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	default:
+		return ""
+	}
+}
+
+func resolvePath(root, p string) string {
+	if filepath.IsAbs(p) || root == "" {
+		return p
+	}
+	return filepath.Join(root, p)
+}
+
+// certReloader keeps the TLS configuration in sync with the files on disk.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	lk   sync.RWMutex
+	conf *tls.Config
+}
+
+func (r *certReloader) current() *tls.Config {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	return r.conf
+}
+
+// reload loads the files and swaps in the new configuration. On failure the
+// previous configuration stays in use.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: loading certificate: %s", err)
+	}
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("tls: loading client CAs: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates found in %s", r.caFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.lk.Lock()
+	r.conf = conf
+	r.lk.Unlock()
+	return nil
+}
+
+// watch reloads the configuration when one of the files changes. It watches
+// the parent directories rather than the files, so that certificates
+// replaced by a rename or a symlink swap are picked up as well.
+func (r *certReloader) watch(closing <-chan struct{}) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		files[filepath.Clean(f)] = true
+		dirs[filepath.Dir(f)] = true
+	}
+	for d := range dirs {
+		if err := w.Add(d); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-closing:
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// kubernetes style secret mounts swap a "..data" symlink
+				if !files[filepath.Clean(e.Name)] && !strings.HasPrefix(filepath.Base(e.Name), "..") {
+					continue
+				}
+				if err := r.reload(); err != nil {
+					// most likely the files are still being written
+					log.Debugf("keeping the previous certificate: %s", err)
+					continue
+				}
+				log.Infof("reloaded TLS certificate %s", r.certFile)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("watching TLS certificates: %s", err)
+			}
+		}
+	}()
+	return nil
+}
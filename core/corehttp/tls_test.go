@@ -0,0 +1,271 @@
+package corehttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// writeTestCert writes a self-signed certificate, usable as a CA, to
+// dir/name.crt and dir/name.key.
+func writeTestCert(t *testing.T, dir, name string, serial int64) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	// write through a rename, like certificate renewal tools do
+	for file, data := range map[string][]byte{name + ".key": keyPEM, name + ".crt": certPEM} {
+		tmp := filepath.Join(dir, "."+file+".tmp")
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// handshake connects a client to a server using conf and returns the serial
+// of the server certificate.
+func handshake(conf *tls.Config, client *tls.Config) (*big.Int, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	srv := tls.Server(s, conf)
+	go srv.Handshake()
+
+	cli := tls.Client(c, client)
+	if err := cli.Handshake(); err != nil {
+		return nil, err
+	}
+	// the server rejects client certificates after the client finished
+	// its side of the handshake, so make a round trip.
+	go srv.Write([]byte{1})
+	if _, err := cli.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return cli.ConnectionState().PeerCertificates[0].SerialNumber, nil
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCert(t, dir, "server", 1)
+
+	closing := make(chan struct{})
+	defer close(closing)
+	// relative paths are resolved against the repo root
+	conf, err := NewTLSConfig(TLSListenerConfig{CertFile: "server.crt", KeyFile: "server.key"}, dir, closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &tls.Config{InsecureSkipVerify: true}
+	serial, err := handshake(conf, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Int64() != 1 {
+		t.Fatalf("expected serial 1, got %s", serial)
+	}
+
+	writeTestCert(t, dir, "server", 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		serial, err := handshake(conf, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Int64() == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCert(t, dir, "server", 1)
+	clientCert := writeTestCert(t, dir, "client", 2)
+	writeTestCert(t, dir, "other", 3)
+
+	closing := make(chan struct{})
+	defer close(closing)
+	conf, err := NewTLSConfig(TLSListenerConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "client.crt"),
+	}, "", closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handshake(conf, &tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("client without a certificate was accepted")
+	}
+
+	other, err := tls.LoadX509KeyPair(filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(conf, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{other}}); err == nil {
+		t.Fatal("client with an untrusted certificate was accepted")
+	}
+
+	if _, err := handshake(conf, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitTLS(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+		secure     bool
+	}{
+		{"/ip4/127.0.0.1/tcp/5001/tls", "/ip4/127.0.0.1/tcp/5001", true},
+		{"/ip4/127.0.0.1/tcp/5001", "/ip4/127.0.0.1/tcp/5001", false},
+		{"/unix/tmp/api.sock/tls", "/unix/tmp/api.sock", true},
+		{"/unix/tmp/api.sock", "/unix/tmp/api.sock", false},
+		{"/unix/tmp/tls.sock", "/unix/tmp/tls.sock", false},
+		// a socket named tls
+		{"/unix/tls", "/unix/tls", false},
+	} {
+		addr, secure := SplitTLS(ma.StringCast(tc.addr))
+		if secure != tc.secure || !addr.Equal(ma.StringCast(tc.want)) {
+			t.Errorf("%s: unexpected split: %s %t", tc.addr, addr, secure)
+		}
+	}
+	// the socket path is dialed as written
+	addr, _ := SplitTLS(ma.StringCast("/unix/tmp/api.sock/tls"))
+	if p, err := addr.ValueForProtocol(ma.P_UNIX); err != nil || p != "/tmp/api.sock" {
+		t.Fatalf("unexpected socket path %q, %v", p, err)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", 1)
+	withCert := TLSListenerConfig{CertFile: "server.crt", KeyFile: "server.key"}
+
+	for _, tc := range []struct {
+		addr string
+		conf TLSListenerConfig
+		want string
+	}{
+		{"/ip4/127.0.0.1/tcp/5001", withCert, "127.0.0.1"},
+		{"/dns4/api.example.com/tcp/5001", withCert, "api.example.com"},
+		{"/unix/tmp/api.sock", withCert, "localhost"},
+		{"/unix/tmp/api.sock", TLSListenerConfig{}, "localhost"},
+		{"/unix/tmp/api.sock", TLSListenerConfig{CertFile: "missing.crt"}, "localhost"},
+	} {
+		if got := TLSServerName(ma.StringCast(tc.addr), tc.conf, dir); got != tc.want {
+			t.Errorf("%s: got %q, expected %q", tc.addr, got, tc.want)
+		}
+	}
+
+	// a client dialing the unix socket verifies the certificate
+	sock := filepath.Join(dir, "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	closing := make(chan struct{})
+	defer close(closing)
+	conf, err := NewTLSConfig(withCert, dir, closing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		srv := tls.Server(c, conf)
+		if srv.Handshake() == nil {
+			srv.Write([]byte{1})
+		}
+	}()
+
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cli := tls.Client(c, &tls.Config{
+		RootCAs:    roots,
+		ServerName: TLSServerName(ma.StringCast("/unix"+sock), withCert, dir),
+	})
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
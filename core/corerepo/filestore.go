@@ -0,0 +1,556 @@
+package corerepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	bserv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	filestore "github.com/ipfs/go-filestore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// FilestoreWatchConfigKey is the config section holding the
+// FilestoreWatchConfig.
+const FilestoreWatchConfigKey = "FilestoreWatch"
+
+// FilestoreWatchConfig configures the filestore watcher.
+type FilestoreWatchConfig struct {
+	// Enabled watches the files referenced by the filestore while the
+	// daemon runs.
+	Enabled bool
+
+	// Settle is how long a file must stay untouched after a change before
+	// it is checked, and how long a removed file may take to reappear
+	// elsewhere before it is considered gone.
+	Settle string
+
+	// RescanInterval is how often the filestore is listed again to watch
+	// the files added since.
+	RescanInterval string
+}
+
+// Defaults for the FilestoreWatchConfig fields left unset.
+const (
+	DefaultFilestoreSettle         = 2 * time.Second
+	DefaultFilestoreRescanInterval = 5 * time.Minute
+)
+
+// FilestoreWatchLabel is the label put on the pins of files re-added by the
+// filestore watcher.
+const FilestoreWatchLabel = "filestore-watch"
+
+// FilestoreRoot returns the directory the filestore paths are relative to.
+func FilestoreRoot(r repo.Repo) (string, error) {
+	fr, ok := r.(*fsrepo.FSRepo)
+	if !ok {
+		return "", errors.New("the filestore needs an fs-repo")
+	}
+	return filepath.Dir(fr.Path()), nil
+}
+
+// FilestoreGC removes the filestore entries whose backing file is gone or
+// changed. Every entry is verified again with the GC lock held, so no entry
+// repaired or re-added meanwhile is dropped. Entries of blocks that are still
+// pinned are kept, so pins never lose blocks. With dryRun, entries are only
+// reported.
+func FilestoreGC(ctx context.Context, n *core.IpfsNode, dryRun bool, out func(*filestore.ListRes) error) error {
+	fs := n.Filestore
+	if fs == nil {
+		return filestore.ErrFilestoreNotEnabled
+	}
+
+	next, err := filestore.VerifyAll(fs, true)
+	if err != nil {
+		return err
+	}
+	var dead []cid.Cid
+	for r := next(); r != nil; r = next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isDeadEntry(r.Status) {
+			dead = append(dead, r.Key)
+		}
+	}
+	if len(dead) == 0 {
+		return nil
+	}
+
+	defer n.Blockstore.GCLock().Unlock()
+	pinned, err := pinnedBlocks(ctx, n)
+	if err != nil {
+		return err
+	}
+	for _, c := range dead {
+		r := filestore.Verify(fs, c)
+		if !isDeadEntry(r.Status) {
+			continue
+		}
+		if pinned.Has(c) {
+			log.Infof("filestore gc: keeping %s, it is still pinned", c)
+			continue
+		}
+		if !dryRun {
+			if err := fs.FileManager().DeleteBlock(c); err != nil {
+				return err
+			}
+		}
+		if err := out(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinnedBlocks returns the blocks reachable from the pins of n, reading only
+// local blocks. Blocks that cannot be read, such as dead filestore entries,
+// are included but not walked.
+func pinnedBlocks(ctx context.Context, n *core.IpfsNode) (*cid.Set, error) {
+	dserv := dag.NewDAGService(bserv.New(n.Blockstore, offline.Exchange(n.Blockstore)))
+	getLinks := func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		links, err := ipld.GetLinks(ctx, dserv, c)
+		if err != nil {
+			return nil, nil
+		}
+		return links, nil
+	}
+
+	set := cid.NewSet()
+	rkeys, err := n.Pinning.RecursiveKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := gc.Descendants(ctx, getLinks, set, rkeys); err != nil {
+		return nil, err
+	}
+	dkeys, err := n.Pinning.DirectKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range dkeys {
+		set.Add(k)
+	}
+	return set, nil
+}
+
+func isDeadEntry(s filestore.Status) bool {
+	return s == filestore.StatusFileNotFound || s == filestore.StatusFileChanged
+}
+
+// filestoreEntry is a block stored by reference.
+type filestoreEntry struct {
+	key    cid.Cid
+	offset uint64
+	size   uint64
+}
+
+// FilestoreWatcher follows the files referenced by the filestore. When a
+// file is moved within the watched directories, its entries are pointed to
+// the new location if the content still matches. When a file is modified,
+// it is added again and the new version pinned. If the previous version was
+// pinned by the watcher, that pin is moved to the new version.
+type FilestoreWatcher struct {
+	n      *core.IpfsNode
+	fs     *filestore.Filestore
+	root   string
+	settle time.Duration
+	rescan time.Duration
+	w      *fsnotify.Watcher
+
+	lk      sync.Mutex
+	files   map[string][]filestoreEntry // by absolute path
+	dirs    map[string]struct{}
+	removed map[string]time.Time // files gone, waiting for a matching create
+	changed map[string]time.Time // files written, by last write
+}
+
+// NewFilestoreWatcher returns a watcher for the filestore of n.
+func NewFilestoreWatcher(n *core.IpfsNode, cfg FilestoreWatchConfig) (*FilestoreWatcher, error) {
+	if n.Filestore == nil {
+		return nil, filestore.ErrFilestoreNotEnabled
+	}
+	root, err := FilestoreRoot(n.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &FilestoreWatcher{
+		n:       n,
+		fs:      n.Filestore,
+		root:    root,
+		settle:  DefaultFilestoreSettle,
+		rescan:  DefaultFilestoreRescanInterval,
+		dirs:    make(map[string]struct{}),
+		removed: make(map[string]time.Time),
+		changed: make(map[string]time.Time),
+	}
+	if cfg.Settle != "" {
+		if fw.settle, err = time.ParseDuration(cfg.Settle); err != nil {
+			return nil, fmt.Errorf("invalid FilestoreWatch.Settle: %s", err)
+		}
+	}
+	if cfg.RescanInterval != "" {
+		if fw.rescan, err = time.ParseDuration(cfg.RescanInterval); err != nil {
+			return nil, fmt.Errorf("invalid FilestoreWatch.RescanInterval: %s", err)
+		}
+	}
+
+	if fw.settle <= 0 || fw.rescan <= 0 {
+		return nil, errors.New("FilestoreWatch durations must be positive")
+	}
+
+	if fw.w, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// Run watches the files until ctx is done.
+func (fw *FilestoreWatcher) Run(ctx context.Context) error {
+	defer fw.w.Close()
+
+	if err := fw.index(); err != nil {
+		return err
+	}
+
+	rescan := time.NewTicker(fw.rescan)
+	defer rescan.Stop()
+	tick := time.NewTicker(fw.settle / 2)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-fw.w.Events:
+			if !ok {
+				return nil
+			}
+			fw.event(ev)
+		case err, ok := <-fw.w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnf("filestore watch: %s", err)
+		case <-tick.C:
+			fw.process(ctx, time.Now())
+		case <-rescan.C:
+			if err := fw.index(); err != nil {
+				log.Errorf("filestore watch: failed to list the filestore: %s", err)
+			}
+		}
+	}
+}
+
+// index lists the filestore and watches the directories of every file.
+func (fw *FilestoreWatcher) index() error {
+	next, err := filestore.ListAll(fw.fs, true)
+	if err != nil {
+		return err
+	}
+	byFile := make(map[string][]filestoreEntry)
+	for r := next(); r != nil; r = next() {
+		if r.Status != filestore.StatusOk {
+			continue
+		}
+		p := fw.abs(r.FilePath)
+		byFile[p] = append(byFile[p], filestoreEntry{key: r.Key, offset: r.Offset, size: r.Size})
+	}
+
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+	fw.files = byFile
+	for p := range byFile {
+		fw.watchDir(filepath.Dir(p))
+	}
+	return nil
+}
+
+// watchDir watches dir unless it already is. Must be called with lk held.
+func (fw *FilestoreWatcher) watchDir(dir string) {
+	if _, ok := fw.dirs[dir]; ok {
+		return
+	}
+	if err := fw.w.Add(dir); err != nil {
+		log.Debugf("filestore watch: cannot watch %s: %s", dir, err)
+		return
+	}
+	fw.dirs[dir] = struct{}{}
+}
+
+func (fw *FilestoreWatcher) abs(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(fw.root, p)
+}
+
+func (fw *FilestoreWatcher) event(ev fsnotify.Event) {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+
+	now := time.Now()
+	_, referenced := fw.files[ev.Name]
+	switch {
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if referenced {
+			fw.removed[ev.Name] = now
+			delete(fw.changed, ev.Name)
+		}
+	case ev.Op&fsnotify.Create != 0:
+		if referenced {
+			// replaced in place, e.g. by an editor
+			delete(fw.removed, ev.Name)
+			fw.changed[ev.Name] = now
+			return
+		}
+		fw.changed[ev.Name] = now
+	case ev.Op&fsnotify.Write != 0:
+		// also follow new files still being written
+		if _, pending := fw.changed[ev.Name]; referenced || pending {
+			fw.changed[ev.Name] = now
+		}
+	}
+}
+
+// process handles the files that settled before now.
+func (fw *FilestoreWatcher) process(ctx context.Context, now time.Time) {
+	fw.lk.Lock()
+	var settled []string
+	for p, t := range fw.changed {
+		if now.Sub(t) >= fw.settle {
+			settled = append(settled, p)
+			delete(fw.changed, p)
+		}
+	}
+	fw.lk.Unlock()
+
+	for _, p := range settled {
+		fw.lk.Lock()
+		_, referenced := fw.files[p]
+		fw.lk.Unlock()
+
+		if referenced {
+			fw.refresh(ctx, p)
+		} else {
+			fw.matchMove(p)
+		}
+	}
+
+	// the files removed for longer than settle did not reappear
+	fw.lk.Lock()
+	for p, t := range fw.removed {
+		if now.Sub(t) >= 2*fw.settle {
+			log.Infof("filestore watch: %s was removed, its entries are left for 'ipfs filestore gc'", p)
+			delete(fw.removed, p)
+			delete(fw.files, p)
+		}
+	}
+	fw.lk.Unlock()
+}
+
+// matchMove points the entries of a removed file to p if p has the same
+// content.
+func (fw *FilestoreWatcher) matchMove(p string) {
+	fw.lk.Lock()
+	var candidates []string
+	for old := range fw.removed {
+		candidates = append(candidates, old)
+	}
+	fw.lk.Unlock()
+
+	for _, old := range candidates {
+		fw.lk.Lock()
+		entries := fw.files[old]
+		fw.lk.Unlock()
+
+		if len(entries) == 0 || !contentMatches(p, entries) {
+			continue
+		}
+		if err := fw.repoint(p, entries); err != nil {
+			log.Errorf("filestore watch: failed to move entries of %s to %s: %s", old, p, err)
+			return
+		}
+		log.Infof("filestore watch: %s moved to %s", old, p)
+
+		fw.lk.Lock()
+		delete(fw.removed, old)
+		delete(fw.files, old)
+		fw.files[p] = entries
+		fw.watchDir(filepath.Dir(p))
+		fw.lk.Unlock()
+		return
+	}
+}
+
+// refresh adds a modified file again if its entries no longer match.
+func (fw *FilestoreWatcher) refresh(ctx context.Context, p string) {
+	fw.lk.Lock()
+	entries := fw.files[p]
+	fw.lk.Unlock()
+
+	if contentMatches(p, entries) {
+		return // touched but unchanged
+	}
+
+	c, err := fw.add(ctx, p, fw.watchedPin(p))
+	if err != nil {
+		log.Errorf("filestore watch: failed to add changed file %s: %s", p, err)
+		return
+	}
+	log.Infof("filestore watch: %s changed, added again as %s", p, c)
+
+	// the next rescan picks up the new entries
+	fw.lk.Lock()
+	delete(fw.files, p)
+	fw.lk.Unlock()
+}
+
+// watchedPin returns the pin the watcher made for the file at p, or
+// cid.Undef.
+func (fw *FilestoreWatcher) watchedPin(p string) cid.Cid {
+	metas, err := PinMetas(fw.n.Repo.Datastore())
+	if err != nil {
+		log.Errorf("filestore watch: failed to list the pin metadata: %s", err)
+		return cid.Undef
+	}
+	for c, m := range metas {
+		if m.Name == p && m.Labels["source"] == FilestoreWatchLabel {
+			return c
+		}
+	}
+	return cid.Undef
+}
+
+// add adds the file at p by reference and pins it, naming the pin after p.
+// If old is a recursive pin, it is replaced by the new one.
+func (fw *FilestoreWatcher) add(ctx context.Context, p string, old cid.Cid) (cid.Cid, error) {
+	api, err := coreapi.NewCoreAPI(fw.n)
+	if err != nil {
+		return cid.Undef, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	f, err := files.NewSerialFile(p, false, st)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+
+	// pinned below, hold the pin lock so GC doesn't collect it meanwhile
+	defer fw.n.Blockstore.PinLock().Unlock()
+
+	rp, err := api.Unixfs().Add(ctx, f, options.Unixfs.Nocopy(true), options.Unixfs.Pin(false))
+	if err != nil {
+		return cid.Undef, err
+	}
+	c := rp.Cid()
+
+	swap := false
+	if old.Defined() && !old.Equals(c) {
+		_, swap, err = fw.n.Pinning.IsPinnedWithType(ctx, old, pin.Recursive)
+		if err != nil {
+			return cid.Undef, err
+		}
+	}
+	if swap {
+		err = fw.n.Pinning.Update(ctx, old, c, true)
+	} else {
+		var nd ipld.Node
+		if nd, err = fw.n.DAG.Get(ctx, c); err == nil {
+			err = fw.n.Pinning.Pin(ctx, nd, true)
+		}
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := fw.n.Pinning.Flush(ctx); err != nil {
+		return cid.Undef, err
+	}
+
+	ds := fw.n.Repo.Datastore()
+	if swap {
+		if err := RemovePinMeta(ds, old); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return c, PutPinMeta(ds, PinMeta{
+		Cid:       c,
+		Name:      p,
+		Labels:    map[string]string{"source": FilestoreWatchLabel},
+		Recursive: true,
+	})
+}
+
+// repoint records the entries as stored in the file at p.
+func (fw *FilestoreWatcher) repoint(p string, entries []filestoreEntry) error {
+	fm := fw.fs.FileManager()
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, e := range entries {
+		data := make([]byte, e.size)
+		if _, err := f.ReadAt(data, int64(e.offset)); err != nil {
+			return err
+		}
+		nd, err := dag.NewRawNodeWPrefix(data, e.key.Prefix())
+		if err != nil {
+			return err
+		}
+		err = fm.Put(&posinfo.FilestoreNode{
+			Node:    nd,
+			PosInfo: &posinfo.PosInfo{Offset: e.offset, FullPath: p},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentMatches reports whether every entry can be read back from the file
+// at p.
+func contentMatches(p string, entries []filestoreEntry) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	for _, e := range entries {
+		data := make([]byte, e.size)
+		if _, err := f.ReadAt(data, int64(e.offset)); err != nil {
+			return false // truncated or unreadable
+		}
+		c, err := e.key.Prefix().Sum(data)
+		if err != nil || !c.Equals(e.key) {
+			return false
+		}
+	}
+	return true
+}
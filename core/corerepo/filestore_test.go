@@ -0,0 +1,148 @@
+package corerepo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	filestore "github.com/ipfs/go-filestore"
+	config "github.com/ipfs/go-ipfs-config"
+	files "github.com/ipfs/go-ipfs-files"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// newFilestoreNode returns a node with the filestore enabled, referencing
+// the files in a temporary directory.
+func newFilestoreNode(t *testing.T) (*core.IpfsNode, *FilestoreWatcher) {
+	t.Helper()
+	dir := t.TempDir()
+	ds := syncds.MutexWrap(datastore.NewMapDatastore())
+	fm := filestore.NewFileManager(ds, dir)
+	fm.AllowFiles = true
+
+	cfg := config.Config{
+		Identity: config.Identity{
+			PeerID: testPeerID, // required by offline node
+		},
+	}
+	cfg.Experimental.FilestoreEnabled = true
+	n, err := core.NewNode(context.Background(), &core.BuildCfg{Repo: &repo.Mock{C: cfg, D: ds, F: fm}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+
+	return n, &FilestoreWatcher{
+		n:     n,
+		fs:    n.Filestore,
+		root:  dir,
+		files: make(map[string][]filestoreEntry),
+	}
+}
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pinType(t *testing.T, n *core.IpfsNode, c cid.Cid) (string, bool) {
+	t.Helper()
+	mode, ok, err := n.Pinning.IsPinned(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mode, ok
+}
+
+func TestFilestoreRefreshSwapsPin(t *testing.T) {
+	ctx := context.Background()
+	n, fw := newFilestoreNode(t)
+	ds := n.Repo.Datastore()
+
+	p := filepath.Join(fw.root, "watched.txt")
+	writeFile(t, p, "first version")
+	first, err := fw.add(ctx, p, cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.index(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, p, "second version")
+	fw.refresh(ctx, p)
+
+	second := fw.watchedPin(p)
+	if !second.Defined() || second.Equals(first) {
+		t.Fatalf("the changed file was not pinned again: %s", second)
+	}
+	if _, ok := pinType(t, n, first); ok {
+		t.Fatal("the previous version is still pinned")
+	}
+	if mode, ok := pinType(t, n, second); !ok || mode != pin.Recursive.String() {
+		t.Fatalf("the new version is not pinned recursively: %q", mode)
+	}
+	if _, err := GetPinMeta(ds, first); err != datastore.ErrNotFound {
+		t.Fatalf("metadata of the previous version was kept: %v", err)
+	}
+}
+
+func TestFilestoreGCKeepsPinned(t *testing.T) {
+	ctx := context.Background()
+	n, fw := newFilestoreNode(t)
+	api, err := coreapi.NewCoreAPI(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(name string, pinned bool) cid.Cid {
+		t.Helper()
+		p := filepath.Join(fw.root, name)
+		writeFile(t, p, name)
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := files.NewSerialFile(p, false, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rp, err := api.Unixfs().Add(ctx, f, options.Unixfs.Nocopy(true), options.Unixfs.RawLeaves(true), options.Unixfs.Pin(pinned))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the entry no longer matches the file
+		writeFile(t, p, "changed "+name)
+		return rp.Cid()
+	}
+	pinned := add("pinned.txt", true)
+	unpinned := add("unpinned.txt", false)
+
+	removed := map[cid.Cid]bool{}
+	err = FilestoreGC(ctx, n, false, func(r *filestore.ListRes) error {
+		removed[r.Key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !removed[unpinned] {
+		t.Fatalf("unexpected removed entries: %v", removed)
+	}
+	if has, _ := n.Filestore.FileManager().Has(pinned); !has {
+		t.Fatal("the entry of a pinned block was removed")
+	}
+}
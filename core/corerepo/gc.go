@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/ipfs/go-ipfs/core"
@@ -84,11 +85,13 @@ func BestEffortRoots(filesRoot *mfs.Root) ([]cid.Cid, error) {
 }
 
 func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
-	roots, err := BestEffortRoots(n.FilesRoot)
+	roots, err := BestEffortRoots(n.Files())
 	if err != nil {
 		return err
 	}
-	rmed := gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots)
+	rmed := gc.GCWithOptions(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots, gc.Options{
+		Sources: RetentionSources(n),
+	})
 
 	return CollectResult(ctx, rmed, nil)
 }
@@ -97,6 +100,12 @@ func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
 // given callback for each object removed.  It also collects all errors into a
 // MultiError which is returned after the gc is completed.
 func CollectResult(ctx context.Context, gcOut <-chan gc.Result, cb func(cid.Cid)) error {
+	return CollectResultWithRetained(ctx, gcOut, cb, nil)
+}
+
+// CollectResultWithRetained is like CollectResult, additionally calling
+// retained for every root the run reports as kept.
+func CollectResultWithRetained(ctx context.Context, gcOut <-chan gc.Result, cb func(cid.Cid), retained func(cid.Cid, string)) error {
 	var errors []error
 loop:
 	for {
@@ -109,6 +118,8 @@ loop:
 				errors = append(errors, res.Error)
 			} else if res.KeyRemoved.Defined() && cb != nil {
 				cb(res.KeyRemoved)
+			} else if res.KeyRetained.Defined() && retained != nil {
+				retained(res.KeyRetained, res.Reason)
 			}
 		case <-ctx.Done():
 			errors = append(errors, ctx.Err())
@@ -148,15 +159,22 @@ func (e *MultiError) Error() string {
 }
 
 func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result {
-	roots, err := BestEffortRoots(n.FilesRoot)
+	return GarbageCollectWithOptions(n, ctx, gc.Options{})
+}
+
+// GarbageCollectWithOptions starts a garbage collection run honoring the
+// node's retention sources in addition to the ones in opts.
+func GarbageCollectWithOptions(n *core.IpfsNode, ctx context.Context, opts gc.Options) <-chan gc.Result {
+	roots, err := BestEffortRoots(n.Files())
 	if err != nil {
-		out := make(chan gc.Result)
+		out := make(chan gc.Result, 1)
 		out <- gc.Result{Error: err}
 		close(out)
 		return out
 	}
 
-	return gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots)
+	opts.Sources = append(RetentionSources(n), opts.Sources...)
+	return gc.GCWithOptions(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots, opts)
 }
 
 func PeriodicGC(ctx context.Context, node *core.IpfsNode) error {
@@ -225,3 +243,82 @@ func (gc *GC) maybeGC(ctx context.Context, offset uint64) error {
 	}
 	return nil
 }
+
+// ErrGCRunning is returned when a concurrent garbage collection is started
+// while another one is running on the same node.
+var ErrGCRunning = errors.New("a concurrent garbage collection is already running")
+
+// ErrNoGCRunning is returned when pausing or resuming a node that has no
+// concurrent garbage collection running.
+var ErrNoGCRunning = errors.New("no concurrent garbage collection is running")
+
+var (
+	concurrentLk  sync.Mutex
+	concurrentGCs = make(map[*core.IpfsNode]*gc.Control)
+)
+
+// ConcurrentGarbageCollect starts a garbage collection run that does not
+// block writes while marking. The run can be paused and resumed with PauseGC
+// and ResumeGC. Only one concurrent run is allowed per node.
+func ConcurrentGarbageCollect(n *core.IpfsNode, ctx context.Context, opts gc.ConcurrentOptions) (<-chan gc.Result, error) {
+	concurrentLk.Lock()
+	defer concurrentLk.Unlock()
+	if _, ok := concurrentGCs[n]; ok {
+		return nil, ErrGCRunning
+	}
+
+	if opts.Control == nil {
+		opts.Control = gc.NewControl()
+	}
+	opts.Roots = func(context.Context) ([]cid.Cid, error) {
+		return BestEffortRoots(n.Files())
+	}
+	opts.Sources = append(RetentionSources(n), opts.Sources...)
+
+	concurrentGCs[n] = opts.Control
+	res := gc.Concurrent(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, opts)
+
+	out := make(chan gc.Result, cap(res))
+	go func() {
+		defer close(out)
+		defer func() {
+			concurrentLk.Lock()
+			delete(concurrentGCs, n)
+			concurrentLk.Unlock()
+		}()
+		for r := range res {
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				// keep draining so the run can wind down
+			}
+		}
+	}()
+	return out, nil
+}
+
+// PauseGC pauses the concurrent garbage collection running on n.
+func PauseGC(n *core.IpfsNode) error {
+	c := runningGC(n)
+	if c == nil {
+		return ErrNoGCRunning
+	}
+	c.Pause()
+	return nil
+}
+
+// ResumeGC resumes the concurrent garbage collection running on n.
+func ResumeGC(n *core.IpfsNode) error {
+	c := runningGC(n)
+	if c == nil {
+		return ErrNoGCRunning
+	}
+	c.Resume()
+	return nil
+}
+
+func runningGC(n *core.IpfsNode) *gc.Control {
+	concurrentLk.Lock()
+	defer concurrentLk.Unlock()
+	return concurrentGCs[n]
+}
@@ -0,0 +1,201 @@
+package corerepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	pin "github.com/ipfs/go-ipfs-pinner"
+)
+
+// pinMetaPrefix is the datastore namespace holding the metadata of local pins.
+var pinMetaPrefix = datastore.NewKey("/local/pins/meta")
+
+// PinExpiryInterval is how often PeriodicPinExpiry looks for expired pins.
+const PinExpiryInterval = time.Minute
+
+// PinMeta describes a local pin. The pinner only knows about CIDs, so names,
+// labels and expiry are kept next to it in the datastore.
+type PinMeta struct {
+	Cid       cid.Cid           `json:"-"`
+	Name      string            `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	Expires   time.Time
+	Recursive bool
+}
+
+// Expired reports whether the pin has an expiry that is not after now.
+func (m PinMeta) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// Matches reports whether the pin has the given name, when not empty, and
+// carries every one of the given labels.
+func (m PinMeta) Matches(name string, labels map[string]string) bool {
+	if name != "" && m.Name != name {
+		return false
+	}
+	for k, v := range labels {
+		if got, ok := m.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func pinMetaKey(c cid.Cid) datastore.Key {
+	return pinMetaPrefix.ChildString(c.String())
+}
+
+// PutPinMeta records the metadata of a pin, replacing any previous one.
+func PutPinMeta(ds datastore.Datastore, m PinMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ds.Put(pinMetaKey(m.Cid), b)
+}
+
+// RecordPinMeta records the metadata given when adding the pin on m.Cid.
+// pinned tells whether it was already pinned before. The name and labels
+// are kept when m has none. A pin added without expiry becomes permanent,
+// while a pin that was already permanent stays so even when an expiry is
+// given.
+func RecordPinMeta(ds datastore.Datastore, m PinMeta, pinned bool) error {
+	old, err := GetPinMeta(ds, m.Cid)
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		if m.Name == "" && len(m.Labels) == 0 && (pinned || m.Expires.IsZero()) {
+			return nil
+		}
+		old = PinMeta{Cid: m.Cid}
+	default:
+		return err
+	}
+
+	if m.Name == "" {
+		m.Name = old.Name
+	}
+	if len(m.Labels) == 0 {
+		m.Labels = old.Labels
+	}
+	if pinned && old.Expires.IsZero() {
+		m.Expires = time.Time{}
+	}
+	return PutPinMeta(ds, m)
+}
+
+// GetPinMeta returns the metadata of the pin on c, or datastore.ErrNotFound.
+func GetPinMeta(ds datastore.Datastore, c cid.Cid) (PinMeta, error) {
+	b, err := ds.Get(pinMetaKey(c))
+	if err != nil {
+		return PinMeta{}, err
+	}
+	m := PinMeta{Cid: c}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return PinMeta{}, fmt.Errorf("invalid pin metadata for %s: %s", c, err)
+	}
+	return m, nil
+}
+
+// RemovePinMeta drops the metadata of the pin on c, if any.
+func RemovePinMeta(ds datastore.Datastore, c cid.Cid) error {
+	return ds.Delete(pinMetaKey(c))
+}
+
+// PinMetas returns the metadata of every pin that has some, keyed by CID.
+func PinMetas(ds datastore.Datastore) (map[cid.Cid]PinMeta, error) {
+	res, err := ds.Query(dsq.Query{Prefix: pinMetaPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make(map[cid.Cid]PinMeta, len(entries))
+	for _, e := range entries {
+		k := datastore.RawKey(e.Key)
+		c, err := cid.Decode(k.BaseNamespace())
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin metadata key %s: %s", k, err)
+		}
+		m := PinMeta{Cid: c}
+		if err := json.Unmarshal(e.Value, &m); err != nil {
+			return nil, fmt.Errorf("invalid pin metadata for %s: %s", c, err)
+		}
+		metas[c] = m
+	}
+	return metas, nil
+}
+
+// RemoveExpiredPins unpins every pin whose expiry has passed at now and
+// returns the CIDs it unpinned. A pin that fails to be removed is logged
+// and left for the next pass.
+func RemoveExpiredPins(ctx context.Context, n *core.IpfsNode, now time.Time) ([]cid.Cid, error) {
+	ds := n.Repo.Datastore()
+	metas, err := PinMetas(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []PinMeta
+	for _, m := range metas {
+		if m.Expired(now) {
+			expired = append(expired, m)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	defer n.Blockstore.PinLock().Unlock()
+
+	var removed []cid.Cid
+	for _, m := range expired {
+		err := n.Pinning.Unpin(ctx, m.Cid, m.Recursive)
+		switch err {
+		case nil:
+			removed = append(removed, m.Cid)
+		case pin.ErrNotPinned:
+			// removed by other means, only the metadata is left
+		default:
+			log.Errorf("failed to remove expired pin %s: %s", m.Cid, err)
+			continue
+		}
+		if err := RemovePinMeta(ds, m.Cid); err != nil {
+			log.Errorf("failed to remove the metadata of expired pin %s: %s", m.Cid, err)
+		}
+	}
+	return removed, n.Pinning.Flush(ctx)
+}
+
+// PeriodicPinExpiry removes expired pins every PinExpiryInterval until ctx
+// is done.
+func PeriodicPinExpiry(ctx context.Context, n *core.IpfsNode) {
+	ticker := time.NewTicker(PinExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := RemoveExpiredPins(ctx, n, time.Now())
+			for _, c := range removed {
+				log.Infof("removed expired pin %s", c)
+			}
+			if err != nil {
+				log.Errorf("failed to remove expired pins: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package corerepo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	config "github.com/ipfs/go-ipfs-config"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+const testPeerID = "QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe"
+
+func newTestNode(t *testing.T) *core.IpfsNode {
+	t.Helper()
+	r := &repo.Mock{
+		C: config.Config{
+			Identity: config.Identity{
+				PeerID: testPeerID, // required by offline node
+			},
+		},
+		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+	}
+	n, err := core.NewNode(context.Background(), &core.BuildCfg{Repo: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestRecordPinMeta(t *testing.T) {
+	ds := datastore.NewMapDatastore()
+	c := dag.NewRawNode([]byte("pinned")).Cid()
+	later := time.Now().Add(time.Hour)
+
+	expires := func() time.Time {
+		t.Helper()
+		m, err := GetPinMeta(ds, c)
+		if err == datastore.ErrNotFound {
+			return time.Time{}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Expires
+	}
+
+	// an expiry on a pin that already exists without one is ignored
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Expires: later, Recursive: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !expires().IsZero() {
+		t.Fatal("a permanent pin was given an expiry")
+	}
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Name: "site", Expires: later, Recursive: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !expires().IsZero() {
+		t.Fatal("a permanent pin with a name was given an expiry")
+	}
+
+	// a new pin gets its expiry, and keeps its name
+	if err := RemovePinMeta(ds, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Name: "site", Recursive: true}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Expires: later, Recursive: true}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !expires().Equal(later) {
+		t.Fatal("expiry was not recorded")
+	}
+
+	// re-adding it with another expiry replaces it, without one clears it
+	sooner := later.Add(-time.Minute)
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Expires: sooner, Recursive: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !expires().Equal(sooner) {
+		t.Fatal("expiry was not updated")
+	}
+	if err := RecordPinMeta(ds, PinMeta{Cid: c, Recursive: true}, true); err != nil {
+		t.Fatal(err)
+	}
+	if !expires().IsZero() {
+		t.Fatal("a plain re-add did not clear the expiry")
+	}
+	m, err := GetPinMeta(ds, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "site" {
+		t.Fatalf("name was not kept: %q", m.Name)
+	}
+}
+
+func TestRemoveExpiredPins(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+	ds := n.Repo.Datastore()
+	now := time.Now()
+
+	var nodes []ipld.Node
+	for _, s := range []string{"expired", "expired too", "failing", "unexpired", "unpinned"} {
+		nd := dag.NewRawNode([]byte(s))
+		if err := n.DAG.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, nd)
+	}
+	expired, expired2, failing, unexpired, unpinned := nodes[0], nodes[1], nodes[2], nodes[3], nodes[4]
+
+	for _, nd := range nodes[:4] {
+		if err := n.Pinning.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Pinning.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []PinMeta{
+		{Cid: expired.Cid(), Expires: now.Add(-time.Minute), Recursive: true},
+		{Cid: expired2.Cid(), Expires: now.Add(-time.Second), Recursive: true},
+		// recorded as direct, unpinning it fails
+		{Cid: failing.Cid(), Expires: now.Add(-time.Minute)},
+		{Cid: unexpired.Cid(), Expires: now.Add(time.Hour), Recursive: true},
+		{Cid: unpinned.Cid(), Expires: now.Add(-time.Minute), Recursive: true},
+	} {
+		if err := PutPinMeta(ds, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := RemoveExpiredPins(ctx, n, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[cid.Cid]bool{}
+	for _, c := range removed {
+		got[c] = true
+	}
+	if len(got) != 2 || !got[expired.Cid()] || !got[expired2.Cid()] {
+		t.Fatalf("unexpected removed pins: %v", removed)
+	}
+
+	pinned := func(nd ipld.Node) bool {
+		t.Helper()
+		_, ok, err := n.Pinning.IsPinned(ctx, nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if pinned(expired) || pinned(expired2) {
+		t.Fatal("expired pin is still pinned")
+	}
+	if !pinned(failing) || !pinned(unexpired) {
+		t.Fatal("pin that was not removed is gone")
+	}
+
+	metas, err := PinMetas(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 {
+		t.Fatalf("expected the metadata of the failed and unexpired pins only, got %v", metas)
+	}
+	if _, ok := metas[failing.Cid()]; !ok {
+		t.Fatal("metadata of the pin that failed to be removed is gone")
+	}
+}
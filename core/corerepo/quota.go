@@ -0,0 +1,251 @@
+package corerepo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/repo"
+
+	bserv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs-backup/backup"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+var errStopEviction = errors.New("enough space freed")
+
+// QuotaStat reports the usage of the storage quotas, or nil if they are not
+// enforced.
+func QuotaStat(n *core.IpfsNode) *gc.QuotaStat {
+	q := gc.QuotaOf(n.Blockstore)
+	if q == nil {
+		return nil
+	}
+	st := q.Stat()
+	return &st
+}
+
+// RefreshQuota classifies every block of the repo: the content pinned or
+// reachable from MFS and its snapshots is user content, the content
+// retained for the network is backup content, and the rest is cache.
+func RefreshQuota(ctx context.Context, n *core.IpfsNode) error {
+	q := gc.QuotaOf(n.Blockstore)
+	if q == nil {
+		return nil
+	}
+	classify, err := quotaClassifier(ctx, n)
+	if err != nil {
+		return err
+	}
+	return q.Refresh(ctx, n.BaseBlocks, classify)
+}
+
+// PeriodicQuota classifies the blocks of the repo at the configured
+// interval, enforcing the storage quotas from the first classification on.
+// Backup replicas are recognized as soon as they are written, and the
+// content of the oldest expired leases is evicted once the cache is
+// exhausted. Before evicting, the blocks are classified again, so that the
+// content pinned or retained since the last classification is kept.
+func PeriodicQuota(ctx context.Context, n *core.IpfsNode) error {
+	q := gc.QuotaOf(n.Blockstore)
+	if q == nil {
+		return nil
+	}
+	var cfg gc.QuotaConfig
+	if err := repo.ConfigSection(n.Repo, gc.QuotaConfigKey, &cfg); err != nil {
+		return err
+	}
+	interval, err := cfg.RefreshEvery()
+	if err != nil {
+		return err
+	}
+
+	ds := n.Repo.Datastore()
+	q.SetHint(func(c cid.Cid) (gc.QuotaClass, bool) {
+		for _, k := range backupKeys(c) {
+			if _, err := backup.Get(ds, k); err == nil {
+				return gc.QuotaBackup, true
+			}
+		}
+		if ok, _ := isReplica(ds, c); ok {
+			return gc.QuotaBackup, true
+		}
+		return "", false
+	})
+	q.SetEvictor(expiredLeaseEvictor(n))
+	q.SetGuard(func(ctx context.Context) (func(cid.Cid) (gc.QuotaClass, bool), error) {
+		return quotaClassifier(ctx, n)
+	})
+
+	for {
+		start := time.Now()
+		if err := RefreshQuota(ctx, n); err != nil && ctx.Err() == nil {
+			log.Errorf("storage quota refresh: %s", err)
+		}
+		log.Debugf("storage quota refresh took %s", time.Since(start))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// offlineDAG reads the local blocks only.
+func offlineDAG(n *core.IpfsNode) ipld.DAGService {
+	return dag.NewDAGService(bserv.New(n.Blockstore, offline.Exchange(n.Blockstore)))
+}
+
+// bestEffortLinks walks the blocks present locally and ignores the others.
+func bestEffortLinks(ng ipld.NodeGetter) dag.GetLinks {
+	return func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		links, err := ipld.GetLinks(ctx, ng, c)
+		if err != nil {
+			return nil, nil
+		}
+		return links, nil
+	}
+}
+
+func quotaClassifier(ctx context.Context, n *core.IpfsNode) (func(cid.Cid) (gc.QuotaClass, bool), error) {
+	ng := offlineDAG(n)
+	roots, err := BestEffortRoots(n.Files())
+	if err != nil {
+		return nil, err
+	}
+	// the MFS snapshots are user content too
+	snapshots, err := FilesSnapshots(n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		roots = append(roots, s.Cid)
+	}
+
+	// missing blocks are reported on the output, they don't matter here
+	output := make(chan gc.Result)
+	go func() {
+		for range output {
+		}
+	}()
+	pinned, err := gc.ColoredSet(ctx, n.Pinning, ng, roots, output)
+	close(output)
+	if err != nil {
+		return nil, err
+	}
+
+	retention := NewBackupRetention(n.Repo.Datastore())
+	backupRoots, err := activeBackupRoots(n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	backups := cid.NewSet()
+	if err := gc.Descendants(ctx, bestEffortLinks(ng), backups, backupRoots); err != nil {
+		return nil, err
+	}
+
+	// the blockstore lists the blocks by multihash
+	classes := make(map[string]gc.QuotaClass)
+	_ = backups.ForEach(func(c cid.Cid) error {
+		classes[string(c.Hash())] = gc.QuotaBackup
+		return nil
+	})
+	_ = pinned.ForEach(func(c cid.Cid) error {
+		classes[string(c.Hash())] = gc.QuotaUser
+		return nil
+	})
+
+	return func(c cid.Cid) (gc.QuotaClass, bool) {
+		if class, ok := classes[string(c.Hash())]; ok {
+			return class, true
+		}
+		// when in doubt, keep the block out of the cache
+		if ok, err := retention.Retains(ctx, c); err != nil || ok {
+			return gc.QuotaBackup, true
+		}
+		return "", false
+	}, nil
+}
+
+// expiredLeaseEvictor proposes the blocks of the expired leases, the oldest
+// lease first, except the blocks still retained for the network. The lease
+// is dropped once all its blocks are evicted.
+func expiredLeaseEvictor(n *core.IpfsNode) gc.QuotaEvictor {
+	return func(ctx context.Context, evict func(cid.Cid) bool) error {
+		ds := n.Repo.Datastore()
+		leases, err := gc.ExpiredLeases(ds, time.Now())
+		if err != nil || len(leases) == 0 {
+			return err
+		}
+
+		ng := offlineDAG(n)
+		retention := NewBackupRetention(ds)
+		keepRoots, err := activeBackupRoots(ds)
+		if err != nil {
+			return err
+		}
+		keep := cid.NewSet()
+		if err := gc.Descendants(ctx, bestEffortLinks(ng), keep, keepRoots); err != nil {
+			return err
+		}
+
+		for _, l := range leases {
+			blocks := cid.NewSet()
+			if err := gc.Descendants(ctx, bestEffortLinks(ng), blocks, []cid.Cid{l.Root}); err != nil {
+				return err
+			}
+			err := blocks.ForEach(func(c cid.Cid) error {
+				if keep.Has(c) {
+					return nil
+				}
+				if ok, err := retention.Retains(ctx, c); err != nil || ok {
+					return err
+				}
+				if evict(c) {
+					return errStopEviction
+				}
+				return nil
+			})
+			switch err {
+			case nil:
+				// a GC run may have dropped it meanwhile
+				if err := gc.RemoveLease(ds, l.Root); err != nil && err != datastore.ErrNotFound {
+					return err
+				}
+			case errStopEviction:
+				return nil
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// activeBackupRoots returns the roots retained for the network. Unlike the
+// GC, it leaves the expired leases in place for expiredLeaseEvictor.
+func activeBackupRoots(ds datastore.Datastore) ([]cid.Cid, error) {
+	chainFiles, err := (&backupRetention{ds: ds}).chainFileRoots()
+	if err != nil {
+		return nil, err
+	}
+	leases, err := gc.ActiveLeases(ds, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]cid.Cid, 0, len(chainFiles)+len(leases))
+	for _, r := range chainFiles {
+		roots = append(roots, r.Root)
+	}
+	for _, l := range leases {
+		roots = append(roots, l.Root)
+	}
+	return roots, nil
+}
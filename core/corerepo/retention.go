@@ -0,0 +1,140 @@
+package corerepo
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/gc"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ipfs-backup/backup"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ChainFileKeyPrefix is the datastore namespace recording the chain files
+// this node pulled to store them on behalf of the network.
+const ChainFileKeyPrefix = "fileExist/"
+
+// RetentionSources returns the retention sources every GC run of n honors.
+func RetentionSources(n *core.IpfsNode) []gc.RetentionSource {
+	ds := n.Repo.Datastore()
+	return []gc.RetentionSource{NewBackupRetention(ds), NewSnapshotRetention(ds)}
+}
+
+type backupRetention struct {
+	ds  datastore.Datastore
+	now func() time.Time
+}
+
+// NewBackupRetention returns the retention source keeping the content this
+// node stores for the blockchain: the chain files it pulled, the roots under
+// an active lease, such as the files it allocated backups for, and the
+// replicas pulled from other peers. Retains also checks the backup datastore
+// for the blocks recorded before the allocated files were leased.
+func NewBackupRetention(ds datastore.Datastore) gc.RetentionSource {
+	return &backupRetention{ds: ds, now: time.Now}
+}
+
+func (r *backupRetention) Name() string {
+	return "backup"
+}
+
+func (r *backupRetention) Roots(ctx context.Context) ([]gc.Retained, error) {
+	roots, err := r.chainFileRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	// expired leases are left to the quota evictor, which drops them along
+	// with their blocks
+	leases, err := gc.ActiveLeases(r.ds, r.now())
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range leases {
+		reason := "lease held by " + l.Holder
+		if !l.Expires.IsZero() {
+			reason += " until " + l.Expires.Format(time.RFC3339)
+		}
+		roots = append(roots, gc.Retained{Root: l.Root, Reason: reason})
+	}
+	return roots, nil
+}
+
+// chainFileRoots returns the roots of the chain files pulled by the node.
+func (r *backupRetention) chainFileRoots() ([]gc.Retained, error) {
+	res, err := r.ds.Query(dsq.Query{Prefix: "/" + ChainFileKeyPrefix, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []gc.Retained
+	for _, e := range entries {
+		// keys are the chain file paths, with or without the /ipfs prefix
+		for _, seg := range strings.Split(strings.TrimPrefix(e.Key, "/"+ChainFileKeyPrefix), "/") {
+			if c, err := cid.Decode(seg); err == nil {
+				roots = append(roots, gc.Retained{Root: c, Reason: "chain file"})
+				break
+			}
+		}
+	}
+	return roots, nil
+}
+
+func (r *backupRetention) Blocks(ctx context.Context) ([]cid.Cid, error) {
+	return backupsync.Replicas(r.ds)
+}
+
+func (r *backupRetention) Retains(ctx context.Context, k cid.Cid) (bool, error) {
+	for _, key := range backupKeys(k) {
+		_, err := backup.Get(r.ds, key)
+		switch err {
+		case nil:
+			return true, nil
+		case datastore.ErrNotFound:
+		default:
+			return false, err
+		}
+	}
+	return isReplica(r.ds, k)
+}
+
+// isReplica tells whether k was pulled from another peer as a backup
+// replica.
+func isReplica(ds datastore.Datastore, k cid.Cid) (bool, error) {
+	for _, key := range backupKeys(k) {
+		c, err := cid.Decode(key)
+		if err != nil {
+			continue
+		}
+		if ok, err := backupsync.HasReplica(ds, c); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// backupKeys returns the keys the backup datastore may record c under. The
+// blockstore only knows the multihash of a block, while backups are recorded
+// under the CID the block was added with.
+func backupKeys(c cid.Cid) []string {
+	keys := []string{c.String()}
+	if c.Prefix().MhType == mh.SHA2_256 {
+		keys = append(keys, cid.NewCidV0(c.Hash()).String())
+	}
+	for _, codec := range []uint64{cid.DagProtobuf, cid.Raw} {
+		if k := cid.NewCidV1(codec, c.Hash()); !k.Equals(c) {
+			keys = append(keys, k.String())
+		}
+	}
+	return keys
+}
@@ -0,0 +1,134 @@
+package corerepo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/gc"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bserv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ipfs-backup/backup"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// retentionDAG adds a root linking to a leaf and returns both.
+func retentionDAG(t *testing.T, dserv ipld.DAGService, name string) (root, leaf ipld.Node) {
+	t.Helper()
+	l := dag.NewRawNode([]byte(name + " leaf"))
+	r := dag.NodeWithData([]byte(name))
+	if err := r.AddNodeLink("leaf", l); err != nil {
+		t.Fatal(err)
+	}
+	if err := dserv.AddMany(context.Background(), []ipld.Node{r, l}); err != nil {
+		t.Fatal(err)
+	}
+	return r, l
+}
+
+func TestGCKeepsBackupRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := syncds.MutexWrap(datastore.NewMapDatastore())
+	bs := bstore.NewGCBlockstore(bstore.NewBlockstore(ds), bstore.NewGCLocker())
+	dserv := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	pinner, err := dspinner.New(ctx, ds, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainRoot, chainLeaf := retentionDAG(t, dserv, "chain file")
+	if err := ds.Put(datastore.NewKey(ChainFileKeyPrefix+"/ipfs/"+chainRoot.Cid().String()), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	leaseRoot, leaseLeaf := retentionDAG(t, dserv, "allocated file")
+	if err := gc.PutLease(ds, gc.Lease{Root: leaseRoot.Cid(), Holder: "backup test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiredRoot, expiredLeaf := retentionDAG(t, dserv, "expired lease")
+	if err := gc.PutLease(ds, gc.Lease{Root: expiredRoot.Cid(), Holder: "test", Expires: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a partial replica: its parent was allocated to another peer
+	replicaParent, replica := retentionDAG(t, dserv, "replica")
+	if err := backupsync.PutReplicas(ds, []cid.Cid{replica.Cid()}, backupsync.Replica{Source: "peer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// recorded in the backup datastore only, as before the allocated files
+	// were leased
+	recorded := dag.NewRawNode([]byte("recorded backup"))
+	if err := dserv.Add(ctx, recorded); err != nil {
+		t.Fatal(err)
+	}
+	load := bsmsg.Load{TargetPeerList: []string{"peer"}, Block: recorded}
+	if _, err := backup.AddFileBackupInfo(ds, []bsmsg.Load{load}, "uid", uint64(len(recorded.RawData()))); err != nil {
+		t.Fatal(err)
+	}
+
+	garbage := dag.NewRawNode([]byte("garbage"))
+	if err := dserv.Add(ctx, garbage); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := map[cid.Cid]bool{}
+	reasons := map[cid.Cid]string{}
+	out := gc.GCWithOptions(ctx, bs, ds, pinner, nil, gc.Options{
+		Sources:        []gc.RetentionSource{NewBackupRetention(ds)},
+		ReportRetained: true,
+	})
+	for res := range out {
+		switch {
+		case res.Error != nil:
+			t.Fatal(res.Error)
+		case res.KeyRemoved.Defined():
+			removed[res.KeyRemoved] = true
+		case res.KeyRetained.Defined():
+			reasons[res.KeyRetained] = res.Reason
+		}
+	}
+
+	for _, nd := range []ipld.Node{chainRoot, chainLeaf, leaseRoot, leaseLeaf, replica, recorded} {
+		if removed[nd.Cid()] {
+			t.Errorf("retained block %s was removed", nd.Cid())
+		}
+	}
+	for _, nd := range []ipld.Node{expiredRoot, expiredLeaf, replicaParent, garbage} {
+		if !removed[nd.Cid()] {
+			t.Errorf("block %s was kept", nd.Cid())
+		}
+	}
+
+	for c, want := range map[cid.Cid]string{
+		chainRoot.Cid(): "backup: chain file",
+		leaseRoot.Cid(): "backup: lease held by backup test",
+		replica.Cid():   "backup",
+		recorded.Cid():  "backup",
+	} {
+		if reasons[c] != want {
+			t.Errorf("%s retained for %q, expected %q", c, reasons[c], want)
+		}
+	}
+
+	// marking leaves the expired leases to the quota evictor
+	expired, err := gc.ExpiredLeases(ds, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || !expired[0].Root.Equals(expiredRoot.Cid()) {
+		t.Fatalf("expected the expired lease to remain, got %v", expired)
+	}
+}
@@ -0,0 +1,455 @@
+package corerepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs-backup/backup"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ScrubConfigKey is the config section holding the ScrubConfig.
+const ScrubConfigKey = "Scrub"
+
+// ScrubConfig configures the background scrubber.
+type ScrubConfig struct {
+	// Enabled runs a scrub pass every Interval while the daemon runs.
+	Enabled bool
+
+	// Interval is the time between the start of two passes.
+	Interval string
+
+	// BlocksPerSecond limits how fast blocks are rehashed.
+	BlocksPerSecond float64
+
+	// RepairTimeout bounds the time spent fetching a good copy of a block,
+	// from the backup peers and then from the network.
+	RepairTimeout string
+}
+
+// Defaults for the ScrubConfig fields left unset.
+const (
+	DefaultScrubInterval        = 7 * 24 * time.Hour
+	DefaultScrubBlocksPerSecond = 100
+	DefaultScrubRepairTimeout   = time.Minute
+)
+
+// ErrScrubRunning is returned when a scrub pass is started while another
+// one is running on the same node.
+var ErrScrubRunning = errors.New("a scrub is already running")
+
+var (
+	scrubStatusKey      = datastore.NewKey("/local/scrub/status")
+	scrubQuarantineKey  = datastore.NewKey("/local/scrub/quarantine")
+	scrubMaxRepairs     = 100
+	scrubSaveEvery      = uint64(1000)
+	scrubBackupPeerWait = 30 * time.Second
+)
+
+// ScrubStatus is the persistent report of the scrubber.
+type ScrubStatus struct {
+	Running  bool
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+
+	Checked  uint64
+	Corrupt  uint64
+	Repaired uint64
+	Failed   uint64
+
+	// Error is the error that ended the pass early, if any.
+	Error string `json:",omitempty"`
+
+	// Repairs lists the most recent corrupt blocks, newest last.
+	Repairs []ScrubRepair `json:",omitempty"`
+}
+
+// ScrubRepair records what happened to a corrupt block.
+type ScrubRepair struct {
+	Cid    string
+	Time   time.Time
+	Source string `json:",omitempty"` // where the good copy came from
+	Error  string `json:",omitempty"` // why it could not be repaired
+}
+
+// ScrubConfigFromRepo reads the scrubber configuration, applying defaults.
+func ScrubConfigFromRepo(r repo.Repo) (ScrubConfig, error) {
+	var cfg ScrubConfig
+	if err := repo.ConfigSection(r, ScrubConfigKey, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.BlocksPerSecond <= 0 {
+		cfg.BlocksPerSecond = DefaultScrubBlocksPerSecond
+	}
+	return cfg, nil
+}
+
+func (c ScrubConfig) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return DefaultScrubInterval, nil
+	}
+	return time.ParseDuration(c.Interval)
+}
+
+func (c ScrubConfig) repairTimeout() (time.Duration, error) {
+	if c.RepairTimeout == "" {
+		return DefaultScrubRepairTimeout, nil
+	}
+	return time.ParseDuration(c.RepairTimeout)
+}
+
+// GetScrubStatus returns the report of the last or current scrub pass. It
+// is empty if the repo was never scrubbed.
+func GetScrubStatus(ds datastore.Datastore) (ScrubStatus, error) {
+	var st ScrubStatus
+	b, err := ds.Get(scrubStatusKey)
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return st, nil
+	default:
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, fmt.Errorf("invalid scrub status: %s", err)
+	}
+	return st, nil
+}
+
+func putScrubStatus(ds datastore.Datastore, st ScrubStatus) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ds.Put(scrubStatusKey, b)
+}
+
+var (
+	scrubLk   sync.Mutex
+	scrubbing = make(map[*core.IpfsNode]bool)
+)
+
+// Scrub rehashes every block of the repo at the configured rate. Corrupt
+// blocks are moved to a quarantine namespace of the datastore and fetched
+// again, first from the peers holding a backup of them and then from the
+// network. Progress is saved as a ScrubStatus while the pass runs.
+func Scrub(ctx context.Context, n *core.IpfsNode, cfg ScrubConfig) error {
+	if err := acquireScrub(n); err != nil {
+		return err
+	}
+	defer releaseScrub(n)
+	return scrub(ctx, n, cfg)
+}
+
+// StartScrub runs a scrub pass in the background.
+func StartScrub(ctx context.Context, n *core.IpfsNode, cfg ScrubConfig) error {
+	if err := acquireScrub(n); err != nil {
+		return err
+	}
+	go func() {
+		defer releaseScrub(n)
+		if err := scrub(ctx, n, cfg); err != nil && err != ctx.Err() {
+			log.Errorf("scrub failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+func acquireScrub(n *core.IpfsNode) error {
+	scrubLk.Lock()
+	defer scrubLk.Unlock()
+	if scrubbing[n] {
+		return ErrScrubRunning
+	}
+	scrubbing[n] = true
+	return nil
+}
+
+func releaseScrub(n *core.IpfsNode) {
+	scrubLk.Lock()
+	defer scrubLk.Unlock()
+	delete(scrubbing, n)
+}
+
+func scrub(ctx context.Context, n *core.IpfsNode, cfg ScrubConfig) error {
+	repairTimeout, err := cfg.repairTimeout()
+	if err != nil {
+		return fmt.Errorf("invalid Scrub.RepairTimeout: %s", err)
+	}
+
+	ds := n.Repo.Datastore()
+	prev, err := GetScrubStatus(ds)
+	if err != nil {
+		return err
+	}
+	st := ScrubStatus{
+		Running: true,
+		Started: time.Now(),
+		Repairs: prev.Repairs,
+	}
+	if err := putScrubStatus(ds, st); err != nil {
+		return err
+	}
+
+	repair := func(ctx context.Context, c cid.Cid) (string, error) {
+		return repairBlock(ctx, n, c, repairTimeout)
+	}
+	err = scrubPass(ctx, n, cfg.BlocksPerSecond, repair, &st)
+	st.Running = false
+	st.Finished = time.Now()
+	if err != nil {
+		st.Error = err.Error()
+	}
+	if perr := putScrubStatus(ds, st); perr != nil && err == nil {
+		err = perr
+	}
+	return err
+}
+
+// repairFunc stores a good copy of the block c in place of a corrupt one,
+// and returns where it came from.
+type repairFunc func(ctx context.Context, c cid.Cid) (string, error)
+
+func scrubPass(ctx context.Context, n *core.IpfsNode, rate float64, repair repairFunc, st *ScrubStatus) error {
+	ds := n.Repo.Datastore()
+
+	// read the raw data, regardless of Datastore.HashOnRead
+	bs := bstore.NewBlockstore(ds)
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	every := time.Duration(float64(time.Second) / rate)
+	if every <= 0 {
+		every = time.Nanosecond
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for c := range keys {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		st.Checked++
+		if st.Checked%scrubSaveEvery == 0 {
+			if err := putScrubStatus(ds, *st); err != nil {
+				return err
+			}
+		}
+
+		blk, err := bs.Get(c)
+		if err != nil {
+			continue // removed meanwhile
+		}
+		if ok, err := blockIntact(blk); err != nil || ok {
+			continue
+		}
+
+		log.Warnf("scrub: block %s is corrupt", c)
+		st.Corrupt++
+		rep := ScrubRepair{Cid: c.String(), Time: time.Now()}
+		if src, err := quarantine(ctx, n, blk, repair); err != nil {
+			rep.Error = err.Error()
+			st.Failed++
+		} else {
+			rep.Source = src
+			st.Repaired++
+		}
+		st.Repairs = append(st.Repairs, rep)
+		if len(st.Repairs) > scrubMaxRepairs {
+			st.Repairs = st.Repairs[len(st.Repairs)-scrubMaxRepairs:]
+		}
+		if err := putScrubStatus(ds, *st); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// blockIntact rehashes the data of a block.
+func blockIntact(blk blocks.Block) (bool, error) {
+	c, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		return false, err
+	}
+	return c.Equals(blk.Cid()), nil
+}
+
+// quarantine moves the corrupt data of a block aside, so that repair can
+// store a good copy, and returns where the copy came from. The quarantined
+// data is only dropped once the new copy is verified. Otherwise it is kept,
+// and the block is left missing rather than corrupt.
+func quarantine(ctx context.Context, n *core.IpfsNode, blk blocks.Block, repair repairFunc) (string, error) {
+	c := blk.Cid()
+	ds := n.Repo.Datastore()
+	qkey := scrubQuarantineKey.ChildString(c.String())
+	if err := ds.Put(qkey, blk.RawData()); err != nil {
+		return "", err
+	}
+	if err := n.Blockstore.DeleteBlock(c); err != nil {
+		return "", err
+	}
+
+	src, err := repair(ctx, c)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyBlock(ds, c); err != nil {
+		if derr := n.Blockstore.DeleteBlock(c); derr != nil && derr != bstore.ErrNotFound {
+			log.Warnf("scrub: failed to remove bad copy of %s: %s", c, derr)
+		}
+		return "", fmt.Errorf("copy from %s: %s", src, err)
+	}
+
+	if err := ds.Delete(qkey); err != nil {
+		log.Warnf("scrub: failed to drop quarantined copy of %s: %s", c, err)
+	}
+	return src, nil
+}
+
+// verifyBlock rehashes the stored data of c.
+func verifyBlock(ds repo.Datastore, c cid.Cid) error {
+	blk, err := bstore.NewBlockstore(ds).Get(c)
+	if err != nil {
+		return err
+	}
+	ok, err := blockIntact(blk)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("block is still corrupt")
+	}
+	return nil
+}
+
+// repairBlock fetches a good copy of c, preferring the peers recorded as
+// holding a backup of it, and returns where it came from.
+func repairBlock(ctx context.Context, n *core.IpfsNode, c cid.Cid, timeout time.Duration) (string, error) {
+	if !n.IsOnline {
+		return "", errors.New("node is offline, cannot fetch a good copy")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if key, connected := connectBackupPeers(ctx, n, c); len(connected) > 0 {
+		// the replicas are restored over graphsync from the peers they
+		// were pushed to
+		if n.BackupSync != nil {
+			for _, pid := range connected {
+				bctx, bcancel := context.WithTimeout(ctx, scrubBackupPeerWait)
+				_, err := n.BackupSync.Restore(bctx, pid, backupsync.Root{Cid: key})
+				bcancel()
+				if err == nil {
+					return "backup peer " + pid.Pretty(), nil
+				}
+				log.Debugf("scrub: cannot restore %s from %s: %s", c, pid, err)
+			}
+		}
+
+		bctx, bcancel := context.WithTimeout(ctx, scrubBackupPeerWait)
+		blk, err := n.Exchange.GetBlock(bctx, c)
+		bcancel()
+		if err == nil {
+			return "backup peers", n.Blockstore.Put(blk)
+		}
+	}
+
+	blk, err := n.Exchange.GetBlock(ctx, c)
+	if err != nil {
+		return "", err
+	}
+	return "bitswap", n.Blockstore.Put(blk)
+}
+
+// connectBackupPeers connects to the peers the backup datastore records as
+// holding c and returns the ones reached, along with the CID the backup was
+// recorded under.
+func connectBackupPeers(ctx context.Context, n *core.IpfsNode, c cid.Cid) (cid.Cid, []peer.ID) {
+	var names []string
+	key := c
+	for _, k := range backupKeys(c) {
+		info, err := backup.Get(n.Repo.Datastore(), k)
+		if err != nil {
+			continue
+		}
+		for name := range info.TargetPeerList {
+			names = append(names, name)
+		}
+		if kc, err := cid.Decode(k); err == nil {
+			key = kc
+		}
+		break
+	}
+
+	var connected []peer.ID
+	for _, name := range names {
+		pid, err := peer.Decode(name)
+		if err != nil || pid == n.Identity {
+			continue
+		}
+		if err := n.PeerHost.Connect(ctx, peer.AddrInfo{ID: pid}); err != nil {
+			log.Debugf("scrub: cannot reach backup peer %s: %s", pid, err)
+			continue
+		}
+		connected = append(connected, pid)
+	}
+	return key, connected
+}
+
+// PeriodicScrub runs a scrub pass every configured interval until ctx is
+// done. A pass interrupted by a restart is reported as such.
+func PeriodicScrub(ctx context.Context, n *core.IpfsNode, cfg ScrubConfig) error {
+	interval, err := cfg.interval()
+	if err != nil {
+		return fmt.Errorf("invalid Scrub.Interval: %s", err)
+	}
+
+	ds := n.Repo.Datastore()
+	st, err := GetScrubStatus(ds)
+	if err != nil {
+		return err
+	}
+	if st.Running {
+		st.Running = false
+		st.Error = "interrupted"
+		if err := putScrubStatus(ds, st); err != nil {
+			return err
+		}
+	}
+
+	// resume the schedule from the last pass
+	wait := time.Until(st.Started.Add(interval))
+	for {
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		if err := Scrub(ctx, n, cfg); err != nil && err != ctx.Err() {
+			log.Errorf("scrub failed: %s", err)
+		}
+		wait = interval
+	}
+}
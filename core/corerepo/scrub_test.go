@@ -0,0 +1,105 @@
+package corerepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+func TestScrubPass(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+	ds := n.Repo.Datastore()
+	raw := bstore.NewBlockstore(ds)
+
+	intact := blocks.NewBlock([]byte("intact"))
+	repairable := blocks.NewBlock([]byte("repairable"))
+	unavailable := blocks.NewBlock([]byte("unavailable"))
+	badCopy := blocks.NewBlock([]byte("bad copy"))
+
+	if err := n.Blockstore.Put(intact); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := map[cid.Cid][]byte{}
+	for _, b := range []blocks.Block{repairable, unavailable, badCopy} {
+		data := []byte("bit rot of " + b.Cid().String())
+		bad, err := blocks.NewBlockWithCid(data, b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := raw.Put(bad); err != nil {
+			t.Fatal(err)
+		}
+		corrupt[b.Cid()] = data
+	}
+
+	repaired := map[cid.Cid]bool{}
+	repair := func(ctx context.Context, c cid.Cid) (string, error) {
+		repaired[c] = true
+		switch {
+		case c.Equals(repairable.Cid()):
+			return "test", n.Blockstore.Put(repairable)
+		case c.Equals(badCopy.Cid()):
+			bad, _ := blocks.NewBlockWithCid([]byte("still bad"), c)
+			return "test", n.Blockstore.Put(bad)
+		default:
+			return "", errors.New("no copy found")
+		}
+	}
+
+	var st ScrubStatus
+	if err := scrubPass(ctx, n, 1e6, repair, &st); err != nil {
+		t.Fatal(err)
+	}
+	// the node stores the MFS root as well
+	if st.Checked < 4 || st.Corrupt != 3 || st.Repaired != 1 || st.Failed != 2 {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	if repaired[intact.Cid()] {
+		t.Fatal("an intact block was repaired")
+	}
+	if len(st.Repairs) != 3 {
+		t.Fatalf("expected 3 repairs recorded, got %d", len(st.Repairs))
+	}
+	for _, r := range st.Repairs {
+		ok := r.Error == ""
+		if want := r.Cid == repairable.Cid().String(); ok != want {
+			t.Errorf("repair of %s: unexpected result %+v", r.Cid, r)
+		}
+	}
+
+	quarantined := func(c cid.Cid) []byte {
+		t.Helper()
+		data, err := ds.Get(scrubQuarantineKey.ChildString(c.String()))
+		if err == datastore.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// the repaired block is intact and its quarantined copy dropped
+	if err := verifyBlock(ds, repairable.Cid()); err != nil {
+		t.Fatalf("repaired block: %s", err)
+	}
+	if quarantined(repairable.Cid()) != nil {
+		t.Fatal("quarantined copy of a repaired block was kept")
+	}
+
+	// failed repairs keep the corrupt data aside, and no bad block
+	for _, b := range []blocks.Block{unavailable, badCopy} {
+		if string(quarantined(b.Cid())) != string(corrupt[b.Cid()]) {
+			t.Errorf("corrupt data of %s was not quarantined", b.Cid())
+		}
+		if has, _ := raw.Has(b.Cid()); has {
+			t.Errorf("block %s that could not be repaired is still stored", b.Cid())
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package corerepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/repo"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+)
+
+// FilesSnapshotConfigKey is the config section holding the
+// FilesSnapshotConfig.
+const FilesSnapshotConfigKey = "FilesSnapshot"
+
+// FilesSnapshotConfig configures the automatic snapshots of the MFS root.
+type FilesSnapshotConfig struct {
+	// Enabled takes a snapshot every Interval while the daemon runs, if the
+	// MFS root changed since the last snapshot.
+	Enabled bool
+
+	// Interval is the time between two automatic snapshots.
+	Interval string
+
+	// Keep is the number of automatic snapshots kept, the most recent ones.
+	// Zero keeps them all.
+	Keep int
+
+	// MaxAge drops the automatic snapshots older than it, except the most
+	// recent one. Empty keeps them regardless of age.
+	MaxAge string
+}
+
+// Defaults for the FilesSnapshotConfig fields left unset.
+const (
+	DefaultFilesSnapshotInterval = time.Hour
+)
+
+// autoSnapshotPrefix starts the names of the automatic snapshots, and of the
+// snapshots taken before a restore.
+const (
+	autoSnapshotPrefix       = "auto-"
+	preRestoreSnapshotPrefix = "pre-restore-"
+	snapshotTimeFormat       = "20060102T150405Z"
+)
+
+var snapshotPrefix = datastore.NewKey("/local/filesroot-snapshots")
+
+var (
+	// ErrSnapshotExists is returned when a snapshot is created under a name
+	// already in use.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+
+	// ErrSnapshotNotFound is returned for a snapshot name that is not known.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// snapshotLk serializes the changes to the snapshots and the MFS root swaps.
+var snapshotLk sync.Mutex
+
+// FilesSnapshot is a recorded MFS root.
+type FilesSnapshot struct {
+	Name    string `json:"-"`
+	Cid     cid.Cid
+	Created time.Time
+	Auto    bool `json:",omitempty"`
+
+	// Pinned is set on the snapshots taken by earlier versions, which
+	// pinned their root when it was not pinned already. Such a pin is
+	// removed with the last snapshot of the root. Snapshots are now kept by
+	// their own retention source instead.
+	Pinned bool `json:",omitempty"`
+}
+
+func snapshotKey(name string) datastore.Key {
+	return snapshotPrefix.ChildString(name)
+}
+
+func validSnapshotName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+func putSnapshot(ds datastore.Datastore, s FilesSnapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ds.Put(snapshotKey(s.Name), b)
+}
+
+// GetFilesSnapshot returns the snapshot called name, or ErrSnapshotNotFound.
+func GetFilesSnapshot(ds datastore.Datastore, name string) (FilesSnapshot, error) {
+	if err := validSnapshotName(name); err != nil {
+		return FilesSnapshot{}, err
+	}
+	b, err := ds.Get(snapshotKey(name))
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return FilesSnapshot{}, ErrSnapshotNotFound
+	default:
+		return FilesSnapshot{}, err
+	}
+	s := FilesSnapshot{Name: name}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return FilesSnapshot{}, fmt.Errorf("invalid snapshot %s: %s", name, err)
+	}
+	return s, nil
+}
+
+// FilesSnapshots returns the snapshots of the MFS root, oldest first.
+func FilesSnapshots(ds datastore.Datastore) ([]FilesSnapshot, error) {
+	res, err := ds.Query(dsq.Query{Prefix: snapshotPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]FilesSnapshot, 0, len(entries))
+	for _, e := range entries {
+		s := FilesSnapshot{Name: datastore.RawKey(e.Key).BaseNamespace()}
+		if err := json.Unmarshal(e.Value, &s); err != nil {
+			return nil, fmt.Errorf("invalid snapshot %s: %s", s.Name, err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// CreateFilesSnapshot flushes the MFS root and records it under name. The
+// snapshot retention source keeps it from GC. An empty name is generated
+// from the time.
+func CreateFilesSnapshot(ctx context.Context, n *core.IpfsNode, name string) (FilesSnapshot, error) {
+	snapshotLk.Lock()
+	defer snapshotLk.Unlock()
+	return createSnapshot(ctx, n, name, false, time.Now())
+}
+
+func createSnapshot(ctx context.Context, n *core.IpfsNode, name string, auto bool, now time.Time) (FilesSnapshot, error) {
+	if name == "" {
+		name = now.UTC().Format(snapshotTimeFormat)
+		if auto {
+			name = autoSnapshotPrefix + name
+		}
+	}
+	if err := validSnapshotName(name); err != nil {
+		return FilesSnapshot{}, err
+	}
+	ds := n.Repo.Datastore()
+	switch _, err := GetFilesSnapshot(ds, name); err {
+	case nil:
+		return FilesSnapshot{}, ErrSnapshotExists
+	case ErrSnapshotNotFound:
+	default:
+		return FilesSnapshot{}, err
+	}
+
+	nd, err := mfs.FlushPath(ctx, n.Files(), "/")
+	if err != nil {
+		return FilesSnapshot{}, err
+	}
+	s := FilesSnapshot{Name: name, Cid: nd.Cid(), Created: now, Auto: auto}
+
+	// a GC run reads the snapshots once, record it before or after the run
+	defer n.Blockstore.PinLock().Unlock()
+	if err := putSnapshot(ds, s); err != nil {
+		return FilesSnapshot{}, err
+	}
+	return s, nil
+}
+
+// RemoveFilesSnapshot drops the snapshot called name. The root pinned by a
+// snapshot of an earlier version is unpinned, unless another snapshot
+// records it.
+func RemoveFilesSnapshot(ctx context.Context, n *core.IpfsNode, name string) error {
+	snapshotLk.Lock()
+	defer snapshotLk.Unlock()
+	return removeSnapshot(ctx, n, name)
+}
+
+func removeSnapshot(ctx context.Context, n *core.IpfsNode, name string) error {
+	ds := n.Repo.Datastore()
+	s, err := GetFilesSnapshot(ds, name)
+	if err != nil {
+		return err
+	}
+	if err := ds.Delete(snapshotKey(name)); err != nil {
+		return err
+	}
+	if !s.Pinned {
+		return nil
+	}
+
+	snapshots, err := FilesSnapshots(ds)
+	if err != nil {
+		return err
+	}
+	for _, other := range snapshots {
+		if other.Cid.Equals(s.Cid) {
+			// the pin goes with the remaining snapshot
+			other.Pinned = true
+			return putSnapshot(ds, other)
+		}
+	}
+
+	defer n.Blockstore.PinLock().Unlock()
+	if err := n.Pinning.Unpin(ctx, s.Cid, true); err != nil && err != pin.ErrNotPinned {
+		return err
+	}
+	return n.Pinning.Flush(ctx)
+}
+
+// RestoreFilesSnapshot makes the snapshot called name the MFS root. The root
+// it replaces is first recorded in a snapshot of its own, which is returned.
+//
+// The swap is atomic: the MFS operations running meanwhile complete against
+// the replaced root, which is then flushed and closed, and are dropped with
+// it.
+func RestoreFilesSnapshot(ctx context.Context, n *core.IpfsNode, name string) (FilesSnapshot, error) {
+	snapshotLk.Lock()
+	defer snapshotLk.Unlock()
+
+	ds := n.Repo.Datastore()
+	s, err := GetFilesSnapshot(ds, name)
+	if err != nil {
+		return FilesSnapshot{}, err
+	}
+	rnd, err := n.DAG.Get(ctx, s.Cid)
+	if err != nil {
+		return FilesSnapshot{}, err
+	}
+	nd, ok := rnd.(*dag.ProtoNode)
+	if !ok {
+		return FilesSnapshot{}, dag.ErrNotProtobuf
+	}
+
+	now := time.Now()
+	prev, err := createSnapshot(ctx, n, preRestoreSnapshotPrefix+now.UTC().Format(snapshotTimeFormat), false, now)
+	if err != nil {
+		return FilesSnapshot{}, fmt.Errorf("recording the current root: %s", err)
+	}
+
+	old, err := n.FilesRoots.Replace(n.Context(), nd)
+	if err != nil {
+		return prev, err
+	}
+	if err := old.Flush(); err != nil {
+		log.Warnf("flushing the replaced MFS root: %s", err)
+	}
+	if err := old.Close(); err != nil {
+		log.Warnf("closing the replaced MFS root: %s", err)
+	}
+	return prev, nil
+}
+
+// PruneFilesSnapshots drops the automatic snapshots beyond the ones cfg
+// keeps at now, and returns the names of the dropped snapshots.
+func PruneFilesSnapshots(ctx context.Context, n *core.IpfsNode, cfg FilesSnapshotConfig, now time.Time) ([]string, error) {
+	snapshotLk.Lock()
+	defer snapshotLk.Unlock()
+
+	snapshots, err := FilesSnapshots(n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	expired, err := expiredSnapshots(snapshots, cfg, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, name := range expired {
+		if err := removeSnapshot(ctx, n, name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// expiredSnapshots returns the automatic snapshots, oldest first, that cfg
+// does not keep at now. The most recent one is always kept.
+func expiredSnapshots(snapshots []FilesSnapshot, cfg FilesSnapshotConfig, now time.Time) ([]string, error) {
+	var maxAge time.Duration
+	if cfg.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(cfg.MaxAge); err != nil {
+			return nil, fmt.Errorf("invalid %s.MaxAge: %s", FilesSnapshotConfigKey, err)
+		}
+	}
+
+	var auto []FilesSnapshot
+	for _, s := range snapshots {
+		if s.Auto {
+			auto = append(auto, s)
+		}
+	}
+
+	var expired []string
+	for i, s := range auto {
+		newer := len(auto) - 1 - i
+		if newer == 0 {
+			break
+		}
+		if (cfg.Keep > 0 && newer >= cfg.Keep) || (maxAge > 0 && now.Sub(s.Created) > maxAge) {
+			expired = append(expired, s.Name)
+		}
+	}
+	return expired, nil
+}
+
+// PeriodicFilesSnapshot snapshots the MFS root every cfg.Interval when it
+// changed since the last snapshot, and prunes the automatic snapshots.
+func PeriodicFilesSnapshot(ctx context.Context, n *core.IpfsNode, cfg FilesSnapshotConfig) error {
+	interval := DefaultFilesSnapshotInterval
+	if cfg.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(cfg.Interval); err != nil {
+			return fmt.Errorf("invalid %s.Interval: %s", FilesSnapshotConfigKey, err)
+		}
+	}
+	if _, err := expiredSnapshots(nil, cfg, time.Now()); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		s, err := autoSnapshot(ctx, n)
+		switch {
+		case err != nil:
+			log.Errorf("automatic MFS snapshot: %s", err)
+		case s != nil:
+			log.Infof("created MFS snapshot %s of %s", s.Name, s.Cid)
+		}
+
+		removed, err := PruneFilesSnapshots(ctx, n, cfg, time.Now())
+		for _, name := range removed {
+			log.Infof("removed MFS snapshot %s", name)
+		}
+		if err != nil {
+			log.Errorf("pruning MFS snapshots: %s", err)
+		}
+	}
+}
+
+// autoSnapshot takes an automatic snapshot, unless the MFS root is the one
+// of the most recent snapshot.
+func autoSnapshot(ctx context.Context, n *core.IpfsNode) (*FilesSnapshot, error) {
+	snapshotLk.Lock()
+	defer snapshotLk.Unlock()
+
+	nd, err := mfs.FlushPath(ctx, n.Files(), "/")
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := FilesSnapshots(n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 && snapshots[len(snapshots)-1].Cid.Equals(nd.Cid()) {
+		return nil, nil
+	}
+
+	s, err := createSnapshot(ctx, n, "", true, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+type snapshotRetention struct {
+	ds datastore.Datastore
+}
+
+// NewSnapshotRetention returns the retention source keeping the roots of
+// the MFS snapshots, and their descendants.
+func NewSnapshotRetention(ds datastore.Datastore) gc.RetentionSource {
+	return &snapshotRetention{ds: ds}
+}
+
+func (r *snapshotRetention) Name() string {
+	return "snapshot"
+}
+
+func (r *snapshotRetention) Roots(ctx context.Context) ([]gc.Retained, error) {
+	snapshots, err := FilesSnapshots(r.ds)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]gc.Retained, 0, len(snapshots))
+	for _, s := range snapshots {
+		roots = append(roots, gc.Retained{Root: s.Cid, Reason: s.Name})
+	}
+	return roots, nil
+}
+
+func (r *snapshotRetention) Blocks(ctx context.Context) ([]cid.Cid, error) {
+	return nil, nil
+}
+
+// Retains only knows the roots: the descendants of a snapshot taken during a
+// run are the ones of the MFS root, which the run keeps anyway.
+func (r *snapshotRetention) Retains(ctx context.Context, k cid.Cid) (bool, error) {
+	snapshots, err := FilesSnapshots(r.ds)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range snapshots {
+		if string(s.Cid.Hash()) == string(k.Hash()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FilesSnapshotConfigFromRepo reads the automatic snapshot configuration.
+func FilesSnapshotConfigFromRepo(r repo.Repo) (FilesSnapshotConfig, error) {
+	var cfg FilesSnapshotConfig
+	err := repo.ConfigSection(r, FilesSnapshotConfigKey, &cfg)
+	return cfg, err
+}
@@ -0,0 +1,120 @@
+package corerepo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/gc"
+
+	"github.com/ipfs/go-cid"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+)
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Now()
+	snapshots := []FilesSnapshot{
+		{Name: "auto-1", Created: now.Add(-4 * time.Hour), Auto: true},
+		{Name: "manual", Created: now.Add(-3 * time.Hour)},
+		{Name: "auto-2", Created: now.Add(-2 * time.Hour), Auto: true},
+		{Name: "auto-3", Created: now.Add(-time.Hour), Auto: true},
+	}
+
+	for _, tc := range []struct {
+		cfg  FilesSnapshotConfig
+		want []string
+	}{
+		{FilesSnapshotConfig{}, nil},
+		{FilesSnapshotConfig{Keep: 2}, []string{"auto-1"}},
+		{FilesSnapshotConfig{Keep: 1}, []string{"auto-1", "auto-2"}},
+		{FilesSnapshotConfig{MaxAge: "90m"}, []string{"auto-1", "auto-2"}},
+		// the most recent one is kept even when it is too old
+		{FilesSnapshotConfig{MaxAge: "1m"}, []string{"auto-1", "auto-2"}},
+		{FilesSnapshotConfig{Keep: 3, MaxAge: "3h"}, []string{"auto-1"}},
+	} {
+		got, err := expiredSnapshots(snapshots, tc.cfg, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: expired %v, expected %v", tc.cfg, got, tc.want)
+		}
+	}
+
+	if _, err := expiredSnapshots(snapshots, FilesSnapshotConfig{MaxAge: "a while"}, now); err == nil {
+		t.Fatal("expected an invalid MaxAge to be rejected")
+	}
+}
+
+func TestFilesSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	n := newTestNode(t)
+
+	s, err := CreateFilesSnapshot(ctx, n, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateFilesSnapshot(ctx, n, "empty"); err != ErrSnapshotExists {
+		t.Fatalf("expected ErrSnapshotExists, got %v", err)
+	}
+	if _, pinned, err := n.Pinning.IsPinned(ctx, s.Cid); err != nil || pinned {
+		t.Fatalf("the snapshot root was pinned: %v", err)
+	}
+
+	file := dag.NewRawNode([]byte("written after the snapshot"))
+	if err := n.DAG.Add(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.PutNode(n.Files(), "/file", file); err != nil {
+		t.Fatal(err)
+	}
+	old := n.Files()
+
+	prev, err := RestoreFilesSnapshot(ctx, n, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Files() == old {
+		t.Fatal("the MFS root was not replaced")
+	}
+	nd, err := n.Files().GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(s.Cid) {
+		t.Fatalf("restored root is %s, expected %s", nd.Cid(), s.Cid)
+	}
+
+	// the replaced root is kept by its own snapshot
+	removed := map[cid.Cid]bool{}
+	reasons := map[cid.Cid]string{}
+	for res := range GarbageCollectWithOptions(n, ctx, gc.Options{ReportRetained: true}) {
+		switch {
+		case res.Error != nil:
+			t.Fatal(res.Error)
+		case res.KeyRemoved.Defined():
+			removed[res.KeyRemoved] = true
+		case res.KeyRetained.Defined():
+			reasons[res.KeyRetained] = res.Reason
+		}
+	}
+	if removed[prev.Cid] || removed[file.Cid()] {
+		t.Fatal("the content of the replaced root was collected")
+	}
+	if want := "snapshot: " + prev.Name; reasons[prev.Cid] != want {
+		t.Fatalf("replaced root retained for %q, expected %q", reasons[prev.Cid], want)
+	}
+
+	// once the snapshot is removed, so is its content
+	if err := RemoveFilesSnapshot(ctx, n, prev.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := GarbageCollect(n, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := n.Blockstore.Has(file.Cid()); has {
+		t.Fatal("the content of a removed snapshot was kept")
+	}
+}
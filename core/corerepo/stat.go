@@ -7,7 +7,9 @@ import (
 	context "context"
 
 	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/gc"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/ipfs/go-ipfs/repo/tiered"
 
 	humanize "github.com/dustin/go-humanize"
 )
@@ -24,6 +26,8 @@ type Stat struct {
 	NumObjects uint64
 	RepoPath   string
 	Version    string
+	Tiers      []tiered.TierStat `json:",omitempty"`
+	Quota      *gc.QuotaStat     `json:",omitempty"`
 }
 
 // NoLimit represents the value for unlimited storage
@@ -59,6 +63,7 @@ func RepoStat(ctx context.Context, n *core.IpfsNode) (Stat, error) {
 		NumObjects: count,
 		RepoPath:   path,
 		Version:    fmt.Sprintf("fs-repo@%d", fsrepo.RepoVersion),
+		Quota:      QuotaStat(n),
 	}, nil
 }
 
@@ -89,3 +94,22 @@ func RepoSize(ctx context.Context, n *core.IpfsNode) (SizeStat, error) {
 		StorageMax: storageMax,
 	}, nil
 }
+
+// TierStats describes the tiers of the tiered datastores of the repo, if
+// any, fastest first.
+func TierStats(n *core.IpfsNode) ([]tiered.TierStat, error) {
+	r, ok := n.Repo.(*fsrepo.FSRepo)
+	if !ok {
+		return nil, nil
+	}
+
+	var stats []tiered.TierStat
+	for _, d := range r.TieredDatastores() {
+		s, err := d.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s...)
+	}
+	return stats, nil
+}
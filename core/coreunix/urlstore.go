@@ -0,0 +1,503 @@
+package coreunix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// ErrURLChanged is returned when the content behind a URL changes while it
+// is being read.
+var ErrURLChanged = errors.New("the content changed while it was read")
+
+// URLFile is a files.File reading the content of a URL. When the transfer
+// fails, it resumes where it stopped with a range request, as long as the
+// server reports the same version of the content.
+type URLFile struct {
+	ctx     context.Context
+	client  *http.Client
+	url     string
+	retries int
+	backoff time.Duration
+
+	body   io.ReadCloser
+	offset int64
+	v      URLValidators
+}
+
+// URLValidators identify a version of the content behind a URL.
+type URLValidators struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	Size         int64
+}
+
+// Matches reports whether o describes the same version of the content. Only
+// the validators known on both sides are compared, and at least one must be.
+func (v URLValidators) Matches(o URLValidators) bool {
+	if v.Size != o.Size {
+		return false
+	}
+	compared := false
+	if v.ETag != "" && o.ETag != "" {
+		if v.ETag != o.ETag {
+			return false
+		}
+		compared = true
+	}
+	if v.LastModified != "" && o.LastModified != "" {
+		if v.LastModified != o.LastModified {
+			return false
+		}
+		compared = true
+	}
+	return compared
+}
+
+// ifRange returns the validator to send in an If-Range header.
+func (v URLValidators) ifRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
+}
+
+func validatorsOf(resp *http.Response) URLValidators {
+	return URLValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         resp.ContentLength,
+	}
+}
+
+// NewURLClient returns an HTTP client for the urlstore. Connecting and
+// waiting for the response headers give up after timeout. With whole, the
+// entire request, body included, must complete within timeout too; leave it
+// unset for transfers of unbounded size.
+func NewURLClient(timeout time.Duration, whole bool) *http.Client {
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	if whole {
+		c.Timeout = timeout
+	}
+	return c
+}
+
+var _ files.File = (*URLFile)(nil)
+var _ files.FileInfo = (*URLFile)(nil)
+
+// NewURLFile starts reading url. A failed transfer is resumed up to retries
+// times, waiting backoff before the first retry and twice as long for every
+// following one.
+func NewURLFile(ctx context.Context, client *http.Client, url string, retries int, backoff time.Duration) (*URLFile, error) {
+	f := &URLFile{
+		ctx:     ctx,
+		client:  client,
+		url:     url,
+		retries: retries,
+		backoff: backoff,
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if err := f.wait(attempt); err != nil {
+				return nil, err
+			}
+		}
+		var resp *http.Response
+		resp, err = f.get(nil)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("%s: %s", url, resp.Status)
+			if resp.StatusCode < 500 {
+				return nil, err // not worth retrying
+			}
+			continue
+		}
+		f.body = resp.Body
+		f.v = validatorsOf(resp)
+		return f, nil
+	}
+	return nil, err
+}
+
+func (f *URLFile) get(header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return f.client.Do(req)
+}
+
+func (f *URLFile) wait(attempt int) error {
+	d := f.backoff << uint(attempt-1)
+	select {
+	case <-time.After(d):
+		return nil
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
+
+// resume requests the rest of the content from the current offset.
+func (f *URLFile) resume() error {
+	h := http.Header{}
+	h.Set("Range", "bytes="+strconv.FormatInt(f.offset, 10)+"-")
+	if ir := f.v.ifRange(); ir != "" {
+		h.Set("If-Range", ir)
+	}
+	resp, err := f.get(h)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			// the server ignored the range, or the content changed
+			return ErrURLChanged
+		}
+		return fmt.Errorf("%s: %s", f.url, resp.Status)
+	}
+	f.body = resp.Body
+	return nil
+}
+
+func (f *URLFile) Read(p []byte) (int, error) {
+	var err error
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("resuming %s at byte %d: %s", f.url, f.offset, err)
+			if err := f.wait(attempt); err != nil {
+				return 0, err
+			}
+		}
+		if f.body == nil {
+			if err = f.resume(); err == ErrURLChanged {
+				return 0, err
+			} else if err != nil {
+				continue
+			}
+		}
+
+		var n int
+		n, err = f.body.Read(p)
+		f.offset += int64(n)
+		if err == nil || err == io.EOF {
+			if err == io.EOF && f.v.Size >= 0 && f.offset < f.v.Size {
+				// cut short, resume
+				f.body.Close()
+				f.body = nil
+				if n > 0 {
+					return n, nil
+				}
+				err = io.ErrUnexpectedEOF
+				continue
+			}
+			return n, err
+		}
+
+		f.body.Close()
+		f.body = nil
+		if n > 0 {
+			return n, nil // resume on the next read
+		}
+	}
+	return 0, err
+}
+
+func (f *URLFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (f *URLFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent && offset == 0 {
+		return f.offset, nil
+	}
+	return 0, errors.New("seeking is not supported")
+}
+
+func (f *URLFile) Size() (int64, error) {
+	if f.v.Size < 0 {
+		return 0, errors.New("size of URL unknown")
+	}
+	return f.v.Size, nil
+}
+
+// AbsPath returns the URL, which the filestore records as the location of
+// the blocks.
+func (f *URLFile) AbsPath() string {
+	return f.url
+}
+
+func (f *URLFile) Stat() os.FileInfo {
+	return nil
+}
+
+// Validators returns the version of the content being read.
+func (f *URLFile) Validators() URLValidators {
+	return f.v
+}
+
+// urlRecordPrefix is the datastore namespace holding the URLRecords.
+var urlRecordPrefix = ds.NewKey("/local/urlstore")
+
+// URLRecord remembers the version of a URL added to the urlstore.
+type URLRecord struct {
+	URL  string
+	Root cid.Cid
+	URLValidators
+	Added time.Time
+
+	// Verified is when the content was last found unchanged.
+	Verified time.Time `json:",omitempty"`
+}
+
+func urlRecordKey(url string) ds.Key {
+	// URLs contain slashes, keep them in a single key segment
+	return urlRecordPrefix.ChildString(neturl.QueryEscape(url))
+}
+
+// PutURLRecord stores r, replacing the previous record of the same URL.
+func PutURLRecord(d ds.Datastore, r URLRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return d.Put(urlRecordKey(r.URL), b)
+}
+
+// GetURLRecord returns the record of url, or ds.ErrNotFound.
+func GetURLRecord(d ds.Datastore, url string) (URLRecord, error) {
+	var r URLRecord
+	b, err := d.Get(urlRecordKey(url))
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+// URLRecords returns every URL record.
+func URLRecords(d ds.Datastore) ([]URLRecord, error) {
+	res, err := d.Query(dsq.Query{Prefix: urlRecordPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]URLRecord, 0, len(entries))
+	for _, e := range entries {
+		var r URLRecord
+		if err := json.Unmarshal(e.Value, &r); err != nil {
+			return nil, fmt.Errorf("invalid urlstore record %s: %s", e.Key, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// urlVerifyKey holds the urlVerifyRun of the last 'urlstore verify'.
+var urlVerifyKey = ds.NewKey("/local/urlverify")
+
+type urlVerifyRun struct {
+	Started  time.Time
+	Finished bool
+}
+
+// BeginURLVerify records the start of a verification run and returns the
+// time from which verified URLs can be skipped. With resume, an unfinished
+// previous run is continued instead.
+func BeginURLVerify(d ds.Datastore, resume bool) (time.Time, error) {
+	if resume {
+		var run urlVerifyRun
+		b, err := d.Get(urlVerifyKey)
+		switch err {
+		case nil:
+			if err := json.Unmarshal(b, &run); err != nil {
+				return time.Time{}, err
+			}
+			if !run.Finished {
+				return run.Started, nil
+			}
+		case ds.ErrNotFound:
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	run := urlVerifyRun{Started: time.Now()}
+	b, err := json.Marshal(run)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return run.Started, d.Put(urlVerifyKey, b)
+}
+
+// EndURLVerify marks the current verification run as finished.
+func EndURLVerify(d ds.Datastore) error {
+	var run urlVerifyRun
+	b, err := d.Get(urlVerifyKey)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &run); err != nil {
+		return err
+	}
+	run.Finished = true
+	if b, err = json.Marshal(run); err != nil {
+		return err
+	}
+	return d.Put(urlVerifyKey, b)
+}
+
+// URLBlock is a block stored by reference to a byte range of a URL.
+type URLBlock struct {
+	Key    cid.Cid
+	Offset uint64
+	Size   uint64
+}
+
+// URL verification statuses.
+const (
+	URLUnchanged   = "unchanged"   // the validators match the recorded ones
+	URLOk          = "ok"          // every block was read back
+	URLChanged     = "changed"     // some blocks no longer match
+	URLUnreachable = "unreachable" // the server could not be queried
+	URLMissing     = "missing"     // no block of the URL is stored
+)
+
+// URLVerifyResult is the outcome of VerifyURL.
+type URLVerifyResult struct {
+	URL     string
+	Status  string
+	Checked int       // blocks read back with range requests
+	Bad     []cid.Cid `json:",omitempty"`
+	Current URLValidators
+	Error   string `json:",omitempty"`
+}
+
+// VerifyURL checks that the blocks are still served by url. When the server
+// reports the recorded version through ETag or Last-Modified, nothing is
+// downloaded. Otherwise, or with full, every block is read back with a range
+// request covering only its bytes. A URL without any block is reported
+// missing.
+func VerifyURL(ctx context.Context, client *http.Client, url string, recorded *URLValidators, blocks []URLBlock, full bool) URLVerifyResult {
+	res := URLVerifyResult{URL: url}
+	if len(blocks) == 0 {
+		res.Status, res.Error = URLMissing, "no blocks in the urlstore"
+		return res
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		res.Status, res.Error = URLUnreachable, err.Error()
+		return res
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Status, res.Error = URLUnreachable, err.Error()
+		return res
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		res.Status, res.Error = URLUnreachable, resp.Status
+		return res
+	}
+	res.Current = validatorsOf(resp)
+
+	if !full && recorded != nil && recorded.Matches(res.Current) {
+		res.Status = URLUnchanged
+		return res
+	}
+
+	for _, b := range blocks {
+		ok, err := verifyRange(ctx, client, url, b)
+		if err != nil {
+			res.Status, res.Error = URLUnreachable, err.Error()
+			return res
+		}
+		res.Checked++
+		if !ok {
+			res.Bad = append(res.Bad, b.Key)
+		}
+	}
+	if len(res.Bad) > 0 {
+		res.Status = URLChanged
+	} else {
+		res.Status = URLOk
+	}
+	return res
+}
+
+// verifyRange reads back the bytes of a block and rehashes them.
+func verifyRange(ctx context.Context, client *http.Client, url string, b URLBlock) (bool, error) {
+	if b.Size == 0 {
+		return true, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", b.Offset, b.Offset+b.Size-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return false, nil // truncated
+	default:
+		return false, fmt.Errorf("range request failed: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(b.Size)))
+	if err != nil {
+		return false, err
+	}
+	if uint64(len(data)) != b.Size {
+		return false, nil
+	}
+	c, err := b.Key.Prefix().Sum(data)
+	if err != nil {
+		return false, err
+	}
+	return c.Equals(b.Key), nil
+}
@@ -0,0 +1,149 @@
+package coreunix
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// flakyHandler serves data, cutting the first full response in the middle.
+type flakyHandler struct {
+	data    []byte
+	etag    string
+	cut     int32
+	ranges  int32
+	fullGet int32
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", h.etag)
+	if r.Header.Get("Range") == "" && r.Method == http.MethodGet {
+		atomic.AddInt32(&h.fullGet, 1)
+		if atomic.CompareAndSwapInt32(&h.cut, 0, 1) {
+			hj := w.(http.Hijacker)
+			conn, buf, err := hj.Hijack()
+			if err != nil {
+				return
+			}
+			buf.WriteString("HTTP/1.1 200 OK\r\n")
+			buf.WriteString("ETag: " + h.etag + "\r\n")
+			buf.WriteString("Content-Length: " + strconv.Itoa(len(h.data)) + "\r\n\r\n")
+			buf.Write(h.data[:len(h.data)/2])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+	}
+	if r.Header.Get("Range") != "" {
+		atomic.AddInt32(&h.ranges, 1)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(h.data))
+}
+
+func TestURLFileResume(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	h := &flakyHandler{data: data, etag: `"v1"`}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	f, err := NewURLFile(context.Background(), srv.Client(), srv.URL, 3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed content differs")
+	}
+	if atomic.LoadInt32(&h.ranges) == 0 {
+		t.Fatal("expected the transfer to resume with a range request")
+	}
+	if v := f.Validators(); v.ETag != `"v1"` || v.Size != int64(len(data)) {
+		t.Fatalf("unexpected validators: %+v", v)
+	}
+}
+
+func TestVerifyURL(t *testing.T) {
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(2)).Read(data)
+	h := &flakyHandler{data: data, etag: `"v1"`, cut: 1}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	var blocks []URLBlock
+	for off := 0; off < len(data); off += 1000 {
+		hash, err := mh.Sum(data[off:off+1000], mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, URLBlock{Key: cid.NewCidV1(cid.Raw, hash), Offset: uint64(off), Size: 1000})
+	}
+	recorded := URLValidators{ETag: `"v1"`, Size: int64(len(data))}
+	ctx := context.Background()
+
+	res := VerifyURL(ctx, srv.Client(), srv.URL, &recorded, blocks, false)
+	if res.Status != URLUnchanged || atomic.LoadInt32(&h.ranges) != 0 {
+		t.Fatalf("expected a validator match without download, got %+v", res)
+	}
+
+	// a new ETag with the same bytes: read back by ranges only
+	h.etag = `"v2"`
+	res = VerifyURL(ctx, srv.Client(), srv.URL, &recorded, blocks, false)
+	if res.Status != URLOk || res.Checked != 3 {
+		t.Fatalf("expected the ranges to verify, got %+v", res)
+	}
+	if atomic.LoadInt32(&h.fullGet) != 0 {
+		t.Fatal("verify downloaded the whole object")
+	}
+
+	data[1500] ^= 0xff
+	res = VerifyURL(ctx, srv.Client(), srv.URL, &recorded, blocks, false)
+	if res.Status != URLChanged || len(res.Bad) != 1 || !res.Bad[0].Equals(blocks[1].Key) {
+		t.Fatalf("expected the middle block to be reported, got %+v", res)
+	}
+
+	// a URL without blocks is not reported ok, even if it is unchanged
+	h.etag = `"v1"`
+	res = VerifyURL(ctx, srv.Client(), srv.URL, &recorded, nil, false)
+	if res.Status != URLMissing {
+		t.Fatalf("expected a URL without blocks to be missing, got %+v", res)
+	}
+}
+
+func TestURLRecords(t *testing.T) {
+	d := datastore.NewMapDatastore()
+	url := "http://example.com/a//b?c=d"
+	if err := PutURLRecord(d, URLRecord{URL: url, URLValidators: URLValidators{ETag: `"x"`}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := GetURLRecord(d, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.URL != url || r.ETag != `"x"` {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if _, err := GetURLRecord(d, "http://example.com/a/b?c=d"); err != datastore.ErrNotFound {
+		t.Fatalf("expected distinct URLs to have distinct records, got %v", err)
+	}
+	all, err := URLRecords(d)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("expected one record, got %d (%v)", len(all), err)
+	}
+}
@@ -0,0 +1,35 @@
+package node
+
+import (
+	"context"
+
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"go.uber.org/fx"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// BackupSync constructs the backup distribution service. The replicas it
+// pulls are accounted as backup content by the storage quotas.
+func BackupSync(lc fx.Lifecycle, mctx helpers.MetricsCtx, host host.Host, r repo.Repo, bs blockstore.GCBlockstore) (*backupsync.Service, error) {
+	ctx := helpers.LifecycleCtx(mctx, lc)
+
+	s, err := backupsync.New(ctx, host, r.Datastore(),
+		storeutil.LinkSystemForBlockstore(gc.QuotaView(bs, gc.QuotaBackup)),
+		storeutil.LinkSystemForBlockstore(bs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return s.Close()
+		},
+	})
+	return s, nil
+}
@@ -3,6 +3,7 @@ package node
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ipfs/go-bitswap"
@@ -24,6 +25,7 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/repo"
 )
 
@@ -90,6 +92,8 @@ func Dag(bs blockservice.BlockService) format.DAGService {
 // OnlineExchange creates new LibP2P backed block exchange (BitSwap)
 func OnlineExchange(provide bool) interface{} {
 	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, rt routing.Routing, bs blockstore.GCBlockstore, ds datastore.Datastore) exchange.Interface {
+		// blocks fetched for others or not pinned yet are cache
+		bs = gc.QuotaView(bs, gc.QuotaCache)
 		bitswapNetwork := network.NewFromIpfsHost(host, rt)
 		exch := bitswap.New(helpers.LifecycleCtx(mctx, lc), bitswapNetwork, bs, ds, bitswap.ProvideEnabled(provide))
 		lc.Append(fx.Hook{
@@ -102,26 +106,83 @@ func OnlineExchange(provide bool) interface{} {
 	}
 }
 
-// Files loads persisted MFS root
-func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService) (*mfs.Root, error) {
-	dsk := datastore.NewKey("/local/filesroot")
+// filesRootKey is the datastore key of the persisted MFS root.
+var filesRootKey = datastore.NewKey("/local/filesroot")
+
+// FilesRoots holds the MFS root of a node. Only the current root persists
+// itself, so that a root replaced by Replace can't overwrite its replacement
+// when it is flushed or closed.
+type FilesRoots struct {
+	repo repo.Repo
+	dag  format.DAGService
+
+	persistLk sync.Mutex // serializes the writes of the persisted root
+	lk        sync.RWMutex
+	current   *mfs.Root
+}
+
+// Current returns the MFS root in use.
+func (f *FilesRoots) Current() *mfs.Root {
+	f.lk.RLock()
+	defer f.lk.RUnlock()
+	return f.current
+}
+
+// persist records c as the MFS root of the repo. Callers hold persistLk.
+func (f *FilesRoots) persist(c cid.Cid) error {
+	rootDS := f.repo.Datastore()
+	if err := rootDS.Sync(blockstore.BlockPrefix); err != nil {
+		return err
+	}
+	if err := rootDS.Sync(filestore.FilestorePrefix); err != nil {
+		return err
+	}
+
+	if err := rootDS.Put(filesRootKey, c.Bytes()); err != nil {
+		return err
+	}
+	return rootDS.Sync(filesRootKey)
+}
+
+func (f *FilesRoots) open(ctx context.Context, nd *merkledag.ProtoNode) (*mfs.Root, error) {
+	var root *mfs.Root
 	pf := func(ctx context.Context, c cid.Cid) error {
-		rootDS := repo.Datastore()
-		if err := rootDS.Sync(blockstore.BlockPrefix); err != nil {
-			return err
-		}
-		if err := rootDS.Sync(filestore.FilestorePrefix); err != nil {
-			return err
+		f.persistLk.Lock()
+		defer f.persistLk.Unlock()
+		if f.Current() != root {
+			return nil
 		}
+		return f.persist(c)
+	}
+	root, err := mfs.NewRoot(ctx, f.dag, nd, pf)
+	return root, err
+}
 
-		if err := rootDS.Put(dsk, c.Bytes()); err != nil {
-			return err
-		}
-		return rootDS.Sync(dsk)
+// Replace opens a new MFS root on nd and makes it the current root,
+// persisted before it is returned. The replaced root is returned to the
+// caller, the changes made to it from now on are dropped.
+func (f *FilesRoots) Replace(ctx context.Context, nd *merkledag.ProtoNode) (*mfs.Root, error) {
+	root, err := f.open(ctx, nd)
+	if err != nil {
+		return nil, err
 	}
 
+	f.persistLk.Lock()
+	defer f.persistLk.Unlock()
+	if err := f.persist(nd.Cid()); err != nil {
+		return nil, err
+	}
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	old := f.current
+	f.current = root
+	return old, nil
+}
+
+// Files loads persisted MFS root
+func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService) (*FilesRoots, error) {
 	var nd *merkledag.ProtoNode
-	val, err := repo.Datastore().Get(dsk)
+	val, err := repo.Datastore().Get(filesRootKey)
 	ctx := helpers.LifecycleCtx(mctx, lc)
 
 	switch {
@@ -152,13 +213,17 @@ func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.
 		return nil, err
 	}
 
-	root, err := mfs.NewRoot(ctx, dag, nd, pf)
+	roots := &FilesRoots{repo: repo, dag: dag}
+	if roots.current, err = roots.open(ctx, nd); err != nil {
+		return nil, err
+	}
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
-			return root.Close()
+			// a restore may have replaced the root opened here
+			return roots.Current().Close()
 		},
 	})
 
-	return root, err
+	return roots, nil
 }
@@ -0,0 +1,20 @@
+package node
+
+import (
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.uber.org/fx"
+
+	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/durablesub"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// DurableSubs resumes the durable pubsub subscriptions recorded in the repo
+// datastore.
+func DurableSubs(lc fx.Lifecycle, mctx helpers.MetricsCtx, ps *pubsub.PubSub, r repo.Repo) (*durablesub.Service, error) {
+	var cfg durablesub.Config
+	if err := repo.ConfigSection(r, durablesub.ConfigKey, &cfg); err != nil {
+		return nil, err
+	}
+	return durablesub.New(helpers.LifecycleCtx(mctx, lc), ps, r.Datastore(), cfg.MaxMessages)
+}
@@ -10,6 +10,7 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
 )
 
 // Graphsync constructs a graphsync
@@ -18,6 +19,6 @@ func Graphsync(lc fx.Lifecycle, mctx helpers.MetricsCtx, host libp2p.Host, bs bl
 
 	network := network.NewFromLibp2pHost(host)
 	return gsimpl.New(ctx, network,
-		storeutil.LinkSystemForBlockstore(bs),
+		storeutil.LinkSystemForBlockstore(gc.QuotaView(bs, gc.QuotaCache)),
 	)
 }
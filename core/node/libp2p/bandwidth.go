@@ -0,0 +1,415 @@
+package libp2p
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+	"github.com/ipfs/go-ipfs/ratelimit"
+	"github.com/ipfs/go-ipfs/repo"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// BandwidthLimitsConfigKey is the config section holding the
+// BandwidthLimitsConfig.
+const BandwidthLimitsConfigKey = "BandwidthLimits"
+
+// BandwidthLimit is a pair of rates in bytes per second, such as "1MB".
+// An empty rate means no limit.
+type BandwidthLimit struct {
+	In  string `json:",omitempty"`
+	Out string `json:",omitempty"`
+}
+
+// BandwidthLimitsConfig configures the throttling of libp2p streams.
+type BandwidthLimitsConfig struct {
+	// Protocols limits the streams of a protocol, all peers together. Keys
+	// are protocol ID prefixes, or one of the names in ProtocolClasses.
+	Protocols map[string]BandwidthLimit `json:",omitempty"`
+
+	// PerPeer limits the streams of each peer, all protocols together.
+	PerPeer BandwidthLimit
+
+	// Peers overrides PerPeer for the given peer IDs.
+	Peers map[string]BandwidthLimit `json:",omitempty"`
+}
+
+// ProtocolClasses names the protocol ID prefixes of the services the limits
+// are usually set for.
+var ProtocolClasses = map[string]string{
+	"bitswap":   "/ipfs/bitswap",
+	"graphsync": "/ipfs/graphsync",
+	"p2p":       "/x/",
+	"backup":    backupsync.ProtocolPrefix,
+}
+
+// ProtocolPrefix returns the protocol ID prefix named by s: either a name in
+// ProtocolClasses, or a prefix starting with a slash.
+func ProtocolPrefix(s string) (string, error) {
+	if prefix, ok := ProtocolClasses[s]; ok {
+		return prefix, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return "", fmt.Errorf("unknown protocol %q: expected a protocol ID prefix or one of bitswap, graphsync, p2p, backup", s)
+	}
+	return s, nil
+}
+
+// Rate is a pair of rates in bytes per second. Zero means no limit.
+type Rate struct {
+	In  float64
+	Out float64
+}
+
+// ParseRate parses a BandwidthLimit.
+func ParseRate(l BandwidthLimit) (Rate, error) {
+	var r Rate
+	for _, f := range []struct {
+		s   string
+		out *float64
+	}{{l.In, &r.In}, {l.Out, &r.Out}} {
+		if f.s == "" {
+			continue
+		}
+		n, err := humanize.ParseBytes(f.s)
+		if err != nil {
+			return Rate{}, fmt.Errorf("invalid rate %q: %s", f.s, err)
+		}
+		*f.out = float64(n)
+	}
+	return r, nil
+}
+
+// Limit formats the rate back as a BandwidthLimit.
+func (r Rate) Limit() BandwidthLimit {
+	var l BandwidthLimit
+	if r.In > 0 {
+		l.In = humanize.Bytes(uint64(r.In))
+	}
+	if r.Out > 0 {
+		l.Out = humanize.Bytes(uint64(r.Out))
+	}
+	return l
+}
+
+// BandwidthLimiter throttles the libp2p streams with token buckets, one per
+// configured protocol and one per peer. Both apply to a stream: it goes as
+// fast as the slowest of them allows. The limits can be changed at runtime
+// and apply to the open streams right away.
+type BandwidthLimiter struct {
+	mu          sync.Mutex
+	protocols   []*protocolLimit // longest prefix first
+	peerDefault Rate
+	peerRates   map[peer.ID]Rate
+	peers       map[peer.ID]*peerLimit
+}
+
+// protocolLimit is the state of a limited protocol prefix.
+type protocolLimit struct {
+	prefix  string
+	in, out *ratelimit.Bucket
+}
+
+// peerLimit is the state of a peer with open streams.
+type peerLimit struct {
+	streams int
+	in, out *ratelimit.Bucket
+}
+
+// NewBandwidthLimiter returns a limiter applying cfg.
+func NewBandwidthLimiter(cfg BandwidthLimitsConfig) (*BandwidthLimiter, error) {
+	l := &BandwidthLimiter{
+		peerRates: make(map[peer.ID]Rate),
+		peers:     make(map[peer.ID]*peerLimit),
+	}
+	for name, bl := range cfg.Protocols {
+		prefix, err := ProtocolPrefix(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s.Protocols: %s", BandwidthLimitsConfigKey, err)
+		}
+		r, err := ParseRate(bl)
+		if err != nil {
+			return nil, fmt.Errorf("%s.Protocols[%s]: %s", BandwidthLimitsConfigKey, name, err)
+		}
+		l.SetProtocolLimit(prefix, r)
+	}
+	r, err := ParseRate(cfg.PerPeer)
+	if err != nil {
+		return nil, fmt.Errorf("%s.PerPeer: %s", BandwidthLimitsConfigKey, err)
+	}
+	l.SetDefaultPeerLimit(r)
+	for s, bl := range cfg.Peers {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s.Peers: invalid peer ID %q: %s", BandwidthLimitsConfigKey, s, err)
+		}
+		r, err := ParseRate(bl)
+		if err != nil {
+			return nil, fmt.Errorf("%s.Peers[%s]: %s", BandwidthLimitsConfigKey, s, err)
+		}
+		l.SetPeerLimit(id, r)
+	}
+	return l, nil
+}
+
+// BandwidthLimits builds the limiter from the config of the repo.
+func BandwidthLimits(r repo.Repo) (*BandwidthLimiter, error) {
+	var cfg BandwidthLimitsConfig
+	if err := repo.ConfigSection(r, BandwidthLimitsConfigKey, &cfg); err != nil {
+		return nil, err
+	}
+	return NewBandwidthLimiter(cfg)
+}
+
+// SetProtocolLimit limits the streams of the protocols starting with prefix.
+// A zero rate removes the limit.
+func (l *BandwidthLimiter) SetProtocolLimit(prefix string, r Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, pl := range l.protocols {
+		if pl.prefix != prefix {
+			continue
+		}
+		if r == (Rate{}) {
+			l.protocols = append(l.protocols[:i], l.protocols[i+1:]...)
+			return
+		}
+		pl.in.SetRate(r.In)
+		pl.out.SetRate(r.Out)
+		return
+	}
+	if r == (Rate{}) {
+		return
+	}
+	l.protocols = append(l.protocols, &protocolLimit{
+		prefix: prefix,
+		in:     ratelimit.NewBucket(r.In),
+		out:    ratelimit.NewBucket(r.Out),
+	})
+	sort.SliceStable(l.protocols, func(i, j int) bool {
+		return len(l.protocols[i].prefix) > len(l.protocols[j].prefix)
+	})
+}
+
+// SetDefaultPeerLimit limits the streams of each peer without a limit of
+// its own.
+func (l *BandwidthLimiter) SetDefaultPeerLimit(r Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.peerDefault = r
+	for id, pl := range l.peers {
+		if _, ok := l.peerRates[id]; !ok {
+			pl.in.SetRate(r.In)
+			pl.out.SetRate(r.Out)
+		}
+	}
+}
+
+// SetPeerLimit limits the streams of id. A zero rate removes the limit of
+// the peer, which falls back to the default one.
+func (l *BandwidthLimiter) SetPeerLimit(id peer.ID, r Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r == (Rate{}) {
+		delete(l.peerRates, id)
+		r = l.peerDefault
+	} else {
+		l.peerRates[id] = r
+	}
+	if pl, ok := l.peers[id]; ok {
+		pl.in.SetRate(r.In)
+		pl.out.SetRate(r.Out)
+	}
+}
+
+// BandwidthLimitSet is a snapshot of the limits of a BandwidthLimiter.
+type BandwidthLimitSet struct {
+	Protocols map[string]Rate
+	PerPeer   Rate
+	Peers     map[peer.ID]Rate
+}
+
+// Limits returns the current limits.
+func (l *BandwidthLimiter) Limits() BandwidthLimitSet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := BandwidthLimitSet{
+		Protocols: make(map[string]Rate, len(l.protocols)),
+		PerPeer:   l.peerDefault,
+		Peers:     make(map[peer.ID]Rate, len(l.peerRates)),
+	}
+	for _, pl := range l.protocols {
+		out.Protocols[pl.prefix] = Rate{In: pl.in.Rate(), Out: pl.out.Rate()}
+	}
+	for id, r := range l.peerRates {
+		out.Peers[id] = r
+	}
+	return out
+}
+
+// ThrottleState is the throttling of a protocol limit.
+type ThrottleState struct {
+	// Prefix is the protocol ID prefix the limit applies to.
+	Prefix string
+	Limit  Rate
+
+	// ThrottledIn and ThrottledOut report whether the streams had to wait
+	// in the last second.
+	ThrottledIn  bool
+	ThrottledOut bool
+
+	// DelayIn and DelayOut add up the time the streams waited.
+	DelayIn  time.Duration
+	DelayOut time.Duration
+}
+
+// ProtocolLimit returns the throttling of the limit applying to proto, if
+// any.
+func (l *BandwidthLimiter) ProtocolLimit(proto protocol.ID) (ThrottleState, bool) {
+	l.mu.Lock()
+	pl := l.protocolLimitLocked(proto)
+	l.mu.Unlock()
+	if pl == nil {
+		return ThrottleState{}, false
+	}
+
+	now := time.Now()
+	st := ThrottleState{Prefix: pl.prefix}
+	st.Limit.In, st.DelayIn, st.ThrottledIn = pl.in.State(now)
+	st.Limit.Out, st.DelayOut, st.ThrottledOut = pl.out.State(now)
+	return st, true
+}
+
+// protocolBuckets returns the buckets of the limit applying to proto, if
+// any. They are looked up on every read and write, so that the changes of
+// the protocol limits apply to the open streams.
+func (l *BandwidthLimiter) protocolBuckets(proto protocol.ID) (in, out *ratelimit.Bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pl := l.protocolLimitLocked(proto); pl != nil {
+		return pl.in, pl.out
+	}
+	return nil, nil
+}
+
+func (l *BandwidthLimiter) protocolLimitLocked(proto protocol.ID) *protocolLimit {
+	for _, pl := range l.protocols {
+		if strings.HasPrefix(string(proto), pl.prefix) {
+			return pl
+		}
+	}
+	return nil
+}
+
+// Wrap throttles s. The stream must be closed or reset to release the
+// state of its peer.
+func (l *BandwidthLimiter) Wrap(s network.Stream) network.Stream {
+	id := s.Conn().RemotePeer()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.peers[id]
+	if !ok {
+		r, ok := l.peerRates[id]
+		if !ok {
+			r = l.peerDefault
+		}
+		p = &peerLimit{in: ratelimit.NewBucket(r.In), out: ratelimit.NewBucket(r.Out)}
+		l.peers[id] = p
+	}
+	p.streams++
+	return &limitedStream{Stream: s, l: l, peer: id, in: p.in, out: p.out}
+}
+
+func (l *BandwidthLimiter) release(id peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p, ok := l.peers[id]; ok {
+		p.streams--
+		if p.streams <= 0 {
+			delete(l.peers, id)
+		}
+	}
+}
+
+// limitedStream is a stream throttled by a BandwidthLimiter.
+type limitedStream struct {
+	network.Stream
+
+	l       *BandwidthLimiter
+	peer    peer.ID
+	in, out *ratelimit.Bucket // of the peer
+	once    sync.Once
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	in, _ := s.l.protocolBuckets(s.Protocol())
+	ratelimit.Wait(n, in, s.in)
+	return n, err
+}
+
+func (s *limitedStream) Write(p []byte) (int, error) {
+	_, out := s.l.protocolBuckets(s.Protocol())
+	ratelimit.Wait(len(p), out, s.out)
+	return s.Stream.Write(p)
+}
+
+func (s *limitedStream) Close() error {
+	s.once.Do(func() { s.l.release(s.peer) })
+	return s.Stream.Close()
+}
+
+func (s *limitedStream) Reset() error {
+	s.once.Do(func() { s.l.release(s.peer) })
+	return s.Stream.Reset()
+}
+
+// limitedHost throttles the streams the services open and accept.
+type limitedHost struct {
+	host.Host
+	l *BandwidthLimiter
+}
+
+// LimitHost wraps h so that the streams of the stream handlers set on it,
+// and the streams it opens, are throttled by l.
+func LimitHost(h host.Host, l *BandwidthLimiter) host.Host {
+	return &limitedHost{Host: h, l: l}
+}
+
+func (h *limitedHost) wrapHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(h.l.Wrap(s))
+	}
+}
+
+func (h *limitedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, h.wrapHandler(handler))
+}
+
+func (h *limitedHost) SetStreamHandlerMatch(pid protocol.ID, match func(string) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, h.wrapHandler(handler))
+}
+
+func (h *limitedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return h.l.Wrap(s), nil
+}
@@ -0,0 +1,107 @@
+package libp2p
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/backupsync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// sendTime returns how long writing size bytes over a new stream of proto
+// takes.
+func sendTime(t *testing.T, ctx context.Context, l *BandwidthLimiter, proto protocol.ID, size int) time.Duration {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	t.Cleanup(func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	})
+
+	received := make(chan int64, 1)
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		n, _ := io.Copy(ioutil.Discard, s)
+		s.Close()
+		received <- n
+	})
+
+	s, err := LimitHost(hosts[0], l).NewStream(ctx, hosts[1].ID(), proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	chunk := make([]byte, 1000)
+	for sent := 0; sent < size; sent += len(chunk) {
+		if _, err := s.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != int64(size) {
+			t.Fatalf("received %d bytes, sent %d", n, size)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stream was not received")
+	}
+	return elapsed
+}
+
+func TestBandwidthLimiterThrottlesStreams(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewBandwidthLimiter(BandwidthLimitsConfig{
+		Protocols: map[string]BandwidthLimit{"backup": {Out: "10kB"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second of traffic goes through at once, the next second waits
+	if d := sendTime(t, ctx, l, backupsync.PushProtocol, 20000); d < 800*time.Millisecond {
+		t.Fatalf("a backup stream was not throttled: sent in %s", d)
+	}
+	st, ok := l.ProtocolLimit(backupsync.GraphsyncProtocol)
+	if !ok || st.Prefix != backupsync.ProtocolPrefix || st.DelayOut == 0 {
+		t.Fatalf("the backup limit reports no throttling: %+v", st)
+	}
+
+	if d := sendTime(t, ctx, l, "/ipfs/bitswap/1.2.0", 20000); d > 500*time.Millisecond {
+		t.Fatalf("an unlimited stream was throttled: sent in %s", d)
+	}
+
+	// limits changed at runtime apply to the next writes
+	l.SetProtocolLimit(backupsync.ProtocolPrefix, Rate{})
+	if d := sendTime(t, ctx, l, backupsync.PushProtocol, 20000); d > 500*time.Millisecond {
+		t.Fatalf("a removed limit still applies: sent in %s", d)
+	}
+}
+
+func TestBandwidthLimiterPerPeer(t *testing.T) {
+	l, err := NewBandwidthLimiter(BandwidthLimitsConfig{
+		PerPeer: BandwidthLimit{Out: "10kB"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := sendTime(t, context.Background(), l, "/x/test", 20000); d < 800*time.Millisecond {
+		t.Fatalf("the stream of a limited peer was not throttled: sent in %s", d)
+	}
+	if n := len(l.peers); n != 0 {
+		t.Fatalf("the state of %d peers was kept after their streams closed", n)
+	}
+}
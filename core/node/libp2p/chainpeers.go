@@ -0,0 +1,118 @@
+package libp2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-ipfs-auth/selector"
+	"github.com/ipfs/go-ipfs-auth/standard/model"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// chainPeersTTL is how long the chain peer list is cached.
+const chainPeersTTL = 5 * time.Minute
+
+// ChainPeers is the peer list registered on chain, shared by the services
+// restricted to those peers and by the chain peering.
+var ChainPeers = &ChainPeerSet{list: selector.GetPeerList}
+
+// ChainPeerSet is a cached set of the peers registered on chain.
+type ChainPeerSet struct {
+	list func(int) ([]model.CorePeer, error)
+
+	mu         sync.Mutex
+	peers      map[peer.ID]bool
+	fetched    time.Time
+	refreshing bool
+}
+
+// Has reports whether id is registered on chain, from the cached list. It
+// never waits for the chain: once the list is older than chainPeersTTL, it
+// is read again in the background and the previous list is used meanwhile.
+// Until the first read completes, no peer is registered.
+func (s *ChainPeerSet) Has(id peer.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	return s.peers[id]
+}
+
+// Prefetch reads the list in the background when it is stale, so that Has
+// answers from the chain by the time the first peer shows up.
+func (s *ChainPeerSet) Prefetch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+}
+
+func (s *ChainPeerSet) refreshLocked() {
+	if s.refreshing || time.Since(s.fetched) < chainPeersTTL {
+		return
+	}
+	s.refreshing = true
+	go func() {
+		_, err := s.fetch()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			log.Warnf("reading the chain peer list: %s", err)
+			// don't hammer the chain when it fails
+			s.fetched = time.Now()
+		}
+		s.refreshing = false
+	}()
+}
+
+// Infos reads the peer list from the chain, and refreshes the cache with
+// it. Peers with no valid address are skipped.
+func (s *ChainPeerSet) Infos() ([]peer.AddrInfo, error) {
+	all, err := s.fetch()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]peer.AddrInfo, 0, len(all))
+	for _, ai := range all {
+		if len(ai.Addrs) > 0 {
+			infos = append(infos, ai)
+		}
+	}
+	return infos, nil
+}
+
+// fetch reads the peer list from the chain and caches the peer IDs.
+func (s *ChainPeerSet) fetch() ([]peer.AddrInfo, error) {
+	peers, err := s.list(0)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]peer.AddrInfo, 0, len(peers))
+	ids := make(map[peer.ID]bool, len(peers))
+	for _, p := range peers {
+		id, err := peer.Decode(p.PeerId)
+		if err != nil {
+			continue
+		}
+		ids[id] = true
+		ai := peer.AddrInfo{ID: id}
+		for _, a := range p.Addresses {
+			maddr, err := ma.NewMultiaddr(a)
+			if err != nil {
+				continue
+			}
+			// addresses may or may not end in /p2p/<id>
+			addr, _ := peer.SplitAddr(maddr)
+			if addr != nil {
+				ai.Addrs = append(ai.Addrs, addr)
+			}
+		}
+		infos = append(infos, ai)
+	}
+
+	s.mu.Lock()
+	s.peers = ids
+	s.fetched = time.Now()
+	s.mu.Unlock()
+	return infos, nil
+}
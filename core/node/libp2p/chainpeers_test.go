@@ -0,0 +1,79 @@
+package libp2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs-auth/standard/model"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	chainPeerA = "QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15"
+	chainPeerB = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+)
+
+func TestChainPeerSetHasDoesNotBlock(t *testing.T) {
+	a, _ := peer.Decode(chainPeerA)
+	b, _ := peer.Decode(chainPeerB)
+
+	release := make(chan struct{})
+	s := &ChainPeerSet{list: func(int) ([]model.CorePeer, error) {
+		<-release
+		return []model.CorePeer{
+			{PeerId: chainPeerA, Addresses: []string{"/ip4/127.0.0.1/tcp/4001/p2p/" + chainPeerA}},
+			{PeerId: chainPeerB},
+		}, nil
+	}}
+
+	done := make(chan bool)
+	go func() { done <- s.Has(a) }()
+	select {
+	case has := <-done:
+		if has {
+			t.Fatal("a peer was registered before the list was read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Has waited for the chain")
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Has(a) {
+		if time.Now().After(deadline) {
+			t.Fatal("the list was never read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.Has(b) {
+		t.Fatal("a peer without address is not registered")
+	}
+
+	// only the peers with an address are peered with
+	infos, err := s.Infos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ID != a || len(infos[0].Addrs) != 1 {
+		t.Fatalf("unexpected peer infos: %v", infos)
+	}
+}
+
+func TestChainPeerSetKeepsListOnError(t *testing.T) {
+	a, _ := peer.Decode(chainPeerA)
+	s := &ChainPeerSet{list: func(int) ([]model.CorePeer, error) {
+		return []model.CorePeer{{PeerId: chainPeerA}}, nil
+	}}
+	if _, err := s.Infos(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.list = func(int) ([]model.CorePeer, error) { return nil, errors.New("chain unreachable") }
+	if _, err := s.Infos(); err == nil {
+		t.Fatal("expected the error of the chain")
+	}
+	if !s.Has(a) {
+		t.Fatal("the previous list was dropped")
+	}
+}
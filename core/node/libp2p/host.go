@@ -26,6 +26,7 @@ type P2PHostIn struct {
 	RoutingOption RoutingOption
 	ID            peer.ID
 	Peerstore     peerstore.Peerstore
+	Limiter       *BandwidthLimiter `optional:"true"`
 
 	Opts [][]libp2p.Option `group:"libp2p"`
 }
@@ -80,6 +81,10 @@ func Host(mctx helpers.MetricsCtx, lc fx.Lifecycle, params P2PHostIn) (out P2PHo
 		out.Host = routedhost.Wrap(out.Host, out.Routing)
 	}
 
+	if params.Limiter != nil {
+		out.Host = LimitHost(out.Host, params.Limiter)
+	}
+
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
 			return out.Host.Close()
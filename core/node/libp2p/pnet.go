@@ -18,23 +18,47 @@ import (
 
 type PNetFingerprint []byte
 
-func PNet(repo repo.Repo) (opts Libp2pOpts, fp PNetFingerprint, err error) {
+func PNet(repo repo.Repo) (opts Libp2pOpts, fp PNetFingerprint, keys *PNetKeys, err error) {
 	swarmkey, err := repo.SwarmKey()
 	if err != nil || swarmkey == nil {
-		return opts, nil, err
+		return opts, nil, nil, err
 	}
 
 	psk, err := pnet.DecodeV1PSK(bytes.NewReader(swarmkey))
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to configure private network: %s", err)
+		return opts, nil, nil, fmt.Errorf("failed to configure private network: %s", err)
 	}
 
-	opts.Opts = append(opts.Opts, libp2p.PrivateNetwork(psk))
+	var next pnet.PSK
+	nextkey, err := repo.NextSwarmKey()
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	if nextkey != nil {
+		next, err = pnet.DecodeV1PSK(bytes.NewReader(nextkey))
+		if err != nil {
+			return opts, nil, nil, fmt.Errorf("failed to configure private network: next key: %s", err)
+		}
+	}
 
-	return opts, pnetFingerprint(psk), nil
+	fp = pnetFingerprint(psk)
+	if pnet.ForcePrivateNetwork {
+		// LIBP2P_FORCE_PNET makes the upgraders refuse the connections
+		// they don't protect with a single key of their own. Keep that
+		// protector, which rules out the rotation.
+		if next != nil {
+			return opts, nil, nil, fmt.Errorf("failed to configure private network: a next swarm key can't be used with %s=1", pnet.EnvKey)
+		}
+		opts.Opts = append(opts.Opts, libp2p.PrivateNetwork(psk))
+		return opts, fp, nil, nil
+	}
+
+	// The key set protects the connections of all the transports, the
+	// relayed ones included, see Transports.
+	return opts, fp, NewPNetKeys(psk, next), nil
 }
 
-func PNetChecker(repo repo.Repo, ph host.Host, lc fx.Lifecycle) error {
+func PNetChecker(repo repo.Repo, ph host.Host, lc fx.Lifecycle, keys *PNetKeys) error {
 	// TODO: better check?
 	swarmkey, err := repo.SwarmKey()
 	if err != nil || swarmkey == nil {
@@ -52,10 +76,14 @@ func PNetChecker(repo repo.Repo, ph host.Host, lc fx.Lifecycle) error {
 				for {
 					select {
 					case <-t.C:
-						if len(ph.Network().Peers()) == 0 {
+						peers := ph.Network().Peers()
+						if len(peers) == 0 {
 							log.Warn("We are in private network and have no peers.")
 							log.Warn("This might be configuration mistake.")
 						}
+						if keys != nil {
+							keys.Forget(peers)
+						}
 					case <-done:
 						return
 					}
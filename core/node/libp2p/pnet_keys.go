@@ -0,0 +1,292 @@
+package libp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/davidlazar/go-crypto/salsa20"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/sec"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+)
+
+// pnetNonceSize is the size of the nonce each side of a private network
+// connection sends first.
+const pnetNonceSize = 24
+
+// pnetFirstMessage is what a libp2p peer sends first on a connection, the
+// multistream header. It tells which key the peer encrypts with.
+var pnetFirstMessage = []byte("\x13/multistream/1.0.0\n")
+
+var errUnknownSwarmKey = errors.New("peer uses an unknown swarm key")
+
+// Names of the swarm keys, as reported by PeerKey.
+const (
+	PNetKeyPrimary = "primary"
+	PNetKeyNext    = "next"
+	PNetKeyRetired = "retired"
+)
+
+// PNetKeys holds the swarm keys of the private network: the primary key,
+// and while the key is rotated, the next key. Connections are dialed with
+// the primary key; both keys are accepted, and an inbound connection
+// answers with the key of the peer, so that the nodes can switch to the
+// next key one at a time.
+//
+// The wire format is the one of the stock private network protector:
+// with a single key, the node talks to any peer of the network.
+type PNetKeys struct {
+	mu      sync.RWMutex
+	primary pnetKey
+	next    *pnetKey
+
+	// peers records the fingerprint of the key each peer connected with.
+	peers map[peer.ID]string
+}
+
+type pnetKey struct {
+	psk [32]byte
+	fp  PNetFingerprint
+}
+
+func newPNetKey(psk pnet.PSK) pnetKey {
+	var k pnetKey
+	copy(k.psk[:], psk)
+	k.fp = pnetFingerprint(psk)
+	return k
+}
+
+// NewPNetKeys returns the key set with the primary key and the optional next
+// key.
+func NewPNetKeys(primary, next pnet.PSK) *PNetKeys {
+	k := &PNetKeys{peers: make(map[peer.ID]string)}
+	k.Set(primary, next)
+	return k
+}
+
+// Set replaces the keys. A nil next key ends the rotation. The connections
+// already established are kept.
+func (k *PNetKeys) Set(primary, next pnet.PSK) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.primary = newPNetKey(primary)
+	k.next = nil
+	if next != nil {
+		nk := newPNetKey(next)
+		k.next = &nk
+	}
+}
+
+// Fingerprints returns the fingerprints of the primary key and of the next
+// key, nil if none.
+func (k *PNetKeys) Fingerprints() (primary, next PNetFingerprint) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.next != nil {
+		next = k.next.fp
+	}
+	return k.primary.fp, next
+}
+
+// PeerKey tells which key p connected with: PNetKeyPrimary, PNetKeyNext, or
+// PNetKeyRetired for a key replaced since. It returns false for the peers
+// not connected since the keys were loaded.
+func (k *PNetKeys) PeerKey(p peer.ID) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	fp, ok := k.peers[p]
+	switch {
+	case !ok:
+		return "", false
+	case fp == string(k.primary.fp):
+		return PNetKeyPrimary, true
+	case k.next != nil && fp == string(k.next.fp):
+		return PNetKeyNext, true
+	default:
+		return PNetKeyRetired, true
+	}
+}
+
+// Forget drops what is recorded about the peers not in connected.
+func (k *PNetKeys) Forget(connected []peer.ID) {
+	keep := make(map[peer.ID]bool, len(connected))
+	for _, p := range connected {
+		keep[p] = true
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for p := range k.peers {
+		if !keep[p] {
+			delete(k.peers, p)
+		}
+	}
+}
+
+func (k *PNetKeys) record(p peer.ID, fp PNetFingerprint) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.peers[p] = string(fp)
+}
+
+// Protect makes u protect the connections with the key set, and returns
+// it. u is changed in place: libp2p hands the same upgrader to all the
+// transports and to the relay, so that the relayed connections are
+// protected with the key set too. Protecting u twice is a no-op.
+func (k *PNetKeys) Protect(u *tptu.Upgrader) (*tptu.Upgrader, error) {
+	if _, ok := u.Secure.(*pnetSecurity); ok {
+		return u, nil
+	}
+	if u.PSK != nil {
+		return nil, errors.New("the upgrader is already protected by a single swarm key")
+	}
+	u.Secure = &pnetSecurity{SecureMuxer: u.Secure, keys: k}
+	return u, nil
+}
+
+// protect wraps a raw connection. Outbound connections are written with the
+// primary key.
+func (k *PNetKeys) protect(conn net.Conn, outbound bool) *pnetConn {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	pc := &pnetConn{Conn: conn, accepted: []pnetKey{k.primary}}
+	if k.next != nil {
+		pc.accepted = append(pc.accepted, *k.next)
+	}
+	if outbound {
+		pc.writeKey = &pc.accepted[0]
+	}
+	return pc
+}
+
+// pnetSecurity protects the connections before the security handshake, as
+// the upgrader would.
+type pnetSecurity struct {
+	sec.SecureMuxer
+	keys *PNetKeys
+}
+
+func (s *pnetSecurity) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, bool, error) {
+	pc := s.keys.protect(insecure, false)
+	sc, server, err := s.SecureMuxer.SecureInbound(ctx, pc)
+	if err != nil {
+		return nil, server, err
+	}
+	if pc.readKey != nil {
+		s.keys.record(sc.RemotePeer(), pc.readKey.fp)
+	}
+	return sc, server, nil
+}
+
+func (s *pnetSecurity) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, bool, error) {
+	pc := s.keys.protect(insecure, true)
+	sc, server, err := s.SecureMuxer.SecureOutbound(ctx, pc, p)
+	if err != nil {
+		return nil, server, err
+	}
+	if pc.readKey != nil {
+		s.keys.record(sc.RemotePeer(), pc.readKey.fp)
+	}
+	return sc, server, nil
+}
+
+// pnetConn is a private network connection: each side sends a nonce, then
+// its data encrypted with XSalsa20 under the swarm key. The key of the peer
+// is found by decrypting its first message.
+type pnetConn struct {
+	net.Conn
+	accepted []pnetKey
+
+	detectOnce sync.Once
+	detectErr  error
+	readKey    *pnetKey
+	readS      cipher.Stream
+	pending    []byte // first message, decrypted
+
+	wmu      sync.Mutex
+	writeKey *pnetKey // nil until detected on inbound connections
+	writeS   cipher.Stream
+}
+
+// detect reads the nonce and the first message of the peer, and finds the
+// key it is encrypted with.
+func (c *pnetConn) detect() error {
+	c.detectOnce.Do(func() {
+		buf := make([]byte, pnetNonceSize+len(pnetFirstMessage))
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			c.detectErr = err
+			return
+		}
+		nonce, first := buf[:pnetNonceSize], buf[pnetNonceSize:]
+
+		plain := make([]byte, len(first))
+		for i := range c.accepted {
+			s := salsa20.New(&c.accepted[i].psk, nonce)
+			s.XORKeyStream(plain, first)
+			if bytes.Equal(plain, pnetFirstMessage) {
+				c.readKey = &c.accepted[i]
+				c.readS = s
+				c.pending = plain
+				return
+			}
+		}
+		log.Debugf("connection from %s: %s", c.Conn.RemoteAddr(), errUnknownSwarmKey)
+		c.detectErr = errUnknownSwarmKey
+	})
+	return c.detectErr
+}
+
+func (c *pnetConn) Read(out []byte) (int, error) {
+	if err := c.detect(); err != nil {
+		return 0, err
+	}
+	if len(c.pending) > 0 {
+		n := copy(out, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(out)
+	if n > 0 {
+		c.readS.XORKeyStream(out[:n], out[:n])
+	}
+	return n, err
+}
+
+func (c *pnetConn) Write(in []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.writeS == nil {
+		if c.writeKey == nil {
+			// answer with the key of the peer, which sends first
+			if err := c.detect(); err != nil {
+				return 0, err
+			}
+			c.writeKey = c.readKey
+		}
+		nonce := make([]byte, pnetNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, fmt.Errorf("generating the private network nonce: %s", err)
+		}
+		if _, err := c.Conn.Write(nonce); err != nil {
+			return 0, err
+		}
+		c.writeS = salsa20.New(&c.writeKey.psk, nonce)
+	}
+
+	out := make([]byte, len(in))
+	c.writeS.XORKeyStream(out, in)
+	return c.Conn.Write(out)
+}
@@ -0,0 +1,85 @@
+package libp2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+func testPSK(b byte) pnet.PSK {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// pnetPair connects a connection dialed with dialer to one accepted with
+// listener.
+func pnetPair(t *testing.T, dialer, listener *PNetKeys) (out, in *pnetConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return dialer.protect(a, true), listener.protect(b, false)
+}
+
+// exchange sends msg over w after the multistream header, and reads it on r.
+func exchange(w, r *pnetConn, msg string) (string, error) {
+	sent := append(append([]byte{}, pnetFirstMessage...), msg...)
+	go func() { _, _ = w.Write(sent) }()
+
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(r, got); err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(got, pnetFirstMessage) {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(got[len(pnetFirstMessage):]), nil
+}
+
+func TestPNetConnKeyDetection(t *testing.T) {
+	k1, k2, k3 := testPSK(1), testPSK(2), testPSK(3)
+
+	for _, tc := range []struct {
+		name             string
+		dialer, listener *PNetKeys
+		want             string // the key the listener detects
+	}{
+		{"same primary key", NewPNetKeys(k1, nil), NewPNetKeys(k1, nil), PNetKeyPrimary},
+		{"dialer promoted", NewPNetKeys(k2, k1), NewPNetKeys(k1, k2), PNetKeyNext},
+		{"listener promoted", NewPNetKeys(k1, nil), NewPNetKeys(k2, k1), PNetKeyNext},
+	} {
+		out, in := pnetPair(t, tc.dialer, tc.listener)
+		if got, err := exchange(out, in, "ping"); err != nil || got != "ping" {
+			t.Fatalf("%s: received %q, %v", tc.name, got, err)
+		}
+
+		fp, next := tc.listener.Fingerprints()
+		if tc.want == PNetKeyNext {
+			fp = next
+		}
+		if !bytes.Equal(in.readKey.fp, fp) {
+			t.Fatalf("%s: the %s key was not detected", tc.name, tc.want)
+		}
+
+		// the listener answers with the key of the dialer
+		if got, err := exchange(in, out, "pong"); err != nil || got != "pong" {
+			t.Fatalf("%s: the answer was %q, %v", tc.name, got, err)
+		}
+		if !bytes.Equal(in.writeKey.fp, in.readKey.fp) {
+			t.Fatalf("%s: the listener answered with another key", tc.name)
+		}
+	}
+
+	out, in := pnetPair(t, NewPNetKeys(k3, nil), NewPNetKeys(k1, k2))
+	if _, err := exchange(out, in, "ping"); err != errUnknownSwarmKey {
+		t.Fatalf("expected errUnknownSwarmKey, got %v", err)
+	}
+	// nothing is sent to a peer using an unknown key
+	if _, err := in.Write([]byte("pong")); err != errUnknownSwarmKey {
+		t.Fatalf("expected errUnknownSwarmKey, got %v", err)
+	}
+}
@@ -10,17 +10,25 @@ import (
 )
 
 func FloodSub(pubsubOptions ...pubsub.Option) interface{} {
-	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, disc discovery.Discovery) (service *pubsub.PubSub, err error) {
-		return pubsub.NewFloodSub(helpers.LifecycleCtx(mctx, lc), host, append(pubsubOptions, pubsub.WithDiscovery(disc))...)
+	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, disc discovery.Discovery, acl *PubsubACL) (service *pubsub.PubSub, err error) {
+		ps, err := pubsub.NewFloodSub(helpers.LifecycleCtx(mctx, lc), host, append(pubsubOptions, pubsub.WithDiscovery(disc))...)
+		if err != nil {
+			return nil, err
+		}
+		return ps, acl.Register(ps)
 	}
 }
 
 func GossipSub(pubsubOptions ...pubsub.Option) interface{} {
-	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, disc discovery.Discovery) (service *pubsub.PubSub, err error) {
-		return pubsub.NewGossipSub(helpers.LifecycleCtx(mctx, lc), host, append(
+	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, disc discovery.Discovery, acl *PubsubACL) (service *pubsub.PubSub, err error) {
+		ps, err := pubsub.NewGossipSub(helpers.LifecycleCtx(mctx, lc), host, append(
 			pubsubOptions,
 			pubsub.WithDiscovery(disc),
 			pubsub.WithFloodPublish(true))...,
 		)
+		if err != nil {
+			return nil, err
+		}
+		return ps, acl.Register(ps)
 	}
 }
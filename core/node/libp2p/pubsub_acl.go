@@ -0,0 +1,256 @@
+package libp2p
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-ipfs/repo"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// PubsubACLConfigKey is the config section holding the PubsubACLConfig.
+const PubsubACLConfigKey = "PubsubACL"
+
+// PubsubACLConfig restricts what is accepted on pubsub topics.
+type PubsubACLConfig struct {
+	// Topics holds the policy of each restricted topic, keyed by the exact
+	// topic name.
+	Topics map[string]PubsubTopicPolicy `json:",omitempty"`
+}
+
+// PubsubTopicPolicy is the policy of a topic. The zero policy accepts
+// everything.
+type PubsubTopicPolicy struct {
+	// Publishers are the peer IDs allowed to publish on the topic.
+	Publishers []string `json:",omitempty"`
+
+	// ChainPeers allows the peers registered on chain to publish, besides
+	// Publishers.
+	ChainPeers bool `json:",omitempty"`
+
+	// RequireSignature rejects the messages that are not signed by their
+	// publisher, even when signing is disabled node-wide. It is implied by
+	// Publishers and ChainPeers: the publisher of an unsigned message could
+	// be anyone.
+	RequireSignature bool `json:",omitempty"`
+
+	// MaxMessageSize caps the payload of a message, such as "64KiB".
+	MaxMessageSize string `json:",omitempty"`
+}
+
+// Reasons a message is rejected for.
+const (
+	RejectPublisher = "publisher not allowed"
+	RejectUnsigned  = "unsigned"
+	RejectSignature = "bad signature"
+	RejectTooLarge  = "too large"
+)
+
+// signPrefix is prepended to the messages signed by pubsub publishers.
+const signPrefix = "libp2p-pubsub:"
+
+// PubsubACL enforces the topic policies through pubsub topic validators,
+// and counts the messages they reject.
+type PubsubACL struct {
+	topics map[string]*topicACL
+}
+
+type topicACL struct {
+	policy     PubsubTopicPolicy
+	publishers map[peer.ID]bool
+	maxSize    uint64
+	isChain    func(peer.ID) bool
+
+	mu       sync.Mutex
+	rejected map[string]uint64
+}
+
+// NewPubsubACL checks the topic policies of cfg.
+func NewPubsubACL(cfg PubsubACLConfig) (*PubsubACL, error) {
+	acl := &PubsubACL{topics: make(map[string]*topicACL, len(cfg.Topics))}
+	for topic, p := range cfg.Topics {
+		t := &topicACL{
+			policy:   p,
+			rejected: make(map[string]uint64),
+		}
+		if len(p.Publishers) > 0 {
+			t.publishers = make(map[peer.ID]bool, len(p.Publishers))
+			for _, s := range p.Publishers {
+				pid, err := peer.Decode(s)
+				if err != nil {
+					return nil, fmt.Errorf("pubsub topic %q: invalid publisher %q: %s", topic, s, err)
+				}
+				t.publishers[pid] = true
+			}
+		}
+		if p.ChainPeers {
+			t.isChain = ChainPeers.Has
+			ChainPeers.Prefetch()
+		}
+		if t.publishers != nil || t.isChain != nil {
+			t.policy.RequireSignature = true
+		}
+		if p.MaxMessageSize != "" {
+			n, err := humanize.ParseBytes(p.MaxMessageSize)
+			if err != nil {
+				return nil, fmt.Errorf("pubsub topic %q: invalid max message size %q: %s", topic, p.MaxMessageSize, err)
+			}
+			t.maxSize = n
+		}
+		acl.topics[topic] = t
+	}
+	return acl, nil
+}
+
+// PubsubTopicACL reads the topic policies from the config.
+func PubsubTopicACL(r repo.Repo) (*PubsubACL, error) {
+	var cfg PubsubACLConfig
+	if err := repo.ConfigSection(r, PubsubACLConfigKey, &cfg); err != nil {
+		return nil, err
+	}
+	return NewPubsubACL(cfg)
+}
+
+// Register installs a validator on ps for each restricted topic.
+func (acl *PubsubACL) Register(ps *pubsub.PubSub) error {
+	if acl == nil {
+		return nil
+	}
+	for topic, t := range acl.topics {
+		if err := ps.RegisterTopicValidator(topic, t.validate); err != nil {
+			return fmt.Errorf("pubsub topic %q: %s", topic, err)
+		}
+	}
+	return nil
+}
+
+// Policy returns the policy of topic, and whether it is restricted.
+func (acl *PubsubACL) Policy(topic string) (PubsubTopicPolicy, bool) {
+	if acl == nil {
+		return PubsubTopicPolicy{}, false
+	}
+	t, ok := acl.topics[topic]
+	if !ok {
+		return PubsubTopicPolicy{}, false
+	}
+	return t.policy, true
+}
+
+// Rejected returns the number of messages rejected on topic, by reason.
+func (acl *PubsubACL) Rejected(topic string) map[string]uint64 {
+	if acl == nil {
+		return nil
+	}
+	t, ok := acl.topics[topic]
+	if !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]uint64, len(t.rejected))
+	for reason, n := range t.rejected {
+		out[reason] = n
+	}
+	return out
+}
+
+// Topics returns the restricted topics, sorted.
+func (acl *PubsubACL) Topics() []string {
+	if acl == nil {
+		return nil
+	}
+	out := make([]string, 0, len(acl.topics))
+	for topic := range acl.topics {
+		out = append(out, topic)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (t *topicACL) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if reason := t.check(msg); reason != "" {
+		t.mu.Lock()
+		t.rejected[reason]++
+		t.mu.Unlock()
+		log.Debugf("pubsub: rejecting message from %s relayed by %s: %s", peer.ID(msg.Message.GetFrom()), from, reason)
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
+// check returns why msg is rejected, or "" if it is accepted.
+func (t *topicACL) check(msg *pubsub.Message) string {
+	if t.maxSize > 0 && uint64(len(msg.GetData())) > t.maxSize {
+		return RejectTooLarge
+	}
+
+	// the publisher is only known once the signature is checked
+	if t.policy.RequireSignature {
+		if len(msg.GetSignature()) == 0 {
+			return RejectUnsigned
+		}
+		if err := verifySignature(msg.Message); err != nil {
+			return RejectSignature
+		}
+	}
+
+	if t.publishers != nil || t.isChain != nil {
+		pid, err := peer.IDFromBytes(msg.Message.GetFrom())
+		if err != nil {
+			return RejectPublisher
+		}
+		if !t.publishers[pid] && (t.isChain == nil || !t.isChain(pid)) {
+			return RejectPublisher
+		}
+	}
+	return ""
+}
+
+// verifySignature checks that m is signed by the peer in its From field, the
+// way pubsub signs messages.
+func verifySignature(m *pb.Message) error {
+	pid, err := peer.IDFromBytes(m.GetFrom())
+	if err != nil {
+		return err
+	}
+
+	var pk crypto.PubKey
+	if len(m.GetKey()) > 0 {
+		pk, err = crypto.UnmarshalPublicKey(m.GetKey())
+		if err != nil {
+			return err
+		}
+		if !pid.MatchesPublicKey(pk) {
+			return fmt.Errorf("key does not match the publisher")
+		}
+	} else {
+		pk, err = pid.ExtractPublicKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	unsigned := *m
+	unsigned.Signature = nil
+	unsigned.Key = nil
+	b, err := unsigned.Marshal()
+	if err != nil {
+		return err
+	}
+	ok, err := pk.Verify(append([]byte(signPrefix), b...), m.GetSignature())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
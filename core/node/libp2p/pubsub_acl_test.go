@@ -0,0 +1,78 @@
+package libp2p
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func testPublisher(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	sk, pk, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk, pid
+}
+
+// testMessage returns a message claiming to be published by from, signed
+// with sk unless it is nil.
+func testMessage(t *testing.T, topic string, from peer.ID, sk crypto.PrivKey) *pubsub.Message {
+	t.Helper()
+	m := &pb.Message{From: []byte(from), Data: []byte("hello"), Seqno: []byte{1}, Topic: &topic}
+	if sk != nil {
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Signature, err = sk.Sign(append([]byte(signPrefix), b...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &pubsub.Message{Message: m}
+}
+
+func TestPubsubACLPublishers(t *testing.T) {
+	sk, pid := testPublisher(t)
+	otherSk, other := testPublisher(t)
+
+	acl, err := NewPubsubACL(PubsubACLConfig{Topics: map[string]PubsubTopicPolicy{
+		"restricted": {Publishers: []string{pid.Pretty()}},
+		"open":       {MaxMessageSize: "1KiB"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := acl.Policy("restricted"); !p.RequireSignature {
+		t.Fatal("an allow-list does not require signatures")
+	}
+	restricted := acl.topics["restricted"]
+
+	for _, tc := range []struct {
+		name string
+		msg  *pubsub.Message
+		want string
+	}{
+		{"signed by the publisher", testMessage(t, "restricted", pid, sk), ""},
+		{"unsigned", testMessage(t, "restricted", pid, nil), RejectUnsigned},
+		{"forged", testMessage(t, "restricted", pid, otherSk), RejectSignature},
+		{"another publisher", testMessage(t, "restricted", other, otherSk), RejectPublisher},
+	} {
+		if got := restricted.check(tc.msg); got != tc.want {
+			t.Errorf("%s: got %q, expected %q", tc.name, got, tc.want)
+		}
+	}
+
+	// without an allow-list, unsigned messages are fine
+	if got := acl.topics["open"].check(testMessage(t, "open", other, nil)); got != "" {
+		t.Fatalf("an unsigned message was rejected on an open topic: %s", got)
+	}
+}
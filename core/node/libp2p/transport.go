@@ -7,6 +7,7 @@ import (
 	libp2p "github.com/libp2p/go-libp2p"
 	metrics "github.com/libp2p/go-libp2p-core/metrics"
 	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
 	tcp "github.com/libp2p/go-tcp-transport"
 	websocket "github.com/libp2p/go-ws-transport"
 	quic "github.com/lucas-clemente/quic-go"
@@ -25,15 +26,44 @@ func Transports(tptConfig config.Transports) interface{} {
 	return func(pnet struct {
 		fx.In
 		Fprint PNetFingerprint `optional:"true"`
+		Keys   *PNetKeys       `optional:"true"`
 	}) (opts Libp2pOpts, err error) {
 		privateNetworkEnabled := pnet.Fprint != nil
 
-		if tptConfig.Network.TCP.WithDefault(true) {
-			opts.Opts = append(opts.Opts, libp2p.Transport(tcp.NewTCPTransport))
+		tcpEnabled := tptConfig.Network.TCP.WithDefault(true)
+		wsEnabled := tptConfig.Network.Websocket.WithDefault(true)
+		if pnet.Keys != nil && !tcpEnabled && !wsEnabled {
+			// the upgrader, relay included, is protected by the
+			// constructors of these transports
+			return opts, fmt.Errorf("private networks need the TCP or the Websocket transport")
 		}
 
-		if tptConfig.Network.Websocket.WithDefault(true) {
-			opts.Opts = append(opts.Opts, libp2p.Transport(websocket.New))
+		if tcpEnabled {
+			if pnet.Keys != nil {
+				opts.Opts = append(opts.Opts, libp2p.Transport(func(u *tptu.Upgrader) (*tcp.TcpTransport, error) {
+					u, err := pnet.Keys.Protect(u)
+					if err != nil {
+						return nil, err
+					}
+					return tcp.NewTCPTransport(u), nil
+				}))
+			} else {
+				opts.Opts = append(opts.Opts, libp2p.Transport(tcp.NewTCPTransport))
+			}
+		}
+
+		if wsEnabled {
+			if pnet.Keys != nil {
+				opts.Opts = append(opts.Opts, libp2p.Transport(func(u *tptu.Upgrader) (*websocket.WebsocketTransport, error) {
+					u, err := pnet.Keys.Protect(u)
+					if err != nil {
+						return nil, err
+					}
+					return websocket.New(u), nil
+				}))
+			} else {
+				opts.Opts = append(opts.Opts, libp2p.Transport(websocket.New))
+			}
 		}
 
 		if tptConfig.Network.QUIC.WithDefault(!privateNetworkEnabled) {
@@ -8,6 +8,7 @@ import (
 
 	"github.com/ipfs/go-filestore"
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/thirdparty/cidv0v1"
 	"github.com/ipfs/go-ipfs/thirdparty/verifbs"
@@ -52,23 +53,52 @@ func BaseBlockstoreCtor(cacheOpts blockstore.CacheOpts, nilRepo bool, hashOnRead
 }
 
 // GcBlockstoreCtor wraps the base blockstore with GC and Filestore layers
-func GcBlockstoreCtor(bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore) {
+func GcBlockstoreCtor(repo repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, err error) {
 	gclocker = blockstore.NewGCLocker()
 	gcbs = blockstore.NewGCBlockstore(bb, gclocker)
+	if gcbs, err = quotaBlockstore(repo, gcbs); err != nil {
+		return
+	}
+	gcbs = gc.NewBarrierBlockstore(gcbs)
 
 	bs = gcbs
 	return
 }
 
 // GcBlockstoreCtor wraps GcBlockstore and adds Filestore support
-func FilestoreBlockstoreCtor(repo repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore) {
+func FilestoreBlockstoreCtor(repo repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore, err error) {
 	gclocker = blockstore.NewGCLocker()
 
 	// hash security
 	fstore = filestore.NewFilestore(bb, repo.FileManager())
 	gcbs = blockstore.NewGCBlockstore(fstore, gclocker)
 	gcbs = &verifbs.VerifBSGC{GCBlockstore: gcbs}
+	if gcbs, err = quotaBlockstore(repo, gcbs); err != nil {
+		return
+	}
+	gcbs = gc.NewBarrierBlockstore(gcbs)
 
 	bs = gcbs
 	return
 }
+
+// quotaBlockstore enforces the storage quotas on bs when they are enabled.
+// They only take effect once the blocks are classified by the daemon.
+func quotaBlockstore(r repo.Repo, bs blockstore.GCBlockstore) (blockstore.GCBlockstore, error) {
+	var qcfg gc.QuotaConfig
+	if err := repo.ConfigSection(r, gc.QuotaConfigKey, &qcfg); err != nil {
+		return nil, err
+	}
+	if !qcfg.Enabled {
+		return bs, nil
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	limits, err := qcfg.Limits(cfg.Datastore.StorageMax)
+	if err != nil {
+		return nil, err
+	}
+	return gc.NewQuotaBlockstore(bs, limits), nil
+}
@@ -0,0 +1,441 @@
+// Package durablesub keeps durable pubsub subscriptions.
+//
+// A durable subscription records the messages of its topic in the datastore
+// under a subscriber name, whether a client is reading them or not. Each
+// message gets a sequence number, so that a client reconnecting after a
+// blip can replay the messages it missed, from the last one it processed,
+// before the live ones. The history of a subscription is bounded: the
+// oldest messages are dropped first.
+package durablesub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+var log = logging.Logger("durablesub")
+
+// DefaultMaxMessages is the number of messages a subscription keeps when
+// none is configured.
+const DefaultMaxMessages = 1000
+
+// ConfigKey is the config section holding the Config.
+const ConfigKey = "PubsubDurable"
+
+// Config configures the durable subscriptions.
+type Config struct {
+	// MaxMessages is the number of messages each subscription keeps.
+	MaxMessages int `json:",omitempty"`
+}
+
+var (
+	// ErrNotFound is returned for a subscriber name not subscribed.
+	ErrNotFound = errors.New("no such durable subscription")
+
+	errInvalidName = errors.New("invalid subscriber name: must be non-empty and without '/'")
+)
+
+var (
+	// subsPrefix holds the topic of each subscription, by name.
+	subsPrefix = datastore.NewKey("/local/pubsub-durable/subs")
+	// msgsPrefix holds the messages of each subscription, by name then
+	// sequence number.
+	msgsPrefix = datastore.NewKey("/local/pubsub-durable/msgs")
+)
+
+// Message is a message recorded for a durable subscription.
+type Message struct {
+	// Seq numbers the messages of the subscription from 1.
+	Seq      uint64
+	From     string
+	Data     []byte
+	Seqno    []byte
+	TopicIDs []string
+	Received time.Time
+}
+
+// Info describes a durable subscription.
+type Info struct {
+	Name  string
+	Topic string
+
+	// First and Last are the sequence numbers of the oldest and newest
+	// messages kept, zero if there are none.
+	First uint64
+	Last  uint64
+}
+
+type subMeta struct {
+	Topic string
+}
+
+// Service runs the durable subscriptions of the node.
+type Service struct {
+	ctx context.Context
+	ps  *pubsub.PubSub
+	ds  datastore.Datastore
+	max uint64
+
+	mu   sync.Mutex
+	subs map[string]*sub
+}
+
+type sub struct {
+	name   string
+	topic  string
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	first    uint64 // oldest message kept
+	next     uint64 // number of the next message
+	watchers map[chan struct{}]struct{}
+	removed  bool
+}
+
+// New starts the durable subscriptions recorded in ds. Each keeps at most
+// maxMessages messages, DefaultMaxMessages if zero.
+func New(ctx context.Context, ps *pubsub.PubSub, ds datastore.Datastore, maxMessages int) (*Service, error) {
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxMessages
+	}
+	s := &Service{
+		ctx:  ctx,
+		ps:   ps,
+		ds:   ds,
+		max:  uint64(maxMessages),
+		subs: make(map[string]*sub),
+	}
+
+	res, err := ds.Query(query.Query{Prefix: subsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		var meta subMeta
+		if err := json.Unmarshal(e.Value, &meta); err != nil {
+			log.Warnf("skipping durable subscription %s: %s", e.Key, err)
+			continue
+		}
+		sb, err := s.load(datastore.NewKey(e.Key).BaseNamespace(), meta.Topic)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.start(sb); err != nil {
+			return nil, err
+		}
+		s.subs[sb.name] = sb
+	}
+	if err := s.dropOrphans(msgsPrefix); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dropOrphans deletes the messages under prefix of the names not subscribed,
+// left behind by a Remove interrupted between dropping a subscription and
+// dropping its messages. Callers hold s.mu, or own s.
+func (s *Service) dropOrphans(prefix datastore.Key) error {
+	res, err := s.ds.Query(query.Query{
+		Prefix:   prefix.String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		k := datastore.NewKey(e.Key)
+		if _, ok := s.subs[k.Parent().BaseNamespace()]; ok {
+			continue
+		}
+		if err := s.ds.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func msgKey(name string, seq uint64) datastore.Key {
+	return msgsPrefix.ChildString(name).ChildString(fmt.Sprintf("%020d", seq))
+}
+
+// load reads the range of messages kept for the subscription name.
+func (s *Service) load(name, topic string) (*sub, error) {
+	sb := &sub{
+		name:     name,
+		topic:    topic,
+		first:    1,
+		next:     1,
+		watchers: make(map[chan struct{}]struct{}),
+	}
+	res, err := s.ds.Query(query.Query{
+		Prefix:   msgsPrefix.ChildString(name).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		seq, err := strconv.ParseUint(datastore.NewKey(e.Key).BaseNamespace(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if i == 0 || seq < sb.first {
+			sb.first = seq
+		}
+		if seq >= sb.next {
+			sb.next = seq + 1
+		}
+	}
+	return sb, nil
+}
+
+func (s *Service) start(sb *sub) error {
+	psub, err := s.ps.Subscribe(sb.topic) //nolint:staticcheck
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	sb.cancel = cancel
+
+	go func() {
+		defer psub.Cancel()
+		for {
+			msg, err := psub.Next(ctx)
+			if err != nil {
+				return
+			}
+			if err := s.record(sb, Message{
+				From:     peer.ID(msg.Message.GetFrom()).String(),
+				Data:     msg.GetData(),
+				Seqno:    msg.GetSeqno(),
+				TopicIDs: msg.GetTopicIDs(),
+				Received: time.Now(),
+			}); err != nil {
+				log.Errorf("recording a message of durable subscription %s: %s", sb.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// record numbers m, stores it and drops the oldest messages over the limit.
+func (s *Service) record(sb *sub, m Message) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.removed {
+		return nil
+	}
+	m.Seq = sb.next
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := s.ds.Put(msgKey(sb.name, m.Seq), b); err != nil {
+		return err
+	}
+	sb.next++
+
+	for sb.next-sb.first > s.max {
+		if err := s.ds.Delete(msgKey(sb.name, sb.first)); err != nil {
+			return err
+		}
+		sb.first++
+	}
+
+	for w := range sb.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe creates the durable subscription name to topic, unless it
+// exists already. Subscribing an existing name to another topic fails.
+func (s *Service) Subscribe(name, topic string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return errInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sb, ok := s.subs[name]; ok {
+		if sb.topic != topic {
+			return fmt.Errorf("durable subscription %s is subscribed to %q", name, sb.topic)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(subMeta{Topic: topic})
+	if err != nil {
+		return err
+	}
+	// number on from the messages an interrupted Remove left behind, so
+	// that a client resuming from the removed subscription doesn't take the
+	// new messages for ones it processed, but don't replay them
+	sb, err := s.load(name, topic)
+	if err != nil {
+		return err
+	}
+	if err := s.dropOrphans(msgsPrefix.ChildString(name)); err != nil {
+		return err
+	}
+	sb.first = sb.next
+	if err := s.ds.Put(subsPrefix.ChildString(name), b); err != nil {
+		return err
+	}
+	if err := s.start(sb); err != nil {
+		return err
+	}
+	s.subs[name] = sb
+	return nil
+}
+
+// Remove ends the durable subscription name and drops its messages.
+func (s *Service) Remove(name string) error {
+	s.mu.Lock()
+	sb, ok := s.subs[name]
+	delete(s.subs, name)
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	sb.cancel()
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.removed = true
+	for w := range sb.watchers {
+		close(w)
+		delete(sb.watchers, w)
+	}
+	if err := s.ds.Delete(subsPrefix.ChildString(name)); err != nil {
+		return err
+	}
+	for seq := sb.first; seq < sb.next; seq++ {
+		if err := s.ds.Delete(msgKey(name, seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) get(name string) (*sub, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sb, ok := s.subs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return sb, nil
+}
+
+// Read returns up to limit messages of the subscription name numbered
+// after since, oldest first. The messages dropped from the history, or
+// missing from the datastore, are skipped: the caller sees a gap in the
+// numbers.
+func (s *Service) Read(name string, since uint64, limit int) ([]Message, error) {
+	sb, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	from := since + 1
+	if from < sb.first {
+		from = sb.first
+	}
+	var msgs []Message
+	for seq := from; seq < sb.next && len(msgs) < limit; seq++ {
+		b, err := s.ds.Get(msgKey(name, seq))
+		if err == datastore.ErrNotFound {
+			// lost, e.g. to an interrupted trim: a gap like a dropped one
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Watch returns a channel signaled when a message is recorded for the
+// subscription name, and closed if the subscription is removed. The
+// returned function stops the notifications.
+func (s *Service) Watch(name string) (<-chan struct{}, func(), error) {
+	sb, err := s.get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	w := make(chan struct{}, 1)
+	sb.watchers[w] = struct{}{}
+	return w, func() {
+		sb.mu.Lock()
+		defer sb.mu.Unlock()
+		delete(sb.watchers, w)
+	}, nil
+}
+
+// List describes the durable subscriptions, sorted by name.
+func (s *Service) List() []Info {
+	s.mu.Lock()
+	subs := make([]*sub, 0, len(s.subs))
+	for _, sb := range s.subs {
+		subs = append(subs, sb)
+	}
+	s.mu.Unlock()
+
+	out := make([]Info, 0, len(subs))
+	for _, sb := range subs {
+		sb.mu.Lock()
+		info := Info{Name: sb.name, Topic: sb.topic}
+		if sb.next > sb.first {
+			info.First, info.Last = sb.first, sb.next-1
+		}
+		sb.mu.Unlock()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,159 @@
+package durablesub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func TestRecordReadTrim(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	s := &Service{
+		ctx:  context.Background(),
+		ds:   ds,
+		max:  3,
+		subs: make(map[string]*sub),
+	}
+	sb, err := s.load("app", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.cancel = func() {}
+	s.subs["app"] = sb
+
+	w, stop, err := s.Watch("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 1; i <= 5; i++ {
+		if err := s.record(sb, Message{Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-w:
+	default:
+		t.Fatal("expected the watcher to be signaled")
+	}
+
+	// only the last 3 messages are kept
+	msgs, err := s.Read("app", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].Seq != 3 || string(msgs[2].Data) != "5" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+
+	msgs, err = s.Read("app", 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Seq != 5 {
+		t.Fatalf("unexpected messages after 4: %+v", msgs)
+	}
+
+	msgs, err = s.Read("app", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected the limit to apply, got %d messages", len(msgs))
+	}
+
+	// the numbering survives a restart
+	reloaded, err := s.load("app", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.first != 3 || reloaded.next != 6 {
+		t.Fatalf("reloaded range [%d, %d), expected [3, 6)", reloaded.first, reloaded.next)
+	}
+
+	if info := s.List(); len(info) != 1 || info[0].First != 3 || info[0].Last != 5 {
+		t.Fatalf("unexpected list: %+v", info)
+	}
+
+	if err := s.Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w; ok {
+		t.Fatal("expected the watcher to be closed")
+	}
+	if _, err := s.Read("app", 0, 10); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if sb, err := s.load("app", "events"); err != nil || sb.next != 1 {
+		t.Fatalf("expected the messages to be dropped: %v", err)
+	}
+}
+
+func TestReadSkipsMissing(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	s := &Service{
+		ctx:  context.Background(),
+		ds:   ds,
+		max:  10,
+		subs: make(map[string]*sub),
+	}
+	sb, err := s.load("app", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.cancel = func() {}
+	s.subs["app"] = sb
+
+	for i := 1; i <= 3; i++ {
+		if err := s.record(sb, Message{Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Delete(msgKey("app", 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := s.Read("app", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Seq != 1 || msgs[1].Seq != 3 {
+		t.Fatalf("expected messages 1 and 3, got %+v", msgs)
+	}
+}
+
+func TestNewDropsOrphans(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	// the messages of a subscription whose Remove was interrupted
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := ds.Put(msgKey("gone", seq), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(context.Background(), nil, ds, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.List()) != 0 {
+		t.Fatalf("unexpected subscriptions: %+v", s.List())
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		if has, err := ds.Has(msgKey("gone", seq)); err != nil || has {
+			t.Fatalf("expected message %d to be dropped: %v", seq, err)
+		}
+	}
+}
+
+func TestSubscribeInvalidName(t *testing.T) {
+	s := &Service{subs: make(map[string]*sub)}
+	for _, name := range []string{"", "a/b"} {
+		if err := s.Subscribe(name, "events"); err != errInvalidName {
+			t.Errorf("%q: expected errInvalidName, got %v", name, err)
+		}
+	}
+}
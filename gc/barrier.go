@@ -0,0 +1,101 @@
+package gc
+
+import (
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// BarrierBlockstore wraps a GCBlockstore with a write barrier: while a
+// concurrent collection is marking, every block written is recorded so
+// that it survives the sweep even though the mark phase never saw it.
+// It also counts the PinLock acquisitions, so that a collection only marks
+// the pins again when they may have changed.
+type BarrierBlockstore struct {
+	// accessed atomically, kept first for alignment
+	pinLocks uint64
+
+	bstore.GCBlockstore
+
+	lk   sync.RWMutex
+	sets map[*shadedSet]struct{}
+}
+
+// NewBarrierBlockstore wraps bs with a write barrier.
+func NewBarrierBlockstore(bs bstore.GCBlockstore) *BarrierBlockstore {
+	return &BarrierBlockstore{
+		GCBlockstore: bs,
+		sets:         make(map[*shadedSet]struct{}),
+	}
+}
+
+func (b *BarrierBlockstore) Put(blk blocks.Block) error {
+	b.shade(blk.Cid())
+	return b.GCBlockstore.Put(blk)
+}
+
+func (b *BarrierBlockstore) PutMany(blks []blocks.Block) error {
+	for _, blk := range blks {
+		b.shade(blk.Cid())
+	}
+	return b.GCBlockstore.PutMany(blks)
+}
+
+// PinLock takes the pin lock of the wrapped blockstore. Pins only change
+// under it, so the count is raised once the lock is held: a sweep batch,
+// which holds the GC lock, sees every change made before it.
+func (b *BarrierBlockstore) PinLock() bstore.Unlocker {
+	u := b.GCBlockstore.PinLock()
+	atomic.AddUint64(&b.pinLocks, 1)
+	return u
+}
+
+// pinGeneration changes every time the pins may have changed.
+func (b *BarrierBlockstore) pinGeneration() uint64 {
+	return atomic.LoadUint64(&b.pinLocks)
+}
+
+// shade records c in every active set. Blocks are shaded before they are
+// written, so a block is never stored without being recorded.
+func (b *BarrierBlockstore) shade(c cid.Cid) {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	for s := range b.sets {
+		s.add(c)
+	}
+}
+
+// watch starts recording writes. The returned function stops it.
+func (b *BarrierBlockstore) watch() (*shadedSet, func()) {
+	s := &shadedSet{set: cid.NewSet()}
+	b.lk.Lock()
+	b.sets[s] = struct{}{}
+	b.lk.Unlock()
+
+	return s, func() {
+		b.lk.Lock()
+		delete(b.sets, s)
+		b.lk.Unlock()
+	}
+}
+
+// shadedSet is the set of blocks written during a collection.
+type shadedSet struct {
+	lk  sync.Mutex
+	set *cid.Set
+}
+
+func (s *shadedSet) add(c cid.Cid) {
+	s.lk.Lock()
+	s.set.Add(c)
+	s.lk.Unlock()
+}
+
+func (s *shadedSet) has(c cid.Cid) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.set.Has(c)
+}
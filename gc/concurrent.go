@@ -0,0 +1,572 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// ErrNoWriteBarrier is returned by Concurrent when the blockstore does not
+// record the blocks written while marking.
+var ErrNoWriteBarrier = errors.New("concurrent garbage collection requires a BarrierBlockstore")
+
+// DefaultBatchSize is the number of blocks deleted per GC lock acquisition
+// when ConcurrentOptions.BatchSize is not set.
+const DefaultBatchSize = 1000
+
+// ConcurrentOptions configure a concurrent garbage collection run.
+type ConcurrentOptions struct {
+	Options
+
+	// Roots returns the current best effort roots, such as the MFS root.
+	// Unlike the pins, these are not protected by the GC lock, so they are
+	// read again before every sweep batch.
+	Roots func(ctx context.Context) ([]cid.Cid, error)
+
+	// DeletesPerSecond limits the rate at which blocks are deleted. Zero
+	// means no limit.
+	DeletesPerSecond float64
+
+	// BatchSize is the number of blocks deleted per GC lock acquisition.
+	BatchSize int
+
+	// Control, if set, pauses and resumes the run.
+	Control *Control
+
+	// ProgressInterval, if set, emits a Progress result at this interval.
+	ProgressInterval time.Duration
+}
+
+// Progress reports the state of a concurrent run.
+type Progress struct {
+	Phase      string // mark, scan, sweep or done
+	Marked     uint64
+	Scanned    uint64
+	Candidates uint64
+	Removed    uint64
+	Paused     bool
+}
+
+// Control pauses and resumes a concurrent run. Pausing holds no lock, so
+// the node keeps working normally while the run is paused.
+type Control struct {
+	lk     sync.Mutex
+	resume chan struct{} // nil unless paused
+}
+
+// NewControl returns a Control for a run that is not paused.
+func NewControl() *Control {
+	return &Control{}
+}
+
+// Pause stops the run at the next block it marks or deletes.
+func (c *Control) Pause() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+// Resume continues a paused run.
+func (c *Control) Resume() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// Paused reports whether the run is paused.
+func (c *Control) Paused() bool {
+	if c == nil {
+		return false
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.resume != nil
+}
+
+// wait blocks while the run is paused.
+func (c *Control) wait(ctx context.Context) error {
+	if c == nil {
+		return ctx.Err()
+	}
+	c.lk.Lock()
+	resume := c.resume
+	c.lk.Unlock()
+	if resume == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Concurrent performs a garbage collection that does not hold the GC lock
+// while marking. bs must be a BarrierBlockstore: blocks written during the
+// run are recorded by its write barrier and never deleted. The live blocks
+// are colored once. The lock is only taken for every sweep batch, during
+// which the pins are marked again if they changed since, the new best
+// effort roots are marked, and the retention sources are asked about every
+// block before it is deleted.
+func Concurrent(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, opts ConcurrentOptions) <-chan Result {
+	ctx, cancel := context.WithCancel(ctx)
+	output := make(chan Result, 128)
+
+	barrier, ok := bs.(*BarrierBlockstore)
+	if !ok {
+		output <- Result{Error: ErrNoWriteBarrier}
+		close(output)
+		cancel()
+		return output
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.DeletesPerSecond > 0 && float64(opts.BatchSize) > opts.DeletesPerSecond {
+		// don't hold the lock while waiting for the rate limit
+		opts.BatchSize = int(opts.DeletesPerSecond)
+		if opts.BatchSize < 1 {
+			opts.BatchSize = 1
+		}
+	}
+
+	bsrv := bserv.New(bs, offline.Exchange(bs))
+	r := &concurrentRun{
+		opts:    opts,
+		bs:      bs,
+		barrier: barrier,
+		pn:      pn,
+		output:  output,
+		marked:  cid.NewSet(),
+	}
+	r.ng = &controlledGetter{NodeGetter: dag.NewDAGService(bsrv), run: r}
+
+	go func() {
+		defer close(output)
+		defer cancel()
+
+		shaded, stop := barrier.watch()
+		defer stop()
+
+		var wg sync.WaitGroup
+		if opts.ProgressInterval > 0 {
+			progressCtx, stopProgress := context.WithCancel(ctx)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.reportProgress(progressCtx, opts.ProgressInterval)
+			}()
+			defer wg.Wait()
+			defer stopProgress()
+		}
+
+		err := r.run(ctx, shaded)
+		if opts.ProgressInterval > 0 {
+			p := r.snapshot()
+			r.emit(ctx, Result{Progress: &p})
+		}
+		switch err {
+		case nil:
+		case ErrCannotDeleteSomeBlocks:
+			// non-fatal, like in GC
+			r.emit(ctx, Result{Error: err})
+		default:
+			r.emit(ctx, Result{Error: err})
+			return
+		}
+
+		gds, ok := dstor.(dstore.GCDatastore)
+		if !ok {
+			return
+		}
+		if err := gds.CollectGarbage(); err != nil {
+			r.emit(ctx, Result{Error: err})
+		}
+	}()
+
+	return output
+}
+
+type concurrentRun struct {
+	// accessed atomically, kept first for alignment
+	nMarked    uint64
+	nScanned   uint64
+	candidates uint64
+	removed    uint64
+	phase      atomic.Value
+
+	opts    ConcurrentOptions
+	bs      bstore.GCBlockstore
+	barrier *BarrierBlockstore
+	pn      pin.Pinner
+	ng      ipld.NodeGetter
+	output  chan<- Result
+
+	marked *cid.Set // blocks reachable from a root
+	pinGen uint64   // pin generation of the last time the pins were marked
+}
+
+func (r *concurrentRun) emit(ctx context.Context, res Result) bool {
+	select {
+	case r.output <- res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (r *concurrentRun) run(ctx context.Context, shaded *shadedSet) error {
+	r.phase.Store("mark")
+	r.pinGen = r.barrier.pinGeneration()
+	roots, err := r.bestEffortRoots(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.mark(ctx, r.opts.Options, func(c *colorer) error {
+		return c.all(ctx, r.pn, roots)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Collect the candidates without holding the lock. Blocks written
+	// from now on are shaded by the barrier.
+	r.phase.Store("scan")
+	keys, err := r.bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	var candidates []cid.Cid
+	for k := range keys {
+		atomic.AddUint64(&r.nScanned, 1)
+		if r.marked.Has(k) || shaded.has(k) {
+			continue
+		}
+		candidates = append(candidates, k)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&r.candidates, uint64(len(candidates)))
+
+	r.phase.Store("sweep")
+	failed := false
+	for len(candidates) > 0 {
+		if err := r.opts.Control.wait(ctx); err != nil {
+			return err
+		}
+
+		n := r.opts.BatchSize
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		batch := candidates[:n]
+		candidates = candidates[n:]
+
+		start := time.Now()
+		batchFailed, err := r.sweep(ctx, batch, shaded)
+		if err != nil {
+			return err
+		}
+		failed = failed || batchFailed
+
+		if r.opts.DeletesPerSecond > 0 {
+			budget := time.Duration(float64(n) / r.opts.DeletesPerSecond * float64(time.Second))
+			select {
+			case <-time.After(budget - time.Since(start)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	r.phase.Store("done")
+
+	if failed {
+		return ErrCannotDeleteSomeBlocks
+	}
+	return nil
+}
+
+// sweep deletes a batch of candidates under the GC lock. The pins are
+// marked again first if they changed since they were last marked, and so
+// are the best effort roots that appeared since the last batch.
+func (r *concurrentRun) sweep(ctx context.Context, batch []cid.Cid, shaded *shadedSet) (bool, error) {
+	unlocker := r.bs.GCLock()
+	defer unlocker.Unlock()
+
+	roots, err := r.bestEffortRoots(ctx)
+	if err != nil {
+		return false, err
+	}
+	gen := r.barrier.pinGeneration()
+	repin := gen != r.pinGen
+	r.pinGen = gen
+
+	opts := r.opts.Options
+	opts.ReportRetained = false
+	err = r.mark(ctx, opts, func(c *colorer) error {
+		if repin {
+			if err := c.pins(ctx, r.pn); err != nil {
+				return err
+			}
+		}
+		return c.walk(ctx, "best effort root", true, roots...)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	failed := false
+	for _, k := range batch {
+		if r.marked.Has(k) || shaded.has(k) {
+			continue
+		}
+		retained, err := r.retained(ctx, k)
+		if err != nil {
+			return failed, err
+		}
+		if retained {
+			continue
+		}
+		if err := r.bs.DeleteBlock(k); err != nil {
+			failed = true
+			if !r.emit(ctx, Result{Error: &CannotDeleteBlockError{k, err}}) {
+				return failed, ctx.Err()
+			}
+			continue
+		}
+		atomic.AddUint64(&r.removed, 1)
+		if !r.emit(ctx, Result{KeyRemoved: k}) {
+			return failed, ctx.Err()
+		}
+	}
+	return failed, nil
+}
+
+// retained asks the retention sources whether k, which was not marked, must
+// be kept anyway. They may have started holding it since the mark phase.
+func (r *concurrentRun) retained(ctx context.Context, k cid.Cid) (bool, error) {
+	name, err := retainedBy(ctx, r.opts.Sources, k)
+	if err != nil || name == "" {
+		return false, err
+	}
+	if r.opts.ReportRetained && !r.emit(ctx, Result{KeyRetained: k, Reason: name}) {
+		return false, ctx.Err()
+	}
+	return true, nil
+}
+
+func (r *concurrentRun) bestEffortRoots(ctx context.Context) ([]cid.Cid, error) {
+	if r.opts.Roots == nil {
+		return nil, nil
+	}
+	return r.opts.Roots(ctx)
+}
+
+// mark runs color, which adds blocks to the marked set, and forwards its
+// results.
+func (r *concurrentRun) mark(ctx context.Context, opts Options, color func(c *colorer) error) error {
+	out := make(chan Result)
+	done := make(chan error, 1)
+	go func() {
+		done <- color(&colorer{ng: r.ng, opts: opts, gcs: r.marked, output: out})
+		close(out)
+	}()
+	failed := false
+	for res := range out {
+		failed = failed || res.Error != nil
+		if !r.emit(ctx, res) {
+			<-done
+			return ctx.Err()
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if failed {
+		return ErrCannotFetchAllLinks
+	}
+	return nil
+}
+
+func (r *concurrentRun) snapshot() Progress {
+	phase, _ := r.phase.Load().(string)
+	return Progress{
+		Phase:      phase,
+		Marked:     atomic.LoadUint64(&r.nMarked),
+		Scanned:    atomic.LoadUint64(&r.nScanned),
+		Candidates: atomic.LoadUint64(&r.candidates),
+		Removed:    atomic.LoadUint64(&r.removed),
+		Paused:     r.opts.Control.Paused(),
+	}
+}
+
+func (r *concurrentRun) reportProgress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p := r.snapshot()
+			if !r.emit(ctx, Result{Progress: &p}) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// controlledGetter counts the nodes marked and stops while the run is
+// paused.
+type controlledGetter struct {
+	ipld.NodeGetter
+	run *concurrentRun
+}
+
+func (g *controlledGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := g.run.opts.Control.wait(ctx); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&g.run.nMarked, 1)
+	return g.NodeGetter.Get(ctx, c)
+}
+
+// colorer is the incremental counterpart of coloredSet: it adds the
+// descendants of roots to gcs. Blocks are immutable, so a walk stops at
+// every block already in gcs and only new roots cost time.
+type colorer struct {
+	ng     ipld.NodeGetter
+	opts   Options
+	gcs    *cid.Set
+	output chan<- Result
+}
+
+// all colors everything the run must keep.
+func (c *colorer) all(ctx context.Context, pn pin.Pinner, bestEffortRoots []cid.Cid) error {
+	if err := c.pins(ctx, pn); err != nil {
+		return err
+	}
+	if err := c.walk(ctx, "best effort root", true, bestEffortRoots...); err != nil {
+		return err
+	}
+	return c.sources(ctx)
+}
+
+func (c *colorer) report(ctx context.Context, reason string, roots ...cid.Cid) error {
+	if !c.opts.ReportRetained {
+		return nil
+	}
+	for _, k := range roots {
+		select {
+		case c.output <- Result{KeyRetained: k, Reason: reason}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (c *colorer) walk(ctx context.Context, reason string, bestEffort bool, roots ...cid.Cid) error {
+	if err := c.report(ctx, reason, roots...); err != nil {
+		return err
+	}
+	getLinks := func(ctx context.Context, k cid.Cid) ([]*ipld.Link, error) {
+		links, err := ipld.GetLinks(ctx, c.ng, k)
+		if err != nil && (!bestEffort || err != ipld.ErrNotFound) {
+			select {
+			case c.output <- Result{Error: &CannotFetchLinksError{k, err}}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return links, nil
+	}
+	if err := Descendants(ctx, getLinks, c.gcs, roots); err != nil {
+		select {
+		case c.output <- Result{Error: err}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// pins colors the pinned blocks.
+func (c *colorer) pins(ctx context.Context, pn pin.Pinner) error {
+	rkeys, err := pn.RecursiveKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.walk(ctx, "recursive pin", false, rkeys...); err != nil {
+		return err
+	}
+	ikeys, err := pn.InternalPins(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.walk(ctx, "internal pin", false, ikeys...); err != nil {
+		return err
+	}
+
+	dkeys, err := pn.DirectKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.report(ctx, "direct pin", dkeys...); err != nil {
+		return err
+	}
+	for _, k := range dkeys {
+		c.gcs.Add(k)
+	}
+	return nil
+}
+
+// sources colors the roots and blocks held by the retention sources.
+func (c *colorer) sources(ctx context.Context) error {
+	for _, src := range c.opts.Sources {
+		retained, err := src.Roots(ctx)
+		if err != nil {
+			return fmt.Errorf("retention source %s: %s", src.Name(), err)
+		}
+		for _, r := range retained {
+			reason := src.Name()
+			if r.Reason != "" {
+				reason += ": " + r.Reason
+			}
+			if err := c.walk(ctx, reason, true, r.Root); err != nil {
+				return err
+			}
+		}
+
+		blocks, err := src.Blocks(ctx)
+		if err != nil {
+			return fmt.Errorf("retention source %s: %s", src.Name(), err)
+		}
+		if err := c.report(ctx, src.Name(), blocks...); err != nil {
+			return err
+		}
+		for _, k := range blocks {
+			c.gcs.Add(k)
+		}
+	}
+	return nil
+}
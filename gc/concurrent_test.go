@@ -0,0 +1,177 @@
+package gc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// countingPinner counts the times the recursive pins are listed.
+type countingPinner struct {
+	pin.Pinner
+	recursive int32
+	listed    chan struct{}
+	once      sync.Once
+}
+
+func (p *countingPinner) RecursiveKeys(ctx context.Context) ([]cid.Cid, error) {
+	atomic.AddInt32(&p.recursive, 1)
+	p.once.Do(func() { close(p.listed) })
+	return p.Pinner.RecursiveKeys(ctx)
+}
+
+// retainSet is a retention source that only answers Retains.
+type retainSet struct {
+	lk   sync.Mutex
+	keys map[cid.Cid]bool
+}
+
+func (s *retainSet) Name() string                              { return "test" }
+func (s *retainSet) Roots(context.Context) ([]Retained, error) { return nil, nil }
+func (s *retainSet) Blocks(context.Context) ([]cid.Cid, error) { return nil, nil }
+func (s *retainSet) Retains(_ context.Context, k cid.Cid) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.keys[k], nil
+}
+
+func newConcurrentRepo(t *testing.T) (dstore.Datastore, *BarrierBlockstore, ipld.DAGService, *countingPinner) {
+	t.Helper()
+	ds := dssync.MutexWrap(dstore.NewMapDatastore())
+	bs := NewBarrierBlockstore(bstore.NewGCBlockstore(bstore.NewBlockstore(ds), bstore.NewGCLocker()))
+	dserv := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	pn, err := dspinner.New(context.Background(), ds, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds, bs, dserv, &countingPinner{Pinner: pn, listed: make(chan struct{})}
+}
+
+func addNodes(t *testing.T, dserv ipld.DAGService, nodes ...ipld.Node) {
+	t.Helper()
+	if err := dserv.AddMany(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pinNode(t *testing.T, bs *BarrierBlockstore, pn pin.Pinner, nd ipld.Node) {
+	t.Helper()
+	ctx := context.Background()
+	defer bs.PinLock().Unlock()
+	if err := pn.Pin(ctx, nd, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pn.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func drainGC(t *testing.T, out <-chan Result) map[cid.Cid]bool {
+	t.Helper()
+	removed := map[cid.Cid]bool{}
+	for res := range out {
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		if res.KeyRemoved.Defined() {
+			removed[res.KeyRemoved] = true
+		}
+	}
+	return removed
+}
+
+func TestConcurrentKeepsWritesDuringMark(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ds, bs, dserv, pn := newConcurrentRepo(t)
+
+	child := dag.NewRawNode([]byte("child"))
+	root := dag.NodeWithData([]byte("root"))
+	if err := root.AddNodeLink("child", child); err != nil {
+		t.Fatal(err)
+	}
+	existing := dag.NewRawNode([]byte("pinned during the run"))
+	garbage := dag.NewRawNode([]byte("garbage"))
+	addNodes(t, dserv, root, child, existing, garbage)
+	pinNode(t, bs, pn, root)
+
+	// pause the run while it marks the pinned root
+	ctl := NewControl()
+	ctl.Pause()
+	out := Concurrent(ctx, bs, ds, pn, ConcurrentOptions{Control: ctl, BatchSize: 1})
+	select {
+	case <-pn.listed:
+	case <-ctx.Done():
+		t.Fatal("the run did not start marking")
+	}
+
+	written := dag.NewRawNode([]byte("written during the run"))
+	addNodes(t, dserv, written)
+	pinNode(t, bs, pn, existing)
+	ctl.Resume()
+
+	removed := drainGC(t, out)
+	for _, nd := range []ipld.Node{root, child, existing, written} {
+		if removed[nd.Cid()] {
+			t.Errorf("live block %s was removed", nd.Cid())
+		}
+		if has, _ := bs.Has(nd.Cid()); !has {
+			t.Errorf("live block %s is gone", nd.Cid())
+		}
+	}
+	if !removed[garbage.Cid()] {
+		t.Error("garbage was not removed")
+	}
+	// once while marking, once more because the pins changed
+	if n := atomic.LoadInt32(&pn.recursive); n != 2 {
+		t.Errorf("pins were listed %d times, expected 2", n)
+	}
+}
+
+func TestConcurrentColorsOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ds, bs, dserv, pn := newConcurrentRepo(t)
+
+	var garbage []ipld.Node
+	for _, s := range []string{"a", "b", "c", "d"} {
+		garbage = append(garbage, dag.NewRawNode([]byte(s)))
+	}
+	addNodes(t, dserv, garbage...)
+
+	// the source doesn't report the block while marking, as if it only
+	// started retaining it afterwards
+	src := &retainSet{keys: map[cid.Cid]bool{}}
+	kept := garbage[3]
+	src.keys[kept.Cid()] = true
+
+	out := Concurrent(ctx, bs, ds, pn, ConcurrentOptions{
+		Options:   Options{Sources: []RetentionSource{src}},
+		BatchSize: 1,
+	})
+	removed := drainGC(t, out)
+	for _, nd := range garbage[:3] {
+		if !removed[nd.Cid()] {
+			t.Errorf("garbage %s was not removed", nd.Cid())
+		}
+	}
+	if removed[kept.Cid()] {
+		t.Error("block retained before its deletion was removed")
+	}
+	if n := atomic.LoadInt32(&pn.recursive); n != 1 {
+		t.Errorf("pins were listed %d times over 4 batches, expected 1", n)
+	}
+}
@@ -22,10 +22,17 @@ import (
 var log = logging.Logger("gc")
 
 // Result represents an incremental output from a garbage collection
-// run.  It contains either an error, or the cid of a removed object.
+// run.  It contains either an error, the cid of a removed object, or, when
+// requested, a retained root and the reason it was kept.
 type Result struct {
 	KeyRemoved cid.Cid
 	Error      error
+
+	KeyRetained cid.Cid
+	Reason      string
+
+	// Progress is only emitted by concurrent runs.
+	Progress *Progress
 }
 
 // GC performs a mark and sweep garbage collection of the blocks in the blockstore
@@ -38,6 +45,14 @@ type Result struct {
 // The routine then iterates over every block in the blockstore and
 // deletes any block that is not found in the marked set.
 func GC(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, bestEffortRoots []cid.Cid) <-chan Result {
+	return GCWithOptions(ctx, bs, dstor, pn, bestEffortRoots, Options{})
+}
+
+// GCWithOptions is like GC, but additionally keeps the blocks held by the
+// retention sources in opts. The sources list their roots and blocks once,
+// while coloring, and are asked about every unmarked block before it is
+// deleted, for the blocks they only know one by one.
+func GCWithOptions(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, bestEffortRoots []cid.Cid, opts Options) <-chan Result {
 	ctx, cancel := context.WithCancel(ctx)
 
 	unlocker := bs.GCLock()
@@ -52,7 +67,7 @@ func GC(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn
 		defer close(output)
 		defer unlocker.Unlock()
 
-		gcs, err := ColoredSet(ctx, pn, ds, bestEffortRoots, output)
+		gcs, err := coloredSet(ctx, pn, ds, bestEffortRoots, opts, output)
 		if err != nil {
 			select {
 			case output <- Result{Error: err}:
@@ -80,7 +95,28 @@ func GC(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn
 					break loop
 				}
 				if !gcs.Has(k) {
-					err := bs.DeleteBlock(k)
+					name, err := retainedBy(ctx, opts.Sources, k)
+					if err != nil {
+						// keep the block, we don't know
+						errors = true
+						select {
+						case output <- Result{Error: err}:
+						case <-ctx.Done():
+							break loop
+						}
+						continue loop
+					}
+					if name != "" {
+						if opts.ReportRetained {
+							select {
+							case output <- Result{KeyRetained: k, Reason: name}:
+							case <-ctx.Done():
+								break loop
+							}
+						}
+						continue loop
+					}
+					err = bs.DeleteBlock(k)
 					removed++
 					if err != nil {
 						errors = true
@@ -168,10 +204,28 @@ func Descendants(ctx context.Context, getLinks dag.GetLinks, set *cid.Set, roots
 // ColoredSet computes the set of nodes in the graph that are pinned by the
 // pins in the given pinner.
 func ColoredSet(ctx context.Context, pn pin.Pinner, ng ipld.NodeGetter, bestEffortRoots []cid.Cid, output chan<- Result) (*cid.Set, error) {
+	return coloredSet(ctx, pn, ng, bestEffortRoots, Options{}, output)
+}
+
+func coloredSet(ctx context.Context, pn pin.Pinner, ng ipld.NodeGetter, bestEffortRoots []cid.Cid, opts Options, output chan<- Result) (*cid.Set, error) {
 	// KeySet currently implemented in memory, in the future, may be bloom filter or
 	// disk backed to conserve memory.
 	errors := false
 	gcs := cid.NewSet()
+
+	report := func(reason string, roots ...cid.Cid) error {
+		if !opts.ReportRetained {
+			return nil
+		}
+		for _, c := range roots {
+			select {
+			case output <- Result{KeyRetained: c, Reason: reason}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
 	getLinks := func(ctx context.Context, cid cid.Cid) ([]*ipld.Link, error) {
 		links, err := ipld.GetLinks(ctx, ng, cid)
 		if err != nil {
@@ -188,6 +242,9 @@ func ColoredSet(ctx context.Context, pn pin.Pinner, ng ipld.NodeGetter, bestEffo
 	if err != nil {
 		return nil, err
 	}
+	if err := report("recursive pin", rkeys...); err != nil {
+		return nil, err
+	}
 	err = Descendants(ctx, getLinks, gcs, rkeys)
 	if err != nil {
 		errors = true
@@ -210,6 +267,9 @@ func ColoredSet(ctx context.Context, pn pin.Pinner, ng ipld.NodeGetter, bestEffo
 		}
 		return links, nil
 	}
+	if err := report("best effort root", bestEffortRoots...); err != nil {
+		return nil, err
+	}
 	err = Descendants(ctx, bestEffortGetLinks, gcs, bestEffortRoots)
 	if err != nil {
 		errors = true
@@ -220,10 +280,53 @@ func ColoredSet(ctx context.Context, pn pin.Pinner, ng ipld.NodeGetter, bestEffo
 		}
 	}
 
+	// Blocks held by retention sources may be partial replicas, so they
+	// are walked on a best effort basis too.
+	for _, src := range opts.Sources {
+		retained, err := src.Roots(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retention source %s: %s", src.Name(), err)
+		}
+		roots := make([]cid.Cid, 0, len(retained))
+		for _, r := range retained {
+			reason := src.Name()
+			if r.Reason != "" {
+				reason += ": " + r.Reason
+			}
+			if err := report(reason, r.Root); err != nil {
+				return nil, err
+			}
+			roots = append(roots, r.Root)
+		}
+		err = Descendants(ctx, bestEffortGetLinks, gcs, roots)
+		if err != nil {
+			errors = true
+			select {
+			case output <- Result{Error: err}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		blocks, err := src.Blocks(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retention source %s: %s", src.Name(), err)
+		}
+		if err := report(src.Name(), blocks...); err != nil {
+			return nil, err
+		}
+		for _, k := range blocks {
+			gcs.Add(k)
+		}
+	}
+
 	dkeys, err := pn.DirectKeys(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if err := report("direct pin", dkeys...); err != nil {
+		return nil, err
+	}
 	for _, k := range dkeys {
 		gcs.Add(k)
 	}
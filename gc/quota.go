@@ -0,0 +1,774 @@
+package gc
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+)
+
+// QuotaConfigKey is the config section holding the QuotaConfig.
+const QuotaConfigKey = "Quota"
+
+// QuotaConfig configures the storage quotas enforced by the blockstore.
+type QuotaConfig struct {
+	// Enabled rejects the writes that would exceed a quota.
+	Enabled bool
+
+	// StorageMax is the quota of the whole blockstore. It defaults to
+	// Datastore.StorageMax.
+	StorageMax string
+
+	// User, Backup and Cache are the quotas of each class of blocks. Empty
+	// means no quota other than StorageMax.
+	User   string
+	Backup string
+	Cache  string
+
+	// MinCacheAge protects the cache blocks used recently from eviction.
+	MinCacheAge string
+
+	// RefreshInterval is the time between two classifications of every
+	// block of the repo.
+	RefreshInterval string
+}
+
+// Defaults for the QuotaConfig fields left unset.
+const (
+	DefaultQuotaMinCacheAge     = time.Hour
+	DefaultQuotaRefreshInterval = 15 * time.Minute
+)
+
+// QuotaClass is the class a block is accounted under.
+type QuotaClass string
+
+const (
+	// QuotaUser is the content pinned or in MFS, and the blocks written by
+	// the node itself until they are classified.
+	QuotaUser QuotaClass = "user"
+	// QuotaBackup is the content stored on behalf of the network: backup
+	// replicas, leased roots and chain files.
+	QuotaBackup QuotaClass = "backup"
+	// QuotaCache is everything else, such as blocks fetched by bitswap.
+	QuotaCache QuotaClass = "cache"
+)
+
+// QuotaClasses lists the classes in reporting order.
+var QuotaClasses = []QuotaClass{QuotaUser, QuotaBackup, QuotaCache}
+
+var (
+	quotaEvictTimeout = 30 * time.Second
+	quotaEvictBackoff = 10 * time.Second
+)
+
+// QuotaLimits are the parsed quotas. A zero limit means no limit.
+type QuotaLimits struct {
+	Total       uint64
+	Classes     map[QuotaClass]uint64
+	MinCacheAge time.Duration
+}
+
+// Limits parses the quotas, using storageMax when StorageMax is not set.
+func (c QuotaConfig) Limits(storageMax string) (QuotaLimits, error) {
+	l := QuotaLimits{
+		Classes:     make(map[QuotaClass]uint64),
+		MinCacheAge: DefaultQuotaMinCacheAge,
+	}
+
+	parse := func(name, s string) (uint64, error) {
+		if s == "" {
+			return 0, nil
+		}
+		v, err := humanize.ParseBytes(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Quota.%s: %s", name, err)
+		}
+		return v, nil
+	}
+
+	var err error
+	if c.StorageMax != "" {
+		storageMax = c.StorageMax
+	}
+	if l.Total, err = parse("StorageMax", storageMax); err != nil {
+		return l, err
+	}
+	for class, s := range map[QuotaClass]string{QuotaUser: c.User, QuotaBackup: c.Backup, QuotaCache: c.Cache} {
+		v, err := parse(string(class), s)
+		if err != nil {
+			return l, err
+		}
+		if v != 0 {
+			l.Classes[class] = v
+		}
+	}
+	if c.MinCacheAge != "" {
+		if l.MinCacheAge, err = time.ParseDuration(c.MinCacheAge); err != nil {
+			return l, fmt.Errorf("invalid Quota.MinCacheAge: %s", err)
+		}
+	}
+	return l, nil
+}
+
+// RefreshEvery returns the refresh interval.
+func (c QuotaConfig) RefreshEvery() (time.Duration, error) {
+	if c.RefreshInterval == "" {
+		return DefaultQuotaRefreshInterval, nil
+	}
+	return time.ParseDuration(c.RefreshInterval)
+}
+
+// QuotaError is returned when a write would exceed a quota, even after
+// evicting what could be evicted.
+type QuotaError struct {
+	Class QuotaClass // empty for the quota of the whole blockstore
+	Limit uint64
+	Used  uint64
+	Size  uint64 // bytes being written
+}
+
+func (e *QuotaError) Error() string {
+	name := "storage quota"
+	if e.Class != "" {
+		name = string(e.Class) + " storage quota"
+	}
+	return fmt.Sprintf("%s exceeded: %s used of %s, cannot store %s more",
+		name, humanize.Bytes(e.Used), humanize.Bytes(e.Limit), humanize.Bytes(e.Size))
+}
+
+// QuotaUsage is the usage of one class, or of the whole blockstore.
+type QuotaUsage struct {
+	Class  QuotaClass `json:",omitempty"`
+	Used   uint64
+	Limit  uint64 `json:",omitempty"`
+	Blocks uint64
+}
+
+// QuotaStat reports the usage of the quotas.
+type QuotaStat struct {
+	// Ready is false until the first scan of the blockstore is done. The
+	// quotas are not enforced before.
+	Ready    bool
+	Total    QuotaUsage
+	Classes  []QuotaUsage
+	Evicted  uint64
+	Rejected uint64
+}
+
+// QuotaEvictor frees space once the unpinned cache is exhausted. It calls
+// evict with the blocks it proposes, the first to go first, and stops once
+// evict returns true.
+type QuotaEvictor func(ctx context.Context, evict func(cid.Cid) bool) error
+
+// QuotaGuard returns a classifier of the blocks about to be evicted, read
+// with the GC lock held. The blocks it knows under a class other than cache,
+// such as the ones pinned since the last Refresh, are kept and reclassified.
+type QuotaGuard func(ctx context.Context) (func(cid.Cid) (QuotaClass, bool), error)
+
+type quotaEntry struct {
+	key     cid.Cid
+	class   QuotaClass
+	size    uint64
+	written time.Time
+	access  time.Time
+	elem    *list.Element // position in the LRU, cache entries only
+}
+
+// QuotaBlockstore accounts the size of the blocks by class and rejects the
+// writes exceeding a quota. Before rejecting a write, it evicts cache blocks
+// not used for MinCacheAge, least recently used first, then asks the
+// QuotaEvictor for more. Every block is checked with the QuotaGuard, under
+// the GC lock, before it is deleted.
+//
+// Blocks are classified on write and reclassified by Refresh. Nothing is
+// enforced until Refresh ran once: the usage of the blocks already stored is
+// unknown before. The accounting is kept in memory, about 150 bytes per
+// block, and rebuilt by every Refresh.
+type QuotaBlockstore struct {
+	bstore.GCBlockstore
+	now func() time.Time
+
+	// pin locks held, accessed atomically
+	pinLocks int32
+
+	lk       sync.Mutex
+	limits   QuotaLimits
+	ready    bool
+	entries  map[string]*quotaEntry // by multihash
+	usage    map[QuotaClass]uint64
+	counts   map[QuotaClass]uint64
+	total    uint64
+	lru      *list.List // cache entries, least recently used first
+	evicted  uint64
+	rejected uint64
+
+	hint          func(cid.Cid) (QuotaClass, bool)
+	evictor       QuotaEvictor
+	guard         QuotaGuard
+	lastFruitless time.Time
+
+	// deferred are the blocks evicted while pin locks were held, deleted
+	// once the GC lock can be taken
+	deferred []*quotaEntry
+	flushing bool
+}
+
+// NewQuotaBlockstore enforces limits on the blocks written to bs.
+func NewQuotaBlockstore(bs bstore.GCBlockstore, limits QuotaLimits) *QuotaBlockstore {
+	return &QuotaBlockstore{
+		GCBlockstore: bs,
+		now:          time.Now,
+		limits:       limits,
+		entries:      make(map[string]*quotaEntry),
+		usage:        make(map[QuotaClass]uint64),
+		counts:       make(map[QuotaClass]uint64),
+		lru:          list.New(),
+	}
+}
+
+// QuotaOf returns the QuotaBlockstore under bs, or nil if there is none.
+func QuotaOf(bs bstore.GCBlockstore) *QuotaBlockstore {
+	switch b := bs.(type) {
+	case *QuotaBlockstore:
+		return b
+	case *BarrierBlockstore:
+		return QuotaOf(b.GCBlockstore)
+	case *quotaView:
+		return b.q
+	}
+	return nil
+}
+
+// QuotaView returns bs writing the blocks under class, for the components
+// storing blocks on behalf of others, such as the exchange. bs is returned
+// unchanged if it enforces no quota.
+func QuotaView(bs bstore.GCBlockstore, class QuotaClass) bstore.GCBlockstore {
+	b, ok := bs.(*BarrierBlockstore)
+	if !ok {
+		return bs
+	}
+	q, ok := b.GCBlockstore.(*QuotaBlockstore)
+	if !ok {
+		return bs
+	}
+	return &quotaView{BarrierBlockstore: b, q: q, class: class}
+}
+
+type quotaView struct {
+	*BarrierBlockstore
+	q     *QuotaBlockstore
+	class QuotaClass
+}
+
+func (v *quotaView) Put(blk blocks.Block) error {
+	v.shade(blk.Cid())
+	return v.q.put(v.class, []blocks.Block{blk})
+}
+
+func (v *quotaView) PutMany(blks []blocks.Block) error {
+	for _, blk := range blks {
+		v.shade(blk.Cid())
+	}
+	return v.q.put(v.class, blks)
+}
+
+// SetHint sets the function classifying the blocks written as cache, such
+// as the backup replicas pushed to the node. Blocks it does not know stay in
+// the cache.
+func (q *QuotaBlockstore) SetHint(hint func(cid.Cid) (QuotaClass, bool)) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.hint = hint
+}
+
+// SetEvictor sets the evictor called once the cache is exhausted.
+func (q *QuotaBlockstore) SetEvictor(e QuotaEvictor) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.evictor = e
+}
+
+// SetGuard sets the guard checking the blocks before they are evicted.
+// Without one, the classification of the last Refresh is trusted.
+func (q *QuotaBlockstore) SetGuard(g QuotaGuard) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.guard = g
+}
+
+// SetLimits replaces the quotas.
+func (q *QuotaBlockstore) SetLimits(limits QuotaLimits) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.limits = limits
+}
+
+// PinLock takes the pin lock of the wrapped blockstore, counting the locks
+// held for evictionLock.
+func (q *QuotaBlockstore) PinLock() bstore.Unlocker {
+	u := q.GCBlockstore.PinLock()
+	atomic.AddInt32(&q.pinLocks, 1)
+	return &quotaUnlocker{u: u, held: &q.pinLocks}
+}
+
+type quotaUnlocker struct {
+	u    bstore.Unlocker
+	held *int32
+	once sync.Once
+}
+
+func (u *quotaUnlocker) Unlock() {
+	u.once.Do(func() {
+		atomic.AddInt32(u.held, -1)
+		u.u.Unlock()
+	})
+}
+
+// evictionLock takes the GC lock, so that no block is pinned between its
+// check and its deletion, and reports whether it did. A write made under the
+// pin lock, such as an add that pins, would wait for itself: while pin locks
+// are held, the lock is not taken and the deletions are deferred.
+func (q *QuotaBlockstore) evictionLock() (func(), bool) {
+	if atomic.LoadInt32(&q.pinLocks) > 0 {
+		return func() {}, false
+	}
+	return q.GCBlockstore.GCLock().Unlock, true
+}
+
+func (q *QuotaBlockstore) Put(blk blocks.Block) error {
+	return q.put(QuotaUser, []blocks.Block{blk})
+}
+
+func (q *QuotaBlockstore) PutMany(blks []blocks.Block) error {
+	return q.put(QuotaUser, blks)
+}
+
+func (q *QuotaBlockstore) put(class QuotaClass, blks []blocks.Block) error {
+	q.lk.Lock()
+	ready, hint := q.ready, q.hint
+	q.lk.Unlock()
+	if !ready {
+		return q.GCBlockstore.PutMany(blks)
+	}
+
+	classes := make([]QuotaClass, len(blks))
+	for i, blk := range blks {
+		classes[i] = class
+		if hint == nil || class != QuotaCache {
+			continue
+		}
+		if c, ok := hint(blk.Cid()); ok {
+			classes[i] = c
+		}
+	}
+
+	q.lk.Lock()
+	need := make(map[QuotaClass]uint64)
+	for i, blk := range blks {
+		if _, ok := blk.(*posinfo.FilestoreNode); ok {
+			continue // stored by reference
+		}
+		if _, ok := q.entries[string(blk.Cid().Hash())]; ok {
+			continue
+		}
+		need[classes[i]] += uint64(len(blk.RawData()))
+	}
+	if err := q.checkLocked(need); err != nil {
+		q.lk.Unlock()
+		q.makeRoom(need)
+		q.lk.Lock()
+		if err := q.checkLocked(need); err != nil {
+			q.rejected++
+			q.lk.Unlock()
+			return err
+		}
+	}
+
+	// account the blocks before writing them, so that concurrent writes
+	// cannot exceed the quotas together
+	now := q.now()
+	var added []*quotaEntry
+	for i, blk := range blks {
+		if _, ok := blk.(*posinfo.FilestoreNode); ok {
+			continue
+		}
+		k := string(blk.Cid().Hash())
+		if _, ok := q.entries[k]; ok {
+			continue
+		}
+		e := &quotaEntry{
+			key:     blk.Cid(),
+			class:   classes[i],
+			size:    uint64(len(blk.RawData())),
+			written: now,
+			access:  now,
+		}
+		q.addLocked(k, e)
+		added = append(added, e)
+	}
+	q.lk.Unlock()
+
+	if err := q.GCBlockstore.PutMany(blks); err != nil {
+		q.lk.Lock()
+		for _, e := range added {
+			k := string(e.key.Hash())
+			if q.entries[k] == e {
+				q.removeLocked(k, e)
+			}
+		}
+		q.lk.Unlock()
+		return err
+	}
+	return nil
+}
+
+// checkLocked returns a QuotaError if need does not fit.
+func (q *QuotaBlockstore) checkLocked(need map[QuotaClass]uint64) error {
+	var sum uint64
+	for class, n := range need {
+		sum += n
+		if limit := q.limits.Classes[class]; limit != 0 && q.usage[class]+n > limit {
+			return &QuotaError{Class: class, Limit: limit, Used: q.usage[class], Size: n}
+		}
+	}
+	if q.limits.Total != 0 && q.total+sum > q.limits.Total {
+		return &QuotaError{Limit: q.limits.Total, Used: q.total, Size: sum}
+	}
+	return nil
+}
+
+// makeRoom evicts blocks until need fits.
+func (q *QuotaBlockstore) makeRoom(need map[QuotaClass]uint64) {
+	q.lk.Lock()
+	evictor, guard := q.evictor, q.guard
+	if evictor != nil && q.now().Sub(q.lastFruitless) < quotaEvictBackoff {
+		evictor = nil
+	}
+	if evictor == nil && !q.staleCacheLocked() {
+		q.lk.Unlock()
+		return // nothing to evict
+	}
+	q.lk.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), quotaEvictTimeout)
+	defer cancel()
+	unlock, exclusive := q.evictionLock()
+	defer unlock()
+
+	classify := func(cid.Cid) (QuotaClass, bool) { return "", false }
+	if guard != nil {
+		var err error
+		if classify, err = guard(ctx); err != nil {
+			log.Warnf("quota eviction: %s", err)
+			return
+		}
+	}
+
+	// victims leave the accounting under q.lk and are deleted after
+	var victims []*quotaEntry
+	defer func() {
+		if exclusive {
+			q.deleteVictims(victims)
+		} else {
+			q.deferVictims(victims)
+		}
+	}()
+
+	q.lk.Lock()
+	fits := q.pickCacheLocked(need, classify, &victims)
+	q.lk.Unlock()
+	if fits || evictor == nil {
+		return
+	}
+
+	n := len(victims)
+	err := evictor(ctx, func(c cid.Cid) bool {
+		class, known := classify(c)
+		q.lk.Lock()
+		defer q.lk.Unlock()
+		k := string(c.Hash())
+		if e, ok := q.entries[k]; ok && e.class != QuotaUser {
+			if known && class != QuotaCache {
+				q.setClassLocked(e, class)
+			} else {
+				q.removeLocked(k, e)
+				victims = append(victims, e)
+			}
+		}
+		return q.checkLocked(need) == nil
+	})
+	if err != nil {
+		log.Warnf("quota eviction: %s", err)
+	}
+
+	if len(victims) == n {
+		q.lk.Lock()
+		q.lastFruitless = q.now()
+		q.lk.Unlock()
+	}
+}
+
+// staleCacheLocked reports whether a cache block was not used for
+// MinCacheAge.
+func (q *QuotaBlockstore) staleCacheLocked() bool {
+	front := q.lru.Front()
+	return front != nil && q.now().Sub(front.Value.(*quotaEntry).access) >= q.limits.MinCacheAge
+}
+
+// pickCacheLocked takes the cache blocks not used for MinCacheAge out of
+// the accounting, least recently used first, and adds them to victims until
+// need fits. The blocks classify knows are reclassified instead.
+func (q *QuotaBlockstore) pickCacheLocked(need map[QuotaClass]uint64, classify func(cid.Cid) (QuotaClass, bool), victims *[]*quotaEntry) bool {
+	for {
+		err := q.checkLocked(need)
+		if err == nil {
+			return true
+		}
+		if qe := err.(*QuotaError); qe.Class != "" && qe.Class != QuotaCache {
+			return false // the cache does not count against this quota
+		}
+		front := q.lru.Front()
+		if front == nil {
+			return false
+		}
+		e := front.Value.(*quotaEntry)
+		if q.now().Sub(e.access) < q.limits.MinCacheAge {
+			return false
+		}
+		if class, ok := classify(e.key); ok && class != QuotaCache {
+			q.setClassLocked(e, class) // leaves the LRU
+			continue
+		}
+		q.removeLocked(string(e.key.Hash()), e)
+		*victims = append(*victims, e)
+	}
+}
+
+// deleteVictims deletes the blocks taken out of the accounting for an
+// eviction. Must be called with the GC lock held, without q.lk.
+func (q *QuotaBlockstore) deleteVictims(victims []*quotaEntry) {
+	for _, e := range victims {
+		k := string(e.key.Hash())
+		q.lk.Lock()
+		_, rewritten := q.entries[k]
+		q.lk.Unlock()
+		if rewritten {
+			continue // written again since it was picked
+		}
+
+		err := q.GCBlockstore.DeleteBlock(e.key)
+		q.lk.Lock()
+		if err != nil && err != bstore.ErrNotFound {
+			log.Warnf("quota eviction of %s: %s", e.key, err)
+			if _, ok := q.entries[k]; !ok {
+				q.addLocked(k, e)
+			}
+		} else {
+			q.evicted++
+		}
+		q.lk.Unlock()
+	}
+}
+
+// deferVictims queues the blocks evicted while pin locks are held. They are
+// checked again and deleted once the GC lock can be taken: until then, a
+// block proposed as cache may be getting pinned.
+func (q *QuotaBlockstore) deferVictims(victims []*quotaEntry) {
+	if len(victims) == 0 {
+		return
+	}
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.deferred = append(q.deferred, victims...)
+	if !q.flushing {
+		q.flushing = true
+		go q.flushDeferred()
+	}
+}
+
+func (q *QuotaBlockstore) flushDeferred() {
+	unlock := q.GCBlockstore.GCLock().Unlock
+	defer unlock()
+
+	q.lk.Lock()
+	victims, guard := q.deferred, q.guard
+	q.deferred, q.flushing = nil, false
+	q.lk.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), quotaEvictTimeout)
+	defer cancel()
+	if guard != nil {
+		classify, err := guard(ctx)
+		if err != nil {
+			// keep the blocks, the next refresh accounts them again
+			log.Warnf("quota eviction: %s", err)
+			return
+		}
+		kept := victims[:0]
+		q.lk.Lock()
+		for _, e := range victims {
+			class, known := classify(e.key)
+			if !known || class == QuotaCache {
+				kept = append(kept, e)
+				continue
+			}
+			// pinned since it was picked
+			if k := string(e.key.Hash()); q.entries[k] == nil {
+				e.class = class
+				q.addLocked(k, e)
+			}
+		}
+		q.lk.Unlock()
+		victims = kept
+	}
+	q.deleteVictims(victims)
+}
+
+func (q *QuotaBlockstore) addLocked(k string, e *quotaEntry) {
+	q.entries[k] = e
+	q.usage[e.class] += e.size
+	q.counts[e.class]++
+	q.total += e.size
+	if e.class == QuotaCache {
+		e.elem = q.lru.PushBack(e)
+	}
+}
+
+func (q *QuotaBlockstore) removeLocked(k string, e *quotaEntry) {
+	delete(q.entries, k)
+	q.usage[e.class] -= e.size
+	q.counts[e.class]--
+	q.total -= e.size
+	if e.elem != nil {
+		q.lru.Remove(e.elem)
+		e.elem = nil
+	}
+}
+
+func (q *QuotaBlockstore) setClassLocked(e *quotaEntry, class QuotaClass) {
+	if e.class == class {
+		return
+	}
+	k := string(e.key.Hash())
+	q.removeLocked(k, e)
+	e.class = class
+	q.addLocked(k, e)
+}
+
+func (q *QuotaBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	blk, err := q.GCBlockstore.Get(c)
+	if err == nil {
+		q.lk.Lock()
+		if e, ok := q.entries[string(c.Hash())]; ok {
+			e.access = q.now()
+			if e.elem != nil {
+				q.lru.MoveToBack(e.elem)
+			}
+		}
+		q.lk.Unlock()
+	}
+	return blk, err
+}
+
+func (q *QuotaBlockstore) DeleteBlock(c cid.Cid) error {
+	err := q.GCBlockstore.DeleteBlock(c)
+	if err == nil || err == bstore.ErrNotFound {
+		q.lk.Lock()
+		k := string(c.Hash())
+		if e, ok := q.entries[k]; ok {
+			q.removeLocked(k, e)
+		}
+		q.lk.Unlock()
+	}
+	return err
+}
+
+type quotaScanned struct {
+	key   cid.Cid
+	size  uint64
+	class QuotaClass
+	known bool
+}
+
+// Refresh scans the blocks of base, the blockstore holding the data of the
+// blocks, and classifies them again. The blocks classify does not know are
+// accounted as cache, except the ones written since the refresh started,
+// which keep their class until the next refresh.
+func (q *QuotaBlockstore) Refresh(ctx context.Context, base bstore.Blockstore, classify func(cid.Cid) (QuotaClass, bool)) error {
+	start := q.now()
+	keys, err := base.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	scanned := make(map[string]quotaScanned)
+	for c := range keys {
+		size, err := base.GetSize(c)
+		if err != nil {
+			continue // removed meanwhile
+		}
+		s := quotaScanned{key: c, size: uint64(size)}
+		s.class, s.known = classify(c)
+		scanned[string(c.Hash())] = s
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for k, e := range q.entries {
+		if _, ok := scanned[k]; !ok && e.written.Before(start) {
+			q.removeLocked(k, e)
+		}
+	}
+	for k, s := range scanned {
+		e, ok := q.entries[k]
+		if !ok {
+			e = &quotaEntry{key: s.key, size: s.size, written: start, access: start, class: QuotaCache}
+			if s.known {
+				e.class = s.class
+			}
+			q.addLocked(k, e)
+			continue
+		}
+		switch {
+		case s.known:
+			q.setClassLocked(e, s.class)
+		case e.written.Before(start):
+			q.setClassLocked(e, QuotaCache)
+		}
+	}
+	q.ready = true
+	return nil
+}
+
+// Stat reports the usage of the quotas.
+func (q *QuotaBlockstore) Stat() QuotaStat {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	st := QuotaStat{
+		Ready:    q.ready,
+		Total:    QuotaUsage{Used: q.total, Limit: q.limits.Total, Blocks: uint64(len(q.entries))},
+		Evicted:  q.evicted,
+		Rejected: q.rejected,
+	}
+	for _, class := range QuotaClasses {
+		st.Classes = append(st.Classes, QuotaUsage{
+			Class:  class,
+			Used:   q.usage[class],
+			Limit:  q.limits.Classes[class],
+			Blocks: q.counts[class],
+		})
+	}
+	return st
+}
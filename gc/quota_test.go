@@ -0,0 +1,259 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+func newQuotaBlockstore(t *testing.T, limits QuotaLimits) (*QuotaBlockstore, bstore.GCBlockstore, *time.Time) {
+	base := bstore.NewBlockstore(dssync.MutexWrap(dstore.NewMapDatastore()))
+	q := NewQuotaBlockstore(bstore.NewGCBlockstore(base, bstore.NewGCLocker()), limits)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	if err := q.Refresh(context.Background(), base, func(cid.Cid) (QuotaClass, bool) { return "", false }); err != nil {
+		t.Fatal(err)
+	}
+	return q, NewBarrierBlockstore(q), &now
+}
+
+func quotaBlock(i int) blocks.Block {
+	data := make([]byte, 100)
+	copy(data, fmt.Sprintf("block %d", i))
+	return blocks.NewBlock(data)
+}
+
+func TestQuotaCacheEviction(t *testing.T) {
+	q, bs, now := newQuotaBlockstore(t, QuotaLimits{Total: 500, MinCacheAge: time.Minute})
+	cache := QuotaView(bs, QuotaCache)
+
+	for i := 0; i < 5; i++ {
+		if err := cache.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Get(quotaBlock(0).Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache is too recent to be evicted
+	err := bs.Put(quotaBlock(10))
+	if _, ok := err.(*QuotaError); !ok {
+		t.Fatalf("expected a QuotaError, got %v", err)
+	}
+
+	*now = now.Add(time.Hour)
+	if err := bs.Put(quotaBlock(10)); err != nil {
+		t.Fatal(err)
+	}
+	// block 1 was the least recently used, block 0 was read
+	if has, _ := bs.Has(quotaBlock(1).Cid()); has {
+		t.Fatal("least recently used cache block was not evicted")
+	}
+	if has, _ := bs.Has(quotaBlock(0).Cid()); !has {
+		t.Fatal("recently read cache block was evicted")
+	}
+
+	st := q.Stat()
+	if !st.Ready || st.Total.Used != 500 || st.Evicted != 1 || st.Rejected != 1 {
+		t.Fatalf("unexpected stat: %+v", st)
+	}
+	if st.Classes[0].Class != QuotaUser || st.Classes[0].Used != 100 {
+		t.Fatalf("unexpected user usage: %+v", st.Classes[0])
+	}
+}
+
+func TestQuotaClassLimit(t *testing.T) {
+	q, bs, _ := newQuotaBlockstore(t, QuotaLimits{Classes: map[QuotaClass]uint64{QuotaUser: 200}})
+
+	for i := 0; i < 2; i++ {
+		if err := bs.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rewriting a stored block takes no space
+	if err := bs.Put(quotaBlock(0)); err != nil {
+		t.Fatal(err)
+	}
+	err := bs.Put(quotaBlock(2))
+	if qe, ok := err.(*QuotaError); !ok || qe.Class != QuotaUser {
+		t.Fatalf("expected the user quota to be exceeded, got %v", err)
+	}
+
+	// backups are accounted separately
+	q.SetHint(func(c cid.Cid) (QuotaClass, bool) {
+		return QuotaBackup, c.Equals(quotaBlock(2).Cid())
+	})
+	if err := bs.Put(quotaBlock(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bs.DeleteBlock(quotaBlock(0).Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(quotaBlock(3)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaEvictor(t *testing.T) {
+	q, bs, _ := newQuotaBlockstore(t, QuotaLimits{Total: 300})
+	backup := QuotaView(bs, QuotaBackup)
+	for i := 0; i < 3; i++ {
+		if err := backup.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.SetEvictor(func(ctx context.Context, evict func(cid.Cid) bool) error {
+		for i := 0; i < 3; i++ {
+			if evict(quotaBlock(i).Cid()) {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err := bs.Put(quotaBlock(10)); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(quotaBlock(0).Cid()); has {
+		t.Fatal("block proposed first was not evicted")
+	}
+	if has, _ := bs.Has(quotaBlock(1).Cid()); !has {
+		t.Fatal("more blocks evicted than needed")
+	}
+}
+
+func TestQuotaRefresh(t *testing.T) {
+	q, bs, now := newQuotaBlockstore(t, QuotaLimits{})
+	for i := 0; i < 3; i++ {
+		if err := bs.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// written before the refresh and unknown: cache
+	*now = now.Add(time.Minute)
+	pinned := quotaBlock(0).Cid()
+	err := q.Refresh(context.Background(), q.GCBlockstore, func(c cid.Cid) (QuotaClass, bool) {
+		return QuotaUser, c.Hash().String() == pinned.Hash().String()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := q.Stat()
+	if st.Classes[0].Blocks != 1 || st.Classes[2].Blocks != 2 {
+		t.Fatalf("unexpected classification: %+v", st.Classes)
+	}
+}
+
+func TestQuotaKeepsPinnedSinceRefresh(t *testing.T) {
+	q, bs, now := newQuotaBlockstore(t, QuotaLimits{Total: 300, MinCacheAge: time.Minute})
+	cache := QuotaView(bs, QuotaCache)
+	for i := 0; i < 3; i++ {
+		if err := cache.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*now = now.Add(time.Hour)
+
+	// block 0 was pinned after the last refresh, the guard knows it
+	pinned := quotaBlock(0).Cid()
+	guarded := make(chan struct{}, 1)
+	q.SetGuard(func(ctx context.Context) (func(cid.Cid) (QuotaClass, bool), error) {
+		select {
+		case guarded <- struct{}{}:
+		default:
+		}
+		return func(c cid.Cid) (QuotaClass, bool) {
+			return QuotaUser, c.Equals(pinned)
+		}, nil
+	})
+
+	// eviction waits for the GC lock
+	gcl := bs.GCLock()
+	done := make(chan error, 1)
+	go func() { done <- bs.Put(quotaBlock(10)) }()
+	select {
+	case <-guarded:
+		t.Fatal("blocks were checked without the GC lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gcl.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := bs.Has(pinned); !has {
+		t.Fatal("block pinned since the refresh was evicted")
+	}
+	if has, _ := bs.Has(quotaBlock(1).Cid()); has {
+		t.Fatal("least recently used unpinned block was not evicted")
+	}
+	st := q.Stat()
+	if st.Classes[0].Blocks != 2 || st.Classes[2].Blocks != 1 {
+		t.Fatalf("the pinned block was not reclassified: %+v", st.Classes)
+	}
+}
+
+func TestQuotaDefersEvictionUnderPinLock(t *testing.T) {
+	q, bs, now := newQuotaBlockstore(t, QuotaLimits{Total: 200, MinCacheAge: time.Minute})
+	cache := QuotaView(bs, QuotaCache)
+	for i := 0; i < 2; i++ {
+		if err := cache.Put(quotaBlock(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*now = now.Add(time.Hour)
+
+	var pinned cid.Cid
+	q.SetGuard(func(ctx context.Context) (func(cid.Cid) (QuotaClass, bool), error) {
+		return func(c cid.Cid) (QuotaClass, bool) {
+			return QuotaUser, c.Equals(pinned)
+		}, nil
+	})
+
+	// a write holding the pin lock makes room without deleting anything
+	pl := bs.PinLock()
+	if err := bs.PutMany([]blocks.Block{quotaBlock(10), quotaBlock(11)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if has, _ := bs.Has(quotaBlock(i).Cid()); !has {
+			t.Fatalf("cache block %d was deleted under the pin lock", i)
+		}
+	}
+
+	// block 1 is pinned before the pin locks are released
+	pinned = quotaBlock(1).Cid()
+	pl.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if has, _ := bs.Has(quotaBlock(0).Cid()); !has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the deferred eviction did not happen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the deletions are done under the GC lock
+	bs.GCLock().Unlock()
+
+	if has, _ := bs.Has(pinned); !has {
+		t.Fatal("block pinned before the deferred eviction was deleted")
+	}
+	st := q.Stat()
+	if st.Classes[0].Blocks != 3 || st.Evicted != 1 {
+		t.Fatalf("the pinned block was not accounted again: %+v", st)
+	}
+}
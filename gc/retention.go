@@ -0,0 +1,155 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// RetentionSource keeps blocks alive that are not pinned, for example
+// replicas stored on behalf of other nodes.
+type RetentionSource interface {
+	// Name identifies the source in the GC output.
+	Name() string
+
+	// Roots returns the roots kept by this source. Their descendants are
+	// kept as well, as far as they are present in the blockstore.
+	Roots(ctx context.Context) ([]Retained, error)
+
+	// Blocks returns the single blocks kept without their descendants,
+	// such as partial replicas. Like the roots, they are read once per
+	// run.
+	Blocks(ctx context.Context) ([]cid.Cid, error)
+
+	// Retains reports whether a single block must be kept. It re-checks a
+	// block outside of a full run, before evicting it.
+	Retains(ctx context.Context, k cid.Cid) (bool, error)
+}
+
+// retainedBy returns the name of the first of sources retaining k, or "" if
+// none does.
+func retainedBy(ctx context.Context, sources []RetentionSource, k cid.Cid) (string, error) {
+	for _, src := range sources {
+		ok, err := src.Retains(ctx, k)
+		if err != nil {
+			return "", fmt.Errorf("retention source %s: %s", src.Name(), err)
+		}
+		if ok {
+			return src.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// Retained is a root kept by a RetentionSource, along with the reason.
+type Retained struct {
+	Root   cid.Cid
+	Reason string
+}
+
+// Options configure a garbage collection run.
+type Options struct {
+	// Sources keep blocks in addition to the pinner and best effort roots.
+	Sources []RetentionSource
+
+	// ReportRetained emits a Result for every root kept by the run,
+	// explaining why it was kept.
+	ReportRetained bool
+}
+
+// leasePrefix is the datastore namespace holding leases.
+var leasePrefix = dstore.NewKey("/gc/leases")
+
+// Lease keeps a root and its descendants until it expires.
+type Lease struct {
+	Root    cid.Cid `json:"-"`
+	Holder  string
+	Expires time.Time
+}
+
+func leaseKey(c cid.Cid) dstore.Key {
+	return leasePrefix.ChildString(c.String())
+}
+
+// PutLease records a lease on l.Root, replacing any previous lease on it.
+func PutLease(ds dstore.Datastore, l Lease) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ds.Put(leaseKey(l.Root), b)
+}
+
+// RemoveLease drops the lease on c, if any.
+func RemoveLease(ds dstore.Datastore, c cid.Cid) error {
+	return ds.Delete(leaseKey(c))
+}
+
+// Leases returns the leases that have not expired at now. Expired leases
+// are removed.
+func Leases(ds dstore.Datastore, now time.Time) ([]Lease, error) {
+	active, expired, err := readLeases(ds, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range expired {
+		if err := ds.Delete(leaseKey(l.Root)); err != nil {
+			log.Warnf("failed to remove expired lease %s: %s", l.Root, err)
+		}
+	}
+	return active, nil
+}
+
+// ActiveLeases is like Leases, but leaves the expired leases in place.
+func ActiveLeases(ds dstore.Datastore, now time.Time) ([]Lease, error) {
+	active, _, err := readLeases(ds, now)
+	return active, err
+}
+
+// ExpiredLeases returns the leases expired at now, the oldest first. Unlike
+// Leases, it leaves them in the datastore.
+func ExpiredLeases(ds dstore.Datastore, now time.Time) ([]Lease, error) {
+	_, expired, err := readLeases(ds, now)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Expires.Before(expired[j].Expires)
+	})
+	return expired, nil
+}
+
+func readLeases(ds dstore.Datastore, now time.Time) (active, expired []Lease, err error) {
+	res, err := ds.Query(dsq.Query{Prefix: leasePrefix.String()})
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range entries {
+		k := dstore.RawKey(r.Key)
+		c, err := cid.Decode(k.BaseNamespace())
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid lease key %s: %s", k, err)
+		}
+		l := Lease{Root: c}
+		if err := json.Unmarshal(r.Value, &l); err != nil {
+			return nil, nil, fmt.Errorf("invalid lease %s: %s", c, err)
+		}
+		if !l.Expires.IsZero() && !now.Before(l.Expires) {
+			expired = append(expired, l)
+			continue
+		}
+		active = append(active, l)
+	}
+	return active, expired, nil
+}
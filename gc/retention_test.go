@@ -0,0 +1,59 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestLeases(t *testing.T) {
+	ds := dstore.NewMapDatastore()
+	now := time.Now()
+
+	mkcid := func(s string) cid.Cid {
+		h, _ := mh.Sum([]byte(s), mh.SHA2_256, -1)
+		return cid.NewCidV1(cid.DagProtobuf, h)
+	}
+	active, expired, forever := mkcid("active"), mkcid("expired"), mkcid("forever")
+
+	for _, l := range []Lease{
+		{Root: active, Holder: "a", Expires: now.Add(time.Hour)},
+		{Root: expired, Holder: "b", Expires: now.Add(-time.Second)},
+		{Root: forever, Holder: "c"},
+	} {
+		if err := PutLease(ds, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leases, err := Leases(ds, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[cid.Cid]string{}
+	for _, l := range leases {
+		got[l.Root] = l.Holder
+	}
+	if len(got) != 2 || got[active] != "a" || got[forever] != "c" {
+		t.Fatalf("unexpected leases: %v", got)
+	}
+
+	// expired leases are dropped from the datastore
+	if has, _ := ds.Has(leaseKey(expired)); has {
+		t.Fatal("expired lease was not removed")
+	}
+
+	if err := RemoveLease(ds, active); err != nil {
+		t.Fatal(err)
+	}
+	leases, err = Leases(ds, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].Root != forever {
+		t.Fatalf("unexpected leases after removal: %v", leases)
+	}
+}
@@ -0,0 +1,424 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Transports of the forwarded addresses.
+const (
+	TransportTCP  = "tcp"
+	TransportUDP  = "udp"
+	TransportUnix = "unix"
+)
+
+const (
+	// maxDatagramSize is the largest datagram a frame can carry.
+	maxDatagramSize = 1<<16 - 1
+	// datagramIdleTimeout closes the stream of a UDP client that neither
+	// sent nor received a datagram for that long.
+	datagramIdleTimeout = 2 * time.Minute
+	// datagramQueueSize is the number of datagrams of a client queued for
+	// its stream. Datagrams beyond it are dropped, as UDP allows.
+	datagramQueueSize = 64
+	// datagramClientsPerHost is the number of clients, each with a stream
+	// of its own, a single host can have at a time. Every source port is a
+	// client, so the datagrams of new clients beyond it are dropped.
+	datagramClientsPerHost = 32
+)
+
+var errDatagramTooLarge = errors.New("datagram too large")
+
+// Transport returns the transport of a forwarded address: TransportUnix,
+// TransportUDP or TransportTCP. A /p2p address has no transport and yields
+// an empty string.
+func Transport(addr ma.Multiaddr) string {
+	for _, p := range addr.Protocols() {
+		switch p.Code {
+		case ma.P_UNIX:
+			return TransportUnix
+		case ma.P_UDP:
+			return TransportUDP
+		case ma.P_TCP:
+			return TransportTCP
+		}
+	}
+	return ""
+}
+
+// datagramConn carries datagrams over the byte stream of a libp2p stream.
+// Each datagram read from recv is framed with its length as a big-endian
+// uint16, and the frames written to it are passed to send one datagram at a
+// time.
+type datagramConn struct {
+	recv  func() ([]byte, error)
+	send  func([]byte) error
+	close func() error
+
+	laddr, raddr ma.Multiaddr
+
+	readBuf  []byte // rest of the frame being read
+	writeBuf []byte // incomplete frame being written
+}
+
+var _ manet.Conn = (*datagramConn)(nil)
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		pkt, err := c.recv()
+		if err != nil {
+			return 0, err
+		}
+		if len(pkt) > maxDatagramSize {
+			return 0, errDatagramTooLarge
+		}
+		frame := make([]byte, 2+len(pkt))
+		binary.BigEndian.PutUint16(frame, uint16(len(pkt)))
+		copy(frame[2:], pkt)
+		c.readBuf = frame
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	c.writeBuf = append(c.writeBuf, p...)
+	for len(c.writeBuf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.writeBuf))
+		if len(c.writeBuf) < 2+size {
+			break
+		}
+		if err := c.send(c.writeBuf[2 : 2+size]); err != nil {
+			return 0, err
+		}
+		c.writeBuf = c.writeBuf[2+size:]
+	}
+	return len(p), nil
+}
+
+func (c *datagramConn) Close() error {
+	return c.close()
+}
+
+func (c *datagramConn) LocalMultiaddr() ma.Multiaddr  { return c.laddr }
+func (c *datagramConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr }
+
+func (c *datagramConn) LocalAddr() net.Addr {
+	a, _ := manet.ToNetAddr(c.laddr)
+	return a
+}
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	a, _ := manet.ToNetAddr(c.raddr)
+	return a
+}
+
+// Deadlines are not supported, streams are closed when idle instead.
+func (c *datagramConn) SetDeadline(time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(time.Time) error { return nil }
+
+// dialDatagram connects to a UDP target, on the remote end of a stream.
+func dialDatagram(addr ma.Multiaddr) (*datagramConn, *net.UDPConn, error) {
+	naddr, err := manet.ToNetAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	uaddr, ok := naddr.(*net.UDPAddr)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a udp address", addr)
+	}
+	conn, err := net.DialUDP("udp", nil, uaddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	return &datagramConn{
+		recv: func() ([]byte, error) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			return buf[:n], nil
+		},
+		send: func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		},
+		close: conn.Close,
+		laddr: laddr,
+		raddr: addr,
+	}, conn, nil
+}
+
+// datagramListener receives the datagrams sent to a local UDP address and
+// forwards the datagrams of each client over a stream of its own.
+type datagramListener struct {
+	ctx context.Context
+
+	p2p *P2P
+
+	proto protocol.ID
+	laddr ma.Multiaddr
+	peer  peer.ID
+
+	conn *net.UDPConn
+
+	lk      sync.Mutex
+	closed  bool
+	clients map[string]*datagramClient
+	perHost map[string]int // clients by source IP
+}
+
+// datagramClient is the state of a UDP client of a datagramListener.
+type datagramClient struct {
+	in      chan []byte
+	done    chan struct{}
+	closing sync.Once
+
+	lk         sync.Mutex
+	lastActive time.Time
+	stream     *Stream // once set up
+}
+
+func (c *datagramClient) active() {
+	c.lk.Lock()
+	c.lastActive = time.Now()
+	c.lk.Unlock()
+}
+
+func (c *datagramClient) idleFor() time.Duration {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return time.Since(c.lastActive)
+}
+
+func (p2p *P2P) forwardLocalDatagram(ctx context.Context, peer peer.ID, proto protocol.ID, bindAddr ma.Multiaddr) (Listener, error) {
+	naddr, err := manet.ToNetAddr(bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	uaddr, ok := naddr.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a udp address", bindAddr)
+	}
+	conn, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	listener := &datagramListener{
+		ctx:     ctx,
+		p2p:     p2p,
+		proto:   proto,
+		laddr:   laddr,
+		peer:    peer,
+		conn:    conn,
+		clients: make(map[string]*datagramClient),
+		perHost: make(map[string]int),
+	}
+	if err := p2p.ListenersLocal.Register(listener); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go listener.receive()
+	return listener, nil
+}
+
+func (l *datagramListener) receive() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Temporary() {
+				continue
+			}
+			return
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+
+		l.lk.Lock()
+		client, ok := l.clients[src.String()]
+		if !ok {
+			host := src.IP.String()
+			if l.perHost[host] >= datagramClientsPerHost {
+				l.lk.Unlock()
+				log.Debugf("dropping datagram from %s, too many clients on its host", src)
+				continue
+			}
+			client = &datagramClient{
+				in:         make(chan []byte, datagramQueueSize),
+				done:       make(chan struct{}),
+				lastActive: time.Now(),
+			}
+			l.clients[src.String()] = client
+			l.perHost[host]++
+			go l.setupStream(src, client)
+		}
+		l.lk.Unlock()
+
+		select {
+		case client.in <- pkt:
+		default:
+			log.Debugf("dropping datagram from %s, its stream is behind", src)
+		}
+	}
+}
+
+func (l *datagramListener) setupStream(src *net.UDPAddr, client *datagramClient) {
+	closeClient := func() error {
+		client.closing.Do(func() {
+			close(client.done)
+			l.lk.Lock()
+			delete(l.clients, src.String())
+			host := src.IP.String()
+			if l.perHost[host]--; l.perHost[host] <= 0 {
+				delete(l.perHost, host)
+			}
+			l.lk.Unlock()
+		})
+		return nil
+	}
+
+	cctx, cancel := context.WithTimeout(l.ctx, time.Second*30)
+	remote, err := l.p2p.peerHost.NewStream(cctx, l.peer, l.proto)
+	cancel()
+	if err != nil {
+		closeClient()
+		log.Warnf("failed to dial to remote %s/%s", l.peer.Pretty(), l.proto)
+		return
+	}
+
+	origin, err := manet.FromNetAddr(src)
+	if err != nil {
+		closeClient()
+		_ = remote.Reset()
+		return
+	}
+
+	local := &datagramConn{
+		recv: func() ([]byte, error) {
+			idle := time.NewTimer(datagramIdleTimeout)
+			defer idle.Stop()
+			for {
+				select {
+				case pkt := <-client.in:
+					client.active()
+					return pkt, nil
+				case <-client.done:
+					return nil, io.EOF
+				case <-idle.C:
+					d := client.idleFor()
+					if d >= datagramIdleTimeout {
+						return nil, io.EOF
+					}
+					idle.Reset(datagramIdleTimeout - d)
+				}
+			}
+		},
+		send: func(b []byte) error {
+			client.active()
+			_, err := l.conn.WriteToUDP(b, src)
+			return err
+		},
+		close: closeClient,
+		laddr: l.laddr,
+		raddr: origin,
+	}
+
+	stream := &Stream{
+		Protocol: l.proto,
+
+		OriginAddr: origin,
+		TargetAddr: l.TargetAddress(),
+		peer:       l.peer,
+		outbound:   true,
+
+		Local:  local,
+		Remote: remote,
+
+		Registry: l.p2p.Streams,
+	}
+
+	l.p2p.Streams.Register(stream)
+
+	// the listener may have closed while the stream was set up
+	client.lk.Lock()
+	client.stream = stream
+	client.lk.Unlock()
+	l.lk.Lock()
+	closed := l.closed
+	l.lk.Unlock()
+	if closed {
+		l.p2p.Streams.Reset(stream)
+	}
+}
+
+// close closes the socket, and the streams of the clients with it: they
+// could not send their replies anymore.
+func (l *datagramListener) close() {
+	l.conn.Close()
+
+	l.lk.Lock()
+	l.closed = true
+	clients := make([]*datagramClient, 0, len(l.clients))
+	for _, c := range l.clients {
+		clients = append(clients, c)
+	}
+	l.lk.Unlock()
+
+	for _, c := range clients {
+		c.lk.Lock()
+		stream := c.stream
+		c.lk.Unlock()
+		if stream != nil {
+			l.p2p.Streams.Reset(stream)
+		}
+	}
+}
+
+func (l *datagramListener) Protocol() protocol.ID {
+	return l.proto
+}
+
+func (l *datagramListener) ListenAddress() ma.Multiaddr {
+	return l.laddr
+}
+
+func (l *datagramListener) TargetAddress() ma.Multiaddr {
+	addr, err := ma.NewMultiaddr(maPrefix + l.peer.Pretty())
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func (l *datagramListener) key() string {
+	return l.ListenAddress().String()
+}
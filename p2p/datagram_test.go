@@ -0,0 +1,229 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+func frame(pkt string) []byte {
+	b := make([]byte, 2+len(pkt))
+	binary.BigEndian.PutUint16(b, uint16(len(pkt)))
+	copy(b[2:], pkt)
+	return b
+}
+
+func TestDatagramConnFraming(t *testing.T) {
+	datagrams := []string{"first", "", "the second datagram"}
+	in := append([]string(nil), datagrams...)
+	var sent []string
+	c := &datagramConn{
+		recv: func() ([]byte, error) {
+			if len(in) == 0 {
+				return nil, io.EOF
+			}
+			pkt := in[0]
+			in = in[1:]
+			return []byte(pkt), nil
+		},
+		send: func(b []byte) error {
+			sent = append(sent, string(b))
+			return nil
+		},
+		close: func() error { return nil },
+	}
+
+	// read a byte at a time, the datagrams come framed
+	stream, err := ioutil.ReadAll(iotest.OneByteReader(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for _, d := range datagrams {
+		want = append(want, frame(d)...)
+	}
+	if !bytes.Equal(stream, want) {
+		t.Fatalf("read %q, expected %q", stream, want)
+	}
+
+	// frames written in pieces are sent as whole datagrams
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if n, err := c.Write(stream[i:end]); err != nil || n != end-i {
+			t.Fatalf("write: %d, %v", n, err)
+		}
+	}
+	if len(sent) != len(datagrams) {
+		t.Fatalf("sent %q, expected %q", sent, datagrams)
+	}
+	for i := range datagrams {
+		if sent[i] != datagrams[i] {
+			t.Fatalf("sent %q, expected %q", sent, datagrams)
+		}
+	}
+
+	c.recv = func() ([]byte, error) { return make([]byte, maxDatagramSize+1), nil }
+	if _, err := c.Read(make([]byte, 10)); err != errDatagramTooLarge {
+		t.Fatalf("expected errDatagramTooLarge, got %v", err)
+	}
+}
+
+// udpEcho serves a UDP socket sending every datagram back.
+func udpEcho(t *testing.T) ma.Multiaddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+	addr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// newDatagramForward forwards a local UDP address to an echo service on
+// another peer.
+func newDatagramForward(t *testing.T) (local, remote *P2P, l Listener) {
+	t.Helper()
+	ctx := context.Background()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	t.Cleanup(func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	})
+	local = New(hosts[0].ID(), hosts[0], hosts[0].Peerstore())
+	remote = New(hosts[1].ID(), hosts[1], hosts[1].Peerstore())
+
+	if _, err := remote.ForwardRemote(ctx, "/x/echo", udpEcho(t), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err = local.ForwardLocal(ctx, hosts[1].ID(), "/x/echo", bind); err != nil {
+		t.Fatal(err)
+	}
+	return local, remote, l
+}
+
+func dialListener(t *testing.T, l Listener) *net.UDPConn {
+	t.Helper()
+	addr, err := manet.ToNetAddr(l.ListenAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func streamCount(p *P2P) int {
+	p.Streams.Lock()
+	defer p.Streams.Unlock()
+	return len(p.Streams.Streams)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	local, remote, l := newDatagramForward(t)
+	conn := dialListener(t, l)
+
+	buf := make([]byte, maxDatagramSize)
+	for _, msg := range []string{"ping", "a longer datagram", "x"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("received %q, expected %q", buf[:n], msg)
+		}
+	}
+	if streamCount(local) != 1 {
+		t.Fatalf("expected a single stream for the client, got %d", streamCount(local))
+	}
+
+	// closing the listener closes the streams of its clients
+	if n := local.ListenersLocal.Close(func(Listener) bool { return true }); n != 1 {
+		t.Fatalf("closed %d listeners", n)
+	}
+	waitFor(t, "the local stream to close", func() bool { return streamCount(local) == 0 })
+	waitFor(t, "the remote stream to close", func() bool { return streamCount(remote) == 0 })
+}
+
+func TestDatagramClientsPerHost(t *testing.T) {
+	local, _, l := newDatagramForward(t)
+
+	var conns []*net.UDPConn
+	for i := 0; i <= datagramClientsPerHost; i++ {
+		conn := dialListener(t, l)
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	waitFor(t, "the clients to be forwarded", func() bool {
+		return streamCount(local) == datagramClientsPerHost
+	})
+
+	// the client beyond the limit gets no stream, hence no reply
+	last := conns[datagramClientsPerHost]
+	if err := last.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := last.Read(make([]byte, 16)); err == nil {
+		t.Fatal("a client beyond the limit was answered")
+	}
+	if n := streamCount(local); n != datagramClientsPerHost {
+		t.Fatalf("expected %d streams, got %d", datagramClientsPerHost, n)
+	}
+}
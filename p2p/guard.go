@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	"github.com/ipfs/go-ipfs/ratelimit"
+)
+
+// maxRecentRejections is the number of rejected streams a listener keeps.
+const maxRecentRejections = 16
+
+// Reasons a listener rejects a stream for.
+const (
+	RejectNotAllowed = "peer not allowed"
+	RejectTooMany    = "too many streams"
+)
+
+// ListenPolicy restricts the streams a p2p listener accepts. The zero value
+// accepts every stream.
+type ListenPolicy struct {
+	// Allow lists the peers accepted. When empty and AllowFunc is nil, any
+	// peer is accepted.
+	Allow map[peer.ID]bool
+
+	// AllowFunc accepts the peers not in Allow, for instance the peers
+	// registered on chain.
+	AllowFunc func(peer.ID) bool
+
+	// MaxStreamsPerPeer caps the concurrent streams of a peer. Zero means
+	// no limit.
+	MaxStreamsPerPeer int
+
+	// BandwidthPerPeer caps the bytes per second a peer sends and receives
+	// over all its streams, in each direction. Zero means no limit.
+	BandwidthPerPeer float64
+}
+
+func (p *ListenPolicy) allowed(id peer.ID) bool {
+	if len(p.Allow) == 0 && p.AllowFunc == nil {
+		return true
+	}
+	if p.Allow[id] {
+		return true
+	}
+	return p.AllowFunc != nil && p.AllowFunc(id)
+}
+
+// Rejection records a stream refused by a listener.
+type Rejection struct {
+	Peer   peer.ID
+	Reason string
+	Time   time.Time
+}
+
+// GuardedListener is a Listener applying a ListenPolicy.
+type GuardedListener interface {
+	Listener
+
+	// Policy returns the policy of the listener.
+	Policy() ListenPolicy
+
+	// Rejections returns the number of streams rejected so far, and the
+	// most recent rejections, oldest first.
+	Rejections() (uint64, []Rejection)
+}
+
+// guard applies a ListenPolicy to the streams of a listener.
+type guard struct {
+	policy ListenPolicy
+
+	mu       sync.Mutex
+	peers    map[peer.ID]*guardedPeer
+	rejected uint64
+	recent   []Rejection
+}
+
+// guardedPeer is the state of a peer with open streams.
+type guardedPeer struct {
+	streams int
+	in, out *ratelimit.Bucket
+}
+
+func newGuard(policy *ListenPolicy) *guard {
+	g := &guard{peers: make(map[peer.ID]*guardedPeer)}
+	if policy != nil {
+		g.policy = *policy
+	}
+	return g
+}
+
+// admission is a stream accepted by a guard.
+type admission struct {
+	g    *guard
+	id   peer.ID
+	peer *guardedPeer
+	once sync.Once
+}
+
+// wrap applies the bandwidth caps to the local end of the stream, and
+// releases the stream when it is closed.
+func (a *admission) wrap(c manet.Conn) manet.Conn {
+	return &guardedConn{Conn: c, in: a.peer.in, out: a.peer.out, release: a.release}
+}
+
+// release releases a stream that could not be set up.
+func (a *admission) release() {
+	a.once.Do(func() { a.g.release(a.id) })
+}
+
+// admit accepts or rejects a stream of id. An accepted stream must be
+// wrapped or released.
+func (g *guard) admit(id peer.ID) (*admission, string) {
+	if !g.policy.allowed(id) {
+		return nil, g.reject(id, RejectNotAllowed)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.peers[id]
+	if !ok {
+		p = &guardedPeer{}
+		if rate := g.policy.BandwidthPerPeer; rate > 0 {
+			p.in, p.out = ratelimit.NewBucket(rate), ratelimit.NewBucket(rate)
+		}
+		g.peers[id] = p
+	}
+	if max := g.policy.MaxStreamsPerPeer; max > 0 && p.streams >= max {
+		return nil, g.rejectLocked(id, RejectTooMany)
+	}
+	p.streams++
+	return &admission{g: g, id: id, peer: p}, ""
+}
+
+func (g *guard) release(id peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if p, ok := g.peers[id]; ok {
+		p.streams--
+		if p.streams <= 0 {
+			delete(g.peers, id)
+		}
+	}
+}
+
+func (g *guard) reject(id peer.ID, reason string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rejectLocked(id, reason)
+}
+
+func (g *guard) rejectLocked(id peer.ID, reason string) string {
+	g.rejected++
+	g.recent = append(g.recent, Rejection{Peer: id, Reason: reason, Time: time.Now()})
+	if len(g.recent) > maxRecentRejections {
+		g.recent = g.recent[len(g.recent)-maxRecentRejections:]
+	}
+	return reason
+}
+
+func (g *guard) rejections() (uint64, []Rejection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	recent := make([]Rejection, len(g.recent))
+	copy(recent, g.recent)
+	return g.rejected, recent
+}
+
+// guardedConn is the local end of an accepted stream. What is read from it
+// goes out to the peer, what is written to it came in from the peer.
+type guardedConn struct {
+	manet.Conn
+
+	in, out *ratelimit.Bucket
+	release func()
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	ratelimit.Wait(n, c.out)
+	return n, err
+}
+
+func (c *guardedConn) Write(p []byte) (int, error) {
+	ratelimit.Wait(len(p), c.in)
+	return c.Conn.Write(p)
+}
+
+func (c *guardedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
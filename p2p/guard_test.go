@@ -0,0 +1,97 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestGuardAllow(t *testing.T) {
+	alice, bob, carol := peer.ID("alice"), peer.ID("bob"), peer.ID("carol")
+
+	g := newGuard(nil)
+	if _, reason := g.admit(alice); reason != "" {
+		t.Fatalf("the zero policy rejected a stream: %s", reason)
+	}
+
+	g = newGuard(&ListenPolicy{
+		Allow:     map[peer.ID]bool{alice: true},
+		AllowFunc: func(id peer.ID) bool { return id == bob },
+	})
+	for _, id := range []peer.ID{alice, bob} {
+		if _, reason := g.admit(id); reason != "" {
+			t.Fatalf("%s was rejected: %s", id, reason)
+		}
+	}
+	if _, reason := g.admit(carol); reason != RejectNotAllowed {
+		t.Fatalf("expected %q, got %q", RejectNotAllowed, reason)
+	}
+
+	n, recent := g.rejections()
+	if n != 1 || len(recent) != 1 || recent[0].Peer != carol || recent[0].Reason != RejectNotAllowed {
+		t.Fatalf("unexpected rejections: %d %+v", n, recent)
+	}
+}
+
+func TestGuardMaxStreamsPerPeer(t *testing.T) {
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	g := newGuard(&ListenPolicy{MaxStreamsPerPeer: 2})
+
+	var admitted []*admission
+	for i := 0; i < 2; i++ {
+		a, reason := g.admit(alice)
+		if reason != "" {
+			t.Fatalf("stream %d was rejected: %s", i, reason)
+		}
+		admitted = append(admitted, a)
+	}
+	if _, reason := g.admit(alice); reason != RejectTooMany {
+		t.Fatalf("expected %q, got %q", RejectTooMany, reason)
+	}
+	// the cap is per peer
+	if _, reason := g.admit(bob); reason != "" {
+		t.Fatalf("another peer was rejected: %s", reason)
+	}
+
+	// releasing twice frees a single stream
+	admitted[0].release()
+	admitted[0].release()
+	if _, reason := g.admit(alice); reason != "" {
+		t.Fatalf("a released stream still counts: %s", reason)
+	}
+	if _, reason := g.admit(alice); reason != RejectTooMany {
+		t.Fatalf("expected %q, got %q", RejectTooMany, reason)
+	}
+
+	n, _ := g.rejections()
+	if n != 2 {
+		t.Fatalf("expected 2 rejections, got %d", n)
+	}
+}
+
+func TestGuardRecentRejections(t *testing.T) {
+	g := newGuard(&ListenPolicy{Allow: map[peer.ID]bool{"alice": true}})
+	for i := 0; i < maxRecentRejections+5; i++ {
+		g.admit(peer.ID(rune('a' + i)))
+	}
+	n, recent := g.rejections()
+	if n != maxRecentRejections+5 || len(recent) != maxRecentRejections {
+		t.Fatalf("got %d rejections, %d recent", n, len(recent))
+	}
+	if recent[0].Peer != peer.ID(rune('a'+5)) {
+		t.Fatalf("the oldest rejections were not dropped first: %s", recent[0].Peer)
+	}
+}
+
+func TestGuardBandwidthShared(t *testing.T) {
+	g := newGuard(&ListenPolicy{BandwidthPerPeer: 1000})
+	a1, _ := g.admit("alice")
+	a2, _ := g.admit("alice")
+	b, _ := g.admit("bob")
+	if a1.peer.in == nil || a1.peer.in != a2.peer.in || a1.peer.out != a2.peer.out {
+		t.Fatal("the streams of a peer don't share its buckets")
+	}
+	if b.peer.in == a1.peer.in {
+		t.Fatal("two peers share a bucket")
+	}
+}
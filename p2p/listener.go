@@ -18,7 +18,8 @@ type Listener interface {
 
 	key() string
 
-	// close closes the listener. Does not affect child streams
+	// close closes the listener. Does not affect child streams, except
+	// the ones of a UDP listener, which cannot outlive its socket
 	close()
 }
 
@@ -25,8 +25,13 @@ type localListener struct {
 	listener manet.Listener
 }
 
-// ForwardLocal creates new P2P stream to a remote listener
+// ForwardLocal creates new P2P stream to a remote listener. For a UDP
+// bindAddr, each client gets a stream of its own carrying its datagrams.
 func (p2p *P2P) ForwardLocal(ctx context.Context, peer peer.ID, proto protocol.ID, bindAddr ma.Multiaddr) (Listener, error) {
+	if Transport(bindAddr) == TransportUDP {
+		return p2p.forwardLocalDatagram(ctx, peer, proto, bindAddr)
+	}
+
 	listener := &localListener{
 		ctx:   ctx,
 		p2p:   p2p,
@@ -86,6 +91,7 @@ func (l *localListener) setupStream(local manet.Conn) {
 		OriginAddr: local.RemoteMultiaddr(),
 		TargetAddr: l.TargetAddress(),
 		peer:       l.peer,
+		outbound:   true,
 
 		Local:  local,
 		Remote: remote,
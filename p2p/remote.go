@@ -3,6 +3,7 @@ package p2p
 import (
 	"context"
 	"fmt"
+	"io"
 
 	net "github.com/libp2p/go-libp2p-core/network"
 	protocol "github.com/libp2p/go-libp2p-core/protocol"
@@ -25,10 +26,14 @@ type remoteListener struct {
 	// reportRemote if set to true makes the handler send '<base58 remote peerid>\n'
 	// to target before any data is forwarded
 	reportRemote bool
+
+	// guard applies the policy of the listener to incoming streams
+	guard *guard
 }
 
-// ForwardRemote creates new p2p listener
-func (p2p *P2P) ForwardRemote(ctx context.Context, proto protocol.ID, addr ma.Multiaddr, reportRemote bool) (Listener, error) {
+// ForwardRemote creates new p2p listener. A nil policy accepts every
+// stream.
+func (p2p *P2P) ForwardRemote(ctx context.Context, proto protocol.ID, addr ma.Multiaddr, reportRemote bool, policy *ListenPolicy) (Listener, error) {
 	listener := &remoteListener{
 		p2p: p2p,
 
@@ -36,6 +41,8 @@ func (p2p *P2P) ForwardRemote(ctx context.Context, proto protocol.ID, addr ma.Mu
 		addr:  addr,
 
 		reportRemote: reportRemote,
+
+		guard: newGuard(policy),
 	}
 
 	if err := p2p.ListenersP2P.Register(listener); err != nil {
@@ -46,16 +53,41 @@ func (p2p *P2P) ForwardRemote(ctx context.Context, proto protocol.ID, addr ma.Mu
 }
 
 func (l *remoteListener) handleStream(remote net.Stream) {
-	local, err := manet.Dial(l.addr)
-	if err != nil {
+	peer := remote.Conn().RemotePeer()
+	adm, reason := l.guard.admit(peer)
+	if adm == nil {
+		log.Infof("rejected %s stream from %s: %s", l.proto, peer.Pretty(), reason)
 		_ = remote.Reset()
 		return
 	}
 
-	peer := remote.Conn().RemotePeer()
+	var (
+		local manet.Conn
+		// raw writes to the target, bypassing the datagram framing
+		raw io.Writer
+	)
+	if Transport(l.addr) == TransportUDP {
+		dc, conn, err := dialDatagram(l.addr)
+		if err != nil {
+			adm.release()
+			_ = remote.Reset()
+			return
+		}
+		local, raw = dc, conn
+	} else {
+		c, err := manet.Dial(l.addr)
+		if err != nil {
+			adm.release()
+			_ = remote.Reset()
+			return
+		}
+		local, raw = c, c
+	}
+	local = adm.wrap(local)
 
 	if l.reportRemote {
-		if _, err := fmt.Fprintf(local, "%s\n", peer.Pretty()); err != nil {
+		if _, err := fmt.Fprintf(raw, "%s\n", peer.Pretty()); err != nil {
+			_ = local.Close()
 			_ = remote.Reset()
 			return
 		}
@@ -63,6 +95,7 @@ func (l *remoteListener) handleStream(remote net.Stream) {
 
 	peerMa, err := ma.NewMultiaddr(maPrefix + peer.Pretty())
 	if err != nil {
+		_ = local.Close()
 		_ = remote.Reset()
 		return
 	}
@@ -99,6 +132,14 @@ func (l *remoteListener) TargetAddress() ma.Multiaddr {
 	return l.addr
 }
 
+func (l *remoteListener) Policy() ListenPolicy {
+	return l.guard.policy
+}
+
+func (l *remoteListener) Rejections() (uint64, []Rejection) {
+	return l.guard.rejections()
+}
+
 func (l *remoteListener) close() {}
 
 func (l *remoteListener) key() string {
@@ -10,9 +10,9 @@ import (
 	protocol "github.com/libp2p/go-libp2p-core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
-)
 
-const cmgrTag = "stream-fwd"
+	"github.com/ipfs/go-ipfs/connprotect"
+)
 
 // Stream holds information on active incoming and outgoing p2p streams.
 type Stream struct {
@@ -24,6 +24,10 @@ type Stream struct {
 	TargetAddr ma.Multiaddr
 	peer       peer.ID
 
+	// outbound is set for the streams of local forwards, opened by this
+	// node.
+	outbound bool
+
 	Local  manet.Conn
 	Remote net.Stream
 
@@ -71,13 +75,20 @@ type StreamRegistry struct {
 	ifconnmgr.ConnManager
 }
 
-// Register registers a stream to the registry
+// Register registers a stream to the registry. The peers of outbound
+// streams are protected from the connection manager until their last
+// outbound stream is closed; inbound streams are left out, or any peer
+// allowed by a listener could make itself untrimmable.
 func (r *StreamRegistry) Register(streamInfo *Stream) {
 	r.Lock()
 	defer r.Unlock()
 
-	r.ConnManager.TagPeer(streamInfo.peer, cmgrTag, 20)
-	r.conns[streamInfo.peer]++
+	if streamInfo.outbound {
+		if r.conns[streamInfo.peer] == 0 {
+			connprotect.Add(r.ConnManager, streamInfo.peer, connprotect.StreamForward)
+		}
+		r.conns[streamInfo.peer]++
+	}
 
 	streamInfo.id = r.nextID
 	r.Streams[r.nextID] = streamInfo
@@ -95,11 +106,12 @@ func (r *StreamRegistry) Deregister(streamID uint64) {
 	if !ok {
 		return
 	}
-	p := s.peer
-	r.conns[p]--
-	if r.conns[p] < 1 {
-		delete(r.conns, p)
-		r.ConnManager.UntagPeer(p, cmgrTag)
+	if p := s.peer; s.outbound {
+		r.conns[p]--
+		if r.conns[p] < 1 {
+			delete(r.conns, p)
+			connprotect.Remove(r.ConnManager, p, connprotect.StreamForward)
+		}
 	}
 
 	delete(r.Streams, streamID)
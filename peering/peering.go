@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multiaddr"
+
+	"github.com/ipfs/go-ipfs/connprotect"
 )
 
 // Seed the random number generator.
@@ -24,7 +27,6 @@ const (
 	// If we go over the max, we'll adjust the delay down to a random value
 	// between 90-100% of the max backoff.
 	maxBackoffJitter = 10 // %
-	connmgrTag       = "ipfs-peering"
 	// This needs to be sufficient to prevent two sides from simultaneously
 	// dialing.
 	initialDelay = 5 * time.Second
@@ -50,8 +52,13 @@ type peerHandler struct {
 	mu             sync.Mutex
 	addrs          []multiaddr.Multiaddr
 	reconnectTimer *time.Timer
+	nextAttempt    time.Time
 
 	nextDelay time.Duration
+
+	// owners are the owners that added the peer, userOwner for AddPeer.
+	// Guarded by the PeeringService lock.
+	owners map[string]bool
 }
 
 // setAddrs sets the addresses for this peer.
@@ -81,6 +88,20 @@ func (ph *peerHandler) stop() {
 	if ph.reconnectTimer != nil {
 		ph.reconnectTimer.Stop()
 		ph.reconnectTimer = nil
+		ph.nextAttempt = time.Time{}
+	}
+}
+
+// state returns the state of the peer.
+func (ph *peerHandler) state() PeerState {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return PeerState{
+		ID:          ph.peer,
+		Addrs:       ph.addrs,
+		Connected:   ph.host.Network().Connectedness(ph.peer) == network.Connected,
+		NextAttempt: ph.nextAttempt,
+		Backoff:     ph.nextDelay,
 	}
 }
 
@@ -112,7 +133,9 @@ func (ph *peerHandler) reconnect() {
 		if ph.reconnectTimer != nil {
 			// Only counts if the reconnectTimer still exists. If not, a
 			// connection _was_ somehow established.
-			ph.reconnectTimer.Reset(ph.nextBackoff())
+			delay := ph.nextBackoff()
+			ph.reconnectTimer.Reset(delay)
+			ph.nextAttempt = time.Now().Add(delay)
 		}
 		// Otherwise, someone else has stopped us so we can assume that
 		// we're either connected or someone else will start us.
@@ -132,6 +155,7 @@ func (ph *peerHandler) stopIfConnected() {
 		logger.Debugw("successfully reconnected", "peer", ph.peer)
 		ph.reconnectTimer.Stop()
 		ph.reconnectTimer = nil
+		ph.nextAttempt = time.Time{}
 		ph.nextDelay = initialDelay
 	}
 }
@@ -144,10 +168,16 @@ func (ph *peerHandler) startIfDisconnected() {
 	if ph.reconnectTimer == nil && ph.host.Network().Connectedness(ph.peer) != network.Connected {
 		logger.Debugw("disconnected from peer", "peer", ph.peer)
 		// Always start with a short timeout so we can stagger things a bit.
-		ph.reconnectTimer = time.AfterFunc(ph.nextBackoff(), ph.reconnect)
+		delay := ph.nextBackoff()
+		ph.reconnectTimer = time.AfterFunc(delay, ph.reconnect)
+		ph.nextAttempt = time.Now().Add(delay)
 	}
 }
 
+// userOwner owns the peers added with AddPeer: the configured peers and the
+// ones added at runtime.
+const userOwner = ""
+
 // PeeringService maintains connections to specified peers, reconnecting on
 // disconnect with a back-off.
 type PeeringService struct {
@@ -156,12 +186,20 @@ type PeeringService struct {
 	mu    sync.RWMutex
 	peers map[peer.ID]*peerHandler
 	state state
+
+	// removed are the peers removed with RemovePeer, which AddPeerAs
+	// doesn't add back.
+	removed map[peer.ID]bool
 }
 
 // NewPeeringService constructs a new peering service. Peers can be added and
 // removed immediately, but connections won't be formed until `Start` is called.
 func NewPeeringService(host host.Host) *PeeringService {
-	return &PeeringService{host: host, peers: make(map[peer.ID]*peerHandler)}
+	return &PeeringService{
+		host:    host,
+		peers:   make(map[peer.ID]*peerHandler),
+		removed: make(map[peer.ID]bool),
+	}
 }
 
 // Start starts the peering service, connecting and maintaining connections to
@@ -215,18 +253,44 @@ func (ps *PeeringService) AddPeer(info peer.AddrInfo) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	delete(ps.removed, info.ID)
+	ps.addPeer(userOwner, info)
+}
+
+// AddPeerAs adds a peer on behalf of owner, a component managing part of the
+// peering set. The peer stays until every owner that added it removes it with
+// RemovePeerAs, or until RemovePeer removes it.
+//
+// The addresses given by AddPeer take precedence, and the peers removed with
+// RemovePeer are left out until AddPeer adds them again.
+func (ps *PeeringService) AddPeerAs(owner string, info peer.AddrInfo) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.removed[info.ID] {
+		logger.Debugw("peer removed by the user", "peer", info.ID, "owner", owner)
+		return
+	}
+	ps.addPeer(owner, info)
+}
+
+func (ps *PeeringService) addPeer(owner string, info peer.AddrInfo) {
 	if handler, ok := ps.peers[info.ID]; ok {
-		logger.Infow("updating addresses", "peer", info.ID, "addrs", info.Addrs)
-		handler.setAddrs(info.Addrs)
+		if owner == userOwner || !handler.owners[userOwner] {
+			logger.Infow("updating addresses", "peer", info.ID, "addrs", info.Addrs)
+			handler.setAddrs(info.Addrs)
+		}
+		handler.owners[owner] = true
 	} else {
 		logger.Infow("peer added", "peer", info.ID, "addrs", info.Addrs)
-		ps.host.ConnManager().Protect(info.ID, connmgrTag)
+		connprotect.Add(ps.host.ConnManager(), info.ID, connprotect.Peering)
 
 		handler = &peerHandler{
 			host:      ps.host,
 			peer:      info.ID,
 			addrs:     info.Addrs,
 			nextDelay: initialDelay,
+			owners:    map[string]bool{owner: true},
 		}
 		handler.ctx, handler.cancel = context.WithCancel(context.Background())
 		ps.peers[info.ID] = handler
@@ -242,22 +306,75 @@ func (ps *PeeringService) AddPeer(info peer.AddrInfo) {
 	}
 }
 
-// RemovePeer removes a peer from the peering service. This function may be
-// safely called at any time: before the service is started, while running, or
-// after it stops.
+// RemovePeer removes a peer from the peering service, whoever added it. This
+// function may be safely called at any time: before the service is started,
+// while running, or after it stops.
 func (ps *PeeringService) RemovePeer(id peer.ID) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	ps.removed[id] = true
+	ps.removePeer(id)
+}
+
+// RemovePeerAs drops the claim of owner on a peer added with AddPeerAs, and
+// removes the peer if no other owner added it.
+func (ps *PeeringService) RemovePeerAs(owner string, id peer.ID) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	handler, ok := ps.peers[id]
+	if !ok {
+		return
+	}
+	delete(handler.owners, owner)
+	if len(handler.owners) == 0 {
+		ps.removePeer(id)
+	}
+}
+
+func (ps *PeeringService) removePeer(id peer.ID) {
 	if handler, ok := ps.peers[id]; ok {
 		logger.Infow("peer removed", "peer", id)
-		ps.host.ConnManager().Unprotect(id, connmgrTag)
+		connprotect.Remove(ps.host.ConnManager(), id, connprotect.Peering)
 
 		handler.stop()
 		delete(ps.peers, id)
 	}
 }
 
+// PeerState describes a peer of the peering service.
+type PeerState struct {
+	ID        peer.ID
+	Addrs     []multiaddr.Multiaddr
+	Connected bool
+
+	// NextAttempt is when the next reconnect attempt is due. It is zero
+	// while connected, and before the service starts.
+	NextAttempt time.Time
+
+	// Backoff is the delay before the next attempt, as last drawn.
+	Backoff time.Duration
+}
+
+// ListPeers returns the state of the peers of the peering service, sorted by
+// ID.
+func (ps *PeeringService) ListPeers() []PeerState {
+	ps.mu.RLock()
+	handlers := make([]*peerHandler, 0, len(ps.peers))
+	for _, handler := range ps.peers {
+		handlers = append(handlers, handler)
+	}
+	ps.mu.RUnlock()
+
+	states := make([]PeerState, 0, len(handlers))
+	for _, handler := range handlers {
+		states = append(states, handler.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
 type netNotifee PeeringService
 
 func (nn *netNotifee) Connected(_ network.Network, c network.Conn) {
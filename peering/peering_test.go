@@ -10,6 +10,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
 
 	"github.com/stretchr/testify/require"
 )
@@ -145,6 +146,79 @@ func TestPeeringService(t *testing.T) {
 	ps1.RemovePeer(h2.ID())
 }
 
+func TestListPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := newNode(ctx, t)
+	ps1 := NewPeeringService(h1)
+	h2 := newNode(ctx, t)
+
+	// an address nothing listens on
+	ps1.AddPeer(peer.AddrInfo{ID: h2.ID(), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")}})
+	states := ps1.ListPeers()
+	require.Len(t, states, 1)
+	require.Equal(t, h2.ID(), states[0].ID)
+	require.False(t, states[0].Connected)
+	require.True(t, states[0].NextAttempt.IsZero(), "no attempt is due before the service starts")
+
+	require.NoError(t, ps1.Start())
+	defer ps1.Stop()
+	require.Eventually(t, func() bool {
+		return !ps1.ListPeers()[0].NextAttempt.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	st := ps1.ListPeers()[0]
+	require.True(t, st.NextAttempt.After(time.Now()))
+	require.True(t, st.Backoff > initialDelay)
+
+	ps1.AddPeer(peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()})
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	require.Eventually(t, func() bool {
+		st := ps1.ListPeers()[0]
+		return st.Connected && st.NextAttempt.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ps1.RemovePeer(h2.ID())
+	require.Empty(t, ps1.ListPeers())
+}
+
+func TestPeerOwners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := newNode(ctx, t)
+	ps1 := NewPeeringService(h1)
+	h2 := newNode(ctx, t)
+	h3 := newNode(ctx, t)
+	userAddr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")
+	chainAddr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/2")
+
+	// a peer the user added stays when the other owner drops it, with the
+	// addresses the user gave
+	ps1.AddPeer(peer.AddrInfo{ID: h2.ID(), Addrs: []multiaddr.Multiaddr{userAddr}})
+	ps1.AddPeerAs("chain", peer.AddrInfo{ID: h2.ID(), Addrs: []multiaddr.Multiaddr{chainAddr}})
+	ps1.RemovePeerAs("chain", h2.ID())
+	states := ps1.ListPeers()
+	require.Len(t, states, 1)
+	require.Equal(t, []multiaddr.Multiaddr{userAddr}, states[0].Addrs)
+
+	// a peer only the owner added goes with it
+	ps1.AddPeerAs("chain", peer.AddrInfo{ID: h3.ID(), Addrs: []multiaddr.Multiaddr{chainAddr}})
+	require.Len(t, ps1.ListPeers(), 2)
+	ps1.RemovePeerAs("chain", h3.ID())
+	require.Len(t, ps1.ListPeers(), 1)
+
+	// a peer the user removed isn't added back by the owner
+	ps1.AddPeerAs("chain", peer.AddrInfo{ID: h3.ID(), Addrs: []multiaddr.Multiaddr{chainAddr}})
+	ps1.RemovePeer(h3.ID())
+	ps1.AddPeerAs("chain", peer.AddrInfo{ID: h3.ID(), Addrs: []multiaddr.Multiaddr{chainAddr}})
+	require.Len(t, ps1.ListPeers(), 1)
+
+	// until the user adds it again
+	ps1.AddPeer(peer.AddrInfo{ID: h3.ID(), Addrs: []multiaddr.Multiaddr{userAddr}})
+	require.Len(t, ps1.ListPeers(), 2)
+}
+
 func TestNextBackoff(t *testing.T) {
 	minMaxBackoff := (100 - maxBackoffJitter) / 100 * maxBackoff
 	for x := 0; x < 1000; x++ {
@@ -0,0 +1,98 @@
+// Package ratelimit throttles byte streams with token buckets. It is shared
+// by the libp2p bandwidth limits and the p2p listener policies.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// throttledWindow is how recent a wait must be for a bucket to be reported
+// as throttling.
+const throttledWindow = time.Second
+
+// Bucket is a token bucket of bytes holding up to a second of traffic.
+// Bytes are taken on credit: the caller waits until the debt is repaid. A
+// zero rate lets everything through. A nil bucket is not limited.
+type Bucket struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	last     time.Time
+	delay    time.Duration
+	lastWait time.Time
+}
+
+// NewBucket returns a full bucket of rate bytes per second.
+func NewBucket(rate float64) *Bucket {
+	return &Bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// SetRate changes the rate of the bucket.
+func (b *Bucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// Rate returns the rate of the bucket, in bytes per second.
+func (b *Bucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// Take takes n bytes and returns how long to wait before using them.
+func (b *Bucket) Take(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	d := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.delay += d
+	b.lastWait = now.Add(d)
+	return d
+}
+
+// State returns the rate of the bucket, the time the callers waited and
+// whether they waited within a second of now.
+func (b *Bucket) State(now time.Time) (float64, time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, b.delay, !b.lastWait.IsZero() && now.Sub(b.lastWait) < throttledWindow
+}
+
+// Wait takes n bytes from the buckets and waits for the slowest of them.
+func Wait(n int, buckets ...*Bucket) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	var d time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if bd := b.Take(n, now); bd > d {
+			d = bd
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
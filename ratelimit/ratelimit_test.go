@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &Bucket{rate: 1000, tokens: 1000, last: now}
+
+	// a second of traffic goes through at once
+	if d := b.Take(1000, now); d != 0 {
+		t.Fatalf("waited %s for a full bucket", d)
+	}
+	// then bytes are taken on credit
+	if d := b.Take(500, now); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", d)
+	}
+	if _, delay, throttled := b.State(now); delay != 500*time.Millisecond || !throttled {
+		t.Fatalf("the wait was not reported: %s, %v", delay, throttled)
+	}
+	// the debt is repaid over time
+	if d := b.Take(0, now.Add(500*time.Millisecond)); d != 0 {
+		t.Fatalf("the debt was not repaid: %s", d)
+	}
+	// an idle bucket holds no more than a second of traffic
+	if d := b.Take(1500, now.Add(time.Hour)); d != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", d)
+	}
+	if _, _, throttled := b.State(now.Add(2 * time.Hour)); throttled {
+		t.Fatal("an old wait is reported as throttling")
+	}
+
+	// a zero rate lets everything through
+	b.SetRate(0)
+	if d := b.Take(1<<30, now.Add(time.Hour)); d != 0 {
+		t.Fatalf("waited %s without a limit", d)
+	}
+}
+
+func TestWaitSlowestBucket(t *testing.T) {
+	fast, slow := NewBucket(1<<20), NewBucket(1000)
+	start := time.Now()
+	Wait(1100, nil, fast, slow)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("did not wait for the slowest bucket: %s", elapsed)
+	}
+}
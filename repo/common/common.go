@@ -5,6 +5,16 @@ import (
 	"strings"
 )
 
+// KeyNotFoundError is returned by MapGetKV for a key that is not set.
+type KeyNotFoundError struct {
+	// Parent is the part of the key that is set.
+	Parent string
+}
+
+func (e KeyNotFoundError) Error() string {
+	return fmt.Sprintf("%s key has no attributes", e.Parent)
+}
+
 func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
 	var ok bool
 	var mcursor map[string]interface{}
@@ -21,7 +31,7 @@ func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
 
 		cursor, ok = mcursor[part]
 		if !ok {
-			return nil, fmt.Errorf("%s key has no attributes", sofar)
+			return nil, KeyNotFoundError{Parent: sofar}
 		}
 	}
 	return cursor, nil
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/tiered"
+
+	humanize "github.com/dustin/go-humanize"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/mount"
@@ -61,6 +65,7 @@ func init() {
 		"mem":     MemDatastoreConfig,
 		"log":     LogDatastoreConfig,
 		"measure": MeasureDatastoreConfig,
+		"tiered":  TieredDatastoreConfig,
 	}
 }
 
@@ -246,3 +251,131 @@ func (c measureDatastoreConfig) Create(path string) (repo.Datastore, error) {
 	}
 	return measure.New(c.prefix, child), nil
 }
+
+type tieredDatastoreConfig struct {
+	tiers []tierConfig
+	opts  tiered.Options
+
+	created *tiered.Datastore // set by Create
+}
+
+type tierConfig struct {
+	name     string
+	capacity uint64
+	child    DatastoreConfig
+}
+
+// TieredDatastoreConfig returns a tiered DatastoreConfig from a spec
+func TieredDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	var res tieredDatastoreConfig
+	tiers, ok := params["tiers"].([]interface{})
+	if !ok || len(tiers) == 0 {
+		return nil, fmt.Errorf("'tiers' field is missing or not a non-empty array")
+	}
+	for _, iface := range tiers {
+		cfg, ok := iface.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected map for tier")
+		}
+		name, ok := cfg["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'name' field was missing or not a string")
+		}
+		childField, ok := cfg["child"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'child' field of tier %s is missing or not a map", name)
+		}
+		child, err := AnyDatastoreConfig(childField)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := tierConfig{name: name, child: child}
+		if capacity, ok := cfg["capacity"]; ok {
+			s, ok := capacity.(string)
+			if !ok {
+				return nil, fmt.Errorf("'capacity' field of tier %s is not a string", name)
+			}
+			if tc.capacity, err = humanize.ParseBytes(s); err != nil {
+				return nil, fmt.Errorf("invalid capacity of tier %s: %s", name, err)
+			}
+		}
+		res.tiers = append(res.tiers, tc)
+	}
+
+	if v, ok := params["promoteAfter"].(float64); ok {
+		res.opts.PromoteAfter = int(v)
+	}
+	if v, ok := params["migrateInterval"].(string); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'migrateInterval': %s", err)
+		}
+		res.opts.MigrateInterval = d
+	}
+	if v, ok := params["lowWater"].(float64); ok {
+		res.opts.LowWater = v
+	}
+	if v, ok := params["trackedKeys"].(float64); ok {
+		res.opts.TrackedKeys = int(v)
+	}
+	return &res, nil
+}
+
+func (c *tieredDatastoreConfig) DiskSpec() DiskSpec {
+	tiers := make([]interface{}, len(c.tiers))
+	for i, t := range c.tiers {
+		tiers[i] = map[string]interface{}{
+			"name":  t.name,
+			"child": map[string]interface{}(t.child.DiskSpec()),
+		}
+	}
+	return map[string]interface{}{"type": "tiered", "tiers": tiers}
+}
+
+func (c *tieredDatastoreConfig) Create(path string) (repo.Datastore, error) {
+	tiers := make([]tiered.Tier, 0, len(c.tiers))
+	closeAll := func() {
+		for _, t := range tiers {
+			t.Datastore.Close()
+		}
+	}
+	for _, t := range c.tiers {
+		child, err := t.child.Create(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		tiers = append(tiers, tiered.Tier{Name: t.name, Datastore: child, Capacity: t.capacity})
+	}
+
+	d, err := tiered.New(tiers, c.opts)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	c.created = d
+	return d, nil
+}
+
+// tieredDatastores returns the tiered datastores created from dsc, so that
+// the repo can report on them.
+func tieredDatastores(dsc DatastoreConfig) []*tiered.Datastore {
+	switch c := dsc.(type) {
+	case *tieredDatastoreConfig:
+		if c.created != nil {
+			return []*tiered.Datastore{c.created}
+		}
+	case *mountDatastoreConfig:
+		var all []*tiered.Datastore
+		for _, m := range c.mounts {
+			all = append(all, tieredDatastores(m.ds)...)
+		}
+		return all
+	case *measureDatastoreConfig:
+		return tieredDatastores(c.child)
+	case *logDatastoreConfig:
+		return tieredDatastores(c.child)
+	}
+	return nil
+}
@@ -14,6 +14,7 @@ import (
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	repo "github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/common"
+	"github.com/ipfs/go-ipfs/repo/tiered"
 	dir "github.com/ipfs/go-ipfs/thirdparty/dir"
 
 	ds "github.com/ipfs/go-datastore"
@@ -65,6 +66,10 @@ func (err NoRepoError) Error() string {
 const apiFile = "api"
 const swarmKeyFile = "swarm.key"
 
+// nextSwarmKeyFile holds the key accepted besides the swarm key while the
+// private network key is rotated.
+const nextSwarmKeyFile = "swarm.key.next"
+
 const specFn = "datastore_spec"
 
 var (
@@ -102,6 +107,8 @@ type FSRepo struct {
 	ds       repo.Datastore
 	keystore keystore.Keystore
 	filemgr  *filestore.FileManager
+	// tiered are the tiered datastores within ds
+	tiered []*tiered.Datastore
 }
 
 var _ repo.Repo = (*FSRepo)(nil)
@@ -442,6 +449,7 @@ func (r *FSRepo) openDatastore() error {
 		return err
 	}
 	r.ds = d
+	r.tiered = tieredDatastores(dsc)
 
 	// Wrap it with metrics gathering
 	prefix := "ipfs.fsrepo.datastore"
@@ -492,6 +500,12 @@ func (r *FSRepo) Close() error {
 	return r.lockfile.Close()
 }
 
+// TieredDatastores returns the tiered datastores configured in the
+// datastore spec, in the order of the spec.
+func (r *FSRepo) TieredDatastores() []*tiered.Datastore {
+	return append([]*tiered.Datastore(nil), r.tiered...)
+}
+
 // Config the current config. This function DOES NOT copy the config. The caller
 // MUST NOT modify it without first calling `Clone`.
 //
@@ -665,8 +679,37 @@ func (r *FSRepo) GetStorageUsage() (uint64, error) {
 }
 
 func (r *FSRepo) SwarmKey() ([]byte, error) {
+	return r.readKeyFile(swarmKeyFile)
+}
+
+// NextSwarmKey returns the key accepted besides the swarm key while the
+// private network key is rotated, nil if none.
+func (r *FSRepo) NextSwarmKey() ([]byte, error) {
+	return r.readKeyFile(nextSwarmKeyFile)
+}
+
+// SetSwarmKeys replaces the swarm key and the next key. A nil next key
+// removes it.
+func (r *FSRepo) SetSwarmKeys(key, next []byte) error {
+	packageLock.Lock()
+	defer packageLock.Unlock()
+
+	if err := r.writeKeyFile(swarmKeyFile, key); err != nil {
+		return err
+	}
+	if next == nil {
+		err := os.Remove(filepath.Join(filepath.Clean(r.path), nextSwarmKeyFile))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	return r.writeKeyFile(nextSwarmKeyFile, next)
+}
+
+func (r *FSRepo) readKeyFile(name string) ([]byte, error) {
 	repoPath := filepath.Clean(r.path)
-	spath := filepath.Join(repoPath, swarmKeyFile)
+	spath := filepath.Join(repoPath, name)
 
 	f, err := os.Open(spath)
 	if err != nil {
@@ -680,6 +723,17 @@ func (r *FSRepo) SwarmKey() ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
+// writeKeyFile replaces the key file name at once, so that a node starting
+// meanwhile reads either key.
+func (r *FSRepo) writeKeyFile(name string, key []byte) error {
+	spath := filepath.Join(filepath.Clean(r.path), name)
+	tmp := spath + ".tmp"
+	if err := ioutil.WriteFile(tmp, key, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, spath)
+}
+
 var _ io.Closer = &FSRepo{}
 var _ repo.Repo = &FSRepo{}
 
@@ -1,10 +1,12 @@
 package repo
 
 import (
+	"encoding/json"
 	"errors"
 
 	filestore "github.com/ipfs/go-filestore"
 	keystore "github.com/ipfs/go-ipfs-keystore"
+	common "github.com/ipfs/go-ipfs/repo/common"
 
 	config "github.com/ipfs/go-ipfs-config"
 	ma "github.com/multiformats/go-multiaddr"
@@ -38,7 +40,15 @@ func (m *Mock) SetConfigKey(key string, value interface{}) error {
 }
 
 func (m *Mock) GetConfigKey(key string) (interface{}, error) {
-	return nil, errTODO
+	b, err := json.Marshal(m.C)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return common.MapGetKV(cfg, key)
 }
 
 func (m *Mock) Datastore() Datastore { return m.D }
@@ -55,4 +65,10 @@ func (m *Mock) SwarmKey() ([]byte, error) {
 	return nil, nil
 }
 
+func (m *Mock) NextSwarmKey() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *Mock) SetSwarmKeys(key, next []byte) error { return errTODO }
+
 func (m *Mock) FileManager() *filestore.FileManager { return m.F }
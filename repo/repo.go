@@ -1,12 +1,15 @@
 package repo
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 
 	filestore "github.com/ipfs/go-filestore"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 
+	common "github.com/ipfs/go-ipfs/repo/common"
+
 	ds "github.com/ipfs/go-datastore"
 	config "github.com/ipfs/go-ipfs-config"
 	ma "github.com/multiformats/go-multiaddr"
@@ -53,6 +56,14 @@ type Repo interface {
 	// SwarmKey returns the configured shared symmetric key for the private networks feature.
 	SwarmKey() ([]byte, error)
 
+	// NextSwarmKey returns the key accepted besides the swarm key while the
+	// private network key is rotated, nil if none.
+	NextSwarmKey() ([]byte, error)
+
+	// SetSwarmKeys replaces the swarm key and the next key. A nil next key
+	// removes it.
+	SetSwarmKeys(key, next []byte) error
+
 	io.Closer
 }
 
@@ -61,3 +72,22 @@ type Repo interface {
 type Datastore interface {
 	ds.Batching // must be thread-safe
 }
+
+// ConfigSection decodes the top-level config section stored under key into
+// out. It is meant for settings that go-ipfs-config does not define: FSRepo
+// keeps unknown top-level keys when the config is rewritten, so such sections
+// survive 'ipfs config replace'. A missing section leaves out untouched.
+func ConfigSection(r Repo, key string, out interface{}) error {
+	val, err := r.GetConfigKey(key)
+	if err != nil {
+		if errors.As(err, &common.KeyNotFoundError{}) {
+			return nil // not set, keep the defaults
+		}
+		return err
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,609 @@
+// Package tiered implements a datastore spreading its keys over a list of
+// tiers, from the fastest to the largest. New and recently read keys live
+// in the fastest tier; keys that are not accessed migrate to slower tiers
+// once a tier grows past its capacity.
+package tiered
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("tiered")
+
+// Defaults for the Options left unset.
+const (
+	DefaultPromoteAfter    = 2
+	DefaultMigrateInterval = 10 * time.Minute
+	DefaultLowWater        = 0.9
+	DefaultTrackedKeys     = 1 << 20
+)
+
+// keyLockStripes is the number of locks the keys are spread over.
+const keyLockStripes = 256
+
+// Tier is one level of a tiered datastore.
+type Tier struct {
+	Name      string
+	Datastore ds.Batching
+
+	// Capacity is the size in bytes past which keys are moved to the next
+	// tier. It must be zero, meaning unbounded, for the last tier.
+	Capacity uint64
+}
+
+// Options configure the migration between tiers.
+type Options struct {
+	// PromoteAfter is the number of reads after which a key stored in a
+	// slower tier is moved to the fastest one.
+	PromoteAfter int
+
+	// MigrateInterval is how often tiers over capacity are drained.
+	MigrateInterval time.Duration
+
+	// LowWater is the fraction of its capacity a tier is drained to.
+	LowWater float64
+
+	// TrackedKeys bounds the number of keys whose accesses are tracked.
+	// Untracked keys are the first to be moved to a slower tier.
+	TrackedKeys int
+}
+
+// TierStat describes the content and activity of a tier.
+type TierStat struct {
+	Name       string
+	Capacity   uint64 `json:",omitempty"`
+	Size       uint64
+	Keys       uint64
+	Hits       uint64 // reads served by the tier
+	Promotions uint64 // keys moved to the fastest tier from this one
+	Demotions  uint64 // keys moved from this tier to the next one
+}
+
+type tier struct {
+	hits       uint64
+	promotions uint64
+	demotions  uint64
+
+	Tier
+}
+
+// access records how a key has been used since it last moved.
+type access struct {
+	last  int64 // unix nanoseconds
+	reads int32
+}
+
+// Datastore is a tiered datastore. Each key is stored in a single tier.
+type Datastore struct {
+	tiers  []*tier
+	opts   Options
+	access *lru.Cache
+
+	// keyLocks serialize moving a key between tiers with its writes and
+	// deletion, so that a key written while it moves is not left in two
+	// tiers, and a key deleted while it moves does not reappear. Keys are
+	// spread over the stripes by hash.
+	keyLocks [keyLockStripes]sync.Mutex
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New returns a datastore over the given tiers, fastest first, and starts
+// migrating keys between them in the background.
+func New(tiers []Tier, opts Options) (*Datastore, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("tiered datastore needs at least one tier")
+	}
+	if tiers[len(tiers)-1].Capacity != 0 {
+		return nil, errors.New("the last tier of a tiered datastore must not have a capacity")
+	}
+
+	if opts.PromoteAfter <= 0 {
+		opts.PromoteAfter = DefaultPromoteAfter
+	}
+	if opts.MigrateInterval <= 0 {
+		opts.MigrateInterval = DefaultMigrateInterval
+	}
+	if opts.LowWater <= 0 || opts.LowWater > 1 {
+		opts.LowWater = DefaultLowWater
+	}
+	if opts.TrackedKeys <= 0 {
+		opts.TrackedKeys = DefaultTrackedKeys
+	}
+
+	cache, err := lru.New(opts.TrackedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Datastore{
+		opts:    opts,
+		access:  cache,
+		closing: make(chan struct{}),
+	}
+	for _, t := range tiers {
+		d.tiers = append(d.tiers, &tier{Tier: t})
+	}
+
+	d.wg.Add(1)
+	go d.migrateLoop()
+	return d, nil
+}
+
+func keyStripe(key ds.Key) int {
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, key.String())
+	return int(h.Sum32() % keyLockStripes)
+}
+
+// lock locks key against moves, writes and deletions.
+func (d *Datastore) lock(key ds.Key) func() {
+	lk := &d.keyLocks[keyStripe(key)]
+	lk.Lock()
+	return lk.Unlock
+}
+
+// tierFor returns the tier a write of key goes to: the tier already holding
+// it, or the fastest one. Tiers are probed fastest first, so that rewriting
+// a hot key does not wait on the slower tiers. Must be called with key
+// locked.
+func (d *Datastore) tierFor(key ds.Key) (*tier, error) {
+	for _, t := range d.tiers {
+		has, err := t.Datastore.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			return t, nil
+		}
+	}
+	return d.tiers[0], nil
+}
+
+// touch records an access to key and returns the number of reads since the
+// key last moved.
+func (d *Datastore) touch(key ds.Key, read bool) int32 {
+	now := time.Now().UnixNano()
+	v, ok := d.access.Get(key.String())
+	if !ok {
+		a := &access{last: now}
+		if read {
+			a.reads = 1
+		}
+		d.access.Add(key.String(), a)
+		return a.reads
+	}
+	a := v.(*access)
+	atomic.StoreInt64(&a.last, now)
+	if !read {
+		return atomic.LoadInt32(&a.reads)
+	}
+	return atomic.AddInt32(&a.reads, 1)
+}
+
+func (d *Datastore) lastAccess(key string) int64 {
+	v, ok := d.access.Peek(key)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(&v.(*access).last)
+}
+
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	for i, t := range d.tiers {
+		value, err := t.Datastore.Get(key)
+		if err == ds.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddUint64(&t.hits, 1)
+		if reads := d.touch(key, true); i > 0 && int(reads) >= d.opts.PromoteAfter {
+			d.promote(key, value, i)
+		}
+		return value, nil
+	}
+	return nil, ds.ErrNotFound
+}
+
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	for _, t := range d.tiers {
+		has, err := t.Datastore.Has(key)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	for _, t := range d.tiers {
+		size, err := t.Datastore.GetSize(key)
+		if err == ds.ErrNotFound {
+			continue
+		}
+		return size, err
+	}
+	return -1, ds.ErrNotFound
+}
+
+// Put writes to the tier already holding key, or to the fastest tier.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	defer d.lock(key)()
+
+	d.touch(key, false)
+	t, err := d.tierFor(key)
+	if err != nil {
+		return err
+	}
+	return t.Datastore.Put(key, value)
+}
+
+func (d *Datastore) Delete(key ds.Key) error {
+	defer d.lock(key)()
+
+	d.access.Remove(key.String())
+	for _, t := range d.tiers {
+		if err := t.Datastore.Delete(key); err != nil && err != ds.ErrNotFound {
+			return err
+		}
+	}
+	// deleting a missing key is not an error, as with flatfs and leveldb
+	return nil
+}
+
+// Query concatenates the results of every tier. Orders, offset and limit
+// apply to the whole.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	inner := q
+	inner.Orders = nil
+	inner.Offset = 0
+	inner.Limit = 0
+
+	results := make([]dsq.Results, 0, len(d.tiers))
+	closeAll := func() error {
+		var err error
+		for _, r := range results {
+			if cerr := r.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	for _, t := range d.tiers {
+		r, err := t.Datastore.Query(inner)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	i := 0
+	merged := dsq.ResultsFromIterator(inner, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for ; i < len(results); i++ {
+				if res, ok := results[i].NextSync(); ok {
+					return res, true
+				}
+			}
+			return dsq.Result{}, false
+		},
+		Close: closeAll,
+	})
+	return dsq.NaiveQueryApply(dsq.Query{Orders: q.Orders, Offset: q.Offset, Limit: q.Limit}, merged), nil
+}
+
+func (d *Datastore) Sync(prefix ds.Key) error {
+	for _, t := range d.tiers {
+		if err := t.Datastore.Sync(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiskUsage adds up the disk usage of the tiers.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	var total uint64
+	for _, t := range d.tiers {
+		du, err := ds.DiskUsage(t.Datastore)
+		if err != nil {
+			return 0, err
+		}
+		total += du
+	}
+	return total, nil
+}
+
+// Batch returns a batch committed through the batches of the tiers.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, ops: make(map[ds.Key][]byte)}, nil
+}
+
+// batch buffers its operations until Commit, which picks the tier of each
+// write with its key locked, as Put does. A nil value is a deletion.
+type batch struct {
+	d   *Datastore
+	ops map[ds.Key][]byte
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	b.ops[key] = value
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.ops[key] = nil
+	return nil
+}
+
+func (b *batch) Commit() error {
+	// lock the stripes of the keys in order, so that batches don't deadlock
+	var stripes [keyLockStripes]bool
+	for key := range b.ops {
+		stripes[keyStripe(key)] = true
+	}
+	for i, locked := range stripes {
+		if locked {
+			b.d.keyLocks[i].Lock()
+			defer b.d.keyLocks[i].Unlock()
+		}
+	}
+
+	batches := make(map[*tier]ds.Batch)
+	tierBatch := func(t *tier) (ds.Batch, error) {
+		if tb, ok := batches[t]; ok {
+			return tb, nil
+		}
+		tb, err := t.Datastore.Batch()
+		if err != nil {
+			return nil, err
+		}
+		batches[t] = tb
+		return tb, nil
+	}
+
+	for key, value := range b.ops {
+		if value == nil {
+			b.d.access.Remove(key.String())
+			for _, t := range b.d.tiers {
+				// only delete where the key is, a missing key may fail
+				// the commit of the tier
+				has, err := t.Datastore.Has(key)
+				if err != nil {
+					return err
+				}
+				if !has {
+					continue
+				}
+				tb, err := tierBatch(t)
+				if err != nil {
+					return err
+				}
+				if err := tb.Delete(key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		b.d.touch(key, false)
+		t, err := b.d.tierFor(key)
+		if err != nil {
+			return err
+		}
+		tb, err := tierBatch(t)
+		if err != nil {
+			return err
+		}
+		if err := tb.Put(key, value); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range b.d.tiers {
+		if tb, ok := batches[t]; ok {
+			if err := tb.Commit(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Datastore) Close() error {
+	d.closeOnce.Do(func() { close(d.closing) })
+	d.wg.Wait()
+
+	var err error
+	for _, t := range d.tiers {
+		if cerr := t.Datastore.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// promote moves a key read from tier i to the fastest tier.
+func (d *Datastore) promote(key ds.Key, value []byte, i int) {
+	defer d.lock(key)()
+
+	if err := d.move(key, value, d.tiers[i], d.tiers[0]); err != nil {
+		log.Warnf("failed to promote %s to tier %s: %s", key, d.tiers[0].Name, err)
+		return
+	}
+	atomic.AddUint64(&d.tiers[i].promotions, 1)
+}
+
+// demote moves a key from tier i to the next one.
+func (d *Datastore) demote(key ds.Key, i int) error {
+	defer d.lock(key)()
+
+	from := d.tiers[i]
+	value, err := from.Datastore.Get(key)
+	if err == ds.ErrNotFound {
+		return nil // deleted meanwhile
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.move(key, value, from, d.tiers[i+1]); err != nil {
+		return err
+	}
+	atomic.AddUint64(&from.demotions, 1)
+	return nil
+}
+
+// move copies key to a tier before removing it from the other, so it can
+// always be found. Must be called with key locked.
+func (d *Datastore) move(key ds.Key, value []byte, from, to *tier) error {
+	if has, err := from.Datastore.Has(key); err != nil || !has {
+		return err // deleted meanwhile
+	}
+	if err := to.Datastore.Put(key, value); err != nil {
+		return err
+	}
+	if v, ok := d.access.Peek(key.String()); ok {
+		atomic.StoreInt32(&v.(*access).reads, 0)
+	}
+	return from.Datastore.Delete(key)
+}
+
+func (d *Datastore) migrateLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.MigrateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-ticker.C:
+			d.Migrate()
+		}
+	}
+}
+
+// Migrate drains every tier over capacity into the next one, moving the
+// least recently used keys first.
+func (d *Datastore) Migrate() {
+	for i, t := range d.tiers {
+		if t.Capacity == 0 {
+			continue
+		}
+		if err := d.drain(i); err != nil {
+			log.Errorf("failed to migrate keys out of tier %s: %s", t.Name, err)
+		}
+	}
+}
+
+type sizedKey struct {
+	key  string
+	size uint64
+	last int64
+}
+
+func (d *Datastore) drain(i int) error {
+	t := d.tiers[i]
+	var keys []sizedKey
+	var total uint64
+	err := walk(t, func(key string, size uint64) {
+		keys = append(keys, sizedKey{key: key, size: size, last: d.lastAccess(key)})
+		total += size
+	})
+	if err != nil {
+		return err
+	}
+	if total <= t.Capacity {
+		return nil
+	}
+
+	target := uint64(float64(t.Capacity) * d.opts.LowWater)
+	sort.Slice(keys, func(a, b int) bool { return keys[a].last < keys[b].last })
+
+	for _, k := range keys {
+		if total <= target {
+			break
+		}
+		select {
+		case <-d.closing:
+			return nil
+		default:
+		}
+		if err := d.demote(ds.RawKey(k.key), i); err != nil {
+			return err
+		}
+		total -= k.size
+	}
+	return nil
+}
+
+// walk calls fn with every key of a tier along with its size.
+func walk(t *tier, fn func(key string, size uint64)) error {
+	res, err := t.Datastore.Query(dsq.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		size := r.Size
+		if size < 0 {
+			if size, err = t.Datastore.GetSize(ds.RawKey(r.Key)); err != nil {
+				continue // deleted meanwhile
+			}
+		}
+		fn(r.Key, uint64(size))
+	}
+	return nil
+}
+
+// Stats describes every tier, fastest first. It lists the content of
+// every tier, which may take a while on large ones.
+func (d *Datastore) Stats() ([]TierStat, error) {
+	stats := make([]TierStat, len(d.tiers))
+	for i, t := range d.tiers {
+		var keys, total uint64
+		err := walk(t, func(_ string, size uint64) {
+			keys++
+			total += size
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = TierStat{
+			Name:       t.Name,
+			Capacity:   t.Capacity,
+			Size:       total,
+			Keys:       keys,
+			Hits:       atomic.LoadUint64(&t.hits),
+			Promotions: atomic.LoadUint64(&t.promotions),
+			Demotions:  atomic.LoadUint64(&t.demotions),
+		}
+	}
+	return stats, nil
+}
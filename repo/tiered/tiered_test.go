@@ -0,0 +1,169 @@
+package tiered
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func newTestDatastore(t *testing.T, capacity uint64) (*Datastore, ds.Batching, ds.Batching) {
+	hot := dssync.MutexWrap(ds.NewMapDatastore())
+	cold := dssync.MutexWrap(ds.NewMapDatastore())
+	d, err := New([]Tier{
+		{Name: "hot", Datastore: hot, Capacity: capacity},
+		{Name: "cold", Datastore: cold},
+	}, Options{PromoteAfter: 2, MigrateInterval: time.Hour, LowWater: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, hot, cold
+}
+
+func TestTieredMigration(t *testing.T) {
+	d, hot, cold := newTestDatastore(t, 40)
+
+	// ten keys of ten bytes, the first ones least recently used
+	for i := 0; i < 10; i++ {
+		if err := d.Put(ds.NewKey(fmt.Sprintf("k%d", i)), make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.Migrate()
+
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Size > 20 || stats[0].Keys+stats[1].Keys != 10 {
+		t.Fatalf("hot tier not drained to its low water mark: %+v", stats)
+	}
+	if has, _ := cold.Has(ds.NewKey("k0")); !has {
+		t.Fatal("least recently used key was not demoted")
+	}
+	if has, _ := hot.Has(ds.NewKey("k9")); !has {
+		t.Fatal("most recently used key was demoted")
+	}
+
+	// reads fall through to the cold tier, and promote after two of them
+	for i := 0; i < 2; i++ {
+		if _, err := d.Get(ds.NewKey("k0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if has, _ := hot.Has(ds.NewKey("k0")); !has {
+		t.Fatal("key read twice was not promoted")
+	}
+	if has, _ := cold.Has(ds.NewKey("k0")); has {
+		t.Fatal("promoted key left in the cold tier")
+	}
+
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("expected 10 keys across tiers, got %d", len(entries))
+	}
+
+	if err := d.Delete(ds.NewKey("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(ds.NewKey("k1")); has {
+		t.Fatal("deleted key still present")
+	}
+	if err := d.Delete(ds.NewKey("k1")); err != nil {
+		t.Fatalf("deleting a missing key failed: %s", err)
+	}
+}
+
+func TestTieredLastTierCapacity(t *testing.T) {
+	_, err := New([]Tier{{Name: "only", Datastore: ds.NewMapDatastore(), Capacity: 1}}, Options{})
+	if err == nil {
+		t.Fatal("expected a capacity on the last tier to be rejected")
+	}
+}
+
+// countingDatastore reports a fixed disk usage and counts its batches.
+type countingDatastore struct {
+	ds.Batching
+	usage   uint64
+	batches int
+}
+
+func (c *countingDatastore) DiskUsage() (uint64, error) {
+	return c.usage, nil
+}
+
+func (c *countingDatastore) Batch() (ds.Batch, error) {
+	c.batches++
+	return c.Batching.Batch()
+}
+
+func TestTieredBatch(t *testing.T) {
+	hot := &countingDatastore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), usage: 10}
+	cold := &countingDatastore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), usage: 32}
+	d, err := New([]Tier{
+		{Name: "hot", Datastore: hot, Capacity: 100},
+		{Name: "cold", Datastore: cold},
+	}, Options{MigrateInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if du, err := ds.DiskUsage(d); err != nil || du != 42 {
+		t.Fatalf("expected the disk usage of both tiers, got %d, %v", du, err)
+	}
+
+	old, gone, fresh := ds.NewKey("old"), ds.NewKey("gone"), ds.NewKey("fresh")
+	if err := cold.Put(old, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hot.Put(gone, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{b.Put(old, []byte("v2")), b.Put(fresh, []byte("v1")), b.Delete(gone)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if has, _ := d.Has(fresh); has {
+		t.Fatal("a batch write is visible before the commit")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrites stay in the tier holding the key
+	if v, err := cold.Get(old); err != nil || string(v) != "v2" {
+		t.Fatalf("the rewrite left the cold tier: %q, %v", v, err)
+	}
+	if has, _ := hot.Has(old); has {
+		t.Fatal("the rewritten key is in two tiers")
+	}
+	if has, _ := hot.Has(fresh); !has {
+		t.Fatal("the new key was not written to the fastest tier")
+	}
+	if has, _ := d.Has(gone); has {
+		t.Fatal("the deleted key is still present")
+	}
+	if hot.batches != 1 || cold.batches != 1 {
+		t.Fatalf("expected one batch per tier, got %d and %d", hot.batches, cold.batches)
+	}
+}
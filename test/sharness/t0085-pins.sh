@@ -164,6 +164,30 @@ test_pin_progress() {
   '
 }
 
+test_pin_export_import() {
+  test_expect_success "'ipfs pin export' lists the pins" '
+    EXPORTED=$(echo "exported" | ipfs add -q) &&
+    ipfs pin add --name exported $EXPORTED &&
+    ipfs pin export > pins.json &&
+    grep "\"Cid\":\"$EXPORTED\"" pins.json | grep -q "\"Name\":\"exported\""
+  '
+
+  test_expect_success "'ipfs pin import --sync --prune' restores the pin set" '
+    EXTRA=$(echo "extra" | ipfs add -q) &&
+    ipfs pin rm $EXPORTED &&
+    ipfs pin import --sync --prune pins.json > import_out &&
+    grep -q "pinned $EXPORTED" import_out &&
+    grep -q "unpinned $EXTRA" import_out &&
+    ipfs pin ls --type=recursive --name=exported | grep -q $EXPORTED
+  '
+
+  test_expect_success "'ipfs pin export --dag' round trips" '
+    ROOT=$(ipfs pin export --dag) &&
+    ipfs pin import --root $ROOT > dag_out &&
+    grep -q "exists $EXPORTED" dag_out
+  '
+}
+
 test_init_ipfs
 
 test_pins '' '' ''
@@ -196,6 +220,8 @@ test_pin_dag --raw-leaves
 
 test_pin_progress
 
+test_pin_export_import
+
 test_kill_ipfs_daemon
 
 test_done
@@ -47,6 +47,32 @@ test_expect_success "can't trigger a dial backoff with swarm connect" '
   test_expect_code 1 grep "backoff" connect_out
 '
 
+test_expect_success "swarm limit set works" '
+  ipfs swarm limit set --out=1MB bitswap &&
+  ipfs swarm limit set --in=500kB --out=500kB peers &&
+  ipfs swarm limit ls >actual &&
+  grep "^protocol */ipfs/bitswap *in unlimited, out 1.0 MB/s" actual &&
+  grep "^peers *peers *in 500 kB/s, out 500 kB/s" actual
+'
+
+test_expect_success "swarm limit rm works" '
+  ipfs swarm limit rm peers &&
+  ipfs swarm limit ls >actual &&
+  test_expect_code 1 grep peers actual
+'
+
+test_expect_success "swarm limit set --persist records the limit" '
+  ipfs swarm limit set --out=2MB --persist backup &&
+  ipfs config BandwidthLimits.Protocols.backup.Out >actual &&
+  echo "2.0 MB" >expected &&
+  test_cmp expected actual
+'
+
+test_expect_success "stats bw --by-proto shows the limits" '
+  ipfs stats bw --by-proto >actual &&
+  head -1 actual | grep "Protocol.*Limit In/Out.*Throttled"
+'
+
 test_kill_ipfs_daemon
 
 announceCfg='["/ip4/127.0.0.1/tcp/4001", "/ip4/1.2.3.4/tcp/1234"]'
@@ -207,6 +207,12 @@ test_expect_success "'ipfs p2p stream ls' output looks good" '
   test_cmp expected actual
 '
 
+test_expect_success "'ipfs swarm peers -v' shows the stream protection" '
+  ipfsi 0 swarm peers -v > actual &&
+  grep "protected: p2p forward stream" actual &&
+  grep "stream-fwd=20" actual
+'
+
 test_expect_success "'ipfs p2p stream close' closes stream" '
   ipfsi 0 p2p stream close 3 &&
   ipfsi 0 p2p stream ls > actual &&
@@ -369,6 +375,37 @@ test_expect_success 'C->S Close local listener' '
   test_must_be_empty actual
 '
 
+test_expect_success "listener only accepts the allowed peers" '
+  ipfsi 0 p2p listen --allow-peer=${PEERID_2} /x/p2p-allow /ip4/127.0.0.1/tcp/10107 &&
+  ipfsi 1 p2p forward /x/p2p-allow /ip4/127.0.0.1/tcp/10108 /p2p/${PEERID_0} &&
+  test_might_fail ma-pipe-unidir recv /ip4/127.0.0.1/tcp/10108 > rejected.out &&
+  test_must_be_empty rejected.out &&
+  ipfsi 0 p2p ls -v > actual &&
+  grep "rejected 1 streams" actual &&
+  grep "${PEERID_1} *peer not allowed" actual
+'
+
+test_expect_success "close the restricted listener" '
+  ipfsi 0 p2p close -p /x/p2p-allow &&
+  ipfsi 1 p2p close -p /x/p2p-allow
+'
+
+test_expect_success "'ipfs p2p ls -v' reports unix and udp listeners" '
+  ipfsi 0 p2p listen /x/p2p-unix /unix$(pwd)/p2p-target.sock &&
+  ipfsi 0 p2p listen /x/p2p-udp /ip4/127.0.0.1/udp/10105 &&
+  ipfsi 1 p2p forward /x/p2p-udp /ip4/127.0.0.1/udp/10106 /p2p/${PEERID_0} &&
+  ipfsi 0 p2p ls -v > actual &&
+  grep "^/x/p2p-unix .*/unix$(pwd)/p2p-target.sock *unix$" actual &&
+  grep "^/x/p2p-udp .*/ip4/127.0.0.1/udp/10105 *udp$" actual &&
+  ipfsi 1 p2p ls -v | grep "^/x/p2p-udp .*/ip4/127.0.0.1/udp/10106 .*udp$"
+'
+
+test_expect_success "close unix and udp listeners" '
+  ipfsi 0 p2p close -p /x/p2p-unix &&
+  ipfsi 0 p2p close -p /x/p2p-udp &&
+  ipfsi 1 p2p close -p /x/p2p-udp
+'
+
 check_test_ports
 
 test_expect_success 'stop iptb' '
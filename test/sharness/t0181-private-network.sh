@@ -127,6 +127,45 @@ run_single_file_test 2 1
 run_single_file_test 3 4
 run_single_file_test 4 3
 
+test_expect_success "generate the next key on node 1" '
+  ipfsi 1 swarm key rotate > key3 &&
+  ipfsi 1 swarm key ls > keys_out &&
+  test_should_contain "^next " keys_out
+'
+
+test_expect_success "install the next key on node 2" '
+  ipfsi 2 swarm key rotate key3 &&
+  test_cmp key3 "${IPTB_ROOT}/testbeds/default/2/swarm.key.next"
+'
+
+test_expect_success "node 1 dials node 2 with the promoted key" '
+  ipfsi 1 swarm key promote &&
+  ipfsi 1 swarm disconnect "/p2p/$(iptb attr get 2 id)" &&
+  iptb connect 1 2 &&
+  ipfsi 2 swarm key ls > keys_out &&
+  test_should_contain "^$(iptb attr get 1 id)  *next$" keys_out
+'
+
+test_expect_success "the rotation completes" '
+  ipfsi 2 swarm key promote &&
+  ipfsi 1 swarm key retire &&
+  ipfsi 2 swarm key retire &&
+  test_cmp key3 "${IPTB_ROOT}/testbeds/default/2/swarm.key" &&
+  test ! -e "${IPTB_ROOT}/testbeds/default/2/swarm.key.next" &&
+  ipfsi 1 swarm disconnect "/p2p/$(iptb attr get 2 id)" &&
+  iptb connect 1 2 &&
+  ipfsi 2 swarm key ls > keys_out &&
+  test_should_contain "^$(iptb attr get 1 id)  *primary$" keys_out
+'
+
+test_expect_success "nodes in other private networks still can't connect" '
+  test_must_fail iptb connect 2 3
+'
+
+test_expect_success "swarm key fails outside a private network" '
+  test_must_fail ipfsi 0 swarm key ls
+'
+
 
 test_expect_success "stop testbed" '
   iptb stop
@@ -0,0 +1,73 @@
+#!/usr/bin/env bash
+
+test_description="Test pubsub topic policies"
+
+. lib/test-lib.sh
+
+NUM_NODES=3
+test_expect_success 'init iptb' '
+  iptb testbed create -type localipfs -count $NUM_NODES -init
+'
+
+test_expect_success 'disable the DHT' '
+  iptb run -- ipfs config Routing.Type none
+'
+
+test_expect_success 'peer ids' '
+  PEERID_1=$(iptb attr get 1 id)
+'
+
+test_expect_success 'restrict the coord topic on node 0' '
+  ipfsi 0 config --json PubsubACL "{\"Topics\": {\"coord\": {\"Publishers\": [\"$PEERID_1\"], \"MaxMessageSize\": \"16B\"}}}"
+'
+
+startup_cluster $NUM_NODES --enable-pubsub-experiment
+
+test_expect_success 'node 0 listens on coord' '
+  rm -f node0_actual &&
+  ipfsi 0 pubsub sub --enc=ndpayload coord > node0_actual &
+'
+
+test_expect_success "wait until ipfs pubsub sub is ready to do work" '
+  go-sleep 500ms
+'
+
+test_expect_success 'publish from a peer not allowed' '
+  ipfsi 2 pubsub pub coord "from node 2"
+'
+
+test_expect_success 'publish a message too large' '
+  ipfsi 1 pubsub pub coord "a message over sixteen bytes"
+'
+
+test_expect_success 'publish from the allowed peer' '
+  ipfsi 1 pubsub pub coord "from node 1"
+'
+
+test_expect_success "wait for the messages" '
+  go-sleep 500ms
+'
+
+test_expect_success 'node 0 only got the allowed message' '
+  echo "from node 1" > expected &&
+  test_cmp expected node0_actual
+'
+
+test_expect_success 'pubsub ls -v shows the policy and rejections' '
+  ipfsi 0 pubsub ls -v > ls_out &&
+  test_should_contain "^coord$" ls_out &&
+  test_should_contain "policy: 1 publishers, max size 16B" ls_out &&
+  test_should_contain "rejected: 2 (publisher not allowed: 1, too large: 1)" ls_out
+'
+
+test_expect_success 'pubsub ls without -v only lists the topics' '
+  ipfsi 0 pubsub ls > ls_out &&
+  echo coord > expected &&
+  test_cmp expected ls_out
+'
+
+test_expect_success 'stop iptb' '
+  iptb stop
+'
+
+test_done
@@ -0,0 +1,80 @@
+#!/usr/bin/env bash
+
+test_description="Test durable pubsub subscriptions"
+
+. lib/test-lib.sh
+
+NUM_NODES=2
+test_expect_success 'init iptb' '
+  iptb testbed create -type localipfs -count $NUM_NODES -init
+'
+
+test_expect_success 'disable the DHT and keep 3 messages' '
+  iptb run -- ipfs config Routing.Type none &&
+  ipfsi 0 config --json PubsubDurable.MaxMessages 3
+'
+
+startup_cluster $NUM_NODES --enable-pubsub-experiment
+
+test_expect_success 'create a durable subscription' '
+  go-timeout 1 ipfsi 0 pubsub sub --durable app events || true
+'
+
+test_expect_success 'it is listed' '
+  ipfsi 0 pubsub durable ls > ls_out &&
+  test_should_contain "^app  *events  *none$" ls_out
+'
+
+test_expect_success "wait until the subscription is announced" '
+  go-sleep 500ms
+'
+
+test_expect_success 'publish while no client reads' '
+  ipfsi 1 pubsub pub events one &&
+  ipfsi 1 pubsub pub events two &&
+  go-sleep 500ms
+'
+
+test_expect_success 'the missed messages are replayed' '
+  go-timeout 2 ipfsi 0 pubsub sub --durable app --enc=ndpayload events > actual || true &&
+  printf "one\ntwo\n" > expected &&
+  test_cmp expected actual
+'
+
+test_expect_success '--since skips the processed messages' '
+  go-timeout 2 ipfsi 0 pubsub sub --durable app --since 1 --enc=ndpayload events > actual || true &&
+  echo two > expected &&
+  test_cmp expected actual
+'
+
+test_expect_success 'the history is bounded' '
+  ipfsi 1 pubsub pub events three &&
+  ipfsi 1 pubsub pub events four &&
+  go-sleep 500ms &&
+  ipfsi 0 pubsub durable ls > ls_out &&
+  test_should_contain "^app  *events  *2-4$" ls_out
+'
+
+test_expect_success 'a name is bound to its topic' '
+  test_must_fail ipfsi 0 pubsub sub --durable app other 2> err &&
+  test_should_contain "subscribed to \"events\"" err
+'
+
+test_expect_success 'the subscription survives a restart' '
+  iptb stop [0] &&
+  iptb start -wait [0] -- --enable-pubsub-experiment &&
+  ipfsi 0 pubsub durable ls > ls_out &&
+  test_should_contain "^app  *events  *2-4$" ls_out
+'
+
+test_expect_success 'remove the subscription' '
+  ipfsi 0 pubsub durable rm app &&
+  ipfsi 0 pubsub durable ls > ls_out &&
+  test_must_be_empty ls_out
+'
+
+test_expect_success 'stop iptb' '
+  iptb stop
+'
+
+test_done
@@ -0,0 +1,49 @@
+#!/usr/bin/env bash
+#
+# Copyright (c) 2021 Protocol Labs
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="test MFS snapshots"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create a snapshot" '
+  echo "keep me" | ipfs files write --create /shared.txt &&
+  ipfs files snapshot create before-rm > create_out &&
+  grep -q "created snapshot before-rm" create_out
+'
+
+test_expect_success "snapshot is listed and pinned" '
+  ipfs files snapshot ls > ls_out &&
+  grep -q "^before-rm " ls_out &&
+  ROOT=$(awk "/^before-rm /{print \$2}" ls_out) &&
+  ipfs pin ls --type=recursive | grep -q $ROOT
+'
+
+test_expect_success "snapshot survives gc" '
+  ipfs files rm /shared.txt &&
+  ipfs repo gc &&
+  ipfs cat $ROOT/shared.txt > cat_out &&
+  echo "keep me" > expected &&
+  test_cmp expected cat_out
+'
+
+test_expect_success "restore brings the MFS root back" '
+  ipfs files snapshot restore before-rm > restore_out &&
+  grep -q "previous root saved as pre-restore-" restore_out &&
+  ipfs files read /shared.txt > read_out &&
+  test_cmp expected read_out &&
+  test "$(ipfs files stat --hash /)" = "$ROOT"
+'
+
+test_expect_success "removing the snapshot unpins its root" '
+  ipfs files snapshot rm before-rm &&
+  test_must_fail ipfs files snapshot rm before-rm &&
+  ipfs pin ls --type=recursive > pins &&
+  test_must_fail grep -q $ROOT pins
+'
+
+test_done
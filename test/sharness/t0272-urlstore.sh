@@ -79,6 +79,11 @@ EOF
     test_cmp ls_expect ls_actual
   '
 
+  test_expect_success "ipfs urlstore verify checks the urls" '
+    ipfs urlstore verify > verify_actual &&
+    test $(grep -c "^\(unchanged\|ok\) http" verify_actual) -eq 2
+  '
+
   cat <<EOF | sort > verify_expect
 ok      bafkreiafqvawjpukk4achpu7edu4d6x5dbzwgigl6nxunjif3ser6bnfpu 262144 http://127.0.0.1:$GWAY_PORT/ipfs/QmUow2T4P69nEsqTQDZCt8yg9CPS8GFmpuDAr5YtsPhTdM 0
 ok      bafkreia46t3jwchosehfcq7kponx26shcjkatxek4m2tzzd67i6o3frpou 237856 http://127.0.0.1:$GWAY_PORT/ipfs/QmUow2T4P69nEsqTQDZCt8yg9CPS8GFmpuDAr5YtsPhTdM 262144
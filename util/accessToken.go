@@ -0,0 +1,88 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// AccessToken 授权持有者在 Expires 之前读取 Root 下的私密文件，解密密钥保存在
+// 网关节点上，不在令牌中
+// 传输格式为 base64url(json(token)) + "." + base64url(签名)，由 Issuer 的私钥签名
+type AccessToken struct {
+	Root    string
+	Issuer  string
+	Expires int64 // unix秒
+	// PublicKey 为 Issuer 的公钥（base64），无法从节点id中提取公钥时（如RSA）需要
+	PublicKey string `json:",omitempty"`
+}
+
+// EncodeAccessToken 使用 sign 对令牌签名并返回传输格式
+func EncodeAccessToken(t AccessToken, sign func([]byte) ([]byte, error)) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	sig, err := sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ParseAccessToken 解析令牌并验证签名，不检查有效期和签发者是否可信
+func ParseAccessToken(s string) (*AccessToken, peer.ID, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, "", errors.New("access token: malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("access token: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("access token: %s", err)
+	}
+
+	var t AccessToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, "", fmt.Errorf("access token: %s", err)
+	}
+	issuer, err := peer.Decode(t.Issuer)
+	if err != nil {
+		return nil, "", fmt.Errorf("access token: invalid issuer: %s", err)
+	}
+
+	pk, err := issuer.ExtractPublicKey()
+	if err == peer.ErrNoPublicKey && t.PublicKey != "" {
+		pk, err = unmarshalIssuerKey(t.PublicKey, issuer)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("access token: %s", err)
+	}
+	if ok, err := pk.Verify(payload, sig); err != nil || !ok {
+		return nil, "", errors.New("access token: invalid signature")
+	}
+	return &t, issuer, nil
+}
+
+func unmarshalIssuerKey(s string, issuer peer.ID) (ic.PubKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ic.UnmarshalPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	if !issuer.MatchesPublicKey(pk) {
+		return nil, errors.New("public key does not match the issuer")
+	}
+	return pk, nil
+}
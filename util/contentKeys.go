@@ -0,0 +1,24 @@
+package util
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+// contentKeysPrefix 为私密文件密钥在本地数据存储中的前缀，密钥只保存在添加
+// 文件的节点上，访问令牌中不包含密钥
+var contentKeysPrefix = datastore.NewKey("/local/content-keys")
+
+func contentKeyKey(c cid.Cid) datastore.Key {
+	return contentKeysPrefix.ChildString(c.String())
+}
+
+// PutContentKey 保存 c 的内容密钥
+func PutContentKey(ds datastore.Datastore, c cid.Cid, key []byte) error {
+	return ds.Put(contentKeyKey(c), key)
+}
+
+// GetContentKey 返回 c 的内容密钥，没有时返回 datastore.ErrNotFound
+func GetContentKey(ds datastore.Datastore, c cid.Cid) ([]byte, error) {
+	return ds.Get(contentKeyKey(c))
+}
@@ -0,0 +1,395 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// 私密文件的加密格式：
+//
+//	magic(4) | nonce前缀(7) | 分段1 | 分段2 | ... | 最后分段
+//
+// 明文按 StreamChunkSize 分段，每段用 AES-GCM 单独加密并带16字节认证标签。
+// 除最后一段外每段都是满的，最后一段为 0 ~ StreamChunkSize-1 字节。第 i 段的
+// nonce 为 前缀 | 大端uint32(i) | 是否最后一段，截断或调换分段都无法通过认证。
+// 每个文件使用随机的nonce前缀，同一密钥可以加密多个文件。
+const (
+	// StreamChunkSize 为每个分段的明文长度
+	StreamChunkSize = 64 << 10
+
+	streamMagic      = "IPE1"
+	streamPrefixSize = 7
+	streamHeaderSize = len(streamMagic) + streamPrefixSize
+	streamTagSize    = 16
+	streamSealedSize = StreamChunkSize + streamTagSize
+
+	// ContentKeySize 为内容密钥长度（AES-256）
+	ContentKeySize = 32
+)
+
+var (
+	ErrNotEncrypted   = errors.New("encrypted content: unknown format")
+	ErrDecryptFailed  = errors.New("encrypted content: wrong key or corrupted content")
+	errStreamTooLarge = errors.New("encrypted content: too many chunks")
+)
+
+// GenerateContentKey 生成随机的内容密钥
+func GenerateContentKey() ([]byte, error) {
+	key := make([]byte, ContentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(prefix []byte, i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], uint32(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader 边读边加密 src
+type encryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+
+	i      uint64
+	buf    []byte // 明文分段
+	sealed []byte // 加密后的分段
+	out    []byte // 待输出的密文
+	done   bool
+}
+
+// NewEncryptReader 返回读取 src 加密结果的 Reader
+func NewEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	if _, err := rand.Read(header[len(streamMagic):]); err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: header[len(streamMagic):],
+		buf:    make([]byte, StreamChunkSize),
+		out:    header,
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.buf)
+		last := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			return 0, err
+		}
+		if r.i > uint64(^uint32(0)) {
+			return 0, errStreamTooLarge
+		}
+		r.sealed = r.aead.Seal(r.sealed[:0], streamNonce(r.prefix, r.i, last), r.buf[:n], nil)
+		r.out = r.sealed
+		r.i++
+		r.done = last
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptReader) Close() error {
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// DecryptReader 解密 NewEncryptReader 的输出，支持随机读取
+type DecryptReader struct {
+	src    io.ReadSeeker
+	aead   cipher.AEAD
+	prefix []byte
+
+	chunks   uint64 // 分段数，包括最后一段
+	lastSize int64  // 最后一段的密文长度
+	size     int64  // 明文长度
+	offset   int64
+
+	cur   uint64 // plain 对应的分段
+	plain []byte
+	buf   []byte
+}
+
+// NewDecryptReader 读取长度为 srcSize 的密文 src。最后一段在返回前解密，
+// 密钥错误或内容被截断时返回 ErrDecryptFailed。
+func NewDecryptReader(src io.ReadSeeker, srcSize int64, key []byte) (*DecryptReader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	body := srcSize - int64(streamHeaderSize)
+	lastSize := body % streamSealedSize
+	if body < streamTagSize || lastSize < streamTagSize {
+		return nil, ErrNotEncrypted
+	}
+
+	header := make([]byte, streamHeaderSize)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrNotEncrypted
+	}
+
+	chunks := uint64(body/streamSealedSize) + 1
+	if chunks-1 > uint64(^uint32(0)) {
+		return nil, errStreamTooLarge
+	}
+	r := &DecryptReader{
+		src:      src,
+		aead:     aead,
+		prefix:   header[len(streamMagic):],
+		chunks:   chunks,
+		lastSize: lastSize,
+		size:     body - int64(chunks)*streamTagSize,
+		buf:      make([]byte, streamSealedSize),
+	}
+	if err := r.load(chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load 解密第 i 段
+func (r *DecryptReader) load(i uint64) error {
+	if r.plain != nil && r.cur == i {
+		return nil
+	}
+	last := i == r.chunks-1
+	sealed := r.buf[:streamSealedSize]
+	if last {
+		sealed = r.buf[:r.lastSize]
+	}
+	if _, err := r.src.Seek(int64(streamHeaderSize)+int64(i)*streamSealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], streamNonce(r.prefix, i, last), sealed, nil)
+	if err != nil {
+		r.plain = nil
+		return ErrDecryptFailed
+	}
+	r.cur, r.plain = i, plain
+	return nil
+}
+
+// Size 返回明文长度
+func (r *DecryptReader) Size() int64 {
+	return r.size
+}
+
+func (r *DecryptReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := uint64(r.offset / StreamChunkSize)
+	if err := r.load(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.offset-int64(i)*StreamChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("invalid seek offset")
+	}
+	r.offset = offset
+	return r.offset, nil
+}
+
+// EncryptDirectory 返回加密了 d 中所有文件内容的目录，每个文件使用各自的
+// nonce前缀
+func EncryptDirectory(d files.Directory, key []byte) files.Directory {
+	return &encryptedDir{Directory: d, key: key}
+}
+
+type encryptedDir struct {
+	files.Directory
+	key []byte
+}
+
+func (d *encryptedDir) Entries() files.DirIterator {
+	return &encryptedIter{DirIterator: d.Directory.Entries(), key: d.key}
+}
+
+type encryptedIter struct {
+	files.DirIterator
+	key  []byte
+	node files.Node
+	err  error
+}
+
+func (it *encryptedIter) Next() bool {
+	it.node = nil
+	if it.err != nil || !it.DirIterator.Next() {
+		return false
+	}
+	switch n := it.DirIterator.Node().(type) {
+	case *files.Symlink:
+		it.node = n
+	case files.Directory:
+		it.node = EncryptDirectory(n, it.key)
+	case files.File:
+		r, err := NewEncryptReader(n, it.key)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.node = files.NewReaderFile(r)
+	default:
+		it.node = n
+	}
+	return true
+}
+
+func (it *encryptedIter) Node() files.Node {
+	return it.node
+}
+
+func (it *encryptedIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.DirIterator.Err()
+}
+
+// DecryptNode 返回解密了 n 中所有文件内容的节点，与 EncryptDirectory 对应。
+// 文件在第一次读取时才检查密钥。
+func DecryptNode(n files.Node, key []byte) files.Node {
+	switch n := n.(type) {
+	case *files.Symlink:
+		return n
+	case files.Directory:
+		return &decryptedDir{Directory: n, key: key}
+	case files.File:
+		return &decryptedFile{File: n, key: key}
+	default:
+		return n
+	}
+}
+
+type decryptedFile struct {
+	files.File
+	key []byte
+	dec *DecryptReader
+}
+
+func (f *decryptedFile) open() error {
+	if f.dec != nil {
+		return nil
+	}
+	size, err := f.File.Size()
+	if err != nil {
+		return err
+	}
+	f.dec, err = NewDecryptReader(f.File, size, f.key)
+	return err
+}
+
+func (f *decryptedFile) Size() (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.dec.Size(), nil
+}
+
+func (f *decryptedFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.dec.Read(p)
+}
+
+func (f *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.dec.Seek(offset, whence)
+}
+
+type decryptedDir struct {
+	files.Directory
+	key []byte
+}
+
+func (d *decryptedDir) Entries() files.DirIterator {
+	return &decryptedIter{DirIterator: d.Directory.Entries(), key: d.key}
+}
+
+type decryptedIter struct {
+	files.DirIterator
+	key []byte
+}
+
+func (it *decryptedIter) Node() files.Node {
+	return DecryptNode(it.DirIterator.Node(), it.key)
+}
+
+// IsEncryptedContent 判断 r 的内容是否为私密文件的加密格式，读取后回到开头
+func IsEncryptedContent(r io.ReadSeeker) (bool, error) {
+	magic := make([]byte, len(streamMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return string(magic[:n]) == streamMagic, nil
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func encryptBytes(t *testing.T, plain, key []byte) []byte {
+	r, err := NewEncryptReader(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, err := GenerateContentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, 1000, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		enc := encryptBytes(t, plain, key)
+
+		r, err := NewDecryptReader(bytes.NewReader(enc), int64(len(enc)), key)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Fatalf("expected size %d, got %d", size, r.Size())
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, plain) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+
+		// ranges, as used by http.ServeContent
+		for _, off := range []int{1, StreamChunkSize - 3, StreamChunkSize, size / 2} {
+			if off >= size {
+				continue
+			}
+			if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 7)
+			n, err := io.ReadFull(r, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], plain[off:off+n]) {
+				t.Fatalf("size %d: wrong content at offset %d", size, off)
+			}
+		}
+	}
+}
+
+func TestStreamRejects(t *testing.T) {
+	key, _ := GenerateContentKey()
+	other, _ := GenerateContentKey()
+	plain := make([]byte, 2*StreamChunkSize+10)
+	rand.Read(plain)
+	enc := encryptBytes(t, plain, key)
+
+	if _, err := NewDecryptReader(bytes.NewReader(enc), int64(len(enc)), other); err != ErrDecryptFailed {
+		t.Fatalf("wrong key: expected ErrDecryptFailed, got %v", err)
+	}
+
+	// dropping the last chunk makes a full chunk the last one
+	cut := enc[:len(enc)-(10+streamTagSize)]
+	if _, err := NewDecryptReader(bytes.NewReader(cut), int64(len(cut)), key); err == nil {
+		t.Fatal("truncated content was accepted")
+	}
+
+	tampered := append([]byte(nil), enc...)
+	tampered[streamHeaderSize+5] ^= 1
+	r, err := NewDecryptReader(bytes.NewReader(tampered), int64(len(tampered)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrDecryptFailed {
+		t.Fatalf("tampered chunk: expected ErrDecryptFailed, got %v", err)
+	}
+
+	// the same content is encrypted differently each time
+	if bytes.Equal(enc, encryptBytes(t, plain, key)) {
+		t.Fatal("expected a fresh nonce for each encryption")
+	}
+}
+
+func TestDecryptNode(t *testing.T) {
+	key, _ := GenerateContentKey()
+	plain := []byte("confidential")
+	enc := EncryptDirectory(files.NewMapDirectory(map[string]files.Node{
+		"a.txt": files.NewBytesFile(plain),
+	}), key)
+
+	// store the encrypted files the way they are read back: seekable
+	stored := make(map[string]files.Node)
+	var sealed []byte
+	it := enc.Entries()
+	for it.Next() {
+		b, err := ioutil.ReadAll(it.Node().(files.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := IsEncryptedContent(bytes.NewReader(b)); !ok {
+			t.Fatalf("%s is not encrypted", it.Name())
+		}
+		stored[it.Name()] = files.NewBytesFile(b)
+		sealed = b
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+
+	it = DecryptNode(files.NewMapDirectory(stored), key).(files.Directory).Entries()
+	if !it.Next() {
+		t.Fatal("the directory is empty")
+	}
+	f := it.Node().(files.File)
+	if size, err := f.Size(); err != nil || size != int64(len(plain)) {
+		t.Fatalf("expected size %d, got %d, %v", len(plain), size, err)
+	}
+	if out, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("decrypted %q, %v", out, err)
+	}
+
+	other, _ := GenerateContentKey()
+	if _, err := DecryptNode(files.NewBytesFile(sealed), other).Size(); err != ErrDecryptFailed {
+		t.Fatalf("wrong key: expected ErrDecryptFailed, got %v", err)
+	}
+}